@@ -6,14 +6,33 @@ import (
 	"gear/service"
 	log "github.com/sirupsen/logrus"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "validate":
+			os.Exit(validateCommand(os.Args[2:]))
+		case "repair":
+			os.Exit(repairCommand(os.Args[2:]))
+		case "rebalance":
+			os.Exit(rebalanceCommand(os.Args[2:]))
+		}
+	}
 
 	configFile := flag.String("config", "./influx_gear_test.conf", "give a file path for config file")
 	logLevel := flag.String("loglevel", "info", "give log level")
+	check := flag.Bool("check-config", false, "validate the config file and exit")
+	ping := flag.Bool("ping", false, "with -check-config, also ping every replica node")
 
 	flag.Parse()
+	if *check {
+		log.SetLevel(log.WarnLevel)
+		os.Exit(checkConfig(os.Stdout, *configFile, *ping, 5*time.Second))
+	}
 	logrusLevel, err := log.ParseLevel(*logLevel)
 	if err != nil {
 		logrusLevel = log.WarnLevel
@@ -21,11 +40,37 @@ func main() {
 	log.SetLevel(logrusLevel)
 	cfg := config.Config(*configFile)
 	cfg.WithDefaults()
+	invalid := false
+	for _, problem := range cfg.Check() {
+		if problem.Warning {
+			log.Warn(problem)
+			continue
+		}
+		log.Error(problem)
+		invalid = true
+	}
+	if invalid {
+		log.Fatalf("invalid config file %s, run `gear validate -config %s` for a report", *configFile, *configFile)
+	}
 
 	gear := service.NewGearService(*cfg)
+	gear.ConfigPath = *configFile
+	go reloadOnSignal(gear)
 	gear.Run()
 }
 
+// reloadOnSignal reloads the topology on every SIGHUP.
+func reloadOnSignal(gear *service.GearService) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	for range signals {
+		log.Info("received SIGHUP, reloading ", gear.ConfigPath)
+		if err := gear.Reload(); err != nil {
+			log.Error("reload failed: ", err)
+		}
+	}
+}
+
 func init() {
 	log.SetReportCaller(true)
 	log.SetFormatter(&log.TextFormatter{})
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"gear/config"
+	"gear/engine"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// rebalanceCommand implements `gear rebalance`, which moves the measurements
+// of the previous placement of the [migration] section to the shard nodes
+// owning them now.
+func rebalanceCommand(args []string) int {
+	flags := flag.NewFlagSet("rebalance", flag.ExitOnError)
+	configFile := flags.String("config", "./influx_gear_test.conf", "give a file path for config file")
+	database := flags.String("db", "", "database to move, every one by default")
+	measurements := flags.String("measurement", "", "comma separated measurements to move, every one by default")
+	drop := flags.Bool("drop", false, "delete the measurements moved by a previous run from the shard nodes that no longer own them")
+	chunk := flags.Duration("chunk", 0, "time range moved per query, migration.chunk by default")
+	rate := flags.Int("rate", 0, "points written per second, migration.points-per-second by default")
+	interval := flags.Duration("progress", 10*time.Second, "interval of the progress reports")
+	_ = flags.Parse(args)
+
+	log.SetLevel(log.WarnLevel)
+	cfg, err := config.Load(*configFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	cfg.WithDefaults()
+
+	spec := engine.RebalanceSpec{
+		Database:        *database,
+		Chunk:           *chunk,
+		PointsPerSecond: *rate,
+		Drop:            *drop,
+	}
+	if *measurements != "" {
+		spec.Measurements = strings.Split(*measurements, ",")
+	}
+	job, err := engine.OpenRebalanceJob(*cfg, spec)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-signals
+		fmt.Fprintln(os.Stderr, "interrupted, stopping after the current chunk")
+		cancel()
+	}()
+
+	go reportRebalance(os.Stdout, job, *interval)
+	err = job.Run(ctx)
+	printRebalanceStatus(os.Stdout, job.Status())
+	if err != nil {
+		fmt.Fprintln(os.Stdout, "run the same command again to resume")
+		return 1
+	}
+	if !*drop {
+		fmt.Fprintln(os.Stdout, "reload gear (SIGHUP) to read the moved measurements from their new shard nodes, then run again with -drop to delete them from the old ones")
+	}
+	return 0
+}
+
+// reportRebalance prints the progress of job every interval until it is done.
+func reportRebalance(w io.Writer, job *engine.RebalanceJob, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-job.Done():
+			return
+		case <-ticker.C:
+			printRebalanceStatus(w, job.Status())
+		}
+	}
+}
+
+func printRebalanceStatus(w io.Writer, status engine.RebalanceStatus) {
+	line := fmt.Sprintf("rebalance: %s, %d/%d measurements, %d points, %d dropped",
+		status.State, status.MeasurementsDone, status.MeasurementsTotal, status.Points, status.Dropped)
+	if status.Measurement != "" {
+		line += ", moving " + status.Measurement + " of " + status.Database
+	}
+	if status.Error != "" {
+		line += ": " + status.Error
+	}
+	fmt.Fprintln(w, line)
+}
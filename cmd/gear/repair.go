@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"gear/config"
+	"gear/engine"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// repairCommand implements `gear repair`, which copies a time range of a
+// database from a replica to another of the same shard node.
+func repairCommand(args []string) int {
+	flags := flag.NewFlagSet("repair", flag.ExitOnError)
+	configFile := flags.String("config", "./influx_gear_test.conf", "give a file path for config file")
+	shard := flags.String("shard", "", "name of the shard node, optional")
+	source := flags.String("source", "", "host:port of the replica to copy from")
+	target := flags.String("target", "", "host:port of the replica to copy to")
+	database := flags.String("db", "", "database to copy")
+	rp := flags.String("rp", "", "retention policy to copy, every one by default")
+	measurements := flags.String("measurement", "", "comma separated measurements to copy, every one by default")
+	start := flags.String("start", "", "start of the time range, RFC3339")
+	end := flags.String("end", "", "end of the time range, RFC3339, now by default")
+	chunk := flags.Duration("chunk", 0, "time range copied per query, repair.chunk by default")
+	rate := flags.Int("rate", 0, "points written per second, repair.points-per-second by default")
+	stateDir := flags.String("state-dir", "", "directory saving the progress, repair.state-dir by default")
+	interval := flags.Duration("progress", 10*time.Second, "interval of the progress reports")
+	_ = flags.Parse(args)
+
+	log.SetLevel(log.WarnLevel)
+	cfg, err := config.Load(*configFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	cfg.WithDefaults()
+	if *stateDir != "" {
+		cfg.Repair.StateDir = *stateDir
+	}
+
+	spec := engine.RepairSpec{
+		Shard:           *shard,
+		Source:          *source,
+		Target:          *target,
+		Database:        *database,
+		RetentionPolicy: *rp,
+		End:             time.Now().UTC(),
+		Chunk:           *chunk,
+		PointsPerSecond: *rate,
+	}
+	if *measurements != "" {
+		spec.Measurements = strings.Split(*measurements, ",")
+	}
+	if spec.Start, err = time.Parse(time.RFC3339, *start); err != nil {
+		fmt.Fprintln(os.Stderr, "invalid start:", err)
+		return 2
+	}
+	if *end != "" {
+		if spec.End, err = time.Parse(time.RFC3339, *end); err != nil {
+			fmt.Fprintln(os.Stderr, "invalid end:", err)
+			return 2
+		}
+	}
+
+	job, err := engine.OpenRepairJob(*cfg, spec)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-signals
+		fmt.Fprintln(os.Stderr, "interrupted, stopping after the current chunk")
+		cancel()
+	}()
+
+	go reportRepair(os.Stdout, job, *interval)
+	err = job.Run(ctx)
+	printRepairStatus(os.Stdout, job.Status())
+	if err != nil {
+		if cfg.Repair.StateDir != "" {
+			fmt.Fprintln(os.Stdout, "run the same command again to resume")
+		}
+		return 1
+	}
+	return 0
+}
+
+// reportRepair prints the progress of job every interval until it is done.
+func reportRepair(w io.Writer, job *engine.RepairJob, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-job.Done():
+			return
+		case <-ticker.C:
+			printRepairStatus(w, job.Status())
+		}
+	}
+}
+
+func printRepairStatus(w io.Writer, status engine.RepairStatus) {
+	line := fmt.Sprintf("repair %s: %s, %d/%d chunks, %d points", status.ID, status.State, status.ChunksDone, status.ChunksTotal, status.Points)
+	if status.Measurement != "" {
+		line += ", copying " + status.Measurement
+	}
+	if status.Error != "" {
+		line += ": " + status.Error
+	}
+	fmt.Fprintln(w, line)
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"gear/config"
+	"gear/engine"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"os"
+	"time"
+)
+
+// validateCommand implements `gear validate`.
+func validateCommand(args []string) int {
+	flags := flag.NewFlagSet("validate", flag.ExitOnError)
+	configFile := flags.String("config", "./influx_gear_test.conf", "give a file path for config file")
+	ping := flags.Bool("ping", false, "also ping every replica node")
+	timeout := flags.Duration("timeout", 5*time.Second, "timeout of each ping")
+	_ = flags.Parse(args)
+
+	log.SetLevel(log.WarnLevel)
+	return checkConfig(os.Stdout, *configFile, *ping, *timeout)
+}
+
+// checkConfig prints a report of the problems of a config file and returns
+// the exit status: 0 when there is none, warnings aside, 1 otherwise.
+func checkConfig(w io.Writer, configFile string, ping bool, timeout time.Duration) int {
+	fmt.Fprintf(w, "checking %s\n", configFile)
+	cfg, err := config.Load(configFile)
+	if err != nil {
+		fmt.Fprintf(w, "  [error] %v\n", err)
+		return 1
+	}
+	cfg.WithDefaults()
+
+	problems, warnings := 0, 0
+	for _, problem := range cfg.Check() {
+		if problem.Warning {
+			warnings++
+			fmt.Fprintf(w, "  [warn]  %s\n", problem)
+			continue
+		}
+		problems++
+		fmt.Fprintf(w, "  [error] %s\n", problem)
+	}
+
+	failed := 0
+	if ping {
+		fmt.Fprintln(w, "pinging replica nodes")
+		for _, node := range cfg.HTTPShardNode {
+			for _, replica := range node.HTTPReplicaNode {
+				start := time.Now()
+				if err := engine.PingReplica(replica, timeout); err != nil {
+					failed++
+					fmt.Fprintf(w, "  [fail] %s %s: %v\n", node.Name, replica.Address, err)
+					continue
+				}
+				fmt.Fprintf(w, "  [ok]   %s %s (%s)\n", node.Name, replica.Address, time.Since(start).Round(time.Millisecond))
+			}
+		}
+	}
+
+	if problems == 0 && failed == 0 {
+		if warnings > 0 {
+			fmt.Fprintf(w, "config is valid, %d warning(s)\n", warnings)
+		} else {
+			fmt.Fprintln(w, "config is valid")
+		}
+		return 0
+	}
+	fmt.Fprintf(w, "%d problem(s), %d warning(s), %d unreachable replica(s)\n", problems, warnings, failed)
+	return 1
+}
@@ -8,23 +8,179 @@ import (
 )
 
 type GearConfig struct {
-	HTTP  HTTP  `toml:"http"`
-	Shard Shard `toml:"shard"`
+	HTTP          HTTP            `toml:"http"`
+	Shard         Shard           `toml:"shard"`
+	HealthCheck   HealthCheck     `toml:"health-check"`
+	SchemaCheck   SchemaCheck     `toml:"schema-check"`
+	Repair        Repair          `toml:"repair"`
+	Migration     Migration       `toml:"migration"`
+	Query         Query           `toml:"query"`
+	Timeout       Timeout         `toml:"timeout"`
 	HTTPShardNode []HTTPShardNode `toml:"http-shard-node"`
+	Admin         Admin           `toml:"admin"`
 }
 
 type HTTP struct {
 	BindAddress string `toml:"bind-address"`
 }
 
+// Admin holds the basic auth credentials of the /admin endpoints. They are
+// refused when no username is set.
+type Admin struct {
+	Username string `toml:"username"`
+	Password string `toml:"password"`
+}
+
+const (
+	ShardStrategyGrid           = "grid"
+	ShardStrategyConsistentHash = "consistent-hash"
+
+	DefaultVirtualNodes = 160
+)
+
 type Shard struct {
-	GridSize int `toml:"grid-size"`
+	GridSize     int        `toml:"grid-size"`
+	Strategy     string     `toml:"strategy"`
+	VirtualNodes int        `toml:"virtual-nodes"`
+	Keys         []ShardKey `toml:"key"`
+}
+
+// ShardKey overrides what is hashed to place the points of a database and/or
+// measurement. By default only the measurement name is hashed. An empty
+// Database or Measurement matches any.
+type ShardKey struct {
+	Database    string   `toml:"database"`
+	Measurement string   `toml:"measurement"`
+	Tags        []string `toml:"tags"`
+	Series      bool     `toml:"series"`
+}
+
+const (
+	DefaultHealthCheckInterval = "10s"
+	DefaultHealthCheckTimeout  = "5s"
+	DefaultHealthCheckRise     = 2
+	DefaultHealthCheckFall     = 3
+)
+
+// HealthCheck configures the background pings of replica nodes. A replica is
+// taken out of query picking after Fall failed pings in a row and put back
+// after Rise successful ones. An Interval of 0 disables the checks.
+type HealthCheck struct {
+	Interval string `toml:"interval"`
+	Timeout  string `toml:"timeout"`
+	Rise     int    `toml:"rise"`
+	Fall     int    `toml:"fall"`
+}
+
+const (
+	DefaultSchemaCheckInterval = "10m"
+	DefaultSchemaCheckTimeout  = "30s"
+)
+
+// SchemaCheck configures the background comparison of the databases,
+// retention policies, users, grants and continuous queries of the replica
+// nodes. With Apply, objects missing on a minority of the replicas are
+// created there. An Interval of 0 disables the background checks.
+type SchemaCheck struct {
+	Interval string `toml:"interval"`
+	Timeout  string `toml:"timeout"`
+	Apply    bool   `toml:"apply"`
+}
+
+const DefaultRepairChunk = "1h"
+
+// Repair configures the jobs copying the data of a time range from a replica
+// to another of the same shard node. Chunk is the time range copied per
+// query, PointsPerSecond throttles the writes when set. The progress of every
+// job is saved under StateDir, if set, so that a job started again resumes.
+type Repair struct {
+	Chunk           string `toml:"chunk"`
+	PointsPerSecond int    `toml:"points-per-second"`
+	StateDir        string `toml:"state-dir"`
+}
+
+// Migration moves data from a previous placement to the current one: From is
+// a config file whose [shard] and [[http-shard-node]] sections are the
+// placement before grid-size, weights, shard keys or shard nodes changed.
+// Until a measurement is moved, its writes go to its previous and current
+// shard nodes and it is read from the previous ones. The measurements moved
+// are recorded in StateFile. Chunk and PointsPerSecond apply to the copies
+// like in the [repair] section.
+type Migration struct {
+	From            string `toml:"from"`
+	StateFile       string `toml:"state-file"`
+	Chunk           string `toml:"chunk"`
+	PointsPerSecond int    `toml:"points-per-second"`
+}
+
+// Query configures how statements sent to several shard nodes are run.
+// FanOutConcurrency caps the shard nodes queried at once, 0 for no cap.
+type Query struct {
+	FanOutConcurrency int `toml:"fan-out-concurrency"`
+}
+
+const DefaultWriteTimeout = "10s"
+
+// Timeout bounds how long gear waits for the backends to answer a query or
+// a write, including the fail-overs of queries, no limit when empty. The
+// Database entries override them for a database. A write timing out on a
+// replica with a retry buffer is buffered like any failed write.
+type Timeout struct {
+	Query    string            `toml:"query"`
+	Write    string            `toml:"write"`
+	Database []DatabaseTimeout `toml:"database"`
+}
+
+// DatabaseTimeout overrides the timeouts of the [timeout] section for the
+// database Name. Empty timeouts are the ones of the section.
+type DatabaseTimeout struct {
+	Name  string `toml:"name"`
+	Query string `toml:"query"`
+	Write string `toml:"write"`
 }
 
+const DefaultConsistency = "all"
+
+// Pickers choosing the replica a query is sent to.
+const (
+	PickerRoundRobin   = "round-robin"
+	PickerLeastRequest = "least-request"
+	PickerPeakEWMA     = "peak-ewma"
+	PickerP2C          = "p2c"
+)
+
+// When a disk retry queue flushes its writes to stable storage.
+const (
+	QueueFsyncAlways   = "always"
+	QueueFsyncInterval = "interval"
+	QueueFsyncNever    = "never"
+
+	DefaultQueueFsync     = QueueFsyncInterval
+	DefaultQueueMaxSizeMb = 1024
+)
+
+// What a replica does with a failed write when its retry buffer is full.
+const (
+	// OverflowReject fails the write, clients get a 503 with Retry-After.
+	OverflowReject = "reject"
+	// OverflowDropOldest drops the oldest buffered writes to make room.
+	OverflowDropOldest = "drop-oldest"
+	// OverflowDeadLetter appends the write to the dead-letter file.
+	OverflowDeadLetter = "dead-letter"
+
+	DefaultOverflowPolicy = OverflowReject
+)
+
 type HTTPShardNode struct {
 	Name            string            `toml:"name"`
 	HTTPReplicaNode []HTTPReplicaNode `toml:"replica-node"`
 	Weight          int
+	Consistency     string `toml:"consistency"`
+	Picker          string `toml:"picker"`
+	// QueryMaxAttempts limits how many replicas a query is tried on when
+	// replicas fail with transport or server errors. 0 tries every replica.
+	QueryMaxAttempts    int    `toml:"query-max-attempts"`
+	QueryAttemptTimeout string `toml:"query-attempt-timeout"`
 }
 
 type HTTPReplicaNode struct {
@@ -33,6 +189,23 @@ type HTTPReplicaNode struct {
 	Password         string
 	BufferSizeMb     int    `toml:"buffer-size-mb"`
 	MaxDelayInterval string `toml:"max-delay-interval"`
+	// QueueDir keeps failed writes in segment files under this directory
+	// instead of memory, so they survive a restart.
+	QueueDir       string `toml:"queue-dir"`
+	QueueMaxSizeMb int    `toml:"queue-max-size-mb"`
+	QueueFsync     string `toml:"queue-fsync"`
+	// OverflowPolicy decides what happens to a failed write when the retry
+	// buffer or queue is full.
+	OverflowPolicy string `toml:"overflow-policy"`
+	DeadLetterFile string `toml:"dead-letter-file"`
+	// Queued writes to the same database, retention policy and precision
+	// are retried in batches of up to RetryBatchSizeKb, at no more than
+	// RetryPointsPerSecond points per second when it is set.
+	RetryBatchSizeKb     int `toml:"retry-batch-size-kb"`
+	RetryPointsPerSecond int `toml:"retry-points-per-second"`
+	// RetryMaxAge drops queued writes, or moves them to the dead-letter
+	// file, once they have been queued that long.
+	RetryMaxAge string `toml:"retry-max-age"`
 }
 
 var (
@@ -42,24 +215,71 @@ var (
 
 func Config(path string) *GearConfig {
 	once.Do(func() {
-		filePath, err := filepath.Abs(path)
-		if err != nil {
-			panic(err)
-		}
-		log.Infof("parse toml file once. filePath: %s\n", filePath)
-		if _, err := toml.DecodeFile(filePath, &cfg); err != nil {
+		var err error
+		if cfg, err = Load(path); err != nil {
 			panic(err)
 		}
 	})
 	return cfg
 }
 
+// Load parses the toml file at path. Unlike Config it reads the file on every
+// call, which is what reloading needs.
+func Load(path string) (*GearConfig, error) {
+	filePath, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	log.Infof("parse toml file. filePath: %s\n", filePath)
+	var c GearConfig
+	if _, err := toml.DecodeFile(filePath, &c); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
 func (cfg *GearConfig) WithDefaults() *GearConfig {
 	d := cfg
+	if d.Shard.Strategy == "" {
+		d.Shard.Strategy = ShardStrategyGrid
+	}
+	if d.Shard.VirtualNodes == 0 {
+		d.Shard.VirtualNodes = DefaultVirtualNodes
+	}
+	if d.HealthCheck.Interval == "" {
+		d.HealthCheck.Interval = DefaultHealthCheckInterval
+	}
+	if d.HealthCheck.Timeout == "" {
+		d.HealthCheck.Timeout = DefaultHealthCheckTimeout
+	}
+	if d.HealthCheck.Rise == 0 {
+		d.HealthCheck.Rise = DefaultHealthCheckRise
+	}
+	if d.HealthCheck.Fall == 0 {
+		d.HealthCheck.Fall = DefaultHealthCheckFall
+	}
+	if d.SchemaCheck.Interval == "" {
+		d.SchemaCheck.Interval = DefaultSchemaCheckInterval
+	}
+	if d.SchemaCheck.Timeout == "" {
+		d.SchemaCheck.Timeout = DefaultSchemaCheckTimeout
+	}
+	if d.Repair.Chunk == "" {
+		d.Repair.Chunk = DefaultRepairChunk
+	}
+	if d.Migration.Chunk == "" {
+		d.Migration.Chunk = DefaultRepairChunk
+	}
+	if d.Timeout.Write == "" {
+		d.Timeout.Write = DefaultWriteTimeout
+	}
 	for index := range d.HTTPShardNode {
 		if d.HTTPShardNode[index].Weight == 0 {
 			d.HTTPShardNode[index].Weight = 1
 		}
+		if d.HTTPShardNode[index].Consistency == "" {
+			d.HTTPShardNode[index].Consistency = DefaultConsistency
+		}
 	}
 
 	return d
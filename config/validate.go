@@ -0,0 +1,252 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"github.com/influxdata/influxdb/models"
+	"net"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Problem is a configuration error found by Check. A warning is a setting
+// that has no effect, it doesn't prevent the config from being used.
+type Problem struct {
+	Field   string
+	Message string
+	Warning bool
+}
+
+func (p Problem) String() string {
+	return p.Field + ": " + p.Message
+}
+
+// Check returns every problem that would prevent a topology from being built
+// from the config, or make it behave unexpectedly. It expects WithDefaults to
+// have been applied.
+func (cfg *GearConfig) Check() []Problem {
+	var problems []Problem
+	report := func(field, format string, args ...interface{}) {
+		problems = append(problems, Problem{Field: field, Message: fmt.Sprintf(format, args...)})
+	}
+	warn := func(field, format string, args ...interface{}) {
+		problems = append(problems, Problem{Field: field, Message: fmt.Sprintf(format, args...), Warning: true})
+	}
+	duration := func(field, value string, positive bool) {
+		if value == "" {
+			return
+		}
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			report(field, "%v", err)
+		} else if positive && d <= 0 {
+			report(field, "must be positive, got %s", value)
+		}
+	}
+
+	if cfg.HTTP.BindAddress == "" {
+		report("http.bind-address", "is empty")
+	} else if _, _, err := net.SplitHostPort(cfg.HTTP.BindAddress); err != nil {
+		report("http.bind-address", "%v", err)
+	}
+
+	if (cfg.Admin.Username == "") != (cfg.Admin.Password == "") {
+		report("admin", "username and password must be set together")
+	}
+
+	switch cfg.Shard.Strategy {
+	case "", ShardStrategyGrid:
+		if len(cfg.HTTPShardNode) > 1 && cfg.Shard.GridSize <= 0 {
+			report("shard.grid-size", "must be positive with several shard nodes, got %d", cfg.Shard.GridSize)
+		}
+	case ShardStrategyConsistentHash:
+		if cfg.Shard.VirtualNodes <= 0 {
+			report("shard.virtual-nodes", "must be positive, got %d", cfg.Shard.VirtualNodes)
+		}
+	default:
+		report("shard.strategy", "unknown strategy %q", cfg.Shard.Strategy)
+	}
+	for index, key := range cfg.Shard.Keys {
+		field := fmt.Sprintf("shard.key[%d]", index)
+		if key.Series && len(key.Tags) > 0 {
+			warn(field, "tags are ignored when series is set")
+		}
+		for _, tag := range key.Tags {
+			if tag == "" {
+				report(field, "empty tag name")
+			}
+		}
+	}
+
+	duration("health-check.interval", cfg.HealthCheck.Interval, false)
+	duration("health-check.timeout", cfg.HealthCheck.Timeout, false)
+	if cfg.HealthCheck.Rise < 0 {
+		report("health-check.rise", "must not be negative, got %d", cfg.HealthCheck.Rise)
+	}
+	if cfg.HealthCheck.Fall < 0 {
+		report("health-check.fall", "must not be negative, got %d", cfg.HealthCheck.Fall)
+	}
+	duration("schema-check.interval", cfg.SchemaCheck.Interval, false)
+	duration("schema-check.timeout", cfg.SchemaCheck.Timeout, false)
+	duration("repair.chunk", cfg.Repair.Chunk, true)
+	if cfg.Repair.PointsPerSecond < 0 {
+		report("repair.points-per-second", "must not be negative, got %d", cfg.Repair.PointsPerSecond)
+	}
+	if cfg.Migration.From != "" {
+		if cfg.Migration.StateFile == "" {
+			report("migration.state-file", "is required to migrate, it records the measurements moved")
+		}
+		if previous, err := Load(cfg.Migration.From); err != nil {
+			report("migration.from", "%v", err)
+		} else if len(previous.HTTPShardNode) == 0 {
+			report("migration.from", "%s has no shard node", cfg.Migration.From)
+		}
+	}
+	duration("migration.chunk", cfg.Migration.Chunk, true)
+	if cfg.Migration.PointsPerSecond < 0 {
+		report("migration.points-per-second", "must not be negative, got %d", cfg.Migration.PointsPerSecond)
+	}
+
+	if cfg.Query.FanOutConcurrency < 0 {
+		report("query.fan-out-concurrency", "must not be negative, got %d", cfg.Query.FanOutConcurrency)
+	}
+	duration("timeout.query", cfg.Timeout.Query, true)
+	duration("timeout.write", cfg.Timeout.Write, true)
+	databases := make(map[string]bool)
+	for index, database := range cfg.Timeout.Database {
+		field := fmt.Sprintf("timeout.database[%d]", index)
+		if database.Name == "" {
+			report(field, "has no name")
+		} else {
+			field = fmt.Sprintf("timeout.database %q", database.Name)
+			if databases[database.Name] {
+				report(field, "duplicate database")
+			}
+			databases[database.Name] = true
+		}
+		duration(field+".query", database.Query, true)
+		duration(field+".write", database.Write, true)
+	}
+
+	if len(cfg.HTTPShardNode) == 0 {
+		report("http-shard-node", "no shard node configured")
+	}
+	names := make(map[string]bool)
+	addresses := make(map[string]string)
+	queueDirs := make(map[string]string)
+	for index, node := range cfg.HTTPShardNode {
+		field := fmt.Sprintf("http-shard-node[%d]", index)
+		if node.Name != "" {
+			field = fmt.Sprintf("http-shard-node %q", node.Name)
+			if names[node.Name] {
+				report(field, "duplicate name")
+			}
+			names[node.Name] = true
+		} else if cfg.Shard.Strategy == ShardStrategyConsistentHash {
+			report(field, "has no name, its ring position changes with its replicas")
+		}
+
+		if node.Weight < 0 {
+			report(field+".weight", "must not be negative, got %d", node.Weight)
+		}
+		if cfg.Shard.Strategy != ShardStrategyConsistentHash && len(cfg.HTTPShardNode) > 1 &&
+			cfg.Shard.GridSize > 0 && node.Weight > cfg.Shard.GridSize {
+			report(field+".weight", "%d is larger than the grid size %d", node.Weight, cfg.Shard.GridSize)
+		}
+		if node.Consistency != "" {
+			if _, err := models.ParseConsistencyLevel(node.Consistency); err != nil {
+				report(field+".consistency", "%v: %s", err, node.Consistency)
+			}
+		}
+		switch node.Picker {
+		case "", PickerRoundRobin, PickerLeastRequest, PickerPeakEWMA, PickerP2C:
+		default:
+			report(field+".picker", "unknown picker %q", node.Picker)
+		}
+		if node.QueryMaxAttempts < 0 {
+			report(field+".query-max-attempts", "must not be negative, got %d", node.QueryMaxAttempts)
+		}
+		duration(field+".query-attempt-timeout", node.QueryAttemptTimeout, true)
+
+		if len(node.HTTPReplicaNode) == 0 {
+			report(field, "no replica-node configured")
+		}
+		for _, replica := range node.HTTPReplicaNode {
+			replicaField := fmt.Sprintf("%s replica-node %q", field, replica.Address)
+			u, err := url.Parse(strings.Trim(replica.Address, "/"))
+			if err != nil {
+				report(replicaField, "%v", err)
+			} else if u.Scheme != "http" && u.Scheme != "https" {
+				report(replicaField, "scheme must be http or https")
+			} else if u.Host == "" {
+				report(replicaField, "missing host")
+			} else {
+				key := u.Host + u.Path
+				if other, ok := addresses[key]; ok {
+					report(replicaField, "duplicate address, also used by %s", other)
+				}
+				addresses[key] = field
+			}
+			if (replica.Username == "") != (replica.Password == "") {
+				report(replicaField, "username and password must be set together")
+			}
+			if replica.BufferSizeMb < 0 {
+				report(replicaField+".buffer-size-mb", "must not be negative, got %d", replica.BufferSizeMb)
+			}
+			duration(replicaField+".max-delay-interval", replica.MaxDelayInterval, true)
+			if replica.QueueDir != "" {
+				dir := filepath.Clean(replica.QueueDir)
+				if other, ok := queueDirs[dir]; ok {
+					report(replicaField+".queue-dir", "also used by %s", other)
+				}
+				queueDirs[dir] = replicaField
+				if replica.BufferSizeMb > 0 {
+					warn(replicaField+".buffer-size-mb", "is ignored when queue-dir is set")
+				}
+			}
+			duration(replicaField+".retry-max-age", replica.RetryMaxAge, true)
+			if replica.RetryBatchSizeKb < 0 {
+				report(replicaField+".retry-batch-size-kb", "must not be negative, got %d", replica.RetryBatchSizeKb)
+			}
+			if replica.RetryPointsPerSecond < 0 {
+				report(replicaField+".retry-points-per-second", "must not be negative, got %d", replica.RetryPointsPerSecond)
+			}
+			if replica.QueueMaxSizeMb < 0 {
+				report(replicaField+".queue-max-size-mb", "must not be negative, got %d", replica.QueueMaxSizeMb)
+			}
+			switch replica.OverflowPolicy {
+			case "", OverflowReject, OverflowDropOldest:
+			case OverflowDeadLetter:
+				if replica.DeadLetterFile == "" {
+					report(replicaField+".dead-letter-file", "is required by the dead-letter overflow policy")
+				}
+			default:
+				report(replicaField+".overflow-policy", "unknown overflow policy %q", replica.OverflowPolicy)
+			}
+			switch replica.QueueFsync {
+			case "", QueueFsyncAlways, QueueFsyncInterval, QueueFsyncNever:
+			default:
+				report(replicaField+".queue-fsync", "unknown fsync policy %q", replica.QueueFsync)
+			}
+		}
+	}
+
+	return problems
+}
+
+// Validate returns the problems found by Check as a single error, warnings
+// aside.
+func (cfg *GearConfig) Validate() error {
+	var messages []string
+	for _, problem := range cfg.Check() {
+		if !problem.Warning {
+			messages = append(messages, problem.String())
+		}
+	}
+	if len(messages) == 0 {
+		return nil
+	}
+	return errors.New(strings.Join(messages, "; "))
+}
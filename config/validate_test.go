@@ -0,0 +1,109 @@
+package config
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func validConfig() *GearConfig {
+	cfg := &GearConfig{
+		HTTP:  HTTP{BindAddress: "0.0.0.0:9096"},
+		Shard: Shard{GridSize: 10},
+		HTTPShardNode: []HTTPShardNode{
+			{Name: "a", HTTPReplicaNode: []HTTPReplicaNode{{Address: "http://127.0.0.1:8086"}}},
+			{Name: "b", HTTPReplicaNode: []HTTPReplicaNode{{Address: "http://127.0.0.1:8087", Username: "u", Password: "p"}}},
+		},
+	}
+	return cfg.WithDefaults()
+}
+
+func TestGearConfig_CheckValid(t *testing.T) {
+	assert.Empty(t, validConfig().Check())
+	assert.Nil(t, validConfig().Validate())
+}
+
+func TestGearConfig_Check(t *testing.T) {
+	cases := []struct {
+		field  string
+		modify func(cfg *GearConfig)
+	}{
+		{"shard.grid-size", func(cfg *GearConfig) { cfg.Shard.GridSize = 0 }},
+		{"shard.strategy", func(cfg *GearConfig) { cfg.Shard.Strategy = "modulo" }},
+		{`http-shard-node "a".weight`, func(cfg *GearConfig) { cfg.HTTPShardNode[0].Weight = 11 }},
+		{`http-shard-node "b"`, func(cfg *GearConfig) { cfg.HTTPShardNode[1].HTTPReplicaNode = nil }},
+		{`http-shard-node "a"`, func(cfg *GearConfig) { cfg.HTTPShardNode[1].Name = "a" }},
+		{`http-shard-node "b" replica-node "http://127.0.0.1:8086"`, func(cfg *GearConfig) {
+			cfg.HTTPShardNode[1].HTTPReplicaNode[0].Address = "http://127.0.0.1:8086"
+		}},
+		{`http-shard-node "a" replica-node "127.0.0.1:8086"`, func(cfg *GearConfig) {
+			cfg.HTTPShardNode[0].HTTPReplicaNode[0].Address = "127.0.0.1:8086"
+		}},
+		{`http-shard-node "a" replica-node "http://127.0.0.1:8086"`, func(cfg *GearConfig) {
+			cfg.HTTPShardNode[0].HTTPReplicaNode[0].Username = "u"
+		}},
+		{`http-shard-node "a" replica-node "http://127.0.0.1:8086".max-delay-interval`, func(cfg *GearConfig) {
+			cfg.HTTPShardNode[0].HTTPReplicaNode[0].MaxDelayInterval = "5"
+		}},
+		{`http-shard-node "b" replica-node "http://127.0.0.1:8087".queue-dir`, func(cfg *GearConfig) {
+			cfg.HTTPShardNode[0].HTTPReplicaNode[0].QueueDir = "/var/lib/gear/queue"
+			cfg.HTTPShardNode[1].HTTPReplicaNode[0].QueueDir = "/var/lib/gear/queue/"
+		}},
+		{`http-shard-node "a" replica-node "http://127.0.0.1:8086".queue-fsync`, func(cfg *GearConfig) {
+			cfg.HTTPShardNode[0].HTTPReplicaNode[0].QueueDir = "/var/lib/gear/queue"
+			cfg.HTTPShardNode[0].HTTPReplicaNode[0].QueueFsync = "sometimes"
+		}},
+		{`http-shard-node "a" replica-node "http://127.0.0.1:8086".overflow-policy`, func(cfg *GearConfig) {
+			cfg.HTTPShardNode[0].HTTPReplicaNode[0].OverflowPolicy = "block"
+		}},
+		{`http-shard-node "a" replica-node "http://127.0.0.1:8086".dead-letter-file`, func(cfg *GearConfig) {
+			cfg.HTTPShardNode[0].HTTPReplicaNode[0].OverflowPolicy = "dead-letter"
+		}},
+		{`http-shard-node "a" replica-node "http://127.0.0.1:8086".retry-points-per-second`, func(cfg *GearConfig) {
+			cfg.HTTPShardNode[0].HTTPReplicaNode[0].RetryPointsPerSecond = -1
+		}},
+		{`http-shard-node "a" replica-node "http://127.0.0.1:8086".retry-max-age`, func(cfg *GearConfig) {
+			cfg.HTTPShardNode[0].HTTPReplicaNode[0].RetryMaxAge = "-1h"
+		}},
+		{`http-shard-node "a".consistency`, func(cfg *GearConfig) { cfg.HTTPShardNode[0].Consistency = "most" }},
+		{"health-check.timeout", func(cfg *GearConfig) { cfg.HealthCheck.Timeout = "fast" }},
+		{"schema-check.interval", func(cfg *GearConfig) { cfg.SchemaCheck.Interval = "hourly" }},
+		{"repair.chunk", func(cfg *GearConfig) { cfg.Repair.Chunk = "0s" }},
+		{"query.fan-out-concurrency", func(cfg *GearConfig) { cfg.Query.FanOutConcurrency = -1 }},
+		{"timeout.query", func(cfg *GearConfig) { cfg.Timeout.Query = "0s" }},
+		{`timeout.database "foo".write`, func(cfg *GearConfig) {
+			cfg.Timeout.Database = []DatabaseTimeout{{Name: "foo", Write: "ten seconds"}, {Name: "bar", Query: "5m"}}
+		}},
+		{`timeout.database "foo"`, func(cfg *GearConfig) {
+			cfg.Timeout.Database = []DatabaseTimeout{{Name: "foo", Query: "5m"}, {Name: "foo", Write: "1m"}}
+		}},
+		{"migration.from", func(cfg *GearConfig) {
+			cfg.Migration.From = "/nonexistent/gear.toml"
+			cfg.Migration.StateFile = "/var/lib/gear/migration.json"
+		}},
+		{"http.bind-address", func(cfg *GearConfig) { cfg.HTTP.BindAddress = "" }},
+		{"admin", func(cfg *GearConfig) { cfg.Admin.Password = "secret" }},
+	}
+	for _, c := range cases {
+		cfg := validConfig()
+		c.modify(cfg)
+		problems := cfg.Check()
+		if assert.Len(t, problems, 1, c.field) {
+			assert.Equal(t, c.field, problems[0].Field)
+		}
+		assert.NotNil(t, cfg.Validate())
+	}
+}
+
+func TestGearConfig_CheckWarnings(t *testing.T) {
+	cfg := validConfig()
+	cfg.Shard.Keys = []ShardKey{{Measurement: "cpu", Series: true, Tags: []string{"host"}}}
+	cfg.HTTPShardNode[0].HTTPReplicaNode[0].QueueDir = "/var/lib/gear/queue"
+	cfg.HTTPShardNode[0].HTTPReplicaNode[0].BufferSizeMb = 10
+
+	problems := cfg.Check()
+	assert.Len(t, problems, 2)
+	for _, problem := range problems {
+		assert.True(t, problem.Warning, problem.String())
+	}
+	assert.Nil(t, cfg.Validate())
+}
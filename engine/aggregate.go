@@ -0,0 +1,362 @@
+package engine
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/influxdata/influxdb/models"
+	"github.com/influxdata/influxdb/query"
+	"github.com/influxdata/influxql"
+	"sort"
+	"strings"
+)
+
+// aggregateColumn is a column of an aggregate SELECT merged by gear, and the
+// shard columns it is recombined from.
+type aggregateColumn struct {
+	name string
+	call string
+	// shard is the column of a count, sum, min or max; sum and count are the
+	// columns a mean is computed from.
+	shard, sum, count string
+}
+
+// aggregateMerge recombines the partial aggregates the shards computed for a
+// SELECT spanning several of them: counts and sums add up, minimums and
+// maximums are compared, and means are rebuilt from a sum and a count.
+type aggregateMerge struct {
+	columns []aggregateColumn
+	// wildcard is the call of an aggregate over * or a regex, whose columns
+	// depend on the fields found by the shards.
+	wildcard   string
+	timeColumn string
+	// grouped is set when the statement groups by a time interval. Without
+	// one, every shard returns a single row per series, combined into one.
+	grouped   bool
+	ascending bool
+	fill      influxql.FillOption
+	fillValue interface{}
+}
+
+// splitAggregates rewrites an aggregate SELECT into the statement sent to
+// every shard and the merge of their results. Aggregates gear can't
+// recombine are refused rather than returned once per shard.
+func splitAggregates(stmt *influxql.SelectStatement) (*influxql.SelectStatement, *aggregateMerge, error) {
+	m := &aggregateMerge{ascending: stmt.TimeAscending(), fill: stmt.Fill, fillValue: stmt.FillValue}
+	if interval, _ := stmt.GroupByInterval(); interval > 0 {
+		m.grouped = true
+	}
+	if !stmt.OmitTime {
+		m.timeColumn = stmt.TimeFieldName()
+	}
+	shardStmt := stmt.Clone()
+	shardStmt.Fields = nil
+	switch stmt.Fill {
+	case influxql.NumberFill, influxql.PreviousFill:
+		// Buckets are filled once merged, a shard missing one must not make
+		// it up.
+		shardStmt.Fill, shardStmt.FillValue = influxql.NullFill, nil
+	case influxql.LinearFill:
+		return nil, nil, fmt.Errorf("fill(linear) can't be merged across shards")
+	}
+
+	names := stmt.ColumnNames()
+	if !stmt.OmitTime {
+		names = names[1:]
+	}
+	for index, field := range stmt.Fields {
+		call, ok := field.Expr.(*influxql.Call)
+		if !ok || len(call.Args) != 1 {
+			return nil, nil, fmt.Errorf("%s can't be merged across shards", field)
+		}
+		name := strings.ToLower(call.Name)
+		switch name {
+		case "count", "sum", "min", "max", "mean":
+		default:
+			return nil, nil, fmt.Errorf("%s() can't be merged across shards", call.Name)
+		}
+
+		switch call.Args[0].(type) {
+		case *influxql.VarRef:
+		case *influxql.Wildcard, *influxql.RegexLiteral:
+			if len(stmt.Fields) > 1 {
+				return nil, nil, fmt.Errorf("%s can't be merged across shards with other fields", field)
+			}
+			m.wildcard = name
+			if name == "mean" {
+				shardStmt.Fields = influxql.Fields{
+					{Expr: &influxql.Call{Name: "sum", Args: call.Args}},
+					{Expr: &influxql.Call{Name: "count", Args: call.Args}},
+				}
+			} else {
+				shardStmt.Fields = influxql.Fields{{Expr: call}}
+			}
+			return shardStmt, m, nil
+		default:
+			return nil, nil, fmt.Errorf("%s can't be merged across shards", field)
+		}
+
+		column := aggregateColumn{name: names[index], call: name}
+		if name == "mean" {
+			column.sum, column.count = "gear_sum_"+column.name, "gear_count_"+column.name
+			shardStmt.Fields = append(shardStmt.Fields,
+				&influxql.Field{Expr: &influxql.Call{Name: "sum", Args: call.Args}, Alias: column.sum},
+				&influxql.Field{Expr: &influxql.Call{Name: "count", Args: call.Args}, Alias: column.count})
+		} else {
+			column.shard = column.name
+			shardStmt.Fields = append(shardStmt.Fields, &influxql.Field{Expr: call, Alias: column.name})
+		}
+		m.columns = append(m.columns, column)
+	}
+	return shardStmt, m, nil
+}
+
+// hasAggregateSubquery reports whether a source is a subquery aggregating,
+// which the shards can only compute over the part of the data they own.
+func hasAggregateSubquery(sources influxql.Sources) bool {
+	for _, source := range sources {
+		if subquery, ok := source.(*influxql.SubQuery); ok {
+			if !subquery.Statement.IsRawQuery || hasAggregateSubquery(subquery.Statement.Sources) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// merge recombines the results of the shards, series ordered like
+// mergeSelectResults does.
+func (m *aggregateMerge) merge(results []*query.Result) *query.Result {
+	merged := &query.Result{}
+	series := make(map[string][]*models.Row)
+	var ids []string
+	for _, result := range results {
+		if result == nil {
+			continue
+		}
+		if result.Err != nil {
+			return result
+		}
+		merged.StatementID = result.StatementID
+		merged.Messages = append(merged.Messages, result.Messages...)
+		for _, row := range result.Series {
+			id := seriesID(row)
+			if _, ok := series[id]; !ok {
+				ids = append(ids, id)
+			}
+			series[id] = append(series[id], row)
+		}
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		merged.Series = append(merged.Series, m.mergeRows(series[id]))
+	}
+	return merged
+}
+
+// aggregateBucket accumulates the values of one time bucket of a series.
+type aggregateBucket struct {
+	time   interface{}
+	values []interface{}
+	counts []interface{}
+}
+
+// mergeRows recombines the rows of one series, one per shard.
+func (m *aggregateMerge) mergeRows(rows []*models.Row) *models.Row {
+	columns := m.columns
+	if m.wildcard != "" {
+		columns = m.wildcardColumns(rows)
+	}
+
+	// A lone min or max keeps the time of the point it selected, like
+	// InfluxDB does when there is no interval to report the start of.
+	selector := !m.grouped && len(columns) == 1 && (columns[0].call == "min" || columns[0].call == "max")
+
+	buckets := make(map[int64]*aggregateBucket)
+	var times []int64
+	for _, row := range rows {
+		index := make(map[string]int, len(row.Columns))
+		for i, column := range row.Columns {
+			index[column] = i
+		}
+		hasTime := m.timeColumn != "" && len(row.Columns) > 0 && row.Columns[0] == m.timeColumn
+		for _, values := range row.Values {
+			var key int64
+			if hasTime && m.grouped {
+				key, _ = timeValue(values[0])
+			}
+			bucket, ok := buckets[key]
+			if !ok {
+				bucket = &aggregateBucket{values: make([]interface{}, len(columns)), counts: make([]interface{}, len(columns))}
+				if hasTime {
+					bucket.time = values[0]
+				}
+				buckets[key] = bucket
+				times = append(times, key)
+			}
+			for i, column := range columns {
+				if column.call == "mean" {
+					bucket.values[i] = combine("sum", bucket.values[i], columnValue(values, index, column.sum))
+					bucket.counts[i] = combine("count", bucket.counts[i], columnValue(values, index, column.count))
+				} else {
+					value := columnValue(values, index, column.shard)
+					if selector && hasTime && wins(column.call, bucket.values[i], value) {
+						bucket.time = values[0]
+					}
+					bucket.values[i] = combine(column.call, bucket.values[i], value)
+				}
+			}
+		}
+	}
+	sort.Slice(times, func(i, j int) bool {
+		if m.ascending {
+			return times[i] < times[j]
+		}
+		return times[i] > times[j]
+	})
+
+	merged := &models.Row{Name: rows[0].Name, Tags: rows[0].Tags}
+	if m.timeColumn != "" {
+		merged.Columns = append(merged.Columns, m.timeColumn)
+	}
+	for _, column := range columns {
+		merged.Columns = append(merged.Columns, column.name)
+	}
+	previous := make([]interface{}, len(columns))
+	for _, key := range times {
+		bucket := buckets[key]
+		var values []interface{}
+		if m.timeColumn != "" {
+			values = append(values, bucket.time)
+		}
+		for i, column := range columns {
+			value := bucket.values[i]
+			if column.call == "mean" {
+				value = mean(value, bucket.counts[i])
+			}
+			if value == nil {
+				switch m.fill {
+				case influxql.NumberFill:
+					value = m.fillValue
+				case influxql.PreviousFill:
+					value = previous[i]
+				}
+			}
+			previous[i] = value
+			values = append(values, value)
+		}
+		merged.Values = append(merged.Values, values)
+	}
+	return merged
+}
+
+// wildcardColumns lists the columns an aggregate over * or a regex returned
+// for a series, mean_<field> being rebuilt from sum_<field> and
+// count_<field>.
+func (m *aggregateMerge) wildcardColumns(rows []*models.Row) []aggregateColumn {
+	var columns []aggregateColumn
+	seen := make(map[string]bool)
+	for _, row := range rows {
+		for _, shard := range row.Columns {
+			if shard == m.timeColumn {
+				continue
+			}
+			column := aggregateColumn{name: shard, call: m.wildcard, shard: shard}
+			if m.wildcard == "mean" {
+				if !strings.HasPrefix(shard, "sum_") {
+					continue
+				}
+				field := strings.TrimPrefix(shard, "sum_")
+				column = aggregateColumn{name: "mean_" + field, call: "mean", sum: shard, count: "count_" + field}
+			}
+			if !seen[column.name] {
+				seen[column.name] = true
+				columns = append(columns, column)
+			}
+		}
+	}
+	sort.Slice(columns, func(i, j int) bool { return columns[i].name < columns[j].name })
+	return columns
+}
+
+func columnValue(values []interface{}, index map[string]int, column string) interface{} {
+	if i, ok := index[column]; ok && i < len(values) {
+		return values[i]
+	}
+	return nil
+}
+
+// combine merges two partial values of an aggregate, nil standing for a
+// shard without points in the bucket.
+func combine(call string, a, b interface{}) interface{} {
+	if a == nil {
+		return b
+	}
+	if b == nil {
+		return a
+	}
+	switch call {
+	case "count", "sum":
+		if x, ok := integerValue(a); ok {
+			if y, ok := integerValue(b); ok {
+				return x + y
+			}
+		}
+		x, _ := floatValue(a)
+		y, _ := floatValue(b)
+		return x + y
+	case "min", "max":
+		if wins(call, a, b) {
+			return b
+		}
+	}
+	return a
+}
+
+// wins reports whether the partial value b of a min or max replaces a.
+func wins(call string, a, b interface{}) bool {
+	if b == nil {
+		return false
+	}
+	if a == nil {
+		return true
+	}
+	x, _ := floatValue(a)
+	y, _ := floatValue(b)
+	if call == "min" {
+		return y < x
+	}
+	return y > x
+}
+
+func mean(sum, count interface{}) interface{} {
+	n, _ := floatValue(count)
+	if sum == nil || n == 0 {
+		return nil
+	}
+	s, _ := floatValue(sum)
+	return s / n
+}
+
+func integerValue(v interface{}) (int64, bool) {
+	switch v := v.(type) {
+	case json.Number:
+		n, err := v.Int64()
+		return n, err == nil
+	case int64:
+		return v, true
+	}
+	return 0, false
+}
+
+func floatValue(v interface{}) (float64, bool) {
+	switch v := v.(type) {
+	case json.Number:
+		f, err := v.Float64()
+		return f, err == nil
+	case int64:
+		return float64(v), true
+	case float64:
+		return v, true
+	}
+	return 0, false
+}
@@ -0,0 +1,107 @@
+package engine
+
+import (
+	"encoding/json"
+	"github.com/influxdata/influxdb/models"
+	"github.com/influxdata/influxdb/query"
+	"github.com/influxdata/influxql"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func mustParseSelect(t *testing.T, s string) *influxql.SelectStatement {
+	stmt, err := influxql.ParseStatement(s)
+	assert.Nil(t, err)
+	return stmt.(*influxql.SelectStatement)
+}
+
+func TestSplitAggregates(t *testing.T) {
+	stmt := mustParseSelect(t, "SELECT mean(usage), count(usage) AS n, max(usage) FROM cpu WHERE time > 0 GROUP BY time(1m) fill(0)")
+	shardStmt, m, err := splitAggregates(stmt)
+	assert.Nil(t, err)
+	assert.Equal(t, "SELECT sum(usage) AS gear_sum_mean, count(usage) AS gear_count_mean, count(usage) AS n, max(usage) AS max "+
+		"FROM cpu WHERE time > 0 GROUP BY time(1m)", shardStmt.String())
+
+	shard := func(values ...[]interface{}) *query.Result {
+		return &query.Result{Series: models.Rows{{
+			Name:    "cpu",
+			Columns: []string{"time", "gear_sum_mean", "gear_count_mean", "n", "max"},
+			Values:  values,
+		}}}
+	}
+	merged := m.merge([]*query.Result{
+		shard([]interface{}{json.Number("0"), json.Number("10"), json.Number("2"), json.Number("2"), json.Number("7")},
+			[]interface{}{json.Number("60"), nil, json.Number("0"), json.Number("0"), nil}),
+		shard([]interface{}{json.Number("0"), json.Number("20"), json.Number("3"), json.Number("3"), json.Number("9.5")}),
+	})
+	assert.Equal(t, 1, len(merged.Series))
+	assert.Equal(t, []string{"time", "mean", "n", "max"}, merged.Series[0].Columns)
+	assert.Equal(t, [][]interface{}{
+		{json.Number("0"), 6.0, int64(5), json.Number("9.5")},
+		{json.Number("60"), int64(0), json.Number("0"), int64(0)},
+	}, merged.Series[0].Values)
+}
+
+func TestSplitAggregates_Selector(t *testing.T) {
+	stmt := mustParseSelect(t, "SELECT max(usage) FROM cpu")
+	_, m, err := splitAggregates(stmt)
+	assert.Nil(t, err)
+
+	shard := func(time string, value json.Number) *query.Result {
+		return &query.Result{Series: models.Rows{{
+			Name:    "cpu",
+			Columns: []string{"time", "max"},
+			Values:  [][]interface{}{{time, value}},
+		}}}
+	}
+	// Without GROUP BY time, the shards' rows are one, at the time of the
+	// point selected.
+	merged := m.merge([]*query.Result{
+		shard("2020-01-01T00:00:00Z", json.Number("3")),
+		shard("2020-01-02T00:00:00Z", json.Number("5")),
+	})
+	assert.Equal(t, [][]interface{}{{"2020-01-02T00:00:00Z", json.Number("5")}}, merged.Series[0].Values)
+
+	stmt = mustParseSelect(t, "SELECT min(usage), count(usage) FROM cpu")
+	_, m, err = splitAggregates(stmt)
+	assert.Nil(t, err)
+	merged = m.merge([]*query.Result{
+		{Series: models.Rows{{Name: "cpu", Columns: []string{"time", "min", "count"},
+			Values: [][]interface{}{{"1970-01-01T00:00:00Z", json.Number("3"), json.Number("2")}}}}},
+		{Series: models.Rows{{Name: "cpu", Columns: []string{"time", "min", "count"},
+			Values: [][]interface{}{{"1970-01-01T00:00:00Z", json.Number("1"), json.Number("4")}}}}},
+	})
+	assert.Equal(t, [][]interface{}{{"1970-01-01T00:00:00Z", json.Number("1"), int64(6)}}, merged.Series[0].Values)
+}
+
+func TestSplitAggregates_Wildcard(t *testing.T) {
+	stmt := mustParseSelect(t, "SELECT mean(*) FROM cpu GROUP BY host ORDER BY time DESC")
+	shardStmt, m, err := splitAggregates(stmt)
+	assert.Nil(t, err)
+	assert.Equal(t, "SELECT sum(*), count(*) FROM cpu GROUP BY host ORDER BY time DESC", shardStmt.String())
+
+	row := func(sum, count int64) *query.Result {
+		return &query.Result{Series: models.Rows{{
+			Name:    "cpu",
+			Columns: []string{"time", "sum_usage", "count_usage"},
+			Values:  [][]interface{}{{json.Number("0"), sum, count}},
+		}}}
+	}
+	merged := m.merge([]*query.Result{row(3, 1), row(5, 3)})
+	assert.Equal(t, []string{"time", "mean_usage"}, merged.Series[0].Columns)
+	assert.Equal(t, 2.0, merged.Series[0].Values[0][1])
+}
+
+func TestSplitAggregates_Unmergeable(t *testing.T) {
+	for _, s := range []string{
+		"SELECT median(usage) FROM cpu",
+		"SELECT mean(usage) * 2 FROM cpu",
+		"SELECT max(usage), host FROM cpu",
+		"SELECT count(distinct(usage)) FROM cpu",
+		"SELECT count(*), sum(usage) FROM cpu",
+		"SELECT mean(usage) FROM cpu GROUP BY time(1m) fill(linear)",
+	} {
+		_, _, err := splitAggregates(mustParseSelect(t, s))
+		assert.NotNil(t, err, s)
+	}
+}
@@ -1,6 +1,13 @@
 package engine
 
-import "sync"
+import (
+	"fmt"
+	"gear/config"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+)
 
 type Picker interface {
 	Pick() Node
@@ -33,10 +40,146 @@ func (rr *roundRobin) Close()  {
 	}
 }
 
+// Pick returns the next node that isn't marked down, or the next node if all
+// of them are.
 func (rr *roundRobin) Pick() (instance Node) {
 	rr.mu.Lock()
-	instance = rr.instanceList[rr.next]
-	rr.next = (rr.next + 1) % len(rr.instanceList)
-	rr.mu.Unlock()
-	return instance
+	defer rr.mu.Unlock()
+	start := rr.next
+	rr.next = (start + 1) % len(rr.instanceList)
+	for i := 0; i < len(rr.instanceList); i++ {
+		index := (start + i) % len(rr.instanceList)
+		if isAlive(rr.instanceList[index]) {
+			rr.next = (index + 1) % len(rr.instanceList)
+			return rr.instanceList[index]
+		}
+	}
+	return rr.instanceList[start]
+}
+
+// NewPicker returns the picker registered under name, which is one of the
+// config.Picker* constants. An empty name picks round robin.
+func NewPicker(name string, ii []Node) (Picker, error) {
+	switch name {
+	case "", config.PickerRoundRobin:
+		return NewRRPicker(ii), nil
+	case config.PickerLeastRequest:
+		return NewLeastRequestPicker(ii), nil
+	case config.PickerPeakEWMA:
+		return NewPeakEWMAPicker(ii), nil
+	case config.PickerP2C:
+		return NewP2CPicker(ii), nil
+	}
+	return nil, fmt.Errorf("unknown picker %q", name)
+}
+
+// loadReporter is implemented by nodes tracking their own query load.
+type loadReporter interface {
+	outstanding() int64
+	cost() float64
+}
+
+func outstandingOf(node Node) int64 {
+	if l, ok := node.(loadReporter); ok {
+		return l.outstanding()
+	}
+	return 0
+}
+
+func costOf(node Node) float64 {
+	if l, ok := node.(loadReporter); ok {
+		return l.cost()
+	}
+	return 0
+}
+
+// candidates returns the alive nodes, or all of them if none is alive.
+func candidates(ii []Node) []Node {
+	alive := aliveNodes(ii)
+	if len(alive) == 0 {
+		return ii
+	}
+	return alive
+}
+
+// leastRequest picks the node with the fewest outstanding queries. Ties are
+// broken round robin so that idle nodes share the load.
+type leastRequest struct {
+	instanceList []Node
+	next         uint32
+}
+
+func NewLeastRequestPicker(ii []Node) Picker {
+	return &leastRequest{instanceList: ii}
+}
+
+func (lr *leastRequest) Pick() Node {
+	nodes := candidates(lr.instanceList)
+	start := int(atomic.AddUint32(&lr.next, 1))
+	best := nodes[start%len(nodes)]
+	for i := 1; i < len(nodes); i++ {
+		node := nodes[(start+i)%len(nodes)]
+		if outstandingOf(node) < outstandingOf(best) {
+			best = node
+		}
+	}
+	return best
+}
+
+// peakEWMA picks the node with the lowest peak-EWMA latency weighted by its
+// outstanding queries, so a replica that suddenly slows down stops getting
+// queries right away and only slowly wins them back.
+type peakEWMA struct {
+	instanceList []Node
+	next         uint32
+}
+
+func NewPeakEWMAPicker(ii []Node) Picker {
+	return &peakEWMA{instanceList: ii}
+}
+
+func (p *peakEWMA) Pick() Node {
+	nodes := candidates(p.instanceList)
+	start := int(atomic.AddUint32(&p.next, 1))
+	best := nodes[start%len(nodes)]
+	for i := 1; i < len(nodes); i++ {
+		node := nodes[(start+i)%len(nodes)]
+		if costOf(node) < costOf(best) {
+			best = node
+		}
+	}
+	return best
+}
+
+// p2c picks two nodes at random and keeps the one with the lower peak-EWMA
+// cost, which avoids herding every query onto the single best node.
+type p2c struct {
+	instanceList []Node
+	mu           sync.Mutex
+	rand         *rand.Rand
+}
+
+func NewP2CPicker(ii []Node) Picker {
+	return &p2c{
+		instanceList: ii,
+		rand:         rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+func (p *p2c) Pick() Node {
+	nodes := candidates(p.instanceList)
+	if len(nodes) == 1 {
+		return nodes[0]
+	}
+	p.mu.Lock()
+	a := p.rand.Intn(len(nodes))
+	b := p.rand.Intn(len(nodes) - 1)
+	p.mu.Unlock()
+	if b >= a {
+		b++
+	}
+	if costOf(nodes[b]) < costOf(nodes[a]) {
+		return nodes[b]
+	}
+	return nodes[a]
 }
@@ -0,0 +1,86 @@
+package engine
+
+import (
+	"gear/config"
+	"github.com/stretchr/testify/assert"
+	"math"
+	"testing"
+	"time"
+)
+
+func newTestReplicas(n int) []Node {
+	var nodes []Node
+	for i := 0; i < n; i++ {
+		node, _ := NewReplicaHTTPNode(config.HTTPReplicaNode{Address: writeOKServer.URL})
+		nodes = append(nodes, node)
+	}
+	return nodes
+}
+
+func TestNewPicker(t *testing.T) {
+	nodes := newTestReplicas(2)
+	for _, name := range []string{"", config.PickerRoundRobin, config.PickerLeastRequest, config.PickerPeakEWMA, config.PickerP2C} {
+		picker, err := NewPicker(name, nodes)
+		assert.Nil(t, err)
+		assert.NotNil(t, picker.Pick())
+	}
+	_, err := NewPicker("random", nodes)
+	assert.NotNil(t, err)
+}
+
+func TestLeastRequestPicker(t *testing.T) {
+	nodes := newTestReplicas(3)
+	busy := nodes[0].(*ReplicaHTTPNode)
+	busy.load.start()
+	busy.load.start()
+
+	picker := NewLeastRequestPicker(nodes)
+	picked := map[Node]int{}
+	for i := 0; i < 10; i++ {
+		picked[picker.Pick()]++
+	}
+	assert.Equal(t, 0, picked[busy])
+	assert.True(t, picked[nodes[1]] > 0)
+	assert.True(t, picked[nodes[2]] > 0)
+}
+
+func TestPeakEWMAPicker(t *testing.T) {
+	nodes := newTestReplicas(2)
+	slow := nodes[0].(*ReplicaHTTPNode)
+	fast := nodes[1].(*ReplicaHTTPNode)
+	slow.load.done(slow.load.start().Add(-2*time.Second), nil)
+	fast.load.done(fast.load.start().Add(-10*time.Millisecond), nil)
+
+	for _, picker := range []Picker{NewPeakEWMAPicker(nodes), NewP2CPicker(nodes)} {
+		for i := 0; i < 10; i++ {
+			assert.Equal(t, fast, picker.Pick())
+		}
+	}
+
+	slow.setAlive(true)
+	fast.setAlive(false)
+	assert.Equal(t, slow, NewPeakEWMAPicker(nodes).Pick())
+}
+
+func TestReplicaLoad_Peak(t *testing.T) {
+	load := newReplicaLoad()
+	load.done(load.start().Add(-100*time.Millisecond), nil)
+	assert.InDelta(t, float64(100*time.Millisecond), load.cost(), float64(5*time.Millisecond))
+
+	load.done(load.start().Add(-time.Second), nil)
+	assert.InDelta(t, float64(time.Second), load.cost(), float64(5*time.Millisecond))
+
+	load.start()
+	assert.InDelta(t, float64(2*time.Second), load.cost(), float64(10*time.Millisecond))
+	assert.Equal(t, int64(1), load.outstanding())
+}
+
+func TestReplicaLoad_DecaysOnce(t *testing.T) {
+	load := newReplicaLoad()
+	load.ewma = float64(time.Second)
+	load.stamp = time.Now().Add(-ewmaDecay)
+
+	load.done(load.start(), nil)
+	w := math.Exp(-1)
+	assert.InDelta(t, float64(time.Second)*w, load.ewma, float64(5*time.Millisecond))
+}
@@ -0,0 +1,242 @@
+package engine
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	. "gear/influx"
+	"github.com/influxdata/influxql"
+	log "github.com/sirupsen/logrus"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// bootstrapKinds is the order objects are copied to a new replica in. Users
+// come first: an InfluxDB with auth enabled and no user accepts nothing but
+// the creation of an admin.
+var bootstrapKinds = []string{schemaUser, schemaDatabase, schemaRetentionPolicy, schemaGrant, schemaContinuousQuery}
+
+// Bootstrap copies to the replicas with an empty schema the schema objects
+// most of their peers have, before they get many writes. A replica that
+// already has objects of its own is left to the schema check, which can
+// tell a lagging replica from its peers. Users are created with the
+// password of the replica configuration when it is the user gear logs in
+// as, and with a random password otherwise. A replica isNew reports as
+// added since the previous topology that can't be reached gets the
+// statements handed off if it can, so that they are applied before the
+// writes queued for it.
+func (s *SchemaChecker) Bootstrap(replicas []Node, isNew func(Node) bool) {
+	if len(replicas) < 2 {
+		return
+	}
+
+	schemas := make([]replicaSchema, len(replicas))
+	errs := make([]error, len(replicas))
+	var wg sync.WaitGroup
+	for index, replica := range replicas {
+		index, replica := index, replica
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			schemas[index], errs[index] = s.fetch(replica)
+		}()
+	}
+	wg.Wait()
+
+	for index, replica := range replicas {
+		if errs[index] == nil && !emptySchema(replica, schemas[index]) || errs[index] != nil && !isNew(replica) {
+			continue
+		}
+		var peers []replicaSchema
+		for peer := range replicas {
+			if peer != index && errs[peer] == nil && nodeKey(replicas[peer]) != nodeKey(replica) {
+				peers = append(peers, schemas[peer])
+			}
+		}
+		if len(peers) == 0 {
+			log.Warnf("schema bootstrap of replica %s skipped, none of its peers could be read", nodeKey(replica))
+			continue
+		}
+		statements := bootstrapStatements(replica, expectedSchema(peers), schemas[index])
+		if len(statements) == 0 {
+			continue
+		}
+		log.Infof("schema bootstrap: copying %d schema objects to replica %s", len(statements), nodeKey(replica))
+		s.bootstrap(replica, statements, errs[index])
+	}
+}
+
+// emptySchema reports whether a replica has no schema objects but the ones
+// of a fresh InfluxDB: the _internal database and the user gear logs in as.
+func emptySchema(replica Node, schema replicaSchema) bool {
+	username, _ := replicaCredentials(replica)
+	for key := range schema {
+		switch {
+		case key.kind == schemaDatabase && key.name == "_internal":
+		case key.kind == schemaRetentionPolicy && strings.HasPrefix(key.name, "_internal."):
+		case key.kind == schemaUser && key.name == username:
+		case isAdminGrant(key) && grantUser(key.name) == username:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// bootstrap applies statements to replica, or hands them off when the
+// replica fails. readErr is the error reading the schema of the replica.
+func (s *SchemaChecker) bootstrap(replica Node, statements []string, readErr error) {
+	target, canHandOff := replica.(handoffTarget)
+	if readErr == nil && canHandOff && target.handingOff() {
+		readErr = errHandoffPending
+	}
+	if readErr != nil && !canHandOff {
+		log.Errorf("schema bootstrap of replica %s failed, it can't be read: %v", nodeKey(replica), readErr)
+		return
+	}
+	for index, statement := range statements {
+		if readErr == nil {
+			_, err := s.query(replica, statement, "")
+			if err == nil {
+				continue
+			}
+			if !isServerError(err) || !canHandOff {
+				log.Errorf("schema bootstrap of replica %s: %q: %v", nodeKey(replica), redacted(statement), err)
+				continue
+			}
+			readErr = err
+		}
+		q, err := NewQueryRequest(statement, "", "", "")
+		if err == nil {
+			err = target.HandOff(q)
+		}
+		if err != nil {
+			log.Errorf("schema bootstrap of replica %s: handing off %d statements: %v", nodeKey(replica), len(statements)-index, err)
+			return
+		}
+	}
+}
+
+// expectedSchema returns the objects at least half of the peers have, as
+// most of them define them.
+func expectedSchema(peers []replicaSchema) replicaSchema {
+	counts := make(map[schemaKey]map[string]int)
+	for _, peer := range peers {
+		for key, definition := range peer {
+			if counts[key] == nil {
+				counts[key] = make(map[string]int)
+			}
+			counts[key][definition]++
+		}
+	}
+	expected := make(replicaSchema)
+	for key, definitions := range counts {
+		n := 0
+		for _, count := range definitions {
+			n += count
+		}
+		if 2*n >= len(peers) && key.name != "" {
+			expected[key] = majority(definitions)
+		}
+	}
+	return expected
+}
+
+// bootstrapStatements returns the statements creating the objects of
+// expected that the replica lacks, in bootstrapKinds order.
+func bootstrapStatements(replica Node, expected, actual replicaSchema) []string {
+	var missing []schemaKey
+	for key := range expected {
+		if _, ok := actual[key]; !ok {
+			missing = append(missing, key)
+		}
+	}
+	admins := make(map[string]bool)
+	for key := range expected {
+		if isAdminGrant(key) {
+			admins[grantUser(key.name)] = true
+		}
+	}
+	username, password := replicaCredentials(replica)
+	sort.Slice(missing, func(i, j int) bool {
+		ki, kj := indexOf(bootstrapKinds, missing[i].kind), indexOf(bootstrapKinds, missing[j].kind)
+		if ki != kj {
+			return ki < kj
+		}
+		// The user gear logs in as, then admins: they may be the only users
+		// allowed to create others.
+		if ui, uj := missing[i].name == username, missing[j].name == username; ui != uj {
+			return ui
+		}
+		if ai, aj := admins[missing[i].name], admins[missing[j].name]; ai != aj {
+			return ai
+		}
+		return missing[i].name < missing[j].name
+	})
+
+	var statements []string
+	created := make(map[string]bool)
+	for _, key := range missing {
+		switch key.kind {
+		case schemaUser:
+			stmt := &influxql.CreateUserStatement{Name: key.name, Admin: admins[key.name]}
+			if key.name == username {
+				stmt.Password = password
+			} else {
+				stmt.Password = randomPassword()
+				log.Warnf("schema bootstrap: user %s is created on replica %s with a random password, set it with SET PASSWORD", key.name, nodeKey(replica))
+			}
+			statements = append(statements, queryString(&influxql.Query{Statements: influxql.Statements{stmt}}))
+			created[key.name] = true
+		case schemaGrant:
+			if isAdminGrant(key) && created[grantUser(key.name)] {
+				// Created WITH ALL PRIVILEGES already.
+				continue
+			}
+			statements = append(statements, expected[key])
+		default:
+			statements = append(statements, expected[key])
+		}
+	}
+	return statements
+}
+
+func isAdminGrant(key schemaKey) bool {
+	return key.kind == schemaGrant && key.name == "ALL PRIVILEGES TO "+grantUser(key.name)
+}
+
+// grantUser returns the user of a grant object name such as "READ ON foo TO bob".
+func grantUser(name string) string {
+	if i := strings.LastIndex(name, " TO "); i >= 0 {
+		return name[i+len(" TO "):]
+	}
+	return ""
+}
+
+// replicaCredentials returns the user gear logs in to a replica as.
+func replicaCredentials(node Node) (username, password string) {
+	switch n := node.(type) {
+	case *ReplicaHTTPNode:
+		return n.username, n.password
+	case *RetryHTTPNode:
+		return n.username, n.password
+	}
+	return "", ""
+}
+
+func randomPassword() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// redacted returns statement with the passwords hidden, for logging.
+func redacted(statement string) string {
+	q, err := influxql.ParseQuery(statement)
+	if err != nil {
+		return "(unparsable statement)"
+	}
+	return q.String()
+}
@@ -0,0 +1,114 @@
+package engine
+
+import (
+	"gear/config"
+	"github.com/influxdata/influxdb/models"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func newPeerSchemaServer() *schemaServer {
+	return &schemaServer{
+		databases: []string{"foo"},
+		users:     [][]interface{}{{"bob", false}, {"root", true}},
+		grants:    map[string][][]interface{}{"bob": {{"foo", "READ"}}},
+		cqs: []*models.Row{{
+			Name:    "foo",
+			Columns: []string{"name", "query"},
+			Values:  [][]interface{}{{"cq", "CREATE CONTINUOUS QUERY cq ON foo BEGIN SELECT mean(value) INTO cpu_1h FROM cpu GROUP BY time(1h) END"}},
+		}},
+	}
+}
+
+func TestSchemaChecker_Bootstrap(t *testing.T) {
+	peer := newPeerSchemaServer()
+	fresh := &schemaServer{grants: map[string][][]interface{}{}}
+	tsPeer, tsFresh := httptest.NewServer(peer), httptest.NewServer(fresh)
+	defer tsPeer.Close()
+	defer tsFresh.Close()
+
+	peerNode, err := NewReplicaHTTPNode(config.HTTPReplicaNode{Address: tsPeer.URL})
+	assert.Nil(t, err)
+	freshNode, err := NewReplicaHTTPNode(config.HTTPReplicaNode{Address: tsFresh.URL, Username: "root", Password: "s3cret"})
+	assert.Nil(t, err)
+	checker, err := NewSchemaChecker(config.SchemaCheck{Timeout: "5s"}, nil)
+	assert.Nil(t, err)
+
+	checker.Bootstrap([]Node{peerNode, freshNode}, func(node Node) bool { return node == freshNode })
+	assert.Equal(t, []string{
+		"CREATE USER root WITH PASSWORD [REDACTED] WITH ALL PRIVILEGES",
+		"CREATE USER bob WITH PASSWORD [REDACTED]",
+		"CREATE DATABASE foo",
+		"CREATE RETENTION POLICY autogen ON foo DURATION 0s REPLICATION 1 SHARD DURATION 1w DEFAULT",
+		"GRANT READ ON foo TO bob",
+		"CREATE CONTINUOUS QUERY cq ON foo BEGIN SELECT mean(value) INTO cpu_1h FROM cpu GROUP BY time(1h) END",
+	}, fresh.applied)
+	assert.Equal(t, "CREATE USER root WITH PASSWORD 's3cret' WITH ALL PRIVILEGES", fresh.raw[0])
+	assert.Empty(t, peer.applied)
+
+	// Nothing is copied once the replica has a schema.
+	fresh.applied = nil
+	checker.Bootstrap([]Node{peerNode, freshNode}, func(node Node) bool { return false })
+	checker.Bootstrap([]Node{peerNode, freshNode}, func(node Node) bool { return true })
+	assert.Empty(t, fresh.applied)
+	assert.Empty(t, peer.applied)
+}
+
+func TestSchemaChecker_BootstrapLagging(t *testing.T) {
+	peer := newPeerSchemaServer()
+	lagging := &schemaServer{
+		databases: []string{"_internal", "bar"},
+		users:     [][]interface{}{{"root", true}},
+		grants:    map[string][][]interface{}{},
+	}
+	tsPeer, tsLagging := httptest.NewServer(peer), httptest.NewServer(lagging)
+	defer tsPeer.Close()
+	defer tsLagging.Close()
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer down.Close()
+
+	peerNode, err := NewReplicaHTTPNode(config.HTTPReplicaNode{Address: tsPeer.URL})
+	assert.Nil(t, err)
+	laggingNode, err := NewReplicaHTTPNode(config.HTTPReplicaNode{Address: tsLagging.URL})
+	assert.Nil(t, err)
+	downNode, err := NewReplicaHTTPNode(config.HTTPReplicaNode{Address: down.URL, BufferSizeMb: 1, MaxDelayInterval: "1h"})
+	assert.Nil(t, err)
+	defer downNode.Shutdown()
+	checker, err := NewSchemaChecker(config.SchemaCheck{Timeout: "5s"}, nil)
+	assert.Nil(t, err)
+
+	// A replica with a schema of its own is left to the schema check, and
+	// one that can't be read only gets the schema if it was just added.
+	checker.Bootstrap([]Node{peerNode, laggingNode, downNode}, func(node Node) bool { return false })
+	assert.Empty(t, lagging.applied)
+	assert.Empty(t, peer.applied)
+	assert.Equal(t, 0, downNode.(*RetryHTTPNode).Status().Handoff)
+
+	assert.True(t, emptySchema(laggingNode, replicaSchema{{schemaDatabase, "_internal"}: ""}))
+	assert.False(t, emptySchema(laggingNode, replicaSchema{{schemaUser, "root"}: ""}))
+}
+
+func TestSchemaChecker_BootstrapHandoff(t *testing.T) {
+	peer := newPeerSchemaServer()
+	tsPeer := httptest.NewServer(peer)
+	defer tsPeer.Close()
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer down.Close()
+
+	peerNode, err := NewReplicaHTTPNode(config.HTTPReplicaNode{Address: tsPeer.URL})
+	assert.Nil(t, err)
+	downNode, err := NewReplicaHTTPNode(config.HTTPReplicaNode{Address: down.URL, BufferSizeMb: 1, MaxDelayInterval: "1h"})
+	assert.Nil(t, err)
+	defer downNode.Shutdown()
+	checker, err := NewSchemaChecker(config.SchemaCheck{Timeout: "5s"}, nil)
+	assert.Nil(t, err)
+
+	checker.Bootstrap([]Node{peerNode, downNode}, func(node Node) bool { return node == downNode })
+	assert.Equal(t, 6, downNode.(*RetryHTTPNode).Status().Handoff)
+}
@@ -0,0 +1,325 @@
+package engine
+
+import (
+	"context"
+	. "gear/influx"
+	"github.com/influxdata/influxdb/models"
+	"github.com/influxdata/influxdb/query"
+	"github.com/influxdata/influxql"
+	log "github.com/sirupsen/logrus"
+)
+
+// ChunkedQuerier is implemented by engines streaming the results of chunked
+// queries instead of buffering them.
+type ChunkedQuerier interface {
+	// QueryChunked calls emit with the chunks of every statement of qr, in
+	// order, as they are produced.
+	QueryChunked(ctx context.Context, qr QueryRequest, emit func(*query.Result) error) error
+}
+
+func (c *Cluster) QueryChunked(ctx context.Context, qr QueryRequest, emit func(*query.Result) error) error {
+	return c.Current().QueryChunked(ctx, qr, emit)
+}
+
+// QueryChunked streams the results of qr in chunks of qr.ValuesPerChunk
+// values, within the query timeout of the database. SELECTs are streamed
+// from the shard nodes, merged chunk by chunk when they span several. The
+// other statements, and aggregates spanning several shard nodes, are run like
+// by Query and their result cut into chunks.
+func (e HTTPEngine) QueryChunked(ctx context.Context, qr QueryRequest, emit func(*query.Result) error) error {
+	ctx, cancel := withTimeout(ctx, e.timeouts.forQuery(qr.Database))
+	defer cancel()
+	for i, stmt := range qr.Query.Statements {
+		log.Debug(stmt.String())
+		statementQuery := QueryRequest{
+			Query:     &influxql.Query{Statements: influxql.Statements{stmt}},
+			Database:  qr.Database,
+			Precision: qr.Precision,
+			Chunked:   qr.Chunked,
+			ChunkSize: qr.ChunkSize,
+		}
+		statementID := i
+		statementEmit := func(result *query.Result) error {
+			result.StatementID = statementID
+			return emit(result)
+		}
+
+		var err error
+		if _, ok := stmt.(*influxql.SelectStatement); ok {
+			err = e.streamSelectStatement(ctx, statementQuery, statementEmit)
+		} else {
+			var result *query.Result
+			if result, err = e.executeStatementQuery(ctx, statementQuery); err == nil {
+				err = emitChunks(result, qr.ValuesPerChunk(), statementEmit)
+			}
+		}
+		if err != nil {
+			return timeoutError(ctx, err, query.ErrQueryTimeoutLimitExceeded)
+		}
+	}
+	return nil
+}
+
+func (e HTTPEngine) streamSelectStatement(ctx context.Context, qr QueryRequest, emit func(*query.Result) error) error {
+	if !e.sharding {
+		return e.NodeList()[0].QueryChunked(ctx, qr, emit)
+	}
+
+	stmt := qr.Query.Statements[0].(*influxql.SelectStatement)
+	plan, err := e.MapSources(ctx, qr.Database, stmt)
+	if err != nil {
+		return err
+	}
+	switch len(plan.nodes) {
+	case 0:
+		return emit(&query.Result{})
+	case 1:
+		qr.Query = &influxql.Query{Statements: influxql.Statements{withSelectSources(stmt, plan.sources[0])}}
+		return plan.nodes[0].QueryChunked(ctx, qr, emit)
+	}
+	if !stmt.IsRawQuery || hasAggregateSubquery(stmt.Sources) {
+		// Partial aggregates are recombined once all are in, they are small.
+		result, err := e.querySelectPlan(ctx, qr, stmt, plan)
+		if err != nil {
+			return err
+		}
+		return emitChunks(result, qr.ValuesPerChunk(), emit)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	cursors := make([]*chunkCursor, len(plan.nodes))
+	for index, node := range plan.nodes {
+		shardQr := qr
+		shardQr.Query = &influxql.Query{Statements: influxql.Statements{withSelectSources(withShardLimits(stmt), plan.sources[index])}}
+		cursors[index] = openChunkCursor(ctx, node, shardQr)
+	}
+	return mergeChunks(cursors, stmt, qr.ValuesPerChunk(), emit)
+}
+
+func withSelectSources(stmt *influxql.SelectStatement, sources influxql.Sources) *influxql.SelectStatement {
+	shardStmt := stmt.Clone()
+	shardStmt.Sources = sources
+	return shardStmt
+}
+
+// chunkCursor walks the values of the chunks a shard node streams, which are
+// read ahead by one chunk.
+type chunkCursor struct {
+	chunks chan *query.Result
+	// err is set before chunks is closed.
+	err error
+
+	rows     models.Rows
+	values   [][]interface{}
+	messages []*query.Message
+}
+
+func openChunkCursor(ctx context.Context, node Node, qr QueryRequest) *chunkCursor {
+	c := &chunkCursor{chunks: make(chan *query.Result, 1)}
+	go func() {
+		defer close(c.chunks)
+		c.err = node.QueryChunked(ctx, qr, func(result *query.Result) error {
+			select {
+			case c.chunks <- result:
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		})
+	}()
+	return c
+}
+
+// row returns the row of the current value, nil once the stream is over. A
+// chunk failing with a statement error is returned as failed.
+func (c *chunkCursor) row() (row *models.Row, failed *query.Result, err error) {
+	for len(c.values) == 0 {
+		if len(c.rows) > 1 {
+			c.rows = c.rows[1:]
+			c.values = c.rows[0].Values
+			continue
+		}
+		result, ok := <-c.chunks
+		if !ok {
+			c.rows = nil
+			return nil, nil, c.err
+		}
+		if result.Err != nil {
+			return nil, result, nil
+		}
+		c.messages = append(c.messages, result.Messages...)
+		if len(result.Series) > 0 {
+			c.rows = result.Series
+			c.values = c.rows[0].Values
+		}
+	}
+	return c.rows[0], nil, nil
+}
+
+func (c *chunkCursor) value() []interface{} {
+	return c.values[0]
+}
+
+func (c *chunkCursor) next() {
+	c.values = c.values[1:]
+}
+
+// mergeChunks merges the streams of one SELECT sent to several shard nodes,
+// like mergeSelectResults does with whole results: series in the order of
+// InfluxDB, the values of a series present on several shard nodes in time
+// order. The OFFSET, LIMIT, SOFFSET and SLIMIT of stmt apply to the merged
+// stream. Only the current chunk of every shard node is held in memory.
+func mergeChunks(cursors []*chunkCursor, stmt *influxql.SelectStatement, size int, emit func(*query.Result) error) error {
+	w := newChunkWriter(size, emit)
+	ascending := stmt.TimeAscending()
+	for seriesIndex := 0; ; seriesIndex++ {
+		// The series coming first, and the cursors having it.
+		var current []*chunkCursor
+		var series *models.Row
+		for _, c := range cursors {
+			row, failed, err := c.row()
+			if err != nil {
+				return err
+			}
+			if failed != nil {
+				return emit(failed)
+			}
+			if row == nil {
+				continue
+			}
+			switch {
+			case series == nil || seriesID(row) < seriesID(series):
+				series, current = row, []*chunkCursor{c}
+			case seriesID(row) == seriesID(series):
+				current = append(current, c)
+			}
+		}
+		if series == nil || stmt.SLimit > 0 && seriesIndex >= stmt.SOffset+stmt.SLimit {
+			break
+		}
+		id := seriesID(series)
+		keep := seriesIndex >= stmt.SOffset
+
+		for n := 0; len(current) > 0; n++ {
+			first := 0
+			for index, c := range current[1:] {
+				if before(c.value(), current[first].value(), ascending) {
+					first = index + 1
+				}
+			}
+			c := current[first]
+			if keep && n >= stmt.Offset && (stmt.Limit == 0 || n < stmt.Offset+stmt.Limit) {
+				if err := w.add(series, c.value()); err != nil {
+					return err
+				}
+			}
+			c.next()
+			row, failed, err := c.row()
+			if err != nil {
+				return err
+			}
+			if failed != nil {
+				return emit(failed)
+			}
+			if row == nil || seriesID(row) != id {
+				current = append(current[:first], current[first+1:]...)
+			}
+		}
+	}
+	for _, c := range cursors {
+		w.messages = append(w.messages, c.messages...)
+	}
+	return w.close()
+}
+
+// before reports whether the values a come before the values b of a series,
+// by their time column. Values without time keep their order.
+func before(a, b []interface{}, ascending bool) bool {
+	if len(a) == 0 || len(b) == 0 {
+		return false
+	}
+	ta, ok := timeValue(a[0])
+	if !ok {
+		return false
+	}
+	tb, ok := timeValue(b[0])
+	if !ok {
+		return false
+	}
+	if ascending {
+		return ta < tb
+	}
+	return ta > tb
+}
+
+// chunkWriter cuts rows into chunks of size values. A chunk is emitted once
+// the next value is known, so that a series going on in the next chunk is
+// marked partial like InfluxDB does, and every chunk but the last is.
+type chunkWriter struct {
+	size     int
+	emit     func(*query.Result) error
+	result   *query.Result
+	series   *models.Row
+	row      *models.Row
+	n        int
+	messages []*query.Message
+}
+
+func newChunkWriter(size int, emit func(*query.Result) error) *chunkWriter {
+	return &chunkWriter{size: size, emit: emit, result: &query.Result{}}
+}
+
+// add appends values to the row of series, emitting the full chunk first.
+func (w *chunkWriter) add(series *models.Row, values []interface{}) error {
+	if w.n >= w.size {
+		if w.row != nil && seriesID(w.series) == seriesID(series) {
+			w.row.Partial = true
+		}
+		w.result.Partial = true
+		if err := w.emit(w.result); err != nil {
+			return err
+		}
+		w.result, w.row, w.n = &query.Result{}, nil, 0
+	}
+	w.start(series)
+	w.row.Values = append(w.row.Values, values)
+	w.n++
+	return nil
+}
+
+// start begins a row of series unless the current row is of series.
+func (w *chunkWriter) start(series *models.Row) {
+	if w.row != nil && seriesID(w.series) == seriesID(series) {
+		return
+	}
+	w.series = series
+	w.row = &models.Row{Name: series.Name, Tags: series.Tags, Columns: series.Columns}
+	w.result.Series = append(w.result.Series, w.row)
+}
+
+// close emits the last chunk, with the messages.
+func (w *chunkWriter) close() error {
+	w.result.Messages = w.messages
+	return w.emit(w.result)
+}
+
+// emitChunks emits a result in chunks of size values.
+func emitChunks(result *query.Result, size int, emit func(*query.Result) error) error {
+	if result.Err != nil {
+		return emit(result)
+	}
+	w := newChunkWriter(size, emit)
+	for _, row := range result.Series {
+		if len(row.Values) == 0 {
+			w.start(row)
+		}
+		for _, values := range row.Values {
+			if err := w.add(row, values); err != nil {
+				return err
+			}
+		}
+	}
+	w.messages = result.Messages
+	return w.close()
+}
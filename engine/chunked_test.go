@@ -0,0 +1,191 @@
+package engine
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"gear/config"
+	"gear/influx"
+	"github.com/influxdata/influxdb/models"
+	"github.com/influxdata/influxdb/query"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// chunkNode streams its chunks to QueryChunked.
+type chunkNode struct {
+	MockNode
+	chunks []*query.Result
+	err    error
+}
+
+func (n *chunkNode) QueryChunked(ctx context.Context, q influx.QueryRequest, emit func(*query.Result) error) error {
+	for _, chunk := range n.chunks {
+		if err := emit(chunk); err != nil {
+			return err
+		}
+	}
+	return n.err
+}
+
+func chunkRow(name string, times ...int64) *models.Row {
+	row := &models.Row{Name: name, Columns: []string{"time", "value"}}
+	for _, t := range times {
+		row.Values = append(row.Values, []interface{}{t, t})
+	}
+	return row
+}
+
+func rowTimes(row *models.Row) []int64 {
+	var times []int64
+	for _, values := range row.Values {
+		times = append(times, values[0].(int64))
+	}
+	return times
+}
+
+func collectChunks(t *testing.T, run func(emit func(*query.Result) error) error) []*query.Result {
+	var chunks []*query.Result
+	assert.Nil(t, run(func(result *query.Result) error {
+		chunks = append(chunks, result)
+		return nil
+	}))
+	return chunks
+}
+
+func TestMergeChunks(t *testing.T) {
+	a := &chunkNode{chunks: []*query.Result{
+		{Series: models.Rows{chunkRow("cpu", 1, 4)}, Partial: true},
+		{Series: models.Rows{chunkRow("mem", 2)}},
+	}}
+	b := &chunkNode{chunks: []*query.Result{
+		{Series: models.Rows{chunkRow("cpu", 2, 3)}, Messages: []*query.Message{{Level: "warning", Text: "slow"}}},
+	}}
+	cursors := []*chunkCursor{
+		openChunkCursor(context.Background(), a, influx.QueryRequest{}),
+		openChunkCursor(context.Background(), b, influx.QueryRequest{}),
+	}
+
+	chunks := collectChunks(t, func(emit func(*query.Result) error) error {
+		return mergeChunks(cursors, mustParseSelect(t, "SELECT * FROM cpu, mem"), 2, emit)
+	})
+	assert.Equal(t, 3, len(chunks))
+
+	assert.True(t, chunks[0].Partial)
+	assert.Equal(t, []int64{1, 2}, rowTimes(chunks[0].Series[0]))
+	assert.True(t, chunks[0].Series[0].Partial)
+
+	assert.True(t, chunks[1].Partial)
+	assert.Equal(t, []int64{3, 4}, rowTimes(chunks[1].Series[0]))
+	assert.False(t, chunks[1].Series[0].Partial)
+
+	assert.False(t, chunks[2].Partial)
+	assert.Equal(t, "mem", chunks[2].Series[0].Name)
+	assert.Equal(t, []int64{2}, rowTimes(chunks[2].Series[0]))
+	assert.Equal(t, "slow", chunks[2].Messages[0].Text)
+}
+
+func TestMergeChunks_Descending(t *testing.T) {
+	a := &chunkNode{chunks: []*query.Result{{Series: models.Rows{chunkRow("cpu", 5, 1)}}}}
+	b := &chunkNode{chunks: []*query.Result{{Series: models.Rows{chunkRow("cpu", 3)}}}}
+	cursors := []*chunkCursor{
+		openChunkCursor(context.Background(), a, influx.QueryRequest{}),
+		openChunkCursor(context.Background(), b, influx.QueryRequest{}),
+	}
+
+	chunks := collectChunks(t, func(emit func(*query.Result) error) error {
+		return mergeChunks(cursors, mustParseSelect(t, "SELECT * FROM cpu ORDER BY time DESC"), 10, emit)
+	})
+	assert.Equal(t, 1, len(chunks))
+	assert.Equal(t, []int64{5, 3, 1}, rowTimes(chunks[0].Series[0]))
+}
+
+func TestMergeChunks_Errors(t *testing.T) {
+	failed := &chunkNode{chunks: []*query.Result{{Err: errors.New("measurement not found")}}}
+	ok := &chunkNode{chunks: []*query.Result{{Series: models.Rows{chunkRow("cpu", 1)}}}}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	chunks := collectChunks(t, func(emit func(*query.Result) error) error {
+		return mergeChunks([]*chunkCursor{
+			openChunkCursor(ctx, ok, influx.QueryRequest{}),
+			openChunkCursor(ctx, failed, influx.QueryRequest{}),
+		}, mustParseSelect(t, "SELECT * FROM cpu"), 10, emit)
+	})
+	assert.Equal(t, 1, len(chunks))
+	assert.Equal(t, "measurement not found", chunks[0].Err.Error())
+
+	broken := &chunkNode{err: errors.New("connection reset")}
+	err := mergeChunks([]*chunkCursor{
+		openChunkCursor(ctx, ok, influx.QueryRequest{}),
+		openChunkCursor(ctx, broken, influx.QueryRequest{}),
+	}, mustParseSelect(t, "SELECT * FROM cpu"), 10, func(*query.Result) error { return nil })
+	assert.Equal(t, "connection reset", err.Error())
+}
+
+func TestEmitChunks(t *testing.T) {
+	result := &query.Result{Series: models.Rows{
+		{Name: "databases", Columns: []string{"name"}, Values: [][]interface{}{{"a"}, {"b"}, {"c"}}},
+		{Name: "empty", Columns: []string{"name"}},
+	}}
+	chunks := collectChunks(t, func(emit func(*query.Result) error) error {
+		return emitChunks(result, 2, emit)
+	})
+	assert.Equal(t, 2, len(chunks))
+	assert.True(t, chunks[0].Partial)
+	assert.True(t, chunks[0].Series[0].Partial)
+	assert.Equal(t, 2, len(chunks[0].Series[0].Values))
+	assert.False(t, chunks[1].Partial)
+	assert.Equal(t, 1, len(chunks[1].Series[0].Values))
+	assert.Equal(t, "empty", chunks[1].Series[1].Name)
+}
+
+func TestHTTPEngine_QueryChunked(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/query" {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		assert.Equal(t, "true", r.FormValue("chunked"))
+		assert.Equal(t, "1", r.FormValue("chunk_size"))
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		_ = enc.Encode(influx.Response{Results: []*query.Result{
+			{Series: models.Rows{chunkRow("cpu", 1)}, Partial: true},
+		}})
+		w.(http.Flusher).Flush()
+		_ = enc.Encode(influx.Response{Results: []*query.Result{
+			{Series: models.Rows{chunkRow("cpu", 2)}},
+		}})
+	}))
+	defer server.Close()
+	e := newTimeoutEngine(server, config.Timeout{})
+
+	qr, _ := influx.NewQueryRequest("SELECT * FROM cpu; SELECT * FROM cpu", "foo", "", "true")
+	qr.ChunkSize = 1
+	chunks := collectChunks(t, func(emit func(*query.Result) error) error {
+		return e.QueryChunked(context.Background(), qr, emit)
+	})
+	assert.Equal(t, 4, len(chunks))
+	assert.Equal(t, []int{0, 0, 1, 1}, []int{chunks[0].StatementID, chunks[1].StatementID, chunks[2].StatementID, chunks[3].StatementID})
+	assert.True(t, chunks[0].Partial)
+	assert.False(t, chunks[1].Partial)
+	assert.Equal(t, "cpu", chunks[1].Series[0].Name)
+}
+
+func TestMergeChunks_Limits(t *testing.T) {
+	a := &chunkNode{chunks: []*query.Result{{Series: models.Rows{chunkRow("cpu", 1, 3, 5), chunkRow("disk", 1), chunkRow("mem", 1)}}}}
+	b := &chunkNode{chunks: []*query.Result{{Series: models.Rows{chunkRow("cpu", 2, 4)}}}}
+	cursors := []*chunkCursor{
+		openChunkCursor(context.Background(), a, influx.QueryRequest{}),
+		openChunkCursor(context.Background(), b, influx.QueryRequest{}),
+	}
+
+	chunks := collectChunks(t, func(emit func(*query.Result) error) error {
+		return mergeChunks(cursors, mustParseSelect(t, "SELECT * FROM cpu, disk, mem LIMIT 3 OFFSET 1 SLIMIT 2"), 10, emit)
+	})
+	assert.Equal(t, 1, len(chunks))
+	assert.Equal(t, 1, len(chunks[0].Series))
+	assert.Equal(t, []int64{2, 3, 4}, rowTimes(chunks[0].Series[0]))
+}
@@ -0,0 +1,412 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"gear/config"
+	. "gear/influx"
+	log "github.com/sirupsen/logrus"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// Reloader is implemented by engines whose topology can be replaced while
+// they serve requests.
+type Reloader interface {
+	Reload(gearConfig config.GearConfig) error
+}
+
+// QueueManager is implemented by engines that queue failed writes per
+// replica node.
+type QueueManager interface {
+	RetryNodes() []*RetryHTTPNode
+}
+
+// SchemaManager is implemented by engines that compare the schema of their
+// replica nodes.
+type SchemaManager interface {
+	LastSchemaReport() *SchemaReport
+	CheckSchema(apply bool) SchemaReport
+}
+
+// RepairManager is implemented by engines that copy data between the
+// replica nodes of a shard node.
+type RepairManager interface {
+	StartRepair(spec RepairSpec) (*RepairJob, error)
+	RepairJobs() []*RepairJob
+}
+
+// RebalanceManager is implemented by engines that move data from a previous
+// shard placement to the current one.
+type RebalanceManager interface {
+	// MigrationStatus returns nil unless a migration is configured.
+	MigrationStatus() *MigrationStatus
+	StartRebalance(spec RebalanceSpec) (*RebalanceJob, error)
+	RebalanceJob() *RebalanceJob
+}
+
+// Cluster serves requests from the current HTTPEngine and swaps it atomically
+// on Reload. Requests started before a reload finish on the topology they
+// started with.
+type Cluster struct {
+	mu      sync.Mutex
+	current atomic.Value
+
+	// repairs are the repair jobs by ID, they outlive reloads.
+	repairMu sync.Mutex
+	repairs  map[string]*RepairJob
+
+	// rebalance is the latest rebalance job, it outlives reloads.
+	rebalanceMu sync.Mutex
+	rebalance   *RebalanceJob
+}
+
+func NewCluster(gearConfig config.GearConfig) *Cluster {
+	engine := &HTTPEngine{
+		config: gearConfig,
+	}
+	engine.InitNode()
+	engine.bootstrap(nil)
+
+	c := &Cluster{repairs: make(map[string]*RepairJob)}
+	c.current.Store(engine)
+	return c
+}
+
+// Current returns the topology requests are served from.
+func (c *Cluster) Current() *HTTPEngine {
+	return c.current.Load().(*HTTPEngine)
+}
+
+func (c *Cluster) Write(ctx context.Context, wr WriteRequest) error {
+	return c.Current().Write(ctx, wr)
+}
+
+func (c *Cluster) Query(ctx context.Context, qr QueryRequest) *Response {
+	return c.Current().Query(ctx, qr)
+}
+
+func (c *Cluster) RetryNodes() []*RetryHTTPNode {
+	return c.Current().RetryNodes()
+}
+
+func (c *Cluster) LastSchemaReport() *SchemaReport {
+	return c.Current().LastSchemaReport()
+}
+
+func (c *Cluster) CheckSchema(apply bool) SchemaReport {
+	return c.Current().CheckSchema(apply)
+}
+
+// StartRepair starts a repair job between replicas of the current topology,
+// unless the same one is running already.
+func (c *Cluster) StartRepair(spec RepairSpec) (*RepairJob, error) {
+	current := c.Current()
+	spec, err := spec.withDefaults(current.config.Repair)
+	if err != nil {
+		return nil, err
+	}
+	source, target, err := current.repairReplicas(spec)
+	if err != nil {
+		return nil, err
+	}
+	job, err := NewRepairJob(spec, source, target, current.config.Repair.StateDir)
+	if err != nil {
+		return nil, err
+	}
+
+	c.repairMu.Lock()
+	defer c.repairMu.Unlock()
+	if running, ok := c.repairs[job.ID()]; ok && running.Status().State == JobRunning {
+		return nil, fmt.Errorf("repair %s is running already", job.ID())
+	}
+	c.repairs[job.ID()] = job
+	job.Start(context.Background())
+	return job, nil
+}
+
+// RepairJobs returns the repair jobs started since gear started, by ID.
+func (c *Cluster) RepairJobs() []*RepairJob {
+	c.repairMu.Lock()
+	defer c.repairMu.Unlock()
+	jobs := make([]*RepairJob, 0, len(c.repairs))
+	for _, job := range c.repairs {
+		jobs = append(jobs, job)
+	}
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].ID() < jobs[j].ID() })
+	return jobs
+}
+
+// MigrationStatus returns the measurements the migration of the current
+// topology moved and the progress of the latest rebalance job.
+func (c *Cluster) MigrationStatus() *MigrationStatus {
+	migration := c.Current().migration
+	if migration == nil {
+		return nil
+	}
+	status := &MigrationStatus{From: migration.from, Moved: migration.Moved()}
+	if job := c.RebalanceJob(); job != nil {
+		jobStatus := job.Status()
+		status.Job = &jobStatus
+	}
+	return status
+}
+
+// StartRebalance starts a rebalance job moving the data of the migration of
+// the current topology, unless one is running already.
+func (c *Cluster) StartRebalance(spec RebalanceSpec) (*RebalanceJob, error) {
+	current := c.Current()
+	if current.migration == nil {
+		return nil, errors.New("no migration, set from in the [migration] section")
+	}
+	spec, err := spec.withDefaults(current.config.Migration)
+	if err != nil {
+		return nil, err
+	}
+
+	c.rebalanceMu.Lock()
+	defer c.rebalanceMu.Unlock()
+	if c.rebalance != nil && c.rebalance.Status().State == JobRunning {
+		return nil, errors.New("a rebalance is running already")
+	}
+	job := newRebalanceJob(spec, current.placement(), current.migration.previous, clusterMoves{c}, true)
+	c.rebalance = job
+	job.Start(context.Background())
+	return job, nil
+}
+
+// RebalanceJob returns the latest rebalance job, nil if none was started.
+func (c *Cluster) RebalanceJob() *RebalanceJob {
+	c.rebalanceMu.Lock()
+	defer c.rebalanceMu.Unlock()
+	return c.rebalance
+}
+
+// clusterMoves records the moves of a rebalance job in the migration of the
+// current topology, which a reload may replace while the job runs.
+type clusterMoves struct {
+	c *Cluster
+}
+
+func (m clusterMoves) isMoved(database, measurement string) bool {
+	migration := m.c.Current().migration
+	return migration == nil || migration.isMoved(database, measurement)
+}
+
+func (m clusterMoves) markMoved(database, measurement string) error {
+	migration := m.c.Current().migration
+	if migration == nil {
+		return errors.New("the migration was removed by a reload")
+	}
+	return migration.markMoved(database, measurement)
+}
+
+// Reload builds the topology of gearConfig and swaps it in. Replica nodes
+// whose configuration didn't change are carried over with their retry
+// buffers; replica nodes that are gone are shut down.
+func (c *Cluster) Reload(gearConfig config.GearConfig) (err error) {
+	if err := gearConfig.Validate(); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	old := c.Current()
+	if old.config.HTTP != gearConfig.HTTP {
+		log.Warn("http section changed, restart gear to apply it")
+	}
+
+	replicas := newReplicaPool(old.replicas.nodes)
+	engine := &HTTPEngine{
+		config:   gearConfig,
+		replicas: replicas,
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			if engine.health != nil {
+				engine.health.Stop()
+			}
+			if engine.schema != nil {
+				engine.schema.Stop()
+			}
+			replicas.rollback()
+			err = fmt.Errorf("reload: %v", r)
+		}
+	}()
+	engine.InitNode()
+
+	replicas.commit()
+	c.current.Store(engine)
+	engine.bootstrap(old.replicas.nodes)
+	old.health.Stop()
+	old.schema.Stop()
+	for key, node := range old.replicas.nodes {
+		if _, ok := replicas.nodes[key]; !ok {
+			log.Infof("replica %s was removed", nodeKey(node))
+			node.Shutdown()
+		}
+	}
+	log.Infof("reloaded topology: %d shard nodes, %d new replica nodes, %d kept",
+		len(engine.nodeList), len(replicas.created), len(replicas.nodes)-len(replicas.created))
+	return nil
+}
+
+// RetryNodes returns the replica nodes that queue failed writes, by name.
+func (e *HTTPEngine) RetryNodes() []*RetryHTTPNode {
+	var nodes []*RetryHTTPNode
+	for _, node := range e.replicas.nodes {
+		if retry, ok := node.(*RetryHTTPNode); ok {
+			nodes = append(nodes, retry)
+		}
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].Name() < nodes[j].Name() })
+	return nodes
+}
+
+// LastSchemaReport returns the report of the latest schema check, nil before
+// the first one.
+func (e *HTTPEngine) LastSchemaReport() *SchemaReport {
+	return e.schema.Last()
+}
+
+// CheckSchema compares the schema of the replica nodes now.
+func (e *HTTPEngine) CheckSchema(apply bool) SchemaReport {
+	return e.schema.Check(apply)
+}
+
+// placement returns the current placement of the shard nodes.
+func (e *HTTPEngine) placement() *placement {
+	return &placement{nodes: e.nodeList, locator: e.locator, shardKeys: e.shardKeys}
+}
+
+// repairReplicas returns the source and target replicas of spec.
+func (e *HTTPEngine) repairReplicas(spec RepairSpec) (source, target Node, err error) {
+	for _, node := range e.nodeList {
+		shard := node.(*ShardHTTPNode)
+		if spec.Shard != "" && shard.Name() != spec.Shard {
+			continue
+		}
+		source, target = nil, nil
+		for _, instance := range shard.GetInstances() {
+			switch nodeKey(instance) {
+			case spec.Source:
+				source = instance
+			case spec.Target:
+				target = instance
+			}
+		}
+		if source != nil && target != nil {
+			return source, target, nil
+		}
+	}
+	return nil, nil, repairNotFound(spec)
+}
+
+// replicaPool hands out replica nodes by configuration, reusing the nodes of
+// a previous topology whose configuration is unchanged.
+type replicaPool struct {
+	previous map[string]Node
+	nodes    map[string]Node
+	created  []Node
+	// handovers are the created nodes taking the disk retry queue of a
+	// previous node over, which happens on commit.
+	handovers []handover
+}
+
+// handover is a replica node waiting for the disk retry queue of previous.
+type handover struct {
+	node     *RetryHTTPNode
+	instance config.HTTPReplicaNode
+	previous Node
+}
+
+func newReplicaPool(previous map[string]Node) *replicaPool {
+	return &replicaPool{
+		previous: previous,
+		nodes:    make(map[string]Node),
+	}
+}
+
+func (p *replicaPool) get(instance config.HTTPReplicaNode) (Node, error) {
+	key := fmt.Sprintf("%#v", instance)
+	if node, ok := p.nodes[key]; ok {
+		return node, nil
+	}
+	if node, ok := p.previous[key]; ok {
+		p.nodes[key] = node
+		return node, nil
+	}
+
+	var node Node
+	var err error
+	if previous := p.queueHolder(instance.QueueDir); previous != nil {
+		if node, err = newReplicaNode(instance); err != nil {
+			return nil, err
+		}
+		p.handovers = append(p.handovers, handover{node: node.(*RetryHTTPNode), instance: instance, previous: previous})
+	} else if node, err = NewReplicaHTTPNode(instance); err != nil {
+		return nil, err
+	}
+	p.nodes[key] = node
+	p.created = append(p.created, node)
+	return node, nil
+}
+
+// queueHolder returns the previous replica node whose disk retry queue is in
+// dir, nil if none.
+func (p *replicaPool) queueHolder(dir string) Node {
+	if dir == "" {
+		return nil
+	}
+	for _, node := range p.previous {
+		retry, ok := node.(*RetryHTTPNode)
+		if !ok {
+			continue
+		}
+		if queue, ok := retry.list.(*diskQueue); ok && queue.dir == filepath.Clean(dir) {
+			return node
+		}
+	}
+	return nil
+}
+
+// commit hands the disk retry queues over once the topology is built: the
+// previous replica nodes holding them are shut down, and the changed ones
+// open them. A queue that can't be opened again is replaced by a memory
+// buffer rather than failing a topology that is built already.
+func (p *replicaPool) commit() {
+	for _, h := range p.handovers {
+		log.Infof("replica %s hands its retry queue %s over", nodeKey(h.previous), h.instance.QueueDir)
+		h.previous.Shutdown()
+		if err := h.node.open(h.instance); err != nil {
+			log.Errorf("replica %s can't open the retry queue %s, buffering in memory: %v", nodeKey(h.node), h.instance.QueueDir, err)
+			fallback := h.instance
+			fallback.QueueDir = ""
+			fallback.BufferSizeMb = fallback.QueueMaxSizeMb
+			if fallback.BufferSizeMb == 0 {
+				fallback.BufferSizeMb = config.DefaultQueueMaxSizeMb
+			}
+			_ = h.node.open(fallback)
+		}
+	}
+	p.handovers = nil
+}
+
+// rollback shuts down the replica nodes created for a topology that failed
+// to build. The queues of the previous replica nodes were not handed over.
+func (p *replicaPool) rollback() {
+	waiting := make(map[Node]bool)
+	for _, h := range p.handovers {
+		waiting[h.node] = true
+	}
+	for _, node := range p.created {
+		if !waiting[node] {
+			node.Shutdown()
+		}
+	}
+	p.handovers = nil
+}
@@ -0,0 +1,90 @@
+package engine
+
+import (
+	"context"
+	"gear/config"
+	"gear/influx"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCluster_Reload(t *testing.T) {
+	kept := config.HTTPReplicaNode{Address: writeErrorServer.URL, BufferSizeMb: 1}
+	removed := config.HTTPReplicaNode{Address: writeOKServer.URL}
+	cfg := config.GearConfig{HTTP: config.HTTP{BindAddress: ":9096"}, Shard: config.Shard{GridSize: 10}, HTTPShardNode: []config.HTTPShardNode{
+		{Name: "a", Weight: 1, HTTPReplicaNode: []config.HTTPReplicaNode{kept, removed}},
+	}}
+	cluster := NewCluster(cfg)
+	before := cluster.Current()
+	retry := before.NodeList()[0].(*ShardHTTPNode).GetInstances()[0].(*RetryHTTPNode)
+
+	writeRequest, _ := influx.NewWriteRequest(
+		[]byte("weather,location=us-midwest temperature=82 1465839830100400200"),
+		"foo",
+		"ms",
+		"")
+	assert.Nil(t, cluster.Write(context.Background(), writeRequest))
+
+	added := config.HTTPReplicaNode{Address: queryOKServer.URL}
+	cfg.HTTPShardNode[0].HTTPReplicaNode = []config.HTTPReplicaNode{kept, added}
+	assert.Nil(t, cluster.Reload(cfg))
+
+	after := cluster.Current()
+	assert.NotEqual(t, before, after)
+	instances := after.NodeList()[0].(*ShardHTTPNode).GetInstances()
+	assert.Equal(t, retry, instances[0])
+	assert.Equal(t, queryOKServer.URL[len("http://"):], instances[1].(*ReplicaHTTPNode).Name())
+}
+
+func TestCluster_ReloadInvalid(t *testing.T) {
+	cfg := config.GearConfig{HTTP: config.HTTP{BindAddress: ":9096"}, Shard: config.Shard{GridSize: 10}, HTTPShardNode: []config.HTTPShardNode{
+		{Name: "a", Weight: 1, HTTPReplicaNode: []config.HTTPReplicaNode{{Address: writeOKServer.URL}}},
+	}}
+	cluster := NewCluster(cfg)
+	before := cluster.Current()
+
+	assert.NotNil(t, cluster.Reload(config.GearConfig{}))
+	cfg.HTTPShardNode[0].Picker = "fastest"
+	assert.NotNil(t, cluster.Reload(cfg))
+	assert.Equal(t, before, cluster.Current())
+}
+
+func TestCluster_ReloadFailedKeepsQueues(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gear-reload")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	// A queue dir that is a file fails to open.
+	blocked := filepath.Join(dir, "blocked")
+	assert.Nil(t, ioutil.WriteFile(blocked, nil, 0644))
+
+	queued := config.HTTPReplicaNode{Address: writeErrorServer.URL, QueueDir: filepath.Join(dir, "queue")}
+	cfg := config.GearConfig{HTTP: config.HTTP{BindAddress: ":9096"}, Shard: config.Shard{GridSize: 10}, HTTPShardNode: []config.HTTPShardNode{
+		{Name: "a", Weight: 1, HTTPReplicaNode: []config.HTTPReplicaNode{queued}},
+	}}
+	cluster := NewCluster(cfg)
+	before := cluster.Current()
+	retry := before.NodeList()[0].(*ShardHTTPNode).GetInstances()[0].(*RetryHTTPNode)
+
+	changed := queued
+	changed.RetryBatchSizeKb = 64
+	cfg.HTTPShardNode[0].HTTPReplicaNode = []config.HTTPReplicaNode{
+		changed,
+		{Address: writeOKServer.URL, QueueDir: blocked},
+	}
+	assert.NotNil(t, cluster.Reload(cfg))
+	assert.Equal(t, before, cluster.Current())
+
+	writeRequest, _ := influx.NewWriteRequest([]byte("cpu value=1 1465839830100400200"), "foo", "ms", "")
+	assert.Nil(t, retry.WritePoints(context.Background(), writeRequest))
+	assert.Equal(t, 1, retry.list.stats().depth)
+
+	cfg.HTTPShardNode[0].HTTPReplicaNode = []config.HTTPReplicaNode{changed}
+	assert.Nil(t, cluster.Reload(cfg))
+	handed := cluster.Current().NodeList()[0].(*ShardHTTPNode).GetInstances()[0].(*RetryHTTPNode)
+	assert.True(t, retry != handed)
+	assert.Equal(t, 1, handed.list.stats().depth)
+	handed.Shutdown()
+}
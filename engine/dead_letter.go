@@ -0,0 +1,78 @@
+package engine
+
+import (
+	"bytes"
+	"encoding/json"
+	. "gear/influx"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+var (
+	// deadLetters shares one file between the replicas that name it.
+	deadLetters   = make(map[string]*deadLetter)
+	deadLettersMu sync.Mutex
+)
+
+// deadLetterRecord is one line of a dead-letter file.
+type deadLetterRecord struct {
+	Time            time.Time `json:"time"`
+	Replica         string    `json:"replica"`
+	Database        string    `json:"db"`
+	RetentionPolicy string    `json:"rp,omitempty"`
+	Precision       string    `json:"precision,omitempty"`
+	Error           string    `json:"error"`
+	Body            string    `json:"body"`
+}
+
+// deadLetter appends the write requests a replica gave up on to a file, one
+// JSON record per line, so that they can be inspected and written again by
+// hand.
+type deadLetter struct {
+	mu   sync.Mutex
+	path string
+	file *os.File
+}
+
+func openDeadLetter(path string) (*deadLetter, error) {
+	path = filepath.Clean(path)
+	deadLettersMu.Lock()
+	defer deadLettersMu.Unlock()
+	if d, ok := deadLetters[path]; ok {
+		return d, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	d := &deadLetter{path: path, file: f}
+	deadLetters[path] = d
+	return d, nil
+}
+
+func (d *deadLetter) write(replica string, wr WriteRequest, reason error) error {
+	var body bytes.Buffer
+	wr.LineProtocol(&body)
+	line, err := json.Marshal(deadLetterRecord{
+		Time:            time.Now().UTC(),
+		Replica:         replica,
+		Database:        wr.Database,
+		RetentionPolicy: wr.RetentionPolicy,
+		Precision:       wr.Precision,
+		Error:           reason.Error(),
+		Body:            body.String(),
+	})
+	if err != nil {
+		return err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	_, err = d.file.Write(append(line, '\n'))
+	return err
+}
@@ -0,0 +1,790 @@
+package engine
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gear/config"
+	. "gear/influx"
+	log "github.com/sirupsen/logrus"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// segmentSize is the size after which a new segment file is started.
+	segmentSize = 16 * MB
+	// recordHeaderSize is the length and the crc32 of the payload.
+	recordHeaderSize = 8
+
+	segmentSuffix = ".seg"
+	positionFile  = "position"
+
+	queueFsyncInterval = time.Second
+)
+
+var (
+	errQueueClosed = errors.New("retry queue is closed")
+
+	// openQueues keeps two replicas from sharing a queue directory.
+	openQueues   = make(map[string]bool)
+	openQueuesMu sync.Mutex
+)
+
+// recordHeader is stored in front of the line protocol of a write request.
+type recordHeader struct {
+	Database        string `json:"db"`
+	RetentionPolicy string `json:"rp,omitempty"`
+	Precision       string `json:"precision,omitempty"`
+	// Queued is when the request was queued, in Unix nanoseconds.
+	Queued int64 `json:"queued,omitempty"`
+}
+
+// diskQueue is a retry queue kept in segment files, so that write requests
+// survive a restart. Every record is [uint32 length][uint32 crc32][payload];
+// the read position is kept in a separate file. Segments are deleted once
+// all their records were committed.
+type diskQueue struct {
+	cond     *sync.Cond
+	dir      string
+	maxSize  int
+	fsync    string
+	segments []uint64
+	// read is the segment and offset of the front record.
+	read       *os.File
+	readOffset int64
+	// write is the last segment, records are appended to it.
+	write       *os.File
+	writeOffset int64
+	size        int
+	num         int
+	// ahead are the oldest records, decoded once until they are removed.
+	// The first inflight of them were returned by front, aheadEnd is the
+	// position following the last one.
+	ahead    []diskRecord
+	aheadEnd segmentCursor
+	inflight int
+	dirty    bool
+	closed   bool
+	done     chan struct{}
+}
+
+func openDiskQueue(dir string, maxSize int, fsync string) (*diskQueue, error) {
+	dir = filepath.Clean(dir)
+	openQueuesMu.Lock()
+	defer openQueuesMu.Unlock()
+	if openQueues[dir] {
+		return nil, fmt.Errorf("retry queue %s is already open", dir)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	q := &diskQueue{
+		cond:    sync.NewCond(new(sync.Mutex)),
+		dir:     dir,
+		maxSize: maxSize,
+		fsync:   fsync,
+		done:    make(chan struct{}),
+	}
+	if err := q.recover(); err != nil {
+		q.closeFiles()
+		return nil, fmt.Errorf("opening retry queue %s: %v", dir, err)
+	}
+	openQueues[dir] = true
+
+	if q.num > 0 {
+		log.Infof("retry queue %s: replaying %d write requests", dir, q.num)
+	}
+	RetryRequestCount.Add(float64(q.num))
+	RetryBufferSize.Add(float64(q.size))
+	if fsync == config.QueueFsyncInterval {
+		go q.syncLoop()
+	}
+	return q, nil
+}
+
+// recover loads the segments and the read position, and truncates a record
+// torn by a crash at the end of a segment.
+func (q *diskQueue) recover() error {
+	files, err := ioutil.ReadDir(q.dir)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		if !strings.HasSuffix(f.Name(), segmentSuffix) {
+			continue
+		}
+		id, err := strconv.ParseUint(strings.TrimSuffix(f.Name(), segmentSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		q.segments = append(q.segments, id)
+	}
+	sort.Slice(q.segments, func(i, j int) bool { return q.segments[i] < q.segments[j] })
+
+	readID, readOffset, err := q.loadPosition()
+	if err != nil {
+		return err
+	}
+	// Segments before the read position were delivered but not deleted yet.
+	for len(q.segments) > 0 && q.segments[0] < readID {
+		if err := os.Remove(q.segmentPath(q.segments[0])); err != nil {
+			return err
+		}
+		q.segments = q.segments[1:]
+	}
+	if len(q.segments) == 0 || q.segments[0] != readID {
+		readOffset = 0
+	}
+
+	for index, id := range q.segments {
+		start := int64(0)
+		if index == 0 {
+			start = readOffset
+		}
+		end, num, err := q.scan(id, start)
+		if err != nil {
+			return err
+		}
+		if index == 0 && end < start {
+			// The position is past the data that made it to disk.
+			log.Warnf("retry queue %s: read position is past the end of its segment, replaying it", q.dir)
+			readOffset = 0
+			if end, num, err = q.scan(id, 0); err != nil {
+				return err
+			}
+			start = 0
+		}
+		q.num += num
+		q.size += int(end - start)
+	}
+
+	if len(q.segments) == 0 {
+		if err := q.createSegment(0); err != nil {
+			return err
+		}
+	} else {
+		last := q.segments[len(q.segments)-1]
+		if q.write, err = os.OpenFile(q.segmentPath(last), os.O_WRONLY|os.O_APPEND, 0644); err != nil {
+			return err
+		}
+		if q.writeOffset, err = q.write.Seek(0, io.SeekEnd); err != nil {
+			return err
+		}
+	}
+	if q.read, err = os.Open(q.segmentPath(q.segments[0])); err != nil {
+		return err
+	}
+	q.readOffset = readOffset
+	return nil
+}
+
+// scan counts the valid records of a segment from offset start and truncates
+// the segment after the last of them. It returns an end before start if the
+// segment is shorter than start.
+func (q *diskQueue) scan(id uint64, start int64) (end int64, num int, err error) {
+	path := q.segmentPath(id)
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	if start > int64(len(data)) {
+		return int64(len(data)), 0, nil
+	}
+	end = start
+	for {
+		n, ok := validRecord(data[end:])
+		if !ok {
+			break
+		}
+		end += int64(n)
+		num++
+	}
+	if end < int64(len(data)) {
+		log.Warnf("retry queue %s: truncating %d bytes of a torn record in %s",
+			q.dir, int64(len(data))-end, filepath.Base(path))
+		if err := os.Truncate(path, end); err != nil {
+			return 0, 0, err
+		}
+	}
+	return end, num, nil
+}
+
+// validRecord returns the length of the record at the start of data.
+func validRecord(data []byte) (int, bool) {
+	if len(data) < recordHeaderSize {
+		return 0, false
+	}
+	length := int(binary.BigEndian.Uint32(data[0:4]))
+	if len(data)-recordHeaderSize < length {
+		return 0, false
+	}
+	payload := data[recordHeaderSize : recordHeaderSize+length]
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(data[4:8]) {
+		return 0, false
+	}
+	return recordHeaderSize + length, true
+}
+
+func (q *diskQueue) segmentPath(id uint64) string {
+	return filepath.Join(q.dir, fmt.Sprintf("%020d%s", id, segmentSuffix))
+}
+
+func (q *diskQueue) createSegment(id uint64) error {
+	f, err := os.OpenFile(q.segmentPath(id), os.O_WRONLY|os.O_APPEND|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	if q.write != nil {
+		q.write.Sync()
+		q.write.Close()
+	}
+	q.write = f
+	q.writeOffset = 0
+	q.segments = append(q.segments, id)
+	return nil
+}
+
+func (q *diskQueue) loadPosition() (uint64, int64, error) {
+	data, err := ioutil.ReadFile(filepath.Join(q.dir, positionFile))
+	if os.IsNotExist(err) {
+		return 0, 0, nil
+	} else if err != nil {
+		return 0, 0, err
+	}
+	var id uint64
+	var offset int64
+	if _, err := fmt.Sscanf(string(data), "%d %d", &id, &offset); err != nil {
+		log.Warnf("retry queue %s: ignoring corrupt position file", q.dir)
+		return 0, 0, nil
+	}
+	return id, offset, nil
+}
+
+// savePosition replaces the position file, so that a crash leaves either the
+// old or the new position.
+func (q *diskQueue) savePosition() error {
+	path := filepath.Join(q.dir, positionFile)
+	f, err := os.Create(path + ".tmp")
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(f, "%d %d\n", q.segments[0], q.readOffset)
+	if q.fsync == config.QueueFsyncAlways {
+		f.Sync()
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+func encodeRecord(wr WriteRequest) ([]byte, error) {
+	var b bytes.Buffer
+	b.Write(make([]byte, recordHeaderSize))
+	header, err := json.Marshal(recordHeader{
+		Database:        wr.Database,
+		RetentionPolicy: wr.RetentionPolicy,
+		Precision:       wr.Precision,
+		Queued:          time.Now().UnixNano(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	b.Write(header)
+	b.WriteByte('\n')
+	wr.LineProtocol(&b)
+
+	record := b.Bytes()
+	payload := record[recordHeaderSize:]
+	binary.BigEndian.PutUint32(record[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(record[4:8], crc32.ChecksumIEEE(payload))
+	return record, nil
+}
+
+func decodeRecord(payload []byte) (WriteRequest, time.Time, error) {
+	i := bytes.IndexByte(payload, '\n')
+	if i < 0 {
+		return WriteRequest{}, time.Time{}, errors.New("record without header")
+	}
+	var header recordHeader
+	if err := json.Unmarshal(payload[:i], &header); err != nil {
+		return WriteRequest{}, time.Time{}, err
+	}
+	var queued time.Time
+	if header.Queued != 0 {
+		queued = time.Unix(0, header.Queued)
+	}
+	wr, err := NewWriteRequest(payload[i+1:], header.Database, header.Precision, header.RetentionPolicy)
+	return wr, queued, err
+}
+
+func (q *diskQueue) add(wr WriteRequest) error {
+	record, err := encodeRecord(wr)
+	if err != nil {
+		return err
+	}
+
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+
+	if q.closed {
+		return errQueueClosed
+	}
+	if q.size+len(record) > q.maxSize {
+		return ErrBufferFull
+	}
+	if q.writeOffset > 0 && q.writeOffset+int64(len(record)) > segmentSize {
+		if err := q.createSegment(q.segments[len(q.segments)-1] + 1); err != nil {
+			return err
+		}
+	}
+	if _, err := q.write.Write(record); err != nil {
+		// Drop what made it to the file, it would be read as a torn record.
+		q.write.Truncate(q.writeOffset)
+		return err
+	}
+	q.writeOffset += int64(len(record))
+	if q.fsync == config.QueueFsyncAlways {
+		if err := q.write.Sync(); err != nil {
+			return err
+		}
+	} else {
+		q.dirty = true
+	}
+
+	q.size += len(record)
+	q.num++
+	q.cond.Signal()
+	RetryRequestCount.Inc()
+	RetryBufferSize.Add(float64(len(record)))
+	return nil
+}
+
+// front will return the oldest records of the queue that can be written
+// together, blocking if necessary.
+func (q *diskQueue) front(maxBytes int) (batch []WriteRequest, ok bool) {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+
+	for {
+		for q.num == 0 && !q.closed {
+			q.cond.Wait()
+		}
+		if q.closed {
+			return nil, false
+		}
+		if err := q.peek(); err != nil {
+			log.Errorf("retry queue %s: %v", q.dir, err)
+			return nil, false
+		}
+		if len(q.ahead) > 0 {
+			break
+		}
+	}
+
+	batch = []WriteRequest{q.ahead[0].wr}
+	size := q.ahead[0].wr.Size()
+	for i := 1; ; i++ {
+		if i == len(q.ahead) {
+			more, err := q.loadMore()
+			if err != nil {
+				log.Errorf("retry queue %s: %v", q.dir, err)
+			}
+			if !more {
+				break
+			}
+		}
+		wr := q.ahead[i].wr
+		if !sameBatch(batch[0], wr) || size+wr.Size() > maxBytes {
+			break
+		}
+		batch = append(batch, wr)
+		size += wr.Size()
+	}
+	q.inflight = len(batch)
+	return batch, true
+}
+
+func (q *diskQueue) evict() (wr WriteRequest, ok bool) {
+	return q.evictIf(func(diskRecord) bool { return true })
+}
+
+// evictBefore ignores records without a queued time, which were written by
+// an older version.
+func (q *diskQueue) evictBefore(t time.Time) (wr WriteRequest, ok bool) {
+	return q.evictIf(func(record diskRecord) bool {
+		return !record.at.IsZero() && record.at.Before(t)
+	})
+}
+
+func (q *diskQueue) evictIf(cond func(diskRecord) bool) (wr WriteRequest, ok bool) {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+
+	if q.closed {
+		return wr, false
+	}
+	if err := q.peek(); err != nil {
+		log.Errorf("retry queue %s: %v", q.dir, err)
+		return wr, false
+	}
+	if len(q.ahead) == 0 || !cond(q.ahead[0]) {
+		return wr, false
+	}
+	wr = q.ahead[0].wr
+	q.remove()
+	if q.inflight > 0 {
+		q.inflight--
+	}
+	q.saveOrLog()
+	return wr, true
+}
+
+// diskRecord is a decoded record of the queue.
+type diskRecord struct {
+	wr   WriteRequest
+	at   time.Time
+	size int
+}
+
+// peek decodes the oldest record into ahead unless it is already there.
+// Records that can't be decoded are logged and skipped.
+func (q *diskQueue) peek() error {
+	for len(q.ahead) == 0 && q.num > 0 {
+		if err := q.advance(); err != nil {
+			return err
+		}
+		record, err := q.readRecord(q.read, q.readOffset)
+		if err != nil {
+			if record.size == 0 {
+				return err
+			}
+			log.Errorf("retry queue %s: dropping undecodable record: %v", q.dir, err)
+			q.drop(record.size)
+			q.saveOrLog()
+			continue
+		}
+		q.ahead = append(q.ahead, record)
+		q.aheadEnd.moveTo(q.segments[0], q.readOffset+int64(record.size))
+	}
+	return nil
+}
+
+// loadMore decodes the record following the ones in ahead. It returns false
+// at the end of the queue and at a record that can't be decoded, which is
+// dropped once it is the oldest one.
+func (q *diskQueue) loadMore() (bool, error) {
+	if len(q.ahead) == 0 || len(q.ahead) >= q.num {
+		return false, nil
+	}
+	// Records don't span segments, the one after a segment's last record
+	// is the first of the next segment.
+	cursor := &q.aheadEnd
+	for {
+		index := q.segmentIndex(cursor.segment)
+		if index < 0 {
+			return false, fmt.Errorf("segment %d was removed", cursor.segment)
+		}
+		end := q.writeOffset
+		if index < len(q.segments)-1 {
+			if !cursor.sized {
+				info, err := os.Stat(q.segmentPath(cursor.segment))
+				if err != nil {
+					return false, err
+				}
+				cursor.size, cursor.sized = info.Size(), true
+			}
+			end = cursor.size
+		}
+		if cursor.offset < end {
+			break
+		}
+		if index == len(q.segments)-1 {
+			return false, nil
+		}
+		cursor.moveTo(q.segments[index+1], 0)
+	}
+
+	f := q.read
+	if cursor.segment != q.segments[0] {
+		if cursor.file == nil {
+			var err error
+			if cursor.file, err = os.Open(q.segmentPath(cursor.segment)); err != nil {
+				return false, err
+			}
+		}
+		f = cursor.file
+	}
+	record, err := q.readRecord(f, cursor.offset)
+	if err != nil {
+		return false, nil
+	}
+	q.ahead = append(q.ahead, record)
+	cursor.offset += int64(record.size)
+	return true, nil
+}
+
+// segmentIndex returns the index of segment in segments, -1 if it's gone.
+func (q *diskQueue) segmentIndex(segment uint64) int {
+	for index, s := range q.segments {
+		if s == segment {
+			return index
+		}
+	}
+	return -1
+}
+
+// segmentCursor is a position in the segments, so that loadMore doesn't walk
+// the records in ahead again. The file and size of the segment are kept
+// while the cursor is in it.
+type segmentCursor struct {
+	segment uint64
+	offset  int64
+	// size is the size of segment, known once sized. Only the last segment
+	// grows, it isn't sized.
+	size  int64
+	sized bool
+	file  *os.File
+}
+
+func (c *segmentCursor) moveTo(segment uint64, offset int64) {
+	if segment != c.segment {
+		c.close()
+		c.segment, c.sized = segment, false
+	}
+	c.offset = offset
+}
+
+func (c *segmentCursor) close() {
+	if c.file != nil {
+		c.file.Close()
+		c.file = nil
+	}
+}
+
+// readRecord reads the record at offset of f. The size of the record is set
+// if only decoding it failed.
+func (q *diskQueue) readRecord(f *os.File, offset int64) (record diskRecord, err error) {
+	var header [recordHeaderSize]byte
+	if _, err := f.ReadAt(header[:], offset); err != nil {
+		return record, fmt.Errorf("reading record: %v", err)
+	}
+	payload := make([]byte, binary.BigEndian.Uint32(header[0:4]))
+	if _, err := f.ReadAt(payload, offset+recordHeaderSize); err != nil {
+		return record, fmt.Errorf("reading record: %v", err)
+	}
+	record.size = recordHeaderSize + len(payload)
+	record.wr, record.at, err = decodeRecord(payload)
+	return record, err
+}
+
+// advance moves the read position to the next segment when the current one
+// was read completely.
+func (q *diskQueue) advance() error {
+	for len(q.segments) > 1 {
+		info, err := q.read.Stat()
+		if err != nil {
+			return err
+		}
+		if q.readOffset < info.Size() {
+			return nil
+		}
+		q.read.Close()
+		if err := os.Remove(q.segmentPath(q.segments[0])); err != nil {
+			return err
+		}
+		q.segments = q.segments[1:]
+		if q.read, err = os.Open(q.segmentPath(q.segments[0])); err != nil {
+			return err
+		}
+		q.readOffset = 0
+	}
+	return nil
+}
+
+func (q *diskQueue) commit() {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+
+	if q.closed || q.inflight == 0 {
+		return
+	}
+	for ; q.inflight > 0 && len(q.ahead) > 0; q.inflight-- {
+		q.remove()
+	}
+	q.inflight = 0
+	q.saveOrLog()
+}
+
+// remove drops the oldest record, which must be in ahead.
+func (q *diskQueue) remove() {
+	q.drop(q.ahead[0].size)
+	q.ahead = q.ahead[1:]
+}
+
+// drop moves the read position over the oldest record of size bytes.
+func (q *diskQueue) drop(size int) {
+	q.readOffset += int64(size)
+	q.size -= size
+	q.num--
+	RetryRequestCount.Dec()
+	RetryBufferSize.Sub(float64(size))
+
+	if err := q.advance(); err != nil {
+		log.Errorf("retry queue %s: %v", q.dir, err)
+	}
+}
+
+func (q *diskQueue) saveOrLog() {
+	if err := q.savePosition(); err != nil {
+		log.Errorf("retry queue %s: saving position: %v", q.dir, err)
+	}
+}
+
+func (q *diskQueue) stats() queueStats {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+	stats := queueStats{depth: q.num, bytes: q.size}
+	if q.closed {
+		return stats
+	}
+	if err := q.peek(); err != nil {
+		log.Errorf("retry queue %s: %v", q.dir, err)
+	} else if len(q.ahead) > 0 {
+		stats.oldest = q.ahead[0].at
+	}
+	return stats
+}
+
+// each reads the records without holding the lock, from files opened while
+// holding it. Segments deleted meanwhile stay readable through them.
+func (q *diskQueue) each(fn func(wr WriteRequest) error) error {
+	type span struct {
+		file       *os.File
+		start, end int64
+	}
+	var spans []span
+	defer func() {
+		for _, s := range spans {
+			s.file.Close()
+		}
+	}()
+
+	q.cond.L.Lock()
+	if q.closed {
+		q.cond.L.Unlock()
+		return errQueueClosed
+	}
+	for index, id := range q.segments {
+		f, err := os.Open(q.segmentPath(id))
+		if err != nil {
+			q.cond.L.Unlock()
+			return err
+		}
+		s := span{file: f}
+		if index == 0 {
+			s.start = q.readOffset
+		}
+		if index == len(q.segments)-1 {
+			s.end = q.writeOffset
+		} else if info, err := f.Stat(); err != nil {
+			q.cond.L.Unlock()
+			return err
+		} else {
+			s.end = info.Size()
+		}
+		spans = append(spans, s)
+	}
+	q.cond.L.Unlock()
+
+	for _, s := range spans {
+		data := make([]byte, s.end-s.start)
+		if _, err := s.file.ReadAt(data, s.start); err != nil {
+			return err
+		}
+		for len(data) > 0 {
+			n, ok := validRecord(data)
+			if !ok {
+				return fmt.Errorf("corrupt record in %s", s.file.Name())
+			}
+			wr, _, err := decodeRecord(data[recordHeaderSize:n])
+			data = data[n:]
+			if err != nil {
+				continue
+			}
+			if err := fn(wr); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (q *diskQueue) syncLoop() {
+	ticker := time.NewTicker(queueFsyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			q.cond.L.Lock()
+			if q.dirty && !q.closed {
+				q.write.Sync()
+				q.dirty = false
+			}
+			q.cond.L.Unlock()
+		case <-q.done:
+			return
+		}
+	}
+}
+
+// close syncs and closes the segment files. The records that are left are
+// replayed when the directory is opened again.
+func (q *diskQueue) close() int {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+	if q.closed {
+		return q.num
+	}
+	q.closed = true
+	q.cond.Broadcast()
+	close(q.done)
+	q.closeFiles()
+
+	openQueuesMu.Lock()
+	delete(openQueues, q.dir)
+	openQueuesMu.Unlock()
+
+	RetryRequestCount.Sub(float64(q.num))
+	RetryBufferSize.Sub(float64(q.size))
+	return q.num
+}
+
+func (q *diskQueue) closeFiles() {
+	if q.write != nil {
+		q.write.Sync()
+		q.write.Close()
+	}
+	if q.read != nil {
+		q.read.Close()
+	}
+	q.aheadEnd.close()
+}
+
+func (q *diskQueue) isClosed() bool {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+	return q.closed
+}
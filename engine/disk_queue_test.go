@@ -0,0 +1,212 @@
+package engine
+
+import (
+	"gear/config"
+	"gear/influx"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func testWriteRequest(t *testing.T, line string) influx.WriteRequest {
+	wr, err := influx.NewWriteRequest([]byte(line), "foo", "ms", "autogen")
+	assert.Nil(t, err)
+	return wr
+}
+
+func TestDiskQueue_Replay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gear-queue")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	q, err := openDiskQueue(dir, MB, config.QueueFsyncAlways)
+	assert.Nil(t, err)
+	_, err = openDiskQueue(dir, MB, config.QueueFsyncAlways)
+	assert.NotNil(t, err)
+
+	assert.Nil(t, q.add(testWriteRequest(t, "cpu,host=a value=1 1465839830100")))
+	assert.Nil(t, q.add(testWriteRequest(t, "cpu,host=b value=2 1465839830200")))
+	assert.Nil(t, q.add(testWriteRequest(t, "cpu,host=c value=3 1465839830300")))
+
+	batch, ok := q.front(1)
+	assert.True(t, ok)
+	wr := batch[0]
+	assert.Equal(t, "cpu,host=a value=1 1465839830100", wr.Points[0].PrecisionString("ms"))
+	q.commit()
+	assert.Equal(t, 2, q.close())
+
+	// A crash in the middle of an append leaves a torn record behind.
+	segment := filepath.Join(dir, "00000000000000000000.seg")
+	f, err := os.OpenFile(segment, os.O_WRONLY|os.O_APPEND, 0644)
+	assert.Nil(t, err)
+	f.Write([]byte{0, 0, 1, 0, 1, 2})
+	f.Close()
+
+	q, err = openDiskQueue(dir, MB, config.QueueFsyncNever)
+	assert.Nil(t, err)
+	defer q.close()
+	assert.Equal(t, 2, q.num)
+
+	batch, ok = q.front(1)
+	assert.True(t, ok)
+	wr = batch[0]
+	assert.Equal(t, "foo", wr.Database)
+	assert.Equal(t, "autogen", wr.RetentionPolicy)
+	assert.Equal(t, "ms", wr.Precision)
+	assert.Equal(t, "cpu,host=b value=2 1465839830200", wr.Points[0].PrecisionString("ms"))
+	q.commit()
+
+	assert.Nil(t, q.add(testWriteRequest(t, "cpu,host=d value=4 1465839830400")))
+	// Both are written in one batch.
+	batch, _ = q.front(MB)
+	assert.Len(t, batch, 2)
+	assert.Equal(t, "cpu,host=c value=3 1465839830300", batch[0].Points[0].PrecisionString("ms"))
+	assert.Equal(t, "cpu,host=d value=4 1465839830400", batch[1].Points[0].PrecisionString("ms"))
+	q.commit()
+	assert.Equal(t, 0, q.num)
+}
+
+func TestDiskQueue_Full(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gear-queue")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	q, err := openDiskQueue(dir, 160, config.QueueFsyncNever)
+	assert.Nil(t, err)
+	defer q.close()
+
+	assert.Nil(t, q.add(testWriteRequest(t, "cpu,host=a value=1 1465839830100")))
+	assert.Equal(t, ErrBufferFull, q.add(testWriteRequest(t, "cpu,host=b value=2 1465839830200")))
+}
+
+func TestDiskQueue_Segments(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gear-queue")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	q, err := openDiskQueue(dir, MB, config.QueueFsyncNever)
+	assert.Nil(t, err)
+	defer q.close()
+
+	assert.Nil(t, q.add(testWriteRequest(t, "cpu,host=a value=1 1465839830100")))
+	assert.Nil(t, q.createSegment(1))
+	assert.Nil(t, q.add(testWriteRequest(t, "cpu,host=b value=2 1465839830200")))
+
+	stats := q.stats()
+	assert.Equal(t, 2, stats.depth)
+	assert.False(t, stats.oldest.IsZero())
+	var exported []string
+	assert.Nil(t, q.each(func(wr influx.WriteRequest) error {
+		exported = append(exported, wr.Points[0].PrecisionString("ms"))
+		return nil
+	}))
+	assert.Equal(t, []string{"cpu,host=a value=1 1465839830100", "cpu,host=b value=2 1465839830200"}, exported)
+
+	q.front(1)
+	q.commit()
+	_, err = os.Stat(filepath.Join(dir, "00000000000000000000.seg"))
+	assert.True(t, os.IsNotExist(err))
+
+	batch, ok := q.front(MB)
+	assert.True(t, ok)
+	assert.Len(t, batch, 1)
+	wr := batch[0]
+	assert.Equal(t, "cpu,host=b value=2 1465839830200", wr.Points[0].PrecisionString("ms"))
+}
+
+func TestRetryHTTPNode_DiskQueue(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gear-queue")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	node, err := NewReplicaHTTPNode(config.HTTPReplicaNode{Address: writeOKServer.URL, QueueDir: dir})
+	assert.Nil(t, err)
+	defer node.Shutdown()
+	q := node.(*RetryHTTPNode).list.(*diskQueue)
+
+	assert.Nil(t, q.add(testWriteRequest(t, "cpu,host=a value=1 1465839830100")))
+	assert.True(t, waitFor(func() bool {
+		q.cond.L.Lock()
+		defer q.cond.L.Unlock()
+		return q.num == 0
+	}))
+}
+
+func TestDiskQueue_BatchAcrossSegments(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gear-queue")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	q, err := openDiskQueue(dir, MB, config.QueueFsyncNever)
+	assert.Nil(t, err)
+	defer q.close()
+
+	other, _ := influx.NewWriteRequest([]byte("cpu,host=c value=3 1465839830300"), "bar", "ms", "autogen")
+	assert.Nil(t, q.add(testWriteRequest(t, "cpu,host=a value=1 1465839830100")))
+	assert.Nil(t, q.createSegment(1))
+	assert.Nil(t, q.add(testWriteRequest(t, "cpu,host=b value=2 1465839830200")))
+	assert.Nil(t, q.createSegment(2))
+	assert.Nil(t, q.add(other))
+
+	batch, ok := q.front(MB)
+	assert.True(t, ok)
+	assert.Len(t, batch, 2)
+	assert.Equal(t, "cpu,host=b value=2 1465839830200", batch[1].Points[0].PrecisionString("ms"))
+	q.commit()
+
+	batch, ok = q.front(MB)
+	assert.True(t, ok)
+	assert.Len(t, batch, 1)
+	assert.Equal(t, "bar", batch[0].Database)
+}
+
+func TestDiskQueue_BatchGrowsFromCursor(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gear-queue")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	q, err := openDiskQueue(dir, MB, config.QueueFsyncNever)
+	assert.Nil(t, err)
+	defer q.close()
+
+	a := testWriteRequest(t, "cpu,host=a value=1 1465839830100")
+	assert.Nil(t, q.add(a))
+	assert.Nil(t, q.add(testWriteRequest(t, "cpu,host=b value=2 1465839830200")))
+	batch, ok := q.front(a.Size())
+	assert.True(t, ok)
+	assert.Len(t, batch, 1)
+	q.commit()
+
+	// b stays decoded, the records queued since are read after it.
+	assert.Nil(t, q.add(testWriteRequest(t, "cpu,host=c value=3 1465839830300")))
+	assert.Nil(t, q.createSegment(1))
+	assert.Nil(t, q.add(testWriteRequest(t, "cpu,host=d value=4 1465839830400")))
+	batch, ok = q.front(MB)
+	assert.True(t, ok)
+	var hosts []string
+	for _, wr := range batch {
+		hosts = append(hosts, wr.Points[0].Tags().GetString("host"))
+	}
+	assert.Equal(t, []string{"b", "c", "d"}, hosts)
+}
+
+func TestDiskQueue_EvictBefore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gear-queue")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	q, err := openDiskQueue(dir, MB, config.QueueFsyncNever)
+	assert.Nil(t, err)
+	defer q.close()
+
+	assert.Nil(t, q.add(testWriteRequest(t, "cpu,host=a value=1 1465839830100")))
+	_, ok := q.evictBefore(time.Now().Add(-time.Hour))
+	assert.False(t, ok)
+	wr, ok := q.evictBefore(time.Now().Add(time.Second))
+	assert.True(t, ok)
+	assert.Equal(t, "foo", wr.Database)
+	assert.Equal(t, 0, q.num)
+}
@@ -1,6 +1,7 @@
 package engine
 
 import (
+	"context"
 	"gear/config"
 	. "gear/influx"
 	"github.com/influxdata/influxdb/models"
@@ -8,31 +9,42 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
+// Engine serves the writes and queries of clients. They are given up when
+// their ctx is done, e.g. because the client went away.
 type Engine interface {
-	Write(wr WriteRequest) error
-	Query(qr QueryRequest) *Response
+	Write(ctx context.Context, wr WriteRequest) error
+	Query(ctx context.Context, qr QueryRequest) *Response
 }
 
 type Shard interface {
 
 }
 
-type HTTPEngine struct {
-	nodeList []Node
-	grid     Grid
-	sharding bool
-	picker   Picker
-	config   config.GearConfig
+// ShardLocator decides which shard node owns a hashed key.
+type ShardLocator interface {
+	ShardFor(hash uint64) Node
 }
 
+type HTTPEngine struct {
+	nodeList  []Node
+	locator   ShardLocator
+	shardKeys ShardKeys
+	sharding  bool
+	picker    Picker
+	health    *HealthChecker
+	schema    *SchemaChecker
+	replicas  *replicaPool
+	timeouts  timeouts
+	config    config.GearConfig
+
+	// migration is set while data moves from a previous placement, whose
+	// shard nodes that aren't in the current one are removed.
+	migration *Migration
+	removed   []Node
+}
 
 func NewEngine(gearConfig config.GearConfig) Engine {
-	engine := &HTTPEngine{
-		config: gearConfig,
-	}
-	engine.InitNode()
-
-	return engine
+	return NewCluster(gearConfig)
 }
 
 type ShardMapping struct {
@@ -57,27 +69,38 @@ func (s *ShardMapping) MapPoint(node Node, p models.Point) {
 }
 
 func (e *HTTPEngine) ShardFor(hash uint64) Node {
-	return e.grid[hash%uint64(len(e.grid))]
+	return e.locator.ShardFor(hash)
 }
 
 func (e *HTTPEngine) MapShards(wp *WriteRequest) (ShardMapping, error) {
 	mapping := NewShardMapping()
 	for _, p := range wp.Points {
-		h := models.NewInlineFNV64a()
-		h.Write(p.Name())
-		sum := h.Sum64()
-		node := e.ShardFor(sum)
+		key := e.shardKeys.lookup(wp.Database, string(p.Name()))
+		node := e.ShardFor(key.hashPoint(p))
 		mapping.MapPoint(node, p)
+		if e.migration != nil {
+			if previous := e.migration.previousOwner(wp.Database, p); previous != nil && previous.ID() != node.ID() {
+				mapping.MapPoint(previous, p)
+			}
+		}
 	}
 	return mapping, nil
 }
 
-func (e *HTTPEngine) MapMeasurements(stmt *influxql.SelectStatement) (Node, error) {
-	h := models.NewInlineFNV64a()
-	h.Write([]byte(stmt.Sources.String()))
-	sum := h.Sum64()
-	node := e.ShardFor(sum)
-	return node, nil
+// MapMeasurement returns the shard nodes that may hold the points of a
+// measurement matching cond. It is every node unless the shard key of the
+// measurement can be derived from cond. During a migration, measurements
+// not moved yet are mapped to the shard nodes of the previous placement.
+func (e *HTTPEngine) MapMeasurement(database, name string, cond influxql.Expr) []Node {
+	if e.migration != nil && !e.migration.isMoved(database, name) {
+		return e.migration.previous.mapMeasurement(database, name, cond)
+	}
+	key := e.shardKeys.lookup(database, name)
+	sum, ok := key.hashCondition(name, cond)
+	if !ok {
+		return e.NodeList()
+	}
+	return []Node{e.ShardFor(sum)}
 }
 
 func (e *HTTPEngine) InitNode() {
@@ -88,25 +111,105 @@ func (e *HTTPEngine) InitNode() {
 	} else {
 		e.sharding = false
 	}
+	if e.replicas == nil {
+		e.replicas = newReplicaPool(nil)
+	}
 	for _, node := range e.config.HTTPShardNode {
-		newHTTPNode := NewShardHTTPNode(node)
+		newHTTPNode := newShardHTTPNode(node, e.replicas.get)
 		e.nodeList = append(e.nodeList, newHTTPNode)
 	}
 	e.picker = NewRRPicker(e.nodeList)
-	e.grid = NewGrid(e.nodeList, e.config.Shard.GridSize)
+	timeouts, err := newTimeouts(e.config.Timeout)
+	if err != nil {
+		panic(err)
+	}
+	e.timeouts = timeouts
+	e.shardKeys = NewShardKeys(e.config.Shard.Keys)
+	if e.sharding {
+		e.locator = NewShardLocator(e.config.Shard, e.nodeList)
+	} else {
+		e.locator = Grid(e.nodeList)
+	}
+
+	if e.config.Migration.From != "" {
+		e.initMigration()
+	}
+
+	var replicas []Node
+	for _, node := range e.allNodes() {
+		replicas = append(replicas, node.(*ShardHTTPNode).GetInstances()...)
+	}
+	health, err := NewHealthChecker(e.config.HealthCheck, replicas)
+	if err != nil {
+		panic(err)
+	}
+	e.health = health
+	e.health.Start()
+
+	schema, err := NewSchemaChecker(e.config.SchemaCheck, replicas)
+	if err != nil {
+		panic(err)
+	}
+	e.schema = schema
+	e.schema.Start()
+}
+
+// bootstrap copies the schema of their peers to the replicas of the shard
+// nodes that have none, in the background so that neither startup nor a
+// reload waits for the replicas. previous are the replica nodes of the
+// topology replaced, nil at startup: the replicas at other addresses are
+// new, and unreachable ones get the schema handed off.
+func (e *HTTPEngine) bootstrap(previous map[string]Node) {
+	known := make(map[string]bool)
+	for _, node := range previous {
+		known[nodeKey(node)] = true
+	}
+	isNew := func(replica Node) bool {
+		return previous != nil && !known[nodeKey(replica)]
+	}
+	go func() {
+		for _, node := range e.nodeList {
+			e.schema.Bootstrap(node.(*ShardHTTPNode).GetInstances(), isNew)
+		}
+	}()
 }
 
-func (e *HTTPEngine) Grid() Grid {
-	return e.grid
+// NewShardLocator builds the placement strategy selected in the [shard] section.
+func NewShardLocator(shard config.Shard, nodes []Node) ShardLocator {
+	switch shard.Strategy {
+	case config.ShardStrategyConsistentHash:
+		log.Info("placing measurements on a consistent-hash ring")
+		return NewHashRing(nodes, shard.VirtualNodes)
+	default:
+		return NewGrid(nodes, shard.GridSize)
+	}
+}
+
+func (e *HTTPEngine) Locator() ShardLocator {
+	return e.locator
 }
 
 func (e *HTTPEngine) NodeList() []Node {
 	return e.nodeList
 }
 
+// allNodes returns the shard nodes of the current placement and, during a
+// migration, the ones removed from the previous placement: statements
+// managing or listing the schema go to all of them.
+func (e *HTTPEngine) allNodes() []Node {
+	if len(e.removed) == 0 {
+		return e.nodeList
+	}
+	return append(append([]Node(nil), e.nodeList...), e.removed...)
+}
+
 type Grid []Node
 
-func NewGrid(nodes []Node, size int) []Node {
+func (g Grid) ShardFor(hash uint64) Node {
+	return g[hash%uint64(len(g))]
+}
+
+func NewGrid(nodes []Node, size int) Grid {
 	grid := make([]Node, size)
 	var index = 0
 	for {
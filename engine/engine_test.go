@@ -1,6 +1,7 @@
 package engine
 
 import (
+	"context"
 	. "gear/influx"
 	"github.com/influxdata/influxdb/models"
 	"github.com/influxdata/influxdb/query"
@@ -10,13 +11,20 @@ import (
 
 type MockNode struct{}
 
-func (m *MockNode) ID() uint64                                              { return uint64(1) }
-func (m *MockNode) Ping() error                                             { return nil }
-func (m *MockNode) Query(q QueryRequest) (*query.Result, error)             { return &query.Result{}, nil }
-func (m *MockNode) QueryEachInstance(q QueryRequest) (*query.Result, error) { return &query.Result{}, nil }
-func (m *MockNode) WritePoints(wr WriteRequest) error                       { return nil }
-func (m *MockNode) Shutdown()                                               {}
-func (m *MockNode) Weight() int                                             { return 1 }
+func (m *MockNode) ID() uint64  { return uint64(1) }
+func (m *MockNode) Ping() error { return nil }
+func (m *MockNode) Query(ctx context.Context, q QueryRequest) (*query.Result, error) {
+	return &query.Result{}, nil
+}
+func (m *MockNode) QueryEachInstance(ctx context.Context, q QueryRequest) (*query.Result, error) {
+	return &query.Result{}, nil
+}
+func (m *MockNode) QueryChunked(ctx context.Context, q QueryRequest, emit func(*query.Result) error) error {
+	return emit(&query.Result{})
+}
+func (m *MockNode) WritePoints(ctx context.Context, wr WriteRequest) error { return nil }
+func (m *MockNode) Shutdown()                                              {}
+func (m *MockNode) Weight() int                                            { return 1 }
 
 var (
 	mockNodeA = &MockNode{}
@@ -25,7 +33,7 @@ var (
 
 	mockEngine = HTTPEngine{
 		nodeList: mockNodeList,
-		grid: NewGrid(mockNodeList, 100),
+		locator:  NewGrid(mockNodeList, 100),
 	}
 
 	pointsStr = []byte("weather,location=us-midwest temperature=82 1465839830100400200\n" +
@@ -0,0 +1,50 @@
+package engine
+
+import (
+	"context"
+	"sync"
+)
+
+// fanOut calls fn for every node concurrently, on at most limit nodes at
+// once, every node at once when limit is 0. Once a call fails or ctx is done,
+// the nodes not started yet are skipped and the ctx of the running calls is
+// canceled. The error of the call that failed first is returned, or the one
+// of ctx.
+func fanOut(ctx context.Context, nodes []Node, limit int, fn func(ctx context.Context, index int, node Node) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	if limit <= 0 || limit > len(nodes) {
+		limit = len(nodes)
+	}
+
+	var (
+		wg    sync.WaitGroup
+		once  sync.Once
+		first error
+	)
+	slots := make(chan struct{}, limit)
+	for index, node := range nodes {
+		slots <- struct{}{}
+		if ctx.Err() != nil {
+			break
+		}
+		wg.Add(1)
+		go func(index int, node Node) {
+			defer func() {
+				<-slots
+				wg.Done()
+			}()
+			if err := fn(ctx, index, node); err != nil {
+				once.Do(func() {
+					first = err
+					cancel()
+				})
+			}
+		}(index, node)
+	}
+	wg.Wait()
+	if first == nil {
+		first = ctx.Err()
+	}
+	return first
+}
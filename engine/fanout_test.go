@@ -0,0 +1,91 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	. "gear/influx"
+	"github.com/influxdata/influxdb/models"
+	"github.com/influxdata/influxdb/query"
+	"github.com/stretchr/testify/assert"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// slowNode answers every query with a row named after it, after delay.
+type slowNode struct {
+	MockNode
+	name  string
+	delay time.Duration
+}
+
+func (n *slowNode) Query(ctx context.Context, q QueryRequest) (*query.Result, error) {
+	time.Sleep(n.delay)
+	return &query.Result{Series: models.Rows{{Name: n.name}}}, nil
+}
+
+func newMockNodes(n int) []Node {
+	nodes := make([]Node, n)
+	for index := range nodes {
+		nodes[index] = &MockNode{}
+	}
+	return nodes
+}
+
+func TestFanOut_Concurrency(t *testing.T) {
+	var running, peak, calls int32
+	err := fanOut(context.Background(), newMockNodes(6), 2, func(ctx context.Context, index int, node Node) error {
+		n := atomic.AddInt32(&running, 1)
+		for {
+			p := atomic.LoadInt32(&peak)
+			if n <= p || atomic.CompareAndSwapInt32(&peak, p, n) {
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+		atomic.AddInt32(&running, -1)
+		atomic.AddInt32(&calls, 1)
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.EqualValues(t, 6, calls)
+	assert.EqualValues(t, 2, peak)
+}
+
+func TestFanOut_CancelOnError(t *testing.T) {
+	failure := errors.New("shard down")
+	var started int32
+	err := fanOut(context.Background(), newMockNodes(4), 2, func(ctx context.Context, index int, node Node) error {
+		atomic.AddInt32(&started, 1)
+		if index == 0 {
+			return failure
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(5 * time.Second):
+			return nil
+		}
+	})
+	assert.Equal(t, failure, err)
+	// The node running when the first one failed was canceled, the others
+	// weren't started.
+	assert.EqualValues(t, 2, started)
+}
+
+func TestHTTPEngine_QueryEachOrder(t *testing.T) {
+	e := HTTPEngine{}
+	e.config.Query.FanOutConcurrency = 2
+	nodes := []Node{
+		&slowNode{name: "a", delay: 30 * time.Millisecond},
+		&slowNode{name: "b", delay: 20 * time.Millisecond},
+		&slowNode{name: "c"},
+	}
+	results, err := e.queryNodes(context.Background(), nodes, QueryRequest{})
+	assert.Nil(t, err)
+	var names []string
+	for _, result := range results {
+		names = append(names, result.Series[0].Name)
+	}
+	assert.Equal(t, []string{"a", "b", "c"}, names)
+}
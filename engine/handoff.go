@@ -0,0 +1,274 @@
+package engine
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	. "gear/influx"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const handoffFile = "handoff.log"
+
+// handoffTarget is implemented by replica nodes that can apply statements
+// later, once they are reachable again.
+type handoffTarget interface {
+	HandOff(q QueryRequest) error
+	// handingOff reports whether statements handed off are waiting to be
+	// applied, the next ones must be handed off after them.
+	handingOff() bool
+}
+
+var errHandoffPending = errors.New("statements handed off before are waiting to be applied")
+
+// handoffEntry is a statement waiting to be applied to a replica.
+type handoffEntry struct {
+	Time     time.Time `json:"time"`
+	Database string    `json:"db,omitempty"`
+	Query    string    `json:"query"`
+}
+
+// handoffLog keeps the statements a replica missed, in order. It is written
+// to a file in the queue directory of replicas with a disk queue, so that
+// they survive a restart, and only kept in memory otherwise. Statements are
+// rare, the file is rewritten whenever one is applied.
+type handoffLog struct {
+	cond    *sync.Cond
+	path    string
+	entries []handoffEntry
+	closed  bool
+}
+
+func openHandoffLog(dir string) (*handoffLog, error) {
+	h := &handoffLog{cond: sync.NewCond(new(sync.Mutex))}
+	if dir == "" {
+		return h, nil
+	}
+	h.path = filepath.Join(dir, handoffFile)
+
+	f, err := os.Open(h.path)
+	if os.IsNotExist(err) {
+		return h, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 16*MB)
+	for scanner.Scan() {
+		var entry handoffEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			// A line torn by a crash, the ones before it are complete.
+			log.Warnf("handoff log %s: ignoring a corrupt entry: %v", h.path, err)
+			break
+		}
+		h.entries = append(h.entries, entry)
+	}
+	if len(h.entries) > 0 {
+		log.Infof("handoff log %s: replaying %d statements", h.path, len(h.entries))
+	}
+	return h, scanner.Err()
+}
+
+func (h *handoffLog) add(entry handoffEntry) error {
+	h.cond.L.Lock()
+	defer h.cond.L.Unlock()
+	if h.closed {
+		return errQueueClosed
+	}
+	if h.path != "" {
+		line, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		f, err := os.OpenFile(h.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return err
+		}
+		_, err = f.Write(append(line, '\n'))
+		if err == nil {
+			err = f.Sync()
+		}
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	h.entries = append(h.entries, entry)
+	h.cond.Broadcast()
+	return nil
+}
+
+// front blocks until there is a statement and returns the oldest one. It
+// returns false once the log is closed.
+func (h *handoffLog) front() (entry handoffEntry, ok bool) {
+	h.cond.L.Lock()
+	defer h.cond.L.Unlock()
+	for len(h.entries) == 0 && !h.closed {
+		h.cond.Wait()
+	}
+	if h.closed {
+		return entry, false
+	}
+	return h.entries[0], true
+}
+
+// commit removes the statement returned by front.
+func (h *handoffLog) commit() {
+	h.cond.L.Lock()
+	defer h.cond.L.Unlock()
+	if len(h.entries) == 0 {
+		return
+	}
+	h.entries = h.entries[1:]
+	if err := h.rewrite(); err != nil {
+		log.Errorf("handoff log %s: %v", h.path, err)
+	}
+	h.cond.Broadcast()
+}
+
+// rewrite replaces the file with the remaining entries.
+func (h *handoffLog) rewrite() error {
+	if h.path == "" {
+		return nil
+	}
+	if len(h.entries) == 0 {
+		err := os.Remove(h.path)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	var data []byte
+	for _, entry := range h.entries {
+		line, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		data = append(append(data, line...), '\n')
+	}
+	if err := ioutil.WriteFile(h.path+".tmp", data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(h.path+".tmp", h.path)
+}
+
+func (h *handoffLog) len() int {
+	h.cond.L.Lock()
+	defer h.cond.L.Unlock()
+	return len(h.entries)
+}
+
+// waitEmpty blocks until every statement was applied. It returns false once
+// the log is closed.
+func (h *handoffLog) waitEmpty() bool {
+	h.cond.L.Lock()
+	defer h.cond.L.Unlock()
+	for len(h.entries) > 0 && !h.closed {
+		h.cond.Wait()
+	}
+	return !h.closed
+}
+
+func (h *handoffLog) close() {
+	h.cond.L.Lock()
+	defer h.cond.L.Unlock()
+	h.closed = true
+	h.cond.Broadcast()
+}
+
+// HandOff keeps q to apply it once the replica is reachable, before the
+// writes queued for it.
+func (r *RetryHTTPNode) HandOff(q QueryRequest) error {
+	err := r.handoff.add(handoffEntry{
+		Time:     time.Now().UTC(),
+		Database: q.Database,
+		Query:    queryString(q.Query),
+	})
+	if err == nil {
+		log.Warnf("replica %s: handed off %q", r.Name(), q.Query.String())
+	}
+	return err
+}
+
+func (r *RetryHTTPNode) handingOff() bool {
+	return r.handoff.len() > 0
+}
+
+// runHandoff applies the handed off statements in order, backing off while
+// the replica fails.
+func (r *RetryHTTPNode) runHandoff() {
+	interval := r.initialInterval
+	for {
+		if !r.waitResumed() {
+			return
+		}
+		entry, ok := r.handoff.front()
+		if !ok {
+			return
+		}
+		err := r.applyHandoff(entry)
+		if err == nil {
+			r.handoff.commit()
+			interval = r.initialInterval
+			continue
+		}
+		r.failed(err)
+		if r.list.isClosed() {
+			return
+		}
+		if interval != r.maxInterval {
+			interval *= r.multiplier
+			if interval > r.maxInterval {
+				interval = r.maxInterval
+			}
+		}
+		r.sleep(interval, r.handoffWake)
+	}
+}
+
+// applyHandoff returns an error only if the statement is worth retrying. The
+// ones the replica refuses are logged and given up, like InfluxDB gives up
+// a statement that fails.
+func (r *RetryHTTPNode) applyHandoff(entry handoffEntry) error {
+	q, err := NewQueryRequest(entry.Query, entry.Database, "", "")
+	if err != nil {
+		log.Errorf("replica %s: dropping handed off statement that doesn't parse: %v", r.Name(), err)
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), retryTimeout)
+	defer cancel()
+	result, err := r.ReplicaHTTPNode.Query(ctx, q)
+	if err != nil {
+		if isServerError(err) {
+			return err
+		}
+		log.Errorf("replica %s: handed off statement %q failed: %v", r.Name(), q.Query.String(), err)
+		return nil
+	}
+	if result != nil && result.Err != nil {
+		log.Warnf("replica %s: handed off statement %q failed: %v", r.Name(), q.Query.String(), result.Err)
+		return nil
+	}
+	log.Infof("replica %s: applied handed off statement %q", r.Name(), q.Query.String())
+	return nil
+}
+
+// replicaOutcome is the message reporting how a statement went on a replica.
+func replicaOutcome(name string, err error, handedOff bool) string {
+	switch {
+	case err == nil:
+		return fmt.Sprintf("replica %s: ok", name)
+	case handedOff:
+		return fmt.Sprintf("replica %s: handed off, applied once it is reachable: %v", name, err)
+	default:
+		return fmt.Sprintf("replica %s: failed: %v", name, err)
+	}
+}
@@ -0,0 +1,191 @@
+package engine
+
+import (
+	"context"
+	"gear/config"
+	"gear/influx"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHandoffLog_Replay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gear-handoff")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	h, err := openHandoffLog(dir)
+	assert.Nil(t, err)
+	assert.Nil(t, h.add(handoffEntry{Query: "CREATE DATABASE foo"}))
+	assert.Nil(t, h.add(handoffEntry{Database: "foo", Query: "CREATE RETENTION POLICY half ON foo DURATION 12h REPLICATION 1"}))
+	assert.Nil(t, h.add(handoffEntry{Query: "DROP DATABASE bar"}))
+	entry, ok := h.front()
+	assert.True(t, ok)
+	assert.Equal(t, "CREATE DATABASE foo", entry.Query)
+	h.commit()
+	h.close()
+
+	h, err = openHandoffLog(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, h.len())
+	entry, _ = h.front()
+	assert.Equal(t, "foo", entry.Database)
+	assert.Equal(t, "CREATE RETENTION POLICY half ON foo DURATION 12h REPLICATION 1", entry.Query)
+	h.commit()
+	h.commit()
+	assert.Equal(t, 0, h.len())
+	_, err = os.Stat(dir + "/" + handoffFile)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestShardHTTPNode_QueryEachInstanceHandoff(t *testing.T) {
+	var up int32
+	var mu sync.Mutex
+	var requests []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&up) == 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		mu.Lock()
+		if r.URL.Path == "/query" {
+			requests = append(requests, r.FormValue("q"))
+		} else {
+			body, _ := ioutil.ReadAll(r.Body)
+			requests = append(requests, strings.TrimSpace(string(body)))
+		}
+		mu.Unlock()
+		if r.URL.Path == "/query" {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"results":[{"statement_id":0}]}`))
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer ts.Close()
+
+	node := NewShardHTTPNode(config.HTTPShardNode{HTTPReplicaNode: []config.HTTPReplicaNode{
+		{Address: queryOKServer.URL},
+		{Address: ts.URL, BufferSizeMb: 1, MaxDelayInterval: "1h"},
+	}})
+	defer node.Shutdown()
+	retry := node.nodeList[1].(*RetryHTTPNode)
+
+	q, err := influx.NewQueryRequest("CREATE USER bob WITH PASSWORD 'secret'", "", "", "")
+	assert.Nil(t, err)
+	result, err := node.QueryEachInstance(context.Background(), q)
+	assert.Nil(t, err)
+	assert.Len(t, result.Messages, 2)
+	assert.Equal(t, "info", result.Messages[0].Level)
+	assert.Equal(t, "warning", result.Messages[1].Level)
+	assert.Contains(t, result.Messages[1].Text, "handed off")
+	assert.Equal(t, 1, retry.Status().Handoff)
+
+	// Queued behind the statement without trying the replica.
+	assert.Nil(t, retry.WritePoints(context.Background(), testWriteRequest(t, "cpu,host=a value=1 1465839830100")))
+	assert.Equal(t, 1, retry.Status().Depth)
+
+	atomic.StoreInt32(&up, 1)
+	retry.Flush()
+	assert.True(t, waitFor(func() bool {
+		status := retry.Status()
+		return status.Handoff == 0 && status.Depth == 0
+	}))
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, []string{
+		"CREATE USER bob WITH PASSWORD 'secret'",
+		"cpu,host=a value=1 1465839830100",
+	}, requests)
+}
+
+func TestShardHTTPNode_QueryEachInstanceHandoffOrder(t *testing.T) {
+	var up int32
+	var mu sync.Mutex
+	var statements []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&up) == 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		if r.URL.Path == "/query" {
+			mu.Lock()
+			statements = append(statements, r.FormValue("q"))
+			mu.Unlock()
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"results":[{"statement_id":0}]}`))
+	}))
+	defer ts.Close()
+
+	node := NewShardHTTPNode(config.HTTPShardNode{HTTPReplicaNode: []config.HTTPReplicaNode{
+		{Address: ts.URL, BufferSizeMb: 1, MaxDelayInterval: "1h"},
+	}})
+	defer node.Shutdown()
+	retry := node.nodeList[0].(*RetryHTTPNode)
+
+	create, err := influx.NewQueryRequest("CREATE DATABASE foo", "", "", "")
+	assert.Nil(t, err)
+	_, err = node.QueryEachInstance(context.Background(), create)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, retry.Status().Handoff)
+
+	// Back up, but still holding the first statement: the next one is
+	// handed off behind it rather than run ahead of it.
+	atomic.StoreInt32(&up, 1)
+	drop, err := influx.NewQueryRequest("DROP DATABASE foo", "", "", "")
+	assert.Nil(t, err)
+	result, err := node.QueryEachInstance(context.Background(), drop)
+	assert.Nil(t, err)
+	assert.Contains(t, result.Messages[0].Text, "handed off")
+	assert.Equal(t, 2, retry.Status().Handoff)
+
+	retry.Flush()
+	assert.True(t, waitFor(func() bool { return retry.Status().Handoff == 0 }))
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, []string{"CREATE DATABASE foo", "DROP DATABASE foo"}, statements)
+}
+
+func TestHTTPEngine_StatementEachNodeHandsOffDespiteFailure(t *testing.T) {
+	refusing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/query" {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"error":"forbidden"}`))
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer refusing.Close()
+	slowDown := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/query" {
+			time.Sleep(100 * time.Millisecond)
+		}
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer slowDown.Close()
+
+	e := NewEngine(config.GearConfig{Shard: config.Shard{Strategy: config.ShardStrategyConsistentHash, VirtualNodes: 16}, HTTPShardNode: []config.HTTPShardNode{
+		{Name: "shard-a", Weight: 1, HTTPReplicaNode: []config.HTTPReplicaNode{{Address: refusing.URL}}},
+		{Name: "shard-b", Weight: 1, HTTPReplicaNode: []config.HTTPReplicaNode{{Address: slowDown.URL, BufferSizeMb: 1, MaxDelayInterval: "1h"}}},
+	}}).(*Cluster).Current()
+	retry := e.NodeList()[1].(*ShardHTTPNode).GetInstances()[0].(*RetryHTTPNode)
+	defer retry.Shutdown()
+
+	// shard-a failing first doesn't abort the statement on shard-b, whose
+	// replica gets it handed off.
+	qr, err := influx.NewQueryRequest("CREATE DATABASE foo", "", "", "")
+	assert.Nil(t, err)
+	resp := e.Query(context.Background(), qr)
+	assert.NotNil(t, resp.Error)
+	assert.Contains(t, resp.Error.Error(), "shard-a")
+	assert.Equal(t, 1, retry.Status().Handoff)
+}
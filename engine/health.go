@@ -0,0 +1,149 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"gear/config"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	"sync"
+	"time"
+)
+
+// healthTarget is a node the health checker can probe and mark up or down.
+type healthTarget interface {
+	Name() string
+	IsAlive() bool
+	ping(ctx context.Context) error
+	setAlive(alive bool) bool
+}
+
+// HealthChecker pings replica nodes in the background. A replica is marked
+// down after fall failed pings in a row and up again after rise successful
+// ones; pickers skip replicas that are down.
+type HealthChecker struct {
+	interval time.Duration
+	timeout  time.Duration
+	rise     int
+	fall     int
+	targets  []healthTarget
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+func NewHealthChecker(cfg config.HealthCheck, nodes []Node) (*HealthChecker, error) {
+	h := &HealthChecker{
+		rise: cfg.Rise,
+		fall: cfg.Fall,
+		done: make(chan struct{}),
+	}
+	var err error
+	if cfg.Interval != "" {
+		if h.interval, err = time.ParseDuration(cfg.Interval); err != nil {
+			return nil, fmt.Errorf("error parsing health check interval %v", err)
+		}
+	}
+	h.timeout = h.interval
+	if cfg.Timeout != "" {
+		if h.timeout, err = time.ParseDuration(cfg.Timeout); err != nil {
+			return nil, fmt.Errorf("error parsing health check timeout %v", err)
+		}
+	}
+	if h.rise < 1 {
+		h.rise = 1
+	}
+	if h.fall < 1 {
+		h.fall = 1
+	}
+	for _, node := range nodes {
+		if target, ok := node.(healthTarget); ok {
+			h.targets = append(h.targets, target)
+		}
+	}
+	return h, nil
+}
+
+// Start runs a check loop per replica. It does nothing when the interval is 0.
+func (h *HealthChecker) Start() {
+	if h.interval <= 0 {
+		return
+	}
+	for _, target := range h.targets {
+		ReplicaHealthy.WithLabelValues(target.Name()).Set(boolGauge(target.IsAlive()))
+		h.wg.Add(1)
+		go h.run(target)
+	}
+}
+
+func (h *HealthChecker) Stop() {
+	close(h.done)
+	h.wg.Wait()
+}
+
+func (h *HealthChecker) run(target healthTarget) {
+	defer h.wg.Done()
+	ticker := time.NewTicker(h.interval)
+	defer ticker.Stop()
+
+	var successes, failures int
+	for {
+		select {
+		case <-h.done:
+			return
+		case <-ticker.C:
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), h.timeout)
+		err := target.ping(ctx)
+		cancel()
+
+		if err != nil {
+			successes, failures = 0, failures+1
+			if failures >= h.fall && target.setAlive(false) {
+				log.Warnf("replica %s is down after %d failed health checks: %v", target.Name(), failures, err)
+				h.transition(target, false)
+			}
+			continue
+		}
+		successes, failures = successes+1, 0
+		if successes >= h.rise && target.setAlive(true) {
+			log.Infof("replica %s is up after %d successful health checks", target.Name(), successes)
+			h.transition(target, true)
+		}
+	}
+}
+
+func (h *HealthChecker) transition(target healthTarget, alive bool) {
+	state := "down"
+	if alive {
+		state = "up"
+	}
+	ReplicaHealthy.WithLabelValues(target.Name()).Set(boolGauge(alive))
+	ReplicaHealthTransitions.With(prometheus.Labels{"replica": target.Name(), "state": state}).Inc()
+}
+
+func boolGauge(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// aliveNodes returns the nodes that aren't marked down by the health checker.
+func aliveNodes(nodes []Node) []Node {
+	alive := make([]Node, 0, len(nodes))
+	for _, node := range nodes {
+		if isAlive(node) {
+			alive = append(alive, node)
+		}
+	}
+	return alive
+}
+
+func isAlive(node Node) bool {
+	if n, ok := node.(interface{ IsAlive() bool }); ok {
+		return n.IsAlive()
+	}
+	return true
+}
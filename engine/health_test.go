@@ -0,0 +1,58 @@
+package engine
+
+import (
+	"gear/config"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHealthChecker_EjectsAndRestoresReplica(t *testing.T) {
+	var up int32 = 1
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&up) == 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer ts.Close()
+
+	httpNodeConfig := config.HTTPShardNode{HTTPReplicaNode: []config.HTTPReplicaNode{
+		{Address: ts.URL},
+		{Address: writeOKServer.URL},
+	}}
+	node := NewShardHTTPNode(httpNodeConfig)
+	flaky := node.GetInstances()[0].(*ReplicaHTTPNode)
+
+	checker, err := NewHealthChecker(config.HealthCheck{Interval: "5ms", Timeout: "50ms", Rise: 2, Fall: 2},
+		[]Node{flaky})
+	assert.Nil(t, err)
+	checker.Start()
+	defer checker.Stop()
+
+	atomic.StoreInt32(&up, 0)
+	assert.True(t, waitFor(func() bool { return !flaky.IsAlive() }))
+	for i := 0; i < 4; i++ {
+		assert.NotEqual(t, flaky, node.picker.Pick())
+	}
+
+	atomic.StoreInt32(&up, 1)
+	assert.True(t, waitFor(flaky.IsAlive))
+	assert.NotEqual(t, node.picker.Pick(), node.picker.Pick())
+}
+
+// waitFor polls cond for up to a second.
+func waitFor(cond func() bool) bool {
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		if cond() {
+			return true
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	return false
+}
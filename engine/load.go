@@ -0,0 +1,74 @@
+package engine
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+const (
+	// ewmaDecay is the time constant of the latency average.
+	ewmaDecay = 10 * time.Second
+	// failurePenalty is recorded as the latency of a failed query so that a
+	// replica failing fast doesn't look like the fastest one.
+	failurePenalty = 5 * time.Second
+)
+
+// replicaLoad tracks the outstanding queries and the peak-EWMA latency of a
+// replica. The average jumps to any latency above it and decays towards lower
+// ones, also while no query completes.
+type replicaLoad struct {
+	mu      sync.Mutex
+	pending int64
+	ewma    float64
+	stamp   time.Time
+}
+
+func newReplicaLoad() *replicaLoad {
+	return &replicaLoad{stamp: time.Now()}
+}
+
+func (l *replicaLoad) start() time.Time {
+	l.mu.Lock()
+	l.pending++
+	l.mu.Unlock()
+	return time.Now()
+}
+
+func (l *replicaLoad) done(start time.Time, err error) {
+	now := time.Now()
+	rtt := float64(now.Sub(start))
+	if err != nil && isServerError(err) && rtt < float64(failurePenalty) {
+		rtt = float64(failurePenalty)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.pending--
+	// The time since the last update decays the average through the blend
+	// weight only.
+	if rtt > l.ewma {
+		l.ewma = rtt
+	} else {
+		w := math.Exp(-float64(now.Sub(l.stamp)) / float64(ewmaDecay))
+		l.ewma = l.ewma*w + rtt*(1-w)
+	}
+	l.stamp = now
+}
+
+func (l *replicaLoad) decayed(now time.Time) float64 {
+	return l.ewma * math.Exp(-float64(now.Sub(l.stamp))/float64(ewmaDecay))
+}
+
+func (l *replicaLoad) outstanding() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.pending
+}
+
+// cost is the expected latency of one more query.
+func (l *replicaLoad) cost() float64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.decayed(time.Now()) * float64(l.pending+1)
+}
@@ -15,4 +15,53 @@ var (
 			Help: "Size of retry requests in total",
 		},
 	)
+	DroppedPoints = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "dropped_points_total",
+			Help: "Number of points a replica node gave up writing in total",
+		},
+		[]string{"replica", "database", "reason"},
+	)
+	ReplicaHealthy = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "replica_healthy",
+			Help: "Whether a replica node passes its health checks",
+		},
+		[]string{"replica"},
+	)
+	ReplicaHealthTransitions = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "replica_health_transitions_total",
+			Help: "Number of replica node health state changes in total",
+		},
+		[]string{"replica", "state"},
+	)
+	SchemaDriftObjects = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "schema_drift_objects",
+			Help: "Number of schema objects a replica node has missing, extra or different at the last schema check",
+		},
+		[]string{"replica", "kind"},
+	)
+	SchemaObjectsApplied = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "schema_objects_applied_total",
+			Help: "Number of missing schema objects created on a replica node in total",
+		},
+		[]string{"replica", "kind"},
+	)
+	RepairPointsCopied = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "repair_points_copied_total",
+			Help: "Number of points repair jobs copied to a replica node in total",
+		},
+		[]string{"replica", "database"},
+	)
+	RebalancePointsMoved = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "rebalance_points_moved_total",
+			Help: "Number of points rebalance jobs moved to a shard node in total",
+		},
+		[]string{"shard", "database"},
+	)
 )
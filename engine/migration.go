@@ -0,0 +1,216 @@
+package engine
+
+import (
+	"encoding/json"
+	"fmt"
+	"gear/config"
+	"github.com/influxdata/influxdb/models"
+	"github.com/influxdata/influxql"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// placement maps the points and measurements of a topology to its shard
+// nodes.
+type placement struct {
+	nodes     []Node
+	locator   ShardLocator
+	shardKeys ShardKeys
+}
+
+func newPlacement(shard config.Shard, nodes []Node) *placement {
+	p := &placement{nodes: nodes, shardKeys: NewShardKeys(shard.Keys)}
+	if len(nodes) > 1 {
+		p.locator = NewShardLocator(shard, nodes)
+	} else {
+		p.locator = Grid(nodes)
+	}
+	return p
+}
+
+func (p *placement) shardFor(database string, point models.Point) Node {
+	key := p.shardKeys.lookup(database, string(point.Name()))
+	return p.locator.ShardFor(key.hashPoint(point))
+}
+
+// mapMeasurement returns the shard nodes that may hold the points of a
+// measurement matching cond.
+func (p *placement) mapMeasurement(database, name string, cond influxql.Expr) []Node {
+	key := p.shardKeys.lookup(database, name)
+	sum, ok := key.hashCondition(name, cond)
+	if !ok {
+		return p.nodes
+	}
+	return []Node{p.locator.ShardFor(sum)}
+}
+
+// Migration tracks the measurements moved from a previous placement to the
+// current one. Until a measurement is moved, its points are written to its
+// shard nodes in both placements and it is read from the previous ones,
+// which have all of it.
+type Migration struct {
+	from      string
+	previous  *placement
+	stateFile string
+
+	mu sync.RWMutex
+	// moved are the measurements moved, by database.
+	moved map[string]map[string]bool
+}
+
+// MigrationStatus describes a migration and the rebalance job moving its
+// data.
+type MigrationStatus struct {
+	From  string              `json:"from"`
+	Moved map[string][]string `json:"moved"`
+	Job   *RebalanceStatus    `json:"job,omitempty"`
+}
+
+// migrationState is the content of the state file.
+type migrationState struct {
+	Moved map[string][]string `json:"moved"`
+}
+
+func openMigration(cfg config.Migration, previous *placement) (*Migration, error) {
+	m := &Migration{
+		from:      cfg.From,
+		previous:  previous,
+		stateFile: cfg.StateFile,
+		moved:     make(map[string]map[string]bool),
+	}
+	if m.stateFile == "" {
+		return m, nil
+	}
+	b, err := ioutil.ReadFile(m.stateFile)
+	if os.IsNotExist(err) {
+		return m, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var state migrationState
+	if err := json.Unmarshal(b, &state); err != nil {
+		return nil, fmt.Errorf("reading migration state %s: %v", m.stateFile, err)
+	}
+	for database, measurements := range state.Moved {
+		m.moved[database] = make(map[string]bool)
+		for _, measurement := range measurements {
+			m.moved[database][measurement] = true
+		}
+	}
+	return m, nil
+}
+
+// initMigration sets up the migration from the placement of the
+// [migration] from config file.
+func (e *HTTPEngine) initMigration() {
+	previousConfig, err := config.Load(e.config.Migration.From)
+	if err != nil {
+		panic(fmt.Sprintf("migration: %v", err))
+	}
+	previousConfig.WithDefaults()
+	nodes, removed := previousNodes(*previousConfig, e.nodeList, e.replicas.get)
+	e.migration, err = openMigration(e.config.Migration, newPlacement(previousConfig.Shard, nodes))
+	if err != nil {
+		panic(fmt.Sprintf("migration: %v", err))
+	}
+	e.removed = removed
+	e.sharding = true
+	log.Infof("migrating from the placement of %s: %d previous shard nodes, %d removed",
+		e.config.Migration.From, len(nodes), len(removed))
+}
+
+// previousNodes builds the shard nodes of the placement in previousConfig.
+// It returns as well the ones that aren't in the current placement, i.e.
+// have other replicas than every current shard node.
+func previousNodes(previousConfig config.GearConfig, current []Node, newReplica func(config.HTTPReplicaNode) (Node, error)) (nodes, removed []Node) {
+	for _, node := range previousConfig.HTTPShardNode {
+		shard := newShardHTTPNode(node, newReplica)
+		nodes = append(nodes, shard)
+		if findShard(current, shard) == nil {
+			removed = append(removed, shard)
+		}
+	}
+	return nodes, removed
+}
+
+// findShard returns the node of nodes having the replicas of node, which
+// then hold the same data.
+func findShard(nodes []Node, node Node) Node {
+	for _, n := range nodes {
+		if n.ID() == node.ID() {
+			return n
+		}
+	}
+	return nil
+}
+
+// isMoved reports whether a measurement is read from the current placement.
+func (m *Migration) isMoved(database, measurement string) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.moved[database][measurement]
+}
+
+// previousOwner returns the shard node of point in the previous placement,
+// nil when its measurement was moved.
+func (m *Migration) previousOwner(database string, point models.Point) Node {
+	if m.isMoved(database, string(point.Name())) {
+		return nil
+	}
+	return m.previous.shardFor(database, point)
+}
+
+// markMoved records that a measurement was moved. From then on it is written
+// to and read from the current placement only.
+func (m *Migration) markMoved(database, measurement string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.moved[database] == nil {
+		m.moved[database] = make(map[string]bool)
+	}
+	m.moved[database][measurement] = true
+	log.Infof("migration: measurement %s of database %s moved", measurement, database)
+	return m.save()
+}
+
+// save replaces the state file, so that it is never left half written.
+func (m *Migration) save() error {
+	if m.stateFile == "" {
+		return nil
+	}
+	b, err := json.Marshal(migrationState{Moved: m.movedLocked()})
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(m.stateFile), 0755); err != nil {
+		return err
+	}
+	tmp := m.stateFile + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, m.stateFile)
+}
+
+// Moved returns the measurements moved, sorted, by database.
+func (m *Migration) Moved() map[string][]string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.movedLocked()
+}
+
+func (m *Migration) movedLocked() map[string][]string {
+	moved := make(map[string][]string)
+	for database, measurements := range m.moved {
+		for measurement := range measurements {
+			moved[database] = append(moved[database], measurement)
+		}
+		sort.Strings(moved[database])
+	}
+	return moved
+}
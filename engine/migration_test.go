@@ -0,0 +1,280 @@
+package engine
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"gear/config"
+	"gear/influx"
+	"github.com/influxdata/influxdb/models"
+	"github.com/influxdata/influxdb/query"
+	"github.com/influxdata/influxql"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+// migrationServer keeps the points of database foo in memory, by
+// measurement, with a host tag and a value field.
+type migrationServer struct {
+	mu     sync.Mutex
+	points map[string]map[time.Time]float64
+}
+
+func newMigrationServer(measurements ...string) *migrationServer {
+	s := &migrationServer{points: make(map[string]map[time.Time]float64)}
+	start := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, name := range measurements {
+		s.points[name] = map[time.Time]float64{start: 1, start.Add(3 * time.Hour): 2}
+	}
+	return s
+}
+
+func (s *migrationServer) measurements() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var names []string
+	for name := range s.points {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (s *migrationServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if r.URL.Path == "/write" {
+		body, _ := ioutil.ReadAll(r.Body)
+		points, _ := models.ParsePoints(body)
+		for _, point := range points {
+			name := string(point.Name())
+			if s.points[name] == nil {
+				s.points[name] = make(map[time.Time]float64)
+			}
+			fields, _ := point.Fields()
+			s.points[name][point.Time().UTC()] = fields["value"].(float64)
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	stmt, err := influxql.ParseStatement(r.FormValue("q"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	result := &query.Result{}
+	switch stmt := stmt.(type) {
+	case *influxql.ShowDatabasesStatement:
+		result.Series = models.Rows{{Name: "databases", Columns: []string{"name"}, Values: [][]interface{}{{"_internal"}, {"foo"}}}}
+	case *influxql.ShowRetentionPoliciesStatement:
+		result.Series = models.Rows{{Columns: []string{"name"}, Values: [][]interface{}{{"autogen"}}}}
+	case *influxql.ShowMeasurementsStatement:
+		row := &models.Row{Name: "measurements", Columns: []string{"name"}}
+		for name := range s.points {
+			row.Values = append(row.Values, []interface{}{name})
+		}
+		result.Series = models.Rows{row}
+	case *influxql.ShowFieldKeysStatement:
+		name := stmt.Sources[0].(*influxql.Measurement).Name
+		if s.points[name] != nil {
+			result.Series = models.Rows{{Name: name, Columns: []string{"fieldKey", "fieldType"}, Values: [][]interface{}{{"value", "float"}}}}
+		}
+	case *influxql.ShowSeriesStatement:
+		name := stmt.Sources[0].(*influxql.Measurement).Name
+		if s.points[name] != nil {
+			result.Series = models.Rows{{Columns: []string{"key"}, Values: [][]interface{}{{name + ",host=a"}}}}
+		}
+	case *influxql.ShowSeriesCardinalityStatement:
+		count := 0
+		for name := range s.points {
+			for _, source := range stmt.Sources {
+				if source.(*influxql.Measurement).Name == name {
+					count++
+				}
+			}
+			if len(stmt.Sources) == 0 {
+				count++
+			}
+		}
+		result.Series = models.Rows{{Columns: []string{"count"}, Values: [][]interface{}{{count}}}}
+	case *influxql.DropMeasurementStatement:
+		delete(s.points, stmt.Name)
+	case *influxql.SelectStatement:
+		name := stmt.Sources[0].(*influxql.Measurement).Name
+		var times []time.Time
+		for t := range s.points[name] {
+			times = append(times, t)
+		}
+		sort.Slice(times, func(i, j int) bool { return times[i].Before(times[j]) })
+		if stmt.Limit == 1 && len(times) > 0 {
+			if stmt.SortFields[0].Ascending {
+				times = times[:1]
+			} else {
+				times = times[len(times)-1:]
+			}
+		} else if stmt.Condition != nil {
+			_, timeRange, _ := influxql.ConditionExpr(stmt.Condition, nil)
+			var selected []time.Time
+			for _, t := range times {
+				if !t.Before(timeRange.Min) && !t.After(timeRange.Max) {
+					selected = append(selected, t)
+				}
+			}
+			times = selected
+		}
+		if len(times) > 0 {
+			row := &models.Row{Name: name, Tags: map[string]string{"host": "a"}, Columns: []string{"time", "value"}}
+			for _, t := range times {
+				row.Values = append(row.Values, []interface{}{t.Format(time.RFC3339Nano), s.points[name][t]})
+			}
+			result.Series = models.Rows{row}
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(influx.Response{Results: []*query.Result{result}})
+}
+
+// writeMigrationConfigs writes the config of a previous placement having
+// only the shard node of servers[0] and returns the current config, having
+// all of servers.
+func writeMigrationConfigs(t *testing.T, dir string, servers ...*httptest.Server) config.GearConfig {
+	from := filepath.Join(dir, "previous.toml")
+	previous := fmt.Sprintf("[[http-shard-node]]\n    name = \"shard-a\"\n    weight = 1\n    replica-node = [{ address = %q }]\n", servers[0].URL)
+	assert.Nil(t, ioutil.WriteFile(from, []byte(previous), 0644))
+
+	cfg := config.GearConfig{
+		Shard:     config.Shard{Strategy: config.ShardStrategyConsistentHash, VirtualNodes: 16},
+		Migration: config.Migration{From: from, StateFile: filepath.Join(dir, "migration.json"), Chunk: "2h"},
+	}
+	for index, server := range servers {
+		cfg.HTTPShardNode = append(cfg.HTTPShardNode, config.HTTPShardNode{
+			Name:            "shard-" + string('a'+rune(index)),
+			Weight:          1,
+			HTTPReplicaNode: []config.HTTPReplicaNode{{Address: server.URL}},
+		})
+	}
+	return cfg
+}
+
+func TestHTTPEngine_MigrationRouting(t *testing.T) {
+	dir, err := ioutil.TempDir("", "migration")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	serverA, serverB := httptest.NewServer(newMigrationServer()), httptest.NewServer(newMigrationServer())
+	defer serverA.Close()
+	defer serverB.Close()
+
+	e := NewEngine(writeMigrationConfigs(t, dir, serverA, serverB)).(*Cluster).Current()
+	assert.True(t, e.sharding)
+	assert.Empty(t, e.removed)
+	nodeA, nodeB := e.NodeList()[0], e.NodeList()[1]
+
+	// A measurement placed on the new shard node.
+	var name string
+	for i := 0; name == ""; i++ {
+		candidate := fmt.Sprintf("m%d", i)
+		if e.MapMeasurement("foo", candidate, nil)[0].ID() == nodeA.ID() && e.placement().mapMeasurement("foo", candidate, nil)[0] == nodeB {
+			name = candidate
+		}
+	}
+	points, err := models.ParsePoints([]byte(name + ",host=a value=1 0"))
+	assert.Nil(t, err)
+	mapping, err := e.MapShards(&influx.WriteRequest{Database: "foo", Points: points})
+	assert.Nil(t, err)
+	assert.Len(t, mapping.Nodes, 2)
+
+	assert.Nil(t, e.migration.markMoved("foo", name))
+	assert.Equal(t, []Node{nodeB}, e.MapMeasurement("foo", name, nil))
+	mapping, err = e.MapShards(&influx.WriteRequest{Database: "foo", Points: points})
+	assert.Nil(t, err)
+	assert.Equal(t, map[uint64]Node{nodeB.ID(): nodeB}, mapping.Nodes)
+
+	// The moves survive a restart.
+	e = NewEngine(writeMigrationConfigs(t, dir, serverA, serverB)).(*Cluster).Current()
+	assert.True(t, e.migration.isMoved("foo", name))
+}
+
+func TestHTTPEngine_MigrationCardinality(t *testing.T) {
+	dir, err := ioutil.TempDir("", "migration")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	a, b := newMigrationServer(), newMigrationServer()
+	serverA, serverB := httptest.NewServer(a), httptest.NewServer(b)
+	defer serverA.Close()
+	defer serverB.Close()
+
+	e := NewEngine(writeMigrationConfigs(t, dir, serverA, serverB)).(*Cluster).Current()
+	nodeB := e.NodeList()[1]
+	var moved, kept string
+	for i := 0; moved == "" || kept == ""; i++ {
+		candidate := fmt.Sprintf("m%d", i)
+		if e.placement().mapMeasurement("foo", candidate, nil)[0] == nodeB {
+			if moved == "" {
+				moved = candidate
+			} else {
+				kept = candidate
+			}
+		}
+	}
+	// moved was copied to shard-b and not dropped from shard-a yet.
+	a.points = newMigrationServer(moved, kept).points
+	b.points = newMigrationServer(moved).points
+	assert.Nil(t, e.migration.markMoved("foo", moved))
+
+	qr, _ := influx.NewQueryRequest("SHOW SERIES CARDINALITY", "foo", "", "")
+	resp := e.Query(context.Background(), qr)
+	assert.Nil(t, resp.Error)
+	assert.Equal(t, int64(2), resp.Results[0].Series[0].Values[0][0])
+}
+
+func TestRebalanceJob_Run(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rebalance")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	var measurements []string
+	for i := 0; i < 10; i++ {
+		measurements = append(measurements, fmt.Sprintf("m%d", i))
+	}
+	a, b := newMigrationServer(measurements...), newMigrationServer()
+	serverA, serverB := httptest.NewServer(a), httptest.NewServer(b)
+	defer serverA.Close()
+	defer serverB.Close()
+	cfg := writeMigrationConfigs(t, dir, serverA, serverB)
+	cfg.WithDefaults()
+
+	job, err := OpenRebalanceJob(cfg, RebalanceSpec{Drop: true})
+	assert.Nil(t, err)
+	assert.Nil(t, job.Run(context.Background()))
+	status := job.Status()
+	assert.Equal(t, JobDone, status.State)
+	assert.Equal(t, 10, status.MeasurementsDone)
+	// Nothing is dropped before gear reads the moved measurements from the
+	// current placement.
+	assert.Equal(t, 0, status.Dropped)
+	assert.Equal(t, measurements, a.measurements())
+	moved := b.measurements()
+	assert.NotEmpty(t, moved)
+	assert.EqualValues(t, 2*len(moved), status.Points)
+	for _, name := range moved {
+		assert.Len(t, b.points[name], 2)
+	}
+
+	job, err = OpenRebalanceJob(cfg, RebalanceSpec{Drop: true})
+	assert.Nil(t, err)
+	assert.Nil(t, job.Run(context.Background()))
+	assert.Equal(t, len(moved), job.Status().Dropped)
+	assert.EqualValues(t, 0, job.Status().Points)
+	assert.Len(t, a.measurements(), len(measurements)-len(moved))
+	for _, name := range a.measurements() {
+		assert.NotContains(t, moved, name)
+	}
+}
@@ -1,16 +1,22 @@
 package engine
 
 import (
+	"context"
 	. "gear/influx"
 	"github.com/influxdata/influxdb/query"
 )
 
+// Node is a shard node or one of its replicas. The requests sent to the
+// backends are aborted when their ctx is done.
 type Node interface {
 	ID() uint64
 	Ping() error
-	Query(q QueryRequest) (*query.Result, error)
-	QueryEachInstance(q QueryRequest) (*query.Result, error)
-	WritePoints(wr WriteRequest) error
+	Query(ctx context.Context, q QueryRequest) (*query.Result, error)
+	QueryEachInstance(ctx context.Context, q QueryRequest) (*query.Result, error)
+	// QueryChunked runs q in chunked mode, calling emit with every chunk as
+	// it arrives.
+	QueryChunked(ctx context.Context, q QueryRequest, emit func(*query.Result) error) error
+	WritePoints(ctx context.Context, wr WriteRequest) error
 	Shutdown()
 	Weight() int
 }
@@ -1,11 +1,17 @@
 package engine
 
 import (
+	"context"
 	. "gear/influx"
 	"sync"
 )
 
-func (e HTTPEngine) Write(wr WriteRequest) error {
+// Write sends the points to the shard nodes owning them, within the write
+// timeout of the database.
+func (e HTTPEngine) Write(ctx context.Context, wr WriteRequest) (err error) {
+	ctx, cancel := withTimeout(ctx, e.timeouts.forWrite(wr.Database))
+	defer cancel()
+	defer func() { err = timeoutError(ctx, err, ErrWriteTimeout) }()
 	if e.sharding {
 		shardMappings, err := e.MapShards(&wr)
 		if err != nil {
@@ -19,7 +25,7 @@ func (e HTTPEngine) Write(wr WriteRequest) error {
 			wr.Points = points
 			go func(node Node, w WriteRequest) {
 				defer wg.Done()
-				nodeResp <- e.writeNode(node, w)
+				nodeResp <- e.writeNode(ctx, node, w)
 			}(shardMappings.Nodes[shardID], wr)
 		}
 
@@ -30,7 +36,7 @@ func (e HTTPEngine) Write(wr WriteRequest) error {
 		return mergeResponse(nodeResp)
 	} else {
 		node := e.NodeList()[0]
-		return e.writeNode(node, wr)
+		return e.writeNode(ctx, node, wr)
 	}
 }
 
@@ -46,6 +52,6 @@ func mergeResponse(responses chan error) error {
 	return writeError
 }
 
-func (e *HTTPEngine) writeNode(node Node, w WriteRequest) error {
-	return node.WritePoints(w)
+func (e *HTTPEngine) writeNode(ctx context.Context, node Node, w WriteRequest) error {
+	return node.WritePoints(ctx, w)
 }
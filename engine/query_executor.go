@@ -1,14 +1,22 @@
 package engine
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	. "gear/influx"
 	"github.com/influxdata/influxdb/models"
 	"github.com/influxdata/influxdb/query"
 	"github.com/influxdata/influxql"
 	log "github.com/sirupsen/logrus"
+	"strings"
 )
 
-func (e HTTPEngine) Query(qr QueryRequest) *Response {
+// Query runs the statements of qr one after the other, within the query
+// timeout of the database.
+func (e HTTPEngine) Query(ctx context.Context, qr QueryRequest) *Response {
+	ctx, cancel := withTimeout(ctx, e.timeouts.forQuery(qr.Database))
+	defer cancel()
 	var i int
 	var resp Response
 	for ; i < len(qr.Query.Statements); i++ {
@@ -20,11 +28,11 @@ func (e HTTPEngine) Query(qr QueryRequest) *Response {
 			Precision: qr.Precision,
 			Chunked:   qr.Chunked,
 		}
-		result, err := e.executeStatementQuery(statementQuery)
+		result, err := e.executeStatementQuery(ctx, statementQuery)
 		if err != nil {
 			return &Response{
 				Results: nil,
-				Error:   err,
+				Error:   timeoutError(ctx, err, query.ErrQueryTimeoutLimitExceeded),
 			}
 		}
 		resp.Results = append(resp.Results, result)
@@ -33,75 +41,91 @@ func (e HTTPEngine) Query(qr QueryRequest) *Response {
 	return &resp
 }
 
-func (e HTTPEngine) executeStatementQuery(qr QueryRequest) (result *query.Result, err error) {
+func (e HTTPEngine) executeStatementQuery(ctx context.Context, qr QueryRequest) (result *query.Result, err error) {
 	stmt := qr.Query.Statements[0]
 	switch stmt := stmt.(type) {
 	case *influxql.AlterRetentionPolicyStatement:
-		result, err = e.executeStatementEachNode(qr)
+		result, err = e.executeStatementEachNode(ctx, qr)
 	case *influxql.CreateContinuousQueryStatement:
-		result, err = e.executeStatementEachNode(qr)
+		result, err = e.executeStatementEachNode(ctx, qr)
 	case *influxql.CreateDatabaseStatement:
-		result, err = e.executeStatementEachNode(qr)
+		result, err = e.executeStatementEachNode(ctx, qr)
 	case *influxql.CreateRetentionPolicyStatement:
-		result, err = e.executeStatementEachNode(qr)
+		result, err = e.executeStatementEachNode(ctx, qr)
 	case *influxql.CreateSubscriptionStatement:
-		result, err = e.executeStatementEachNode(qr)
+		result, err = e.executeStatementEachNode(ctx, qr)
 	case *influxql.CreateUserStatement:
-		result, err = e.executeStatementEachNode(qr)
+		result, err = e.executeStatementEachNode(ctx, qr)
 	case *influxql.DeleteStatement:
-		result, err = e.executeStatementEachNode(qr)
+		result, err = e.executeStatementEachNode(ctx, qr)
 	case *influxql.DeleteSeriesStatement:
-		result, err = e.executeStatementEachNode(qr)
+		result, err = e.executeStatementEachNode(ctx, qr)
 	case *influxql.DropContinuousQueryStatement:
-		result, err = e.executeStatementEachNode(qr)
+		result, err = e.executeStatementEachNode(ctx, qr)
 	case *influxql.DropDatabaseStatement:
-		result, err = e.executeStatementEachNode(qr)
+		result, err = e.executeStatementEachNode(ctx, qr)
 	case *influxql.DropMeasurementStatement:
-		result, err = e.executeStatementEachNode(qr)
+		result, err = e.executeStatementEachNode(ctx, qr)
 	case *influxql.DropRetentionPolicyStatement:
-		result, err = e.executeStatementEachNode(qr)
+		result, err = e.executeStatementEachNode(ctx, qr)
 	case *influxql.DropShardStatement:
-		result, err = e.executeStatementEachNode(qr)
+		result, err = e.executeStatementEachNode(ctx, qr)
 	case *influxql.DropSubscriptionStatement:
-		result, err = e.executeStatementEachNode(qr)
+		result, err = e.executeStatementEachNode(ctx, qr)
 	case *influxql.DropUserStatement:
-		result, err = e.executeStatementEachNode(qr)
+		result, err = e.executeStatementEachNode(ctx, qr)
 	case *influxql.GrantStatement:
-		result, err = e.executeStatementEachNode(qr)
+		result, err = e.executeStatementEachNode(ctx, qr)
 	case *influxql.GrantAdminStatement:
-		result, err = e.executeStatementEachNode(qr)
+		result, err = e.executeStatementEachNode(ctx, qr)
 	case *influxql.RevokeAdminStatement:
-		result, err = e.executeStatementEachNode(qr)
+		result, err = e.executeStatementEachNode(ctx, qr)
 	case *influxql.SelectStatement:
-		result, err = e.executeSelectStatement(qr)
+		result, err = e.executeSelectStatement(ctx, qr)
 	case *influxql.ShowDatabasesStatement:
-		result, err = e.executeStatementOneNode(qr)
+		result, err = e.executeStatementOneNode(ctx, qr)
 	case *influxql.ShowContinuousQueriesStatement:
-		result, err = e.executeStatementOneNode(qr)
+		result, err = e.executeStatementOneNode(ctx, qr)
 	case *influxql.ShowGrantsForUserStatement:
-		result, err = e.executeStatementOneNode(qr)
+		result, err = e.executeStatementOneNode(ctx, qr)
 	case *influxql.ShowMeasurementCardinalityStatement:
-		result, err = e.executeStatementOneNode(qr)
+		result, err = e.executeCardinalityStatement(ctx, qr)
 	case *influxql.ShowSeriesCardinalityStatement:
-		result, err = e.executeStatementOneNode(qr)
+		result, err = e.executeCardinalityStatement(ctx, qr)
 	case *influxql.ShowShardsStatement:
-		result, err = e.executeStatementOneNode(qr)
+		result, err = e.executeStatementOneNode(ctx, qr)
 	case *influxql.ShowShardGroupsStatement:
-		result, err = e.executeStatementOneNode(qr)
+		result, err = e.executeStatementOneNode(ctx, qr)
 	case *influxql.ShowStatsStatement:
-		result, err = e.executeStatementOneNode(qr)
+		result, err = e.executeStatementOneNode(ctx, qr)
 	case *influxql.ShowMeasurementsStatement:
-		result, err = e.executeStatementEachNodeMergeValues(qr)
+		result, err = e.executeStatementEachNodeMergeValues(ctx, qr)
 	case *influxql.ShowDiagnosticsStatement:
-		result, err = e.executeStatementEachNodeMergeSeries(qr)
+		result, err = e.executeStatementEachNodeMergeSeries(ctx, qr)
 	case *influxql.ShowTagKeysStatement:
-		result, err = e.executeStatementEachNodeMergeSeries(qr)
+		result, err = e.executeStatementMappedSources(ctx, qr, stmt.Sources, stmt.Condition, mergeShowResults)
 	case *influxql.ShowTagValuesStatement:
-		result, err = e.executeStatementEachNodeMergeSeries(qr)
+		result, err = e.executeStatementMappedSources(ctx, qr, stmt.Sources, stmt.Condition, mergeShowResults)
+	case *influxql.ShowSeriesStatement:
+		result, err = e.executeStatementMappedSources(ctx, qr, stmt.Sources, stmt.Condition, mergeShowResults)
+	case *influxql.ShowFieldKeysStatement:
+		result, err = e.executeStatementMappedSources(ctx, qr, stmt.Sources, nil, mergeShowResults)
+	case *influxql.ShowTagKeyCardinalityStatement:
+		result, err = e.executeCardinalityStatement(ctx, qr)
+	case *influxql.ShowTagValuesCardinalityStatement:
+		result, err = e.executeCardinalityStatement(ctx, qr)
+	case *influxql.ShowFieldKeyCardinalityStatement:
+		result, err = e.executeCardinalityStatement(ctx, qr)
+	case *influxql.ShowQueriesStatement:
+		result, err = e.executeShowQueriesStatement(ctx, qr)
+	case *influxql.KillQueryStatement:
+		result, err = e.executeKillQueryStatement(ctx, qr)
+	case *influxql.ExplainStatement:
+		result, err = e.executeExplainStatement(ctx, qr)
 	case *influxql.ShowUsersStatement:
-		result, err = e.executeStatementOneNode(qr)
+		result, err = e.executeStatementOneNode(ctx, qr)
 	case *influxql.ShowRetentionPoliciesStatement:
-		result, err = e.executeStatementOneNode(qr)
+		result, err = e.executeStatementOneNode(ctx, qr)
 
 	default:
 		err := query.ErrInvalidQuery
@@ -112,27 +136,68 @@ func (e HTTPEngine) executeStatementQuery(qr QueryRequest) (result *query.Result
 	return result, err
 }
 
-func (e HTTPEngine) executeSelectStatement(qr QueryRequest) (result *query.Result, err error) {
+func (e HTTPEngine) executeSelectStatement(ctx context.Context, qr QueryRequest) (result *query.Result, err error) {
+	if !e.sharding {
+		return e.NodeList()[0].Query(ctx, qr)
+	}
+
 	stmt := qr.Query.Statements[0].(*influxql.SelectStatement)
-	node, err := e.MapMeasurements(stmt)
+	plan, err := e.MapSources(ctx, qr.Database, stmt)
 	if err != nil {
 		log.Error("can't locate the cluster node")
 		return result, err
 	}
+	return e.querySelectPlan(ctx, qr, stmt, plan)
+}
 
-	result, err = node.Query(qr)
+// querySelectPlan sends a SELECT to the shard nodes of its plan and merges
+// their results. An aggregate spanning several shard nodes is rewritten into
+// partial aggregates recombined by gear.
+func (e HTTPEngine) querySelectPlan(ctx context.Context, qr QueryRequest, stmt *influxql.SelectStatement, plan *selectPlan) (*query.Result, error) {
+	if len(plan.nodes) == 0 {
+		return &query.Result{}, nil
+	}
 
-	if err != nil {
-		return result, err
+	shardStmt := stmt
+	var aggregates *aggregateMerge
+	if len(plan.nodes) > 1 {
+		if hasAggregateSubquery(stmt.Sources) {
+			return &query.Result{Err: errors.New("aggregate subqueries can't be merged across shards")}, nil
+		}
+		if !stmt.IsRawQuery {
+			var err error
+			if shardStmt, aggregates, err = splitAggregates(stmt); err != nil {
+				return &query.Result{Err: err}, nil
+			}
+		}
 	}
 
-	return
+	if len(plan.nodes) > 1 {
+		shardStmt = withShardLimits(shardStmt)
+	}
+	requests := make([]QueryRequest, len(plan.nodes))
+	for index := range plan.nodes {
+		requests[index] = qr
+		requests[index].Query = &influxql.Query{Statements: influxql.Statements{withSelectSources(shardStmt, plan.sources[index])}}
+	}
+	if len(plan.nodes) == 1 {
+		return plan.nodes[0].Query(ctx, requests[0])
+	}
+
+	results, err := e.queryEach(ctx, plan.nodes, requests)
+	if err != nil {
+		return nil, err
+	}
+	if aggregates != nil {
+		return limitSelectResult(aggregates.merge(results), stmt), nil
+	}
+	return limitSelectResult(mergeSelectResults(results, stmt), stmt), nil
 }
 
-func (e HTTPEngine) executeStatementOneNode(qr QueryRequest) (result *query.Result, err error) {
+func (e HTTPEngine) executeStatementOneNode(ctx context.Context, qr QueryRequest) (result *query.Result, err error) {
 	node := e.picker.Pick()
 
-	result, err = node.Query(qr)
+	result, err = node.Query(ctx, qr)
 
 	if err != nil {
 		return result, err
@@ -141,26 +206,57 @@ func (e HTTPEngine) executeStatementOneNode(qr QueryRequest) (result *query.Resu
 	return
 }
 
-func (e HTTPEngine) executeStatementEachNode(qr QueryRequest) (result *query.Result, err error) {
-	for _, node := range e.NodeList() {
-		result, err = node.QueryEachInstance(qr)
+// executeStatementEachNode runs a statement on every replica of every shard
+// node, on query.fan-out-concurrency shard nodes at once. A shard node
+// failing doesn't cancel the others: the statement goes on to every replica,
+// and the ones down get it handed off. The messages of the results are
+// concatenated in shard order, the shard nodes that failed are named in the
+// error.
+func (e HTTPEngine) executeStatementEachNode(ctx context.Context, qr QueryRequest) (result *query.Result, err error) {
+	nodes := e.allNodes()
+	results := make([]*query.Result, len(nodes))
+	errs := make([]error, len(nodes))
+	err = fanOut(ctx, nodes, e.config.Query.FanOutConcurrency, func(ctx context.Context, index int, node Node) error {
+		results[index], errs[index] = node.QueryEachInstance(ctx, qr)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
 
-		if err != nil {
-			return result, err
+	var messages []*query.Message
+	var failed []string
+	for index, shardErr := range errs {
+		if shardErr != nil {
+			if err == nil {
+				err = shardErr
+			}
+			failed = append(failed, fmt.Sprintf("shard %s: %v", nodes[index].(*ShardHTTPNode).Name(), shardErr))
+			continue
+		}
+		result = results[index]
+		messages = append(messages, result.Messages...)
+	}
+	if err != nil {
+		if len(nodes) > 1 {
+			err = errors.New(strings.Join(failed, "; "))
 		}
+		return nil, err
+	}
+	if result != nil {
+		result.Messages = messages
 	}
 	return
 }
 
-func (e HTTPEngine) executeStatementEachNodeMergeSeries(qr QueryRequest) (result *query.Result, err error) {
-	var series Series
-
-	for _, node := range e.NodeList() {
-		result, err := node.Query(qr)
+func (e HTTPEngine) executeStatementEachNodeMergeSeries(ctx context.Context, qr QueryRequest) (result *query.Result, err error) {
+	results, err := e.queryNodes(ctx, e.allNodes(), qr)
+	if err != nil {
+		return nil, err
+	}
 
-		if err != nil {
-			return result, err
-		}
+	var series Series
+	for _, result := range results {
 		series.MergeSeries(Series(result.Series))
 	}
 	result = &query.Result{
@@ -170,35 +266,18 @@ func (e HTTPEngine) executeStatementEachNodeMergeSeries(qr QueryRequest) (result
 	return
 }
 
-func (e HTTPEngine) executeStatementEachNodeMergeValues(qr QueryRequest) (result *query.Result, err error) {
-	var values Values
-	var queryResult *query.Result
+// executeStatementEachNodeMergeValues runs a SHOW statement listing names on
+// every shard node, and returns the names once, sorted and paginated.
+func (e HTTPEngine) executeStatementEachNodeMergeValues(ctx context.Context, qr QueryRequest) (result *query.Result, err error) {
+	stmt, page := paginate(qr.Query.Statements[0])
+	shardQr := qr
+	shardQr.Query = &influxql.Query{Statements: influxql.Statements{stmt}}
 
-	for _, node := range e.NodeList() {
-		queryResult, err = node.Query(qr)
-
-		if err != nil {
-			return result, err
-		}
-		values.MergeSeriesValues(queryResult.Series[0].Values)
-	}
-
-	name := queryResult.Series[0].Name
-	columns := queryResult.Series[0].Columns
-	result = &query.Result{
-		Series: []*models.Row{{
-			Name:    name,
-			Columns: columns,
-			Values:  values,
-		}},
+	results, err := e.queryNodes(ctx, e.allNodes(), shardQr)
+	if err != nil {
+		return nil, err
 	}
-	return
-}
-
-type Values [][]interface{}
-
-func (v *Values) MergeSeriesValues(newValue Values) {
-	*v = append(*v, newValue...)
+	return page.apply(mergeShowResults(results)), nil
 }
 
 type Series models.Rows
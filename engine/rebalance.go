@@ -0,0 +1,491 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"gear/config"
+	. "gear/influx"
+	"github.com/influxdata/influxdb/models"
+	"github.com/influxdata/influxql"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RebalanceSpec restricts and throttles the moves of a rebalance job.
+type RebalanceSpec struct {
+	// Database and Measurements restrict the moves, which cover every
+	// measurement of every database by default.
+	Database        string        `json:"database,omitempty"`
+	Measurements    []string      `json:"measurements,omitempty"`
+	Chunk           time.Duration `json:"chunk"`
+	PointsPerSecond int           `json:"points_per_second,omitempty"`
+	// Drop deletes the moved points from the shard nodes of the previous
+	// placement that no longer own them.
+	Drop bool `json:"drop,omitempty"`
+}
+
+// withDefaults fills the chunk and throttling the spec leaves out from the
+// [migration] section.
+func (spec RebalanceSpec) withDefaults(cfg config.Migration) (RebalanceSpec, error) {
+	if spec.Chunk == 0 && cfg.Chunk != "" {
+		chunk, err := time.ParseDuration(cfg.Chunk)
+		if err != nil {
+			return spec, fmt.Errorf("error parsing migration chunk %v", err)
+		}
+		spec.Chunk = chunk
+	}
+	if spec.PointsPerSecond == 0 {
+		spec.PointsPerSecond = cfg.PointsPerSecond
+	}
+	switch {
+	case spec.Chunk <= 0:
+		return spec, errors.New("chunk must be positive")
+	case spec.PointsPerSecond < 0:
+		return spec, errors.New("points per second must not be negative")
+	}
+	return spec, nil
+}
+
+// RebalanceStatus is the progress of a rebalance job, counted in
+// measurements of a database.
+type RebalanceStatus struct {
+	Spec              RebalanceSpec `json:"spec"`
+	State             string        `json:"state"`
+	Started           time.Time     `json:"started"`
+	Finished          *time.Time    `json:"finished,omitempty"`
+	Database          string        `json:"database,omitempty"`
+	Measurement       string        `json:"measurement,omitempty"`
+	MeasurementsDone  int           `json:"measurements_done"`
+	MeasurementsTotal int           `json:"measurements_total"`
+	Points            int64         `json:"points"`
+	// Dropped counts the measurements or series deleted from a shard node
+	// of the previous placement.
+	Dropped int    `json:"dropped"`
+	Error   string `json:"error,omitempty"`
+}
+
+// moveTracker records the measurements moved.
+type moveTracker interface {
+	isMoved(database, measurement string) bool
+	markMoved(database, measurement string) error
+}
+
+// RebalanceJob streams the measurements of the shard nodes of the previous
+// placement of a migration to their shard nodes in the current placement,
+// chunk by chunk, and marks them moved. Points a shard node keeps aren't
+// copied.
+type RebalanceJob struct {
+	spec     RebalanceSpec
+	current  *placement
+	previous *placement
+	tracker  moveTracker
+	// live is set when tracker routes the requests of this process: a
+	// measurement can then be dropped from the previous placement as soon
+	// as it is moved. Otherwise only the measurements moved before the job
+	// started are dropped, gear having to be reloaded in between.
+	live     bool
+	throttle copyThrottle
+
+	mu       sync.Mutex
+	status   RebalanceStatus
+	cancel   context.CancelFunc
+	canceled bool
+	done     chan struct{}
+}
+
+func newRebalanceJob(spec RebalanceSpec, current, previous *placement, tracker moveTracker, live bool) *RebalanceJob {
+	return &RebalanceJob{
+		spec:     spec,
+		current:  current,
+		previous: previous,
+		tracker:  tracker,
+		live:     live,
+		throttle: newCopyThrottle(spec.PointsPerSecond),
+		done:     make(chan struct{}),
+		status:   RebalanceStatus{Spec: spec, State: JobRunning},
+	}
+}
+
+// OpenRebalanceJob returns a job moving the data of the migration of
+// gearConfig, with shard and replica nodes of its own that don't retry, to
+// run it outside of a gear server.
+func OpenRebalanceJob(gearConfig config.GearConfig, spec RebalanceSpec) (*RebalanceJob, error) {
+	if gearConfig.Migration.From == "" {
+		return nil, errors.New("no migration, set from in the [migration] section")
+	}
+	spec, err := spec.withDefaults(gearConfig.Migration)
+	if err != nil {
+		return nil, err
+	}
+	previousConfig, err := config.Load(gearConfig.Migration.From)
+	if err != nil {
+		return nil, err
+	}
+	previousConfig.WithDefaults()
+
+	newReplica := func(instance config.HTTPReplicaNode) (Node, error) {
+		instance.BufferSizeMb = 0
+		instance.QueueDir = ""
+		return NewReplicaHTTPNode(instance)
+	}
+	var nodes []Node
+	for _, node := range gearConfig.HTTPShardNode {
+		nodes = append(nodes, newShardHTTPNode(node, newReplica))
+	}
+	current := newPlacement(gearConfig.Shard, nodes)
+	previousNodes, _ := previousNodes(*previousConfig, nodes, newReplica)
+	previous := newPlacement(previousConfig.Shard, previousNodes)
+	migration, err := openMigration(gearConfig.Migration, previous)
+	if err != nil {
+		return nil, err
+	}
+	return newRebalanceJob(spec, current, previous, migration, false), nil
+}
+
+// Start runs the job in the background.
+func (j *RebalanceJob) Start(ctx context.Context) {
+	j.mu.Lock()
+	j.status.Started = time.Now().UTC()
+	j.mu.Unlock()
+	go func() {
+		_ = j.Run(ctx)
+	}()
+}
+
+// Run moves the data until done, ctx is done or the job is canceled.
+func (j *RebalanceJob) Run(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	j.mu.Lock()
+	j.cancel = cancel
+	if j.canceled {
+		cancel()
+	}
+	if j.status.Started.IsZero() {
+		j.status.Started = time.Now().UTC()
+	}
+	j.mu.Unlock()
+	log.Infof("rebalance: moving data from %d previous shard nodes to %d", len(j.previous.nodes), len(j.current.nodes))
+
+	err := j.run(ctx)
+
+	j.mu.Lock()
+	finished := time.Now().UTC()
+	j.status.Finished = &finished
+	j.status.Database, j.status.Measurement = "", ""
+	switch {
+	case err == nil:
+		j.status.State = JobDone
+		log.Infof("rebalance: done, %d points moved", j.status.Points)
+	case ctx.Err() != nil:
+		j.status.State = JobCanceled
+		j.status.Error = err.Error()
+		log.Warnf("rebalance: canceled after %d points", j.status.Points)
+	default:
+		j.status.State = JobFailed
+		j.status.Error = err.Error()
+		log.Errorf("rebalance: %v", err)
+	}
+	j.mu.Unlock()
+	close(j.done)
+	return err
+}
+
+// Cancel stops the job after the chunk being moved.
+func (j *RebalanceJob) Cancel() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.canceled = true
+	if j.cancel != nil {
+		j.cancel()
+	}
+}
+
+// Done is closed once the job stopped.
+func (j *RebalanceJob) Done() <-chan struct{} {
+	return j.done
+}
+
+func (j *RebalanceJob) Status() RebalanceStatus {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.status
+}
+
+// measurementKey is a measurement of a database.
+type measurementKey struct {
+	database    string
+	measurement string
+}
+
+func (j *RebalanceJob) run(ctx context.Context) error {
+	databases := []string{j.spec.Database}
+	if j.spec.Database == "" {
+		var err error
+		if databases, err = j.databases(ctx); err != nil {
+			return err
+		}
+	}
+
+	// The previous shard nodes having every measurement.
+	holders := make(map[measurementKey][]Node)
+	var measurements []measurementKey
+	for _, database := range databases {
+		for _, node := range j.previous.nodes {
+			names, err := readNames(ctx, node, database, "SHOW MEASUREMENTS ON "+influxql.QuoteIdent(database))
+			if err != nil {
+				return err
+			}
+			for _, name := range names {
+				if len(j.spec.Measurements) > 0 && !contains(j.spec.Measurements, name) {
+					continue
+				}
+				key := measurementKey{database, name}
+				if holders[key] == nil {
+					measurements = append(measurements, key)
+				}
+				holders[key] = append(holders[key], node)
+			}
+		}
+	}
+	sort.Slice(measurements, func(a, b int) bool {
+		if measurements[a].database != measurements[b].database {
+			return measurements[a].database < measurements[b].database
+		}
+		return measurements[a].measurement < measurements[b].measurement
+	})
+
+	movedBefore := make(map[measurementKey]bool)
+	for _, key := range measurements {
+		movedBefore[key] = j.tracker.isMoved(key.database, key.measurement)
+	}
+	j.mu.Lock()
+	j.status.MeasurementsTotal = len(measurements)
+	j.mu.Unlock()
+
+	for _, key := range measurements {
+		j.mu.Lock()
+		j.status.Database, j.status.Measurement = key.database, key.measurement
+		j.mu.Unlock()
+
+		if !movedBefore[key] {
+			for _, source := range holders[key] {
+				if err := j.move(ctx, key, source); err != nil {
+					return fmt.Errorf("moving %s of database %s from %s: %v", key.measurement, key.database, nodeKey(source), err)
+				}
+			}
+			if err := j.tracker.markMoved(key.database, key.measurement); err != nil {
+				return err
+			}
+		}
+		if j.spec.Drop && (j.live || movedBefore[key]) {
+			for _, source := range holders[key] {
+				if err := j.drop(ctx, key, source); err != nil {
+					return fmt.Errorf("dropping %s of database %s from %s: %v", key.measurement, key.database, nodeKey(source), err)
+				}
+			}
+		}
+
+		j.mu.Lock()
+		j.status.MeasurementsDone++
+		j.mu.Unlock()
+	}
+	return nil
+}
+
+// databases lists the databases of the previous shard nodes, but _internal.
+func (j *RebalanceJob) databases(ctx context.Context) ([]string, error) {
+	seen := make(map[string]bool)
+	var databases []string
+	for _, node := range j.previous.nodes {
+		names, err := readNames(ctx, node, "", "SHOW DATABASES")
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range names {
+			if name != "_internal" && !seen[name] {
+				seen[name] = true
+				databases = append(databases, name)
+			}
+		}
+	}
+	sort.Strings(databases)
+	return databases, nil
+}
+
+// move copies the points of a measurement source has to their shard nodes
+// in the current placement, but the ones source owns there.
+func (j *RebalanceJob) move(ctx context.Context, key measurementKey, source Node) error {
+	if owners := j.current.mapMeasurement(key.database, key.measurement, nil); len(owners) == 1 && owners[0].ID() == source.ID() {
+		return nil
+	}
+	retentionPolicies, err := readNames(ctx, source, key.database, "SHOW RETENTION POLICIES ON "+influxql.QuoteIdent(key.database))
+	if err != nil {
+		return err
+	}
+	for _, rp := range retentionPolicies {
+		types, err := readFieldTypes(ctx, source, key.database, rp, key.measurement)
+		if err != nil {
+			return err
+		}
+		if len(types) == 0 {
+			continue
+		}
+		first, last, err := timeBounds(ctx, source, key.database, rp, key.measurement)
+		if err != nil {
+			return err
+		}
+		for start := first.Truncate(j.spec.Chunk); !start.After(last); start = start.Add(j.spec.Chunk) {
+			points, err := readChunk(ctx, source, key.database, rp, key.measurement, types, start, start.Add(j.spec.Chunk))
+			if err != nil {
+				return err
+			}
+			if err := j.write(ctx, key.database, rp, source, points); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// write sends points to their shard nodes in the current placement, but
+// the ones source owns.
+func (j *RebalanceJob) write(ctx context.Context, database, rp string, source Node, points []models.Point) error {
+	owners := make(map[uint64]Node)
+	byOwner := make(map[uint64][]models.Point)
+	for _, point := range points {
+		owner := j.current.shardFor(database, point)
+		if owner.ID() == source.ID() {
+			continue
+		}
+		owners[owner.ID()] = owner
+		byOwner[owner.ID()] = append(byOwner[owner.ID()], point)
+	}
+	for id, owned := range byOwner {
+		owner := owners[id]
+		err := j.throttle.write(ctx, owned, func(batch []models.Point) error {
+			wr := WriteRequest{Points: batch, Database: database, RetentionPolicy: rp}
+			if err := owner.WritePoints(ctx, wr); err != nil {
+				return fmt.Errorf("writing to %s: %v", nodeKey(owner), err)
+			}
+			RebalancePointsMoved.With(prometheus.Labels{"shard": nodeKey(owner), "database": database}).Add(float64(len(batch)))
+			j.mu.Lock()
+			j.status.Points += int64(len(batch))
+			j.mu.Unlock()
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// timeBounds returns the times of the first and last points of a
+// measurement.
+func timeBounds(ctx context.Context, node Node, database, rp, measurement string) (first, last time.Time, err error) {
+	for _, order := range []string{"ASC", "DESC"} {
+		statement := fmt.Sprintf("SELECT * FROM %s.%s.%s GROUP BY * ORDER BY time %s LIMIT 1",
+			influxql.QuoteIdent(database), influxql.QuoteIdent(rp), influxql.QuoteIdent(measurement), order)
+		result, err := queryNode(ctx, node, statement, database, "")
+		if err != nil {
+			return first, last, err
+		}
+		for _, row := range result.Series {
+			for _, values := range row.Values {
+				t, err := time.Parse(time.RFC3339Nano, stringValue(field(row, values, "time")))
+				if err != nil {
+					return first, last, fmt.Errorf("invalid time %v", field(row, values, "time"))
+				}
+				if order == "ASC" && (first.IsZero() || t.Before(first)) {
+					first = t
+				}
+				if order == "DESC" && t.After(last) {
+					last = t
+				}
+			}
+		}
+	}
+	return first, last, nil
+}
+
+// drop deletes from source the series of a moved measurement it doesn't own
+// in the current placement, the whole measurement when it owns none.
+func (j *RebalanceJob) drop(ctx context.Context, key measurementKey, source Node) error {
+	statement := "SHOW SERIES ON " + influxql.QuoteIdent(key.database) + " FROM " + influxql.QuoteIdent(key.measurement)
+	result, err := queryNode(ctx, source, statement, key.database, "")
+	if err != nil {
+		return err
+	}
+
+	var moved []models.Tags
+	kept := false
+	tagKeys := make(map[string]bool)
+	for _, row := range result.Series {
+		for _, values := range row.Values {
+			name, tags := models.ParseKey([]byte(stringValue(field(row, values, "key"))))
+			point, err := models.NewPoint(name, tags, models.Fields{"value": 0.0}, time.Unix(0, 0))
+			if err != nil {
+				return err
+			}
+			for _, tag := range tags {
+				tagKeys[string(tag.Key)] = true
+			}
+			if j.current.shardFor(key.database, point).ID() == source.ID() {
+				kept = true
+			} else {
+				moved = append(moved, tags)
+			}
+		}
+	}
+	if len(moved) == 0 {
+		return nil
+	}
+
+	var statements []string
+	if !kept {
+		statements = append(statements, "DROP MEASUREMENT "+influxql.QuoteIdent(key.measurement))
+	} else {
+		keys := make([]string, 0, len(tagKeys))
+		for tag := range tagKeys {
+			keys = append(keys, tag)
+		}
+		sort.Strings(keys)
+		for _, tags := range moved {
+			// A tag compared to '' matches the series lacking it, so that
+			// the condition matches this series only.
+			conditions := make([]string, 0, len(keys))
+			for _, tag := range keys {
+				conditions = append(conditions, influxql.QuoteIdent(tag)+" = "+influxql.QuoteString(string(tags.Get([]byte(tag)))))
+			}
+			statements = append(statements, "DROP SERIES FROM "+influxql.QuoteIdent(key.measurement)+" WHERE "+strings.Join(conditions, " AND "))
+		}
+	}
+
+	for _, statement := range statements {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		q, err := NewQueryRequest(statement, key.database, "", "")
+		if err != nil {
+			return err
+		}
+		result, err := source.QueryEachInstance(ctx, q)
+		if err == nil {
+			err = result.Err
+		}
+		if err != nil {
+			return err
+		}
+		j.mu.Lock()
+		j.status.Dropped++
+		j.mu.Unlock()
+	}
+	log.Infof("rebalance: dropped %s of database %s from %s", key.measurement, key.database, nodeKey(source))
+	return nil
+}
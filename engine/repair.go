@@ -0,0 +1,614 @@
+package engine
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gear/config"
+	. "gear/influx"
+	"github.com/influxdata/influxdb/models"
+	"github.com/influxdata/influxdb/query"
+	"github.com/influxdata/influxql"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/time/rate"
+	"hash/fnv"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// States of a repair or rebalance job.
+const (
+	JobRunning  = "running"
+	JobDone     = "done"
+	JobFailed   = "failed"
+	JobCanceled = "canceled"
+)
+
+// repairBatchPoints is the number of copied points written per request.
+const repairBatchPoints = 5000
+
+// RepairSpec describes the copy of a time range of a database from a replica
+// to another of the same shard node.
+type RepairSpec struct {
+	// Shard is the name of the shard node, any shard node having both
+	// replicas when empty.
+	Shard string `json:"shard,omitempty"`
+	// Source and Target are replicas as named in logs, i.e. host:port.
+	Source   string `json:"source"`
+	Target   string `json:"target"`
+	Database string `json:"database"`
+	// RetentionPolicy and Measurements restrict the copy, which covers every
+	// retention policy and measurement of the database by default.
+	RetentionPolicy string        `json:"retention_policy,omitempty"`
+	Measurements    []string      `json:"measurements,omitempty"`
+	Start           time.Time     `json:"start"`
+	End             time.Time     `json:"end"`
+	Chunk           time.Duration `json:"chunk"`
+	PointsPerSecond int           `json:"points_per_second,omitempty"`
+}
+
+// ID identifies the copy: a job started again with the same spec, throttling
+// aside, resumes where the previous one stopped.
+func (spec RepairSpec) ID() string {
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%s\x00%s\x00%s\x00%s\x00%s\x00%s\x00%d\x00%d\x00%d",
+		spec.Shard, spec.Source, spec.Target, spec.Database, spec.RetentionPolicy,
+		strings.Join(spec.Measurements, ","), spec.Start.UnixNano(), spec.End.UnixNano(), spec.Chunk)
+	return fmt.Sprintf("%016x", h.Sum64())
+}
+
+func (spec RepairSpec) validate() error {
+	switch {
+	case spec.Source == "" || spec.Target == "":
+		return errors.New("source and target replicas are required")
+	case spec.Source == spec.Target:
+		return errors.New("source and target are the same replica")
+	case spec.Database == "":
+		return errors.New("database is required")
+	case !spec.End.After(spec.Start):
+		return errors.New("end must be after start")
+	case spec.Chunk <= 0:
+		return errors.New("chunk must be positive")
+	case spec.PointsPerSecond < 0:
+		return errors.New("points per second must not be negative")
+	}
+	return nil
+}
+
+// withDefaults fills the chunk and throttling the spec leaves out from the
+// [repair] section.
+func (spec RepairSpec) withDefaults(cfg config.Repair) (RepairSpec, error) {
+	if spec.Chunk == 0 && cfg.Chunk != "" {
+		chunk, err := time.ParseDuration(cfg.Chunk)
+		if err != nil {
+			return spec, fmt.Errorf("error parsing repair chunk %v", err)
+		}
+		spec.Chunk = chunk
+	}
+	if spec.PointsPerSecond == 0 {
+		spec.PointsPerSecond = cfg.PointsPerSecond
+	}
+	return spec, spec.validate()
+}
+
+// RepairStatus is the progress of a repair job, counted in chunks of a
+// measurement. Chunks copied by a previous run of the job count as done.
+type RepairStatus struct {
+	ID          string     `json:"id"`
+	Spec        RepairSpec `json:"spec"`
+	State       string     `json:"state"`
+	Started     time.Time  `json:"started"`
+	Finished    *time.Time `json:"finished,omitempty"`
+	Measurement string     `json:"measurement,omitempty"`
+	ChunksDone  int        `json:"chunks_done"`
+	ChunksTotal int        `json:"chunks_total"`
+	Points      int64      `json:"points"`
+	Error       string     `json:"error,omitempty"`
+}
+
+// RepairJob copies the points of a time range from a replica to another, one
+// measurement and chunk at a time, so that a replica that was down longer
+// than its retry buffer lasts, or was just added, catches up with its peers.
+// Points the target already has are overwritten with the same values.
+type RepairJob struct {
+	spec     RepairSpec
+	source   Node
+	target   Node
+	stateDir string
+	throttle copyThrottle
+
+	mu       sync.Mutex
+	status   RepairStatus
+	cancel   context.CancelFunc
+	canceled bool
+	done     chan struct{}
+}
+
+// NewRepairJob returns a job copying from source to target. The chunks
+// copied are recorded in stateDir, if set. Writes go straight to the target,
+// bypassing its retry buffer: a failed write fails the job, which can be
+// started again.
+func NewRepairJob(spec RepairSpec, source, target Node, stateDir string) (*RepairJob, error) {
+	if err := spec.validate(); err != nil {
+		return nil, err
+	}
+	j := &RepairJob{
+		spec:     spec,
+		source:   directNode(source),
+		target:   directNode(target),
+		stateDir: stateDir,
+		throttle: newCopyThrottle(spec.PointsPerSecond),
+		done:     make(chan struct{}),
+		status: RepairStatus{
+			ID:    spec.ID(),
+			Spec:  spec,
+			State: JobRunning,
+		},
+	}
+	return j, nil
+}
+
+// OpenRepairJob returns a job copying between replicas of gearConfig, with
+// replica nodes of its own that don't retry, to run it outside of a gear
+// server.
+func OpenRepairJob(gearConfig config.GearConfig, spec RepairSpec) (*RepairJob, error) {
+	spec, err := spec.withDefaults(gearConfig.Repair)
+	if err != nil {
+		return nil, err
+	}
+	var source, target *config.HTTPReplicaNode
+	for _, node := range gearConfig.HTTPShardNode {
+		if spec.Shard != "" && node.Name != spec.Shard {
+			continue
+		}
+		source, target = nil, nil
+		for index, instance := range node.HTTPReplicaNode {
+			u, err := url.Parse(strings.Trim(instance.Address, "/"))
+			if err != nil {
+				continue
+			}
+			switch u.Host {
+			case spec.Source:
+				source = &node.HTTPReplicaNode[index]
+			case spec.Target:
+				target = &node.HTTPReplicaNode[index]
+			}
+		}
+		if source != nil && target != nil {
+			break
+		}
+	}
+	if source == nil || target == nil {
+		return nil, repairNotFound(spec)
+	}
+
+	nodes := make([]Node, 2)
+	for index, instance := range []config.HTTPReplicaNode{*source, *target} {
+		instance.BufferSizeMb = 0
+		instance.QueueDir = ""
+		if nodes[index], err = NewReplicaHTTPNode(instance); err != nil {
+			return nil, err
+		}
+	}
+	return NewRepairJob(spec, nodes[0], nodes[1], gearConfig.Repair.StateDir)
+}
+
+func repairNotFound(spec RepairSpec) error {
+	if spec.Shard != "" {
+		return fmt.Errorf("shard node %s has no replicas %s and %s", spec.Shard, spec.Source, spec.Target)
+	}
+	return fmt.Errorf("no shard node has replicas %s and %s", spec.Source, spec.Target)
+}
+
+// directNode returns the replica node writing without retries.
+func directNode(node Node) Node {
+	if retry, ok := node.(*RetryHTTPNode); ok {
+		return &retry.ReplicaHTTPNode
+	}
+	return node
+}
+
+// Start runs the job in the background.
+func (j *RepairJob) Start(ctx context.Context) {
+	j.mu.Lock()
+	j.status.Started = time.Now().UTC()
+	j.mu.Unlock()
+	go func() {
+		_ = j.Run(ctx)
+	}()
+}
+
+// Run copies the data until done, ctx is done or the job is canceled.
+func (j *RepairJob) Run(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	j.mu.Lock()
+	j.cancel = cancel
+	if j.canceled {
+		cancel()
+	}
+	if j.status.Started.IsZero() {
+		j.status.Started = time.Now().UTC()
+	}
+	j.mu.Unlock()
+	log.Infof("repair %s: copying database %s from replica %s to %s, %s to %s",
+		j.status.ID, j.spec.Database, j.spec.Source, j.spec.Target, j.spec.Start.Format(time.RFC3339), j.spec.End.Format(time.RFC3339))
+
+	err := j.run(ctx)
+
+	j.mu.Lock()
+	finished := time.Now().UTC()
+	j.status.Finished = &finished
+	j.status.Measurement = ""
+	switch {
+	case err == nil:
+		j.status.State = JobDone
+		log.Infof("repair %s: done, %d points copied", j.status.ID, j.status.Points)
+	case ctx.Err() != nil:
+		j.status.State = JobCanceled
+		j.status.Error = err.Error()
+		log.Warnf("repair %s: canceled after %d points", j.status.ID, j.status.Points)
+	default:
+		j.status.State = JobFailed
+		j.status.Error = err.Error()
+		log.Errorf("repair %s: %v", j.status.ID, err)
+	}
+	j.mu.Unlock()
+	close(j.done)
+	return err
+}
+
+// Cancel stops the job after the chunk being copied.
+func (j *RepairJob) Cancel() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.canceled = true
+	if j.cancel != nil {
+		j.cancel()
+	}
+}
+
+// Done is closed once the job stopped.
+func (j *RepairJob) Done() <-chan struct{} {
+	return j.done
+}
+
+func (j *RepairJob) ID() string {
+	return j.status.ID
+}
+
+func (j *RepairJob) Status() RepairStatus {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.status
+}
+
+func (j *RepairJob) run(ctx context.Context) error {
+	state, err := j.loadState()
+	if err != nil {
+		return err
+	}
+
+	retentionPolicies := []string{j.spec.RetentionPolicy}
+	if j.spec.RetentionPolicy == "" {
+		if retentionPolicies, err = readNames(ctx, j.source, j.spec.Database, "SHOW RETENTION POLICIES ON "+influxql.QuoteIdent(j.spec.Database)); err != nil {
+			return err
+		}
+	}
+	measurements := j.spec.Measurements
+	if len(measurements) == 0 {
+		if measurements, err = readNames(ctx, j.source, j.spec.Database, "SHOW MEASUREMENTS ON "+influxql.QuoteIdent(j.spec.Database)); err != nil {
+			return err
+		}
+	}
+
+	chunks := j.chunks(j.spec.Start)
+	j.mu.Lock()
+	j.status.ChunksTotal = len(retentionPolicies) * len(measurements) * chunks
+	j.mu.Unlock()
+
+	for _, rp := range retentionPolicies {
+		for _, measurement := range measurements {
+			key := rp + "." + measurement
+			from := j.spec.Start
+			if copied, ok := state.Copied[key]; ok && copied.After(from) {
+				from = copied
+			}
+			j.mu.Lock()
+			j.status.Measurement = key
+			j.status.ChunksDone += chunks - j.chunks(from)
+			j.mu.Unlock()
+			if !from.Before(j.spec.End) {
+				continue
+			}
+
+			types, err := readFieldTypes(ctx, j.source, j.spec.Database, rp, measurement)
+			if err != nil {
+				return err
+			}
+			for start := from; start.Before(j.spec.End); {
+				end := start.Add(j.spec.Chunk)
+				if end.After(j.spec.End) {
+					end = j.spec.End
+				}
+				if len(types) > 0 {
+					if err := j.copyChunk(ctx, rp, measurement, types, start, end); err != nil {
+						return fmt.Errorf("copying %s from %s to %s: %v", key, start.Format(time.RFC3339), end.Format(time.RFC3339), err)
+					}
+				}
+				state.Copied[key] = end
+				if err := j.saveState(state); err != nil {
+					return err
+				}
+				j.mu.Lock()
+				j.status.ChunksDone++
+				j.mu.Unlock()
+				start = end
+			}
+		}
+	}
+	return nil
+}
+
+// chunks returns the number of chunks left from start.
+func (j *RepairJob) chunks(start time.Time) int {
+	if !start.Before(j.spec.End) {
+		return 0
+	}
+	return int((j.spec.End.Sub(start) + j.spec.Chunk - 1) / j.spec.Chunk)
+}
+
+// copyChunk copies the points of a measurement in [start, end).
+func (j *RepairJob) copyChunk(ctx context.Context, rp, measurement string, types map[string]string, start, end time.Time) error {
+	points, err := readChunk(ctx, j.source, j.spec.Database, rp, measurement, types, start, end)
+	if err != nil {
+		return err
+	}
+	return j.throttle.write(ctx, points, func(batch []models.Point) error {
+		wr := WriteRequest{Points: batch, Database: j.spec.Database, RetentionPolicy: rp}
+		if err := j.target.WritePoints(ctx, wr); err != nil {
+			return fmt.Errorf("writing to replica %s: %v", j.spec.Target, err)
+		}
+		RepairPointsCopied.With(prometheus.Labels{"replica": j.spec.Target, "database": j.spec.Database}).Add(float64(len(batch)))
+		j.mu.Lock()
+		j.status.Points += int64(len(batch))
+		j.mu.Unlock()
+		return nil
+	})
+}
+
+// copyThrottle writes copied points in batches, at no more than a number of
+// points per second when it has a limiter.
+type copyThrottle struct {
+	batch   int
+	limiter *rate.Limiter
+}
+
+func newCopyThrottle(pointsPerSecond int) copyThrottle {
+	t := copyThrottle{batch: repairBatchPoints}
+	if pointsPerSecond > 0 {
+		if pointsPerSecond < t.batch {
+			t.batch = pointsPerSecond
+		}
+		t.limiter = rate.NewLimiter(rate.Limit(pointsPerSecond), t.batch)
+	}
+	return t
+}
+
+func (t copyThrottle) write(ctx context.Context, points []models.Point, write func(batch []models.Point) error) error {
+	for len(points) > 0 {
+		n := t.batch
+		if n > len(points) {
+			n = len(points)
+		}
+		if t.limiter != nil {
+			if err := t.limiter.WaitN(ctx, n); err != nil {
+				return err
+			}
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := write(points[:n]); err != nil {
+			return err
+		}
+		points = points[n:]
+	}
+	return nil
+}
+
+// readChunk reads the points of a measurement in [start, end) from node.
+func readChunk(ctx context.Context, node Node, database, rp, measurement string, types map[string]string, start, end time.Time) ([]models.Point, error) {
+	statement := fmt.Sprintf("SELECT * FROM %s.%s.%s WHERE time >= %d AND time < %d GROUP BY *",
+		influxql.QuoteIdent(database), influxql.QuoteIdent(rp), influxql.QuoteIdent(measurement),
+		start.UnixNano(), end.UnixNano())
+	// Times are read as RFC3339 strings, epochs are decoded as floats
+	// that can't hold nanoseconds.
+	result, err := queryNode(ctx, node, statement, database, "")
+	if err != nil {
+		return nil, err
+	}
+
+	var points []models.Point
+	for _, row := range result.Series {
+		if row.Partial {
+			return nil, errors.New("the source truncated the result, use a smaller chunk")
+		}
+		rowPoints, err := repairPoints(row, types)
+		if err != nil {
+			return nil, err
+		}
+		points = append(points, rowPoints...)
+	}
+	return points, nil
+}
+
+// repairPoints converts a row of SELECT * GROUP BY * back to points. JSON
+// doesn't tell integers from floats, types gives the type of every field.
+// Integers beyond 2^53 lose precision, as they do through /query.
+func repairPoints(row *models.Row, types map[string]string) ([]models.Point, error) {
+	tags := models.NewTags(row.Tags)
+	points := make([]models.Point, 0, len(row.Values))
+	for _, values := range row.Values {
+		var t time.Time
+		fields := make(models.Fields)
+		for index, column := range row.Columns {
+			if index >= len(values) || values[index] == nil {
+				continue
+			}
+			if column == "time" {
+				var err error
+				if t, err = time.Parse(time.RFC3339Nano, stringValue(values[index])); err != nil {
+					return nil, fmt.Errorf("invalid time %v", values[index])
+				}
+				continue
+			}
+			fields[column] = repairValue(values[index], types[column])
+		}
+		if len(fields) == 0 {
+			continue
+		}
+		point, err := models.NewPoint(row.Name, tags, fields, t)
+		if err != nil {
+			return nil, err
+		}
+		points = append(points, point)
+	}
+	return points, nil
+}
+
+func repairValue(v interface{}, typ string) interface{} {
+	switch v := v.(type) {
+	case float64:
+		switch typ {
+		case "integer":
+			return int64(v)
+		case "unsigned":
+			return uint64(v)
+		}
+	case json.Number:
+		switch typ {
+		case "integer":
+			if n, err := v.Int64(); err == nil {
+				return n
+			}
+		case "unsigned":
+			if n, err := strconv.ParseUint(v.String(), 10, 64); err == nil {
+				return n
+			}
+		}
+		f, _ := v.Float64()
+		return f
+	}
+	return v
+}
+
+// readFieldTypes returns the type of every field of a measurement, none
+// when it has no data in the retention policy.
+func readFieldTypes(ctx context.Context, node Node, database, rp, measurement string) (map[string]string, error) {
+	statement := fmt.Sprintf("SHOW FIELD KEYS ON %s FROM %s.%s",
+		influxql.QuoteIdent(database), influxql.QuoteIdent(rp), influxql.QuoteIdent(measurement))
+	result, err := queryNode(ctx, node, statement, database, "")
+	if err != nil {
+		return nil, err
+	}
+	types := make(map[string]string)
+	for _, row := range result.Series {
+		for _, values := range row.Values {
+			types[stringValue(field(row, values, "fieldKey"))] = stringValue(field(row, values, "fieldType"))
+		}
+	}
+	return types, nil
+}
+
+// readNames returns the name column of a SHOW statement.
+func readNames(ctx context.Context, node Node, database, statement string) ([]string, error) {
+	result, err := queryNode(ctx, node, statement, database, "")
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, row := range result.Series {
+		for _, values := range row.Values {
+			names = append(names, stringValue(field(row, values, "name")))
+		}
+	}
+	return names, nil
+}
+
+// queryNode runs a statement on node, aborting it when ctx is done.
+func queryNode(ctx context.Context, node Node, statement, database, precision string) (*query.Result, error) {
+	q, err := NewQueryRequest(statement, database, precision, "")
+	if err != nil {
+		return nil, err
+	}
+	result, err := node.Query(ctx, q)
+	if err != nil {
+		return nil, fmt.Errorf("querying %s: %v", nodeKey(node), err)
+	}
+	if result.Err != nil {
+		return nil, fmt.Errorf("querying %s: %v", nodeKey(node), result.Err)
+	}
+	return result, nil
+}
+
+// repairState is the progress saved in the state directory.
+type repairState struct {
+	ID string `json:"id"`
+	// Copied maps retention policy.measurement to the end of the last chunk
+	// copied.
+	Copied map[string]time.Time `json:"copied"`
+}
+
+func (j *RepairJob) statePath() string {
+	return filepath.Join(j.stateDir, "repair-"+j.status.ID+".json")
+}
+
+func (j *RepairJob) loadState() (*repairState, error) {
+	state := &repairState{ID: j.status.ID, Copied: make(map[string]time.Time)}
+	if j.stateDir == "" {
+		return state, nil
+	}
+	b, err := ioutil.ReadFile(j.statePath())
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, state); err != nil {
+		return nil, fmt.Errorf("reading repair state %s: %v", j.statePath(), err)
+	}
+	if state.Copied == nil {
+		state.Copied = make(map[string]time.Time)
+	}
+	log.Infof("repair %s: resuming, %d measurements started", j.status.ID, len(state.Copied))
+	return state, nil
+}
+
+// saveState replaces the state file, so that it is never left half written.
+func (j *RepairJob) saveState(state *repairState) error {
+	if j.stateDir == "" {
+		return nil
+	}
+	if err := os.MkdirAll(j.stateDir, 0755); err != nil {
+		return err
+	}
+	b, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	tmp := j.statePath() + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, j.statePath())
+}
@@ -0,0 +1,174 @@
+package engine
+
+import (
+	"context"
+	"encoding/json"
+	"gear/config"
+	"github.com/influxdata/influxdb/models"
+	"github.com/influxdata/influxdb/query"
+	"github.com/influxdata/influxql"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// repairSource serves a measurement cpu with a point per hour, and records
+// the time ranges selected.
+type repairSource struct {
+	mu       sync.Mutex
+	selected []string
+	failAt   int
+}
+
+func (s *repairSource) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stmt, err := influxql.ParseStatement(r.FormValue("q"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	result := &query.Result{}
+	switch stmt := stmt.(type) {
+	case *influxql.ShowRetentionPoliciesStatement:
+		result.Series = models.Rows{{Columns: []string{"name"}, Values: [][]interface{}{{"autogen"}}}}
+	case *influxql.ShowMeasurementsStatement:
+		result.Series = models.Rows{{Name: "measurements", Columns: []string{"name"}, Values: [][]interface{}{{"cpu"}}}}
+	case *influxql.ShowFieldKeysStatement:
+		result.Series = models.Rows{{
+			Name:    "cpu",
+			Columns: []string{"fieldKey", "fieldType"},
+			Values:  [][]interface{}{{"count", "integer"}, {"value", "float"}},
+		}}
+	case *influxql.SelectStatement:
+		if s.failAt > 0 && len(s.selected) == s.failAt {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		s.selected = append(s.selected, stmt.Condition.String())
+		_, timeRange, _ := influxql.ConditionExpr(stmt.Condition, nil)
+		row := &models.Row{Name: "cpu", Tags: map[string]string{"host": "a"}, Columns: []string{"time", "count", "value"}}
+		for t := timeRange.Min; t.Before(timeRange.Max.Add(time.Nanosecond)); t = t.Add(time.Hour) {
+			row.Values = append(row.Values, []interface{}{t.Format(time.RFC3339Nano), 3, 1.0})
+		}
+		result.Series = models.Rows{row}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{"results": []*query.Result{result}})
+}
+
+type repairTarget struct {
+	mu    sync.Mutex
+	lines []string
+}
+
+func (s *repairTarget) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	body, _ := ioutil.ReadAll(r.Body)
+	s.lines = append(s.lines, strings.Fields(strings.Replace(string(body), " ", "_", -1))...)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func newRepairNodes(t *testing.T, source, target http.Handler) (Node, Node, func()) {
+	sourceServer := httptest.NewServer(source)
+	targetServer := httptest.NewServer(target)
+	sourceNode, err := NewReplicaHTTPNode(config.HTTPReplicaNode{Address: sourceServer.URL})
+	assert.Nil(t, err)
+	targetNode, err := NewReplicaHTTPNode(config.HTTPReplicaNode{Address: targetServer.URL})
+	assert.Nil(t, err)
+	return sourceNode, targetNode, func() {
+		sourceServer.Close()
+		targetServer.Close()
+	}
+}
+
+func TestRepairJob_Run(t *testing.T) {
+	source, target := &repairSource{}, &repairTarget{}
+	sourceNode, targetNode, closeNodes := newRepairNodes(t, source, target)
+	defer closeNodes()
+
+	start := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	spec := RepairSpec{
+		Source:   "source:8086",
+		Target:   "target:8086",
+		Database: "foo",
+		Start:    start,
+		End:      start.Add(3 * time.Hour),
+		Chunk:    2 * time.Hour,
+	}
+	job, err := NewRepairJob(spec, sourceNode, targetNode, "")
+	assert.Nil(t, err)
+	assert.Nil(t, job.Run(context.Background()))
+
+	status := job.Status()
+	assert.Equal(t, JobDone, status.State)
+	assert.Equal(t, 2, status.ChunksDone)
+	assert.Equal(t, 2, status.ChunksTotal)
+	assert.Len(t, source.selected, 2)
+	// One point per hour in [start, start+2h) and [start+2h, start+3h),
+	// the end of each range being excluded.
+	assert.EqualValues(t, 3, status.Points)
+	assert.Equal(t, []string{
+		"cpu,host=a_count=3i,value=1_1546300800000000000",
+		"cpu,host=a_count=3i,value=1_1546304400000000000",
+		"cpu,host=a_count=3i,value=1_1546308000000000000",
+	}, target.lines)
+}
+
+func TestRepairJob_Resume(t *testing.T) {
+	dir, err := ioutil.TempDir("", "repair")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	source, target := &repairSource{failAt: 1}, &repairTarget{}
+	sourceNode, targetNode, closeNodes := newRepairNodes(t, source, target)
+	defer closeNodes()
+
+	start := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	spec := RepairSpec{
+		Source:       "source:8086",
+		Target:       "target:8086",
+		Database:     "foo",
+		Measurements: []string{"cpu"},
+		Start:        start,
+		End:          start.Add(3 * time.Hour),
+		Chunk:        time.Hour,
+	}
+	job, err := NewRepairJob(spec, sourceNode, targetNode, dir)
+	assert.Nil(t, err)
+	assert.NotNil(t, job.Run(context.Background()))
+	assert.Equal(t, JobFailed, job.Status().State)
+	assert.Equal(t, 1, job.Status().ChunksDone)
+
+	source.failAt = 0
+	job, err = NewRepairJob(spec, sourceNode, targetNode, dir)
+	assert.Nil(t, err)
+	assert.Nil(t, job.Run(context.Background()))
+	assert.Equal(t, 3, job.Status().ChunksDone)
+	assert.EqualValues(t, 2, job.Status().Points)
+	assert.Len(t, source.selected, 3)
+	assert.Len(t, target.lines, 3)
+}
+
+func TestRepairSpec_Validate(t *testing.T) {
+	start := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	spec := RepairSpec{Source: "a:8086", Target: "a:8086", Database: "foo", Start: start, End: start.Add(time.Hour)}
+	_, err := spec.withDefaults(config.Repair{Chunk: "1h"})
+	assert.NotNil(t, err)
+
+	spec.Target = "b:8086"
+	spec, err = spec.withDefaults(config.Repair{Chunk: "1h", PointsPerSecond: 100})
+	assert.Nil(t, err)
+	assert.Equal(t, time.Hour, spec.Chunk)
+	assert.Equal(t, 100, spec.PointsPerSecond)
+
+	spec.End = start
+	assert.NotNil(t, spec.validate())
+}
@@ -1,6 +1,7 @@
 package engine
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -8,13 +9,17 @@ import (
 	. "gear/influx"
 
 	"github.com/influxdata/influxdb/query"
+	"github.com/influxdata/influxql"
 	log "github.com/sirupsen/logrus"
+	"golang.org/x/time/rate"
 	"hash/crc32"
+	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
 	"net/url"
 	"path"
+	"strconv"
 	"strings"
 	"sync/atomic"
 	"time"
@@ -28,16 +33,35 @@ const (
 )
 
 type ReplicaHTTPNode struct {
-	id       uint64
-	client   *http.Client
-	url      url.URL
-	username string
-	password string
-	status   uint32
+	id         uint64
+	client     *http.Client
+	url        url.URL
+	username   string
+	password   string
+	status     uint32
+	load       *replicaLoad
 	bufferPool BufferPool
 }
 
-func NewReplicaHTTPNode(instance config.HTTPReplicaNode) (newNode Node, err error) {
+func NewReplicaHTTPNode(instance config.HTTPReplicaNode) (Node, error) {
+	node, err := newReplicaNode(instance)
+	if err != nil {
+		return nil, err
+	}
+	if r, ok := node.(*RetryHTTPNode); ok {
+		if err := r.open(instance); err != nil {
+			return nil, err
+		}
+		return r, nil
+	}
+	_ = node.Ping()
+	return node, nil
+}
+
+// newReplicaNode builds the replica node of instance. A RetryHTTPNode is
+// returned unopened: its queue is only opened, and its retries started, by
+// open.
+func newReplicaNode(instance config.HTTPReplicaNode) (Node, error) {
 	transport := &http.Transport{
 		Proxy: http.ProxyFromEnvironment,
 		DialContext: (&net.Dialer{
@@ -52,36 +76,56 @@ func NewReplicaHTTPNode(instance config.HTTPReplicaNode) (newNode Node, err erro
 
 	u, err := url.Parse(strings.Trim(instance.Address, "/"))
 	if err != nil {
-		return
+		return nil, err
 	}
 	newReplicaHTTPNode := ReplicaHTTPNode{
 		client: &http.Client{
 			Transport: transport,
 		},
-		id:       uint64(crc32.ChecksumIEEE([]byte(u.Host))),
-		url:      *u,
-		username: instance.Username,
-		password: instance.Password,
+		id:         uint64(crc32.ChecksumIEEE([]byte(u.Host))),
+		url:        *u,
+		username:   instance.Username,
+		password:   instance.Password,
+		status:     1,
+		load:       newReplicaLoad(),
 		bufferPool: NewBufferPool(),
 	}
-	if instance.BufferSizeMb > 0 {
-		log.Info("set replica node is retry.")
-		max := DefaultMaxDelayInterval
-		if instance.MaxDelayInterval != "" {
-			m, err := time.ParseDuration(instance.MaxDelayInterval)
-			if err != nil {
-				return nil, fmt.Errorf("error parsing max retry time %v", err)
-			}
-			max = m
-		}
-		return NewRetryHTTPNode(newReplicaHTTPNode, instance.BufferSizeMb*MB, max), nil
+	if instance.BufferSizeMb == 0 && instance.QueueDir == "" {
+		return &newReplicaHTTPNode, nil
 	}
-	err = newReplicaHTTPNode.Ping()
 
-	return &newReplicaHTTPNode, nil
+	log.Info("set replica node is retry.")
+	max := DefaultMaxDelayInterval
+	if instance.MaxDelayInterval != "" {
+		m, err := time.ParseDuration(instance.MaxDelayInterval)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing max retry time %v", err)
+		}
+		max = m
+	}
+	r := newRetryHTTPNode(newReplicaHTTPNode, nil, max)
+	if instance.OverflowPolicy != "" {
+		r.overflow = instance.OverflowPolicy
+	}
+	if instance.RetryBatchSizeKb > 0 {
+		r.batchSize = instance.RetryBatchSizeKb * KB
+	}
+	if instance.RetryMaxAge != "" {
+		if r.maxAge, err = time.ParseDuration(instance.RetryMaxAge); err != nil {
+			return nil, fmt.Errorf("error parsing retry max age %v", err)
+		}
+	}
+	if instance.RetryPointsPerSecond > 0 {
+		r.limiter = rate.NewLimiter(rate.Limit(instance.RetryPointsPerSecond), instance.RetryPointsPerSecond)
+	}
+	return r, nil
 }
 
 func (i *ReplicaHTTPNode) Ping() (err error) {
+	return i.ping(context.Background())
+}
+
+func (i *ReplicaHTTPNode) ping(ctx context.Context) (err error) {
 	u := i.url
 	u.Path = path.Join(u.Path, "ping")
 
@@ -89,6 +133,7 @@ func (i *ReplicaHTTPNode) Ping() (err error) {
 	if err != nil {
 		return
 	}
+	req = req.WithContext(ctx)
 
 	if i.username != "" {
 		req.SetBasicAuth(i.username, i.password)
@@ -102,19 +147,53 @@ func (i *ReplicaHTTPNode) Ping() (err error) {
 
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		atomic.StoreUint32(&i.status, 0)
 		return
 	}
 	if resp.StatusCode != http.StatusNoContent {
 		err = errors.New(string(body))
-		atomic.StoreUint32(&i.status, 0)
 		return
 	}
 
-	atomic.StoreUint32(&i.status, 1)
 	return
 }
 
+// PingReplica checks that the InfluxDB of a replica configuration answers
+// /ping within timeout, without setting up retries for it.
+func PingReplica(instance config.HTTPReplicaNode, timeout time.Duration) error {
+	instance.BufferSizeMb = 0
+	instance.QueueDir = ""
+	node, err := newReplicaNode(instance)
+	if err != nil {
+		return err
+	}
+	defer node.Shutdown()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return node.(*ReplicaHTTPNode).ping(ctx)
+}
+
+// queryString renders q for a backend. Unlike q.String it keeps the
+// passwords of user statements, which influxql redacts.
+func queryString(q *influxql.Query) string {
+	var statements []string
+	for _, stmt := range q.Statements {
+		switch stmt := stmt.(type) {
+		case *influxql.CreateUserStatement:
+			s := "CREATE USER " + influxql.QuoteIdent(stmt.Name) + " WITH PASSWORD " + influxql.QuoteString(stmt.Password)
+			if stmt.Admin {
+				s += " WITH ALL PRIVILEGES"
+			}
+			statements = append(statements, s)
+		case *influxql.SetPasswordUserStatement:
+			statements = append(statements, "SET PASSWORD FOR "+influxql.QuoteIdent(stmt.Name)+" = "+influxql.QuoteString(stmt.Password))
+		default:
+			statements = append(statements, stmt.String())
+		}
+	}
+	return strings.Join(statements, ";\n")
+}
+
 func (i *ReplicaHTTPNode) createDefaultRequest(q QueryRequest) (*http.Request, error) {
 	u := i.url
 	u.Path = path.Join(u.Path, "query")
@@ -132,7 +211,7 @@ func (i *ReplicaHTTPNode) createDefaultRequest(q QueryRequest) (*http.Request, e
 	}
 
 	params := req.URL.Query()
-	params.Set("q", q.Query.String())
+	params.Set("q", queryString(q.Query))
 	params.Set("db", q.Database)
 
 	if q.Precision != "" {
@@ -144,64 +223,181 @@ func (i *ReplicaHTTPNode) createDefaultRequest(q QueryRequest) (*http.Request, e
 
 }
 
-func (i *ReplicaHTTPNode) Query(q QueryRequest) (*query.Result, error) {
+// HTTPError is an unexpected status code returned by a backend.
+type HTTPError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e HTTPError) Error() string {
+	return e.Message
+}
+
+// isServerError reports whether err is a transport error or a 5xx response,
+// i.e. another replica may well succeed where this one failed.
+func isServerError(err error) bool {
+	switch err := err.(type) {
+	case HTTPError:
+		return err.StatusCode >= http.StatusInternalServerError
+	case *url.Error, net.Error:
+		return true
+	}
+	return err == context.DeadlineExceeded
+}
+
+// isPermanentWriteError reports whether a write failed in a way retrying
+// can't fix: the backend rejected the request with a 400, because it doesn't
+// parse or conflicts with the schema, or it targets a missing database.
+// Other 4xx, such as credentials being rotated or a proxy in front of a
+// restarting backend, are worth retrying.
+func isPermanentWriteError(err error) bool {
+	e, ok := err.(HTTPError)
+	if !ok {
+		return false
+	}
+	switch e.StatusCode {
+	case http.StatusBadRequest:
+		return true
+	case http.StatusNotFound:
+		return strings.HasPrefix(e.Message, "database not found")
+	}
+	return false
+}
+
+// Query sends q to the backend, the request is aborted when ctx is done.
+func (i *ReplicaHTTPNode) Query(ctx context.Context, q QueryRequest) (result *query.Result, err error) {
+	start := i.load.start()
+	defer func() { i.done(ctx, start, err) }()
+	return i.query(ctx, q)
+}
+
+// done records the outcome of a request started at start.
+func (i *ReplicaHTTPNode) done(ctx context.Context, start time.Time, err error) {
+	if ctx.Err() == context.Canceled {
+		// The caller gave up, the replica isn't to blame.
+		err = nil
+	}
+	i.load.done(start, err)
+}
+
+func (i *ReplicaHTTPNode) query(ctx context.Context, q QueryRequest) (*query.Result, error) {
+	resp, err := i.send(ctx, q, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	dec := json.NewDecoder(resp.Body)
+	dec.UseNumber()
+	return decodeResult(ctx, resp, dec)
+}
+
+// QueryChunked asks the backend for chunks of q.ValuesPerChunk values and
+// calls emit with them as they are decoded. The replica stays loaded until
+// the stream ends, so its latency covers the whole stream.
+func (i *ReplicaHTTPNode) QueryChunked(ctx context.Context, q QueryRequest, emit func(*query.Result) error) (err error) {
+	start := i.load.start()
+	defer func() { i.done(ctx, start, err) }()
+	resp, err := i.send(ctx, q, func(params url.Values) {
+		params.Set("chunked", "true")
+		params.Set("chunk_size", strconv.Itoa(q.ValuesPerChunk()))
+	})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	dec := json.NewDecoder(resp.Body)
+	dec.UseNumber()
+	if resp.StatusCode != http.StatusOK {
+		_, err := decodeResult(ctx, resp, dec)
+		return err
+	}
+	for {
+		var response Response
+		if err := dec.Decode(&response); err == io.EOF {
+			return nil
+		} else if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return HTTPError{StatusCode: resp.StatusCode, Message: fmt.Sprintf("unable to decode json chunk: %s", err)}
+		}
+		if response.Error != nil {
+			return HTTPError{StatusCode: resp.StatusCode, Message: response.Error.Error()}
+		}
+		for _, result := range response.Results {
+			if err := emit(result); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// send posts q to the backend, with the parameters changed by params if set.
+func (i *ReplicaHTTPNode) send(ctx context.Context, q QueryRequest, params func(url.Values)) (*http.Response, error) {
 	req, err := i.createDefaultRequest(q)
 	if err != nil {
 		return nil, err
 	}
+	if params != nil {
+		values := req.URL.Query()
+		params(values)
+		req.URL.RawQuery = values.Encode()
+	}
+	req = req.WithContext(ctx)
 	resp, err := i.client.Do(req)
 	if err != nil {
 		log.Error("service error: ", err)
 		return nil, err
 	}
-	defer resp.Body.Close()
-
 	log.Infof("query status code: %d, the backend is %s\n", resp.StatusCode, req.URL)
+	return resp, nil
+}
 
+// decodeResult decodes the result of a query that isn't chunked, the error
+// of a failed query is returned with an empty result.
+func decodeResult(ctx context.Context, resp *http.Response, dec *json.Decoder) (*query.Result, error) {
 	var response Response
 	var result query.Result
-	dec := json.NewDecoder(resp.Body)
-	dec.UseNumber()
 	decErr := dec.Decode(&response)
 
 	// ignore this error if we got an invalid status code
 	if decErr != nil && decErr.Error() == "EOF" && resp.StatusCode != http.StatusOK {
 		decErr = nil
 	}
+	if decErr != nil && ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
 	// If we got a valid decode error, send that back
 	if decErr != nil {
-		return nil, fmt.Errorf("unable to decode json: received status code %d err: %s", resp.StatusCode, decErr)
+		return nil, HTTPError{
+			StatusCode: resp.StatusCode,
+			Message:    fmt.Sprintf("unable to decode json: received status code %d err: %s", resp.StatusCode, decErr),
+		}
 	}
 
 	if resp.StatusCode != http.StatusOK && response.Error == nil {
-		return &result, fmt.Errorf("received status code %d from server", resp.StatusCode)
+		return &result, HTTPError{
+			StatusCode: resp.StatusCode,
+			Message:    fmt.Sprintf("received status code %d from server", resp.StatusCode),
+		}
 	}
 	if response.Error != nil {
-		return &result, response.Error
+		return &result, HTTPError{StatusCode: resp.StatusCode, Message: response.Error.Error()}
 	}
 	return response.Results[0], nil
 }
 
-func (i *ReplicaHTTPNode) QueryEachInstance(q QueryRequest) (result *query.Result, err error) {
-	return i.Query(q)
+func (i *ReplicaHTTPNode) QueryEachInstance(ctx context.Context, q QueryRequest) (result *query.Result, err error) {
+	return i.Query(ctx, q)
 }
 
-func (i *ReplicaHTTPNode) WritePoints(wr WriteRequest) error {
+func (i *ReplicaHTTPNode) WritePoints(ctx context.Context, wr WriteRequest) error {
 	b := i.bufferPool.Get()
 	defer i.bufferPool.Put(b)
 
-	for _, p := range wr.Points {
-		if p == nil {
-			continue
-		}
-		if _, err := b.WriteString(p.PrecisionString(wr.Precision)); err != nil {
-			return err
-		}
-
-		if err := b.WriteByte('\n'); err != nil {
-			return err
-		}
-	}
+	wr.LineProtocol(b)
 
 	u := i.url
 	u.Path = path.Join(u.Path, "write")
@@ -210,6 +406,7 @@ func (i *ReplicaHTTPNode) WritePoints(wr WriteRequest) error {
 	if err != nil {
 		return err
 	}
+	req = req.WithContext(ctx)
 	req.Header.Set("Content-Type", "")
 	req.Header.Set("User-Agent", "")
 	if i.username != "" {
@@ -234,25 +431,56 @@ func (i *ReplicaHTTPNode) WritePoints(wr WriteRequest) error {
 	}
 
 	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
-		var err = errors.New(string(body))
-		return err
+		return HTTPError{StatusCode: resp.StatusCode, Message: writeErrorMessage(resp.StatusCode, body)}
 	}
 
 	return nil
 }
 
+// writeErrorMessage extracts the error of an InfluxDB /write response body.
+func writeErrorMessage(code int, body []byte) string {
+	var response struct {
+		Error string `json:"error"`
+	}
+	if err := json.Unmarshal(body, &response); err == nil && response.Error != "" {
+		return response.Error
+	}
+	if message := strings.TrimSpace(string(body)); message != "" {
+		return message
+	}
+	return fmt.Sprintf("received status code %d from server", code)
+}
+
 func (i *ReplicaHTTPNode) Shutdown() {
 	i.client.CloseIdleConnections()
 }
 
+// IsAlive reports the verdict of the health checker. Nodes are alive until
+// the checker says otherwise.
 func (i *ReplicaHTTPNode) IsAlive() bool {
+	return atomic.LoadUint32(&i.status) > 0
+}
+
+// setAlive records a health verdict and reports whether it changed.
+func (i *ReplicaHTTPNode) setAlive(alive bool) bool {
 	var status uint32
-	atomic.LoadUint32(&status)
-	if status > 0 {
-		return true
-	} else {
-		return false
+	if alive {
+		status = 1
 	}
+	return atomic.SwapUint32(&i.status, status) != status
+}
+
+func (i *ReplicaHTTPNode) outstanding() int64 {
+	return i.load.outstanding()
+}
+
+func (i *ReplicaHTTPNode) cost() float64 {
+	return i.load.cost()
+}
+
+// Name identifies the replica in logs and metrics.
+func (i *ReplicaHTTPNode) Name() string {
+	return i.url.Host
 }
 
 func (i *ReplicaHTTPNode) Weight() int {
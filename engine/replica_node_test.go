@@ -1,14 +1,17 @@
 package engine
 
 import (
+	"context"
 	"encoding/json"
 	"gear/config"
 	"gear/influx"
+	"github.com/influxdata/influxdb/query"
 	log "github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 )
 
 func TestHTTPInstance_Ping(t *testing.T) {
@@ -30,6 +33,22 @@ func TestHTTPInstance_Ping(t *testing.T) {
 	assert.Nil(t, err)
 }
 
+func TestPingReplica_Timeout(t *testing.T) {
+	release := make(chan struct{})
+	pings := make(chan struct{}, 2)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pings <- struct{}{}
+		<-release
+	}))
+	defer ts.Close()
+	defer close(release)
+
+	start := time.Now()
+	assert.NotNil(t, PingReplica(config.HTTPReplicaNode{Address: ts.URL}, 50*time.Millisecond))
+	assert.True(t, time.Since(start) < time.Second)
+	assert.Equal(t, 1, len(pings))
+}
+
 func TestHTTPInstance_QueryError(t *testing.T) {
 	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		var data influx.Response
@@ -49,7 +68,7 @@ func TestHTTPInstance_QueryError(t *testing.T) {
 		"ms",
 		"false")
 
-	_, err := i.Query(selectQuery)
+	_, err := i.Query(context.Background(), selectQuery)
 	assert.NotNil(t, err)
 }
 
@@ -78,7 +97,7 @@ func TestHTTPInstance_Query(t *testing.T) {
 		"ms",
 		"false")
 
-	result, err := i.Query(selectQuery)
+	result, err := i.Query(context.Background(), selectQuery)
 	assert.Nil(t, err)
 	assert.Equal(t, result.Series[0].Name, "bar")
 	assert.Equal(t, len(result.Series[0].Columns), 2)
@@ -103,7 +122,7 @@ func TestHTTPInstance_WritePoint(t *testing.T) {
 		"ms",
 		"")
 
-	err := i.WritePoints(writeRequest)
+	err := i.WritePoints(context.Background(), writeRequest)
 	assert.Nil(t, err)
 }
 
@@ -127,6 +146,53 @@ func TestHTTPInstance_WritePointError(t *testing.T) {
 		"ms",
 		"")
 
-	err := i.WritePoints(writeRequest)
+	err := i.WritePoints(context.Background(), writeRequest)
 	assert.NotNil(t, err)
 }
+
+func TestIsPermanentWriteError(t *testing.T) {
+	assert.True(t, isPermanentWriteError(HTTPError{StatusCode: http.StatusBadRequest, Message: "partial write: field type conflict"}))
+	assert.True(t, isPermanentWriteError(HTTPError{StatusCode: http.StatusNotFound, Message: `database not found: "foo"`}))
+	for _, code := range []int{http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound, http.StatusRequestTimeout,
+		http.StatusTooManyRequests, http.StatusServiceUnavailable} {
+		assert.False(t, isPermanentWriteError(HTTPError{StatusCode: code}), code)
+	}
+	assert.False(t, isPermanentWriteError(context.DeadlineExceeded))
+}
+
+func TestHTTPInstance_QueryChunkedLoad(t *testing.T) {
+	release := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/query" {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte(`{"results":[{"statement_id":0,"series":[{"name":"bar","columns":["time","value"],"values":[[1,0]]}],"partial":true}]}` + "\n"))
+		w.(http.Flusher).Flush()
+		<-release
+		_, _ = w.Write([]byte(`{"results":[{"statement_id":0,"series":[{"name":"bar","columns":["time","value"],"values":[[2,0]]}]}]}` + "\n"))
+	}))
+	defer ts.Close()
+
+	node, _ := NewReplicaHTTPNode(config.HTTPReplicaNode{Address: ts.URL})
+	defer node.Shutdown()
+	i := node.(*ReplicaHTTPNode)
+	q, _ := influx.NewQueryRequest("select * from bar", "foo", "ms", "false")
+
+	chunks := 0
+	err := i.QueryChunked(context.Background(), q, func(result *query.Result) error {
+		chunks++
+		assert.Equal(t, int64(1), i.load.outstanding())
+		if chunks == 1 {
+			time.Sleep(50 * time.Millisecond)
+			close(release)
+		}
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, chunks)
+	assert.Equal(t, int64(0), i.load.outstanding())
+	assert.True(t, i.load.cost() >= float64(50*time.Millisecond))
+}
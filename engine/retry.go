@@ -2,18 +2,83 @@ package engine
 
 import (
 	"container/list"
+	"context"
 	"errors"
+	"fmt"
+	"gear/config"
 	. "gear/influx"
+	"github.com/influxdata/influxdb/models"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/time/rate"
+	"io"
 	"sync"
 	"time"
 )
 
-
 const (
 	retryInitial    = 500 * time.Millisecond
 	retryMultiplier = 2
+	// retryTimeout bounds every request of the retry and handoff loops, so
+	// that a hung replica doesn't stall them.
+	retryTimeout = time.Minute
+
+	DefaultRetryBatchSize = 1 * MB
+)
+
+// retryQueue holds the write requests a replica failed to accept, oldest
+// first. Requests are only removed by commit once they were delivered, so a
+// persistent queue can replay them after a restart.
+type retryQueue interface {
+	add(wr WriteRequest) error
+	// front blocks until the queue isn't empty and returns its oldest
+	// requests that sameBatch allows to write together, up to maxBytes but
+	// at least one. It returns false once the queue is closed.
+	front(maxBytes int) ([]WriteRequest, bool)
+	// commit removes the requests returned by front, except the ones evict
+	// already dropped.
+	commit()
+	// evict removes the oldest request without waiting.
+	evict() (WriteRequest, bool)
+	// evictBefore removes the oldest request if it was queued before t.
+	evictBefore(t time.Time) (WriteRequest, bool)
+	// close wakes up front and returns the number of requests left.
+	close() int
+	isClosed() bool
+	stats() queueStats
+	// each calls fn with the queued requests, oldest first, until it
+	// returns an error.
+	each(fn func(wr WriteRequest) error) error
+}
+
+type queueStats struct {
+	depth  int
+	bytes  int
+	oldest time.Time
+}
+
+// queuedWrite is a request of the in-memory queue with the time it was
+// queued at.
+type queuedWrite struct {
+	wr WriteRequest
+	at time.Time
+}
+
+var (
+	ErrBufferFull = errors.New("ErrBufferFull")
+	errExpired    = errors.New("queued longer than the retry max age")
 )
 
+// BackpressureError is returned for a write a replica could neither accept
+// nor buffer. Clients should try again after RetryAfter.
+type BackpressureError struct {
+	Replica    string
+	RetryAfter time.Duration
+}
+
+func (e *BackpressureError) Error() string {
+	return fmt.Sprintf("retry buffer of replica %s is full", e.Replica)
+}
+
 type RetryHTTPNode struct {
 	ReplicaHTTPNode
 
@@ -23,56 +88,493 @@ type RetryHTTPNode struct {
 	multiplier      time.Duration
 	maxInterval     time.Duration
 
-	list *bufferList
+	list retryQueue
+	// batchSize limits the bytes of line protocol written per retry, limiter
+	// the points per second.
+	batchSize int
+	limiter   *rate.Limiter
+	// maxAge is how long requests are retried, forever when zero.
+	maxAge time.Duration
+
+	overflow   string
+	deadLetter *deadLetter
+	// handoff holds the statements the replica missed, they are applied
+	// before any queued write.
+	handoff *handoffLog
+
+	// mu guards the delivery state below, resumed is signalled when
+	// delivery is resumed or the node shut down.
+	mu          sync.Mutex
+	resumed     *sync.Cond
+	paused      bool
+	lastError   string
+	lastErrorAt time.Time
+	// wake and handoffWake interrupt the backoff sleep of the retry and
+	// handoff loops.
+	wake        chan struct{}
+	handoffWake chan struct{}
+}
+
+// QueueStatus describes the retry queue of a replica node.
+type QueueStatus struct {
+	Replica string `json:"replica"`
+	// Storage is "memory" or "disk".
+	Storage          string     `json:"storage"`
+	Depth            int        `json:"depth"`
+	Bytes            int        `json:"bytes"`
+	OldestAgeSeconds float64    `json:"oldest_age_seconds"`
+	Paused           bool       `json:"paused"`
+	Handoff          int        `json:"handoff"`
+	LastError        string     `json:"last_error,omitempty"`
+	LastErrorAt      *time.Time `json:"last_error_at,omitempty"`
 }
 
 func NewRetryHTTPNode(node ReplicaHTTPNode, maxSize int, maxInterval time.Duration) Node {
+	r := newRetryHTTPNode(node, newBufferList(maxSize), maxInterval)
+	r.start()
+	return r
+}
+
+// newRetryHTTPNode returns a node that doesn't retry before start is called,
+// so that its settings can be changed first.
+func newRetryHTTPNode(node ReplicaHTTPNode, queue retryQueue, maxInterval time.Duration) *RetryHTTPNode {
 	r := &RetryHTTPNode{
 		ReplicaHTTPNode: node,
 		buffering:       0,
 		initialInterval: retryInitial,
 		multiplier:      retryMultiplier,
 		maxInterval:     maxInterval,
-		list:            newBufferList(maxSize),
+		list:            queue,
+		batchSize:       DefaultRetryBatchSize,
+		overflow:        config.DefaultOverflowPolicy,
+		wake:            make(chan struct{}, 1),
+		handoffWake:     make(chan struct{}, 1),
 	}
-	go r.run()
+	r.handoff, _ = openHandoffLog("")
+	r.resumed = sync.NewCond(&r.mu)
 	return r
 }
 
+// open opens the retry queue, dead-letter file and handoff log of instance
+// and starts retrying.
+func (r *RetryHTTPNode) open(instance config.HTTPReplicaNode) (err error) {
+	var queue retryQueue
+	if instance.QueueDir == "" {
+		queue = newBufferList(instance.BufferSizeMb * MB)
+	} else {
+		maxSize := instance.QueueMaxSizeMb
+		if maxSize == 0 {
+			maxSize = config.DefaultQueueMaxSizeMb
+		}
+		fsync := instance.QueueFsync
+		if fsync == "" {
+			fsync = config.DefaultQueueFsync
+		}
+		if queue, err = openDiskQueue(instance.QueueDir, maxSize*MB, fsync); err != nil {
+			return err
+		}
+	}
+
+	var dl *deadLetter
+	if instance.DeadLetterFile != "" {
+		if dl, err = openDeadLetter(instance.DeadLetterFile); err != nil {
+			queue.close()
+			return err
+		}
+	}
+	if instance.QueueDir != "" {
+		if r.handoff, err = openHandoffLog(instance.QueueDir); err != nil {
+			queue.close()
+			return err
+		}
+	}
+	r.list = queue
+	r.deadLetter = dl
+	r.start()
+	return nil
+}
+
+func (r *RetryHTTPNode) start() {
+	go r.run()
+	go r.runHandoff()
+}
+
+// run retries the oldest queued requests, backing off while they fail. The
+// batch is formed again for every attempt, so that a replica coming back gets
+// the requests queued meanwhile in as few writes as possible.
 func (r *RetryHTTPNode) run() {
+	interval := r.initialInterval
 	for {
-		wr := r.list.pop()
-		interval := r.initialInterval
-		for {
-			err := r.ReplicaHTTPNode.WritePoints(wr)
+		if !r.waitResumed() {
+			return
+		}
+		r.expire()
+		if !r.handoff.waitEmpty() {
+			return
+		}
+		batch, ok := r.list.front(r.batchSize)
+		if !ok {
+			return
+		}
+		if r.handoff.len() > 0 {
+			// Handed off while waiting for the batch, it goes first.
+			continue
+		}
+		wr := mergeBatch(batch)
+		r.throttle(len(wr.Points))
+		ctx, cancel := context.WithTimeout(context.Background(), retryTimeout)
+		err := r.ReplicaHTTPNode.WritePoints(ctx, wr)
+		cancel()
+		if err == nil {
+			r.list.commit()
+			interval = r.initialInterval
+			continue
+		}
+		r.failed(err)
+		if isPermanentWriteError(err) {
+			if len(batch) == 1 {
+				r.rejected(batch[0], err)
+				err = nil
+			} else {
+				// One request may spoil the whole batch, the others must
+				// not go to the dead-letter file with it.
+				err = r.writeEach(batch)
+			}
 			if err == nil {
-				break
+				r.list.commit()
+				interval = r.initialInterval
+				continue
 			}
-			if interval != r.maxInterval {
-				interval *= r.multiplier
-				if interval > r.maxInterval {
-					interval = r.maxInterval
-				}
+			r.failed(err)
+		}
+		if r.list.isClosed() {
+			return
+		}
+		if interval != r.maxInterval {
+			interval *= r.multiplier
+			if interval > r.maxInterval {
+				interval = r.maxInterval
 			}
-			time.Sleep(interval)
 		}
+		r.sleep(interval, r.wake)
 	}
 }
 
-func (r *RetryHTTPNode) WritePoints(wr WriteRequest) (err error) {
-	err = r.ReplicaHTTPNode.WritePoints(wr)
-	if err != nil {
-		err = r.list.add(wr)
+// writeEach writes the requests of a batch the replica rejected one by one,
+// giving up only the ones it rejects too. It returns the error of a request
+// failing for another reason, the batch being retried as a whole then.
+func (r *RetryHTTPNode) writeEach(batch []WriteRequest) error {
+	var rejected []WriteRequest
+	var reasons []error
+	for _, wr := range batch {
+		r.throttle(len(wr.Points))
+		ctx, cancel := context.WithTimeout(context.Background(), retryTimeout)
+		err := r.ReplicaHTTPNode.WritePoints(ctx, wr)
+		cancel()
+		if isPermanentWriteError(err) {
+			rejected = append(rejected, wr)
+			reasons = append(reasons, err)
+		} else if err != nil {
+			return err
+		}
+	}
+	for i, wr := range rejected {
+		r.rejected(wr, reasons[i])
 	}
 	return nil
 }
 
+// expire drops the requests queued longer than maxAge, or moves them to the
+// dead-letter file.
+func (r *RetryHTTPNode) expire() {
+	if r.maxAge <= 0 {
+		return
+	}
+	points := make(map[string]int)
+	requests := 0
+	for {
+		wr, ok := r.list.evictBefore(time.Now().Add(-r.maxAge))
+		if !ok {
+			break
+		}
+		requests++
+		points[wr.Database] += len(wr.Points)
+		r.dropped(wr, "expired")
+		if r.deadLetter != nil {
+			if err := r.deadLetter.write(r.Name(), wr, errExpired); err != nil {
+				log.Errorf("replica %s: writing to dead-letter file %s: %v", r.Name(), r.deadLetter.path, err)
+			}
+		}
+	}
+	if requests == 0 {
+		return
+	}
+	action := "dropped"
+	if r.deadLetter != nil {
+		action = "moved to " + r.deadLetter.path
+	}
+	for database, n := range points {
+		log.Warnf("replica %s: %d points to %s were queued longer than %s, %s", r.Name(), n, database, r.maxAge, action)
+	}
+}
+
+// sameBatch reports whether two queued requests can be written in one request.
+func sameBatch(a, b WriteRequest) bool {
+	return a.Database == b.Database && a.RetentionPolicy == b.RetentionPolicy && a.Precision == b.Precision
+}
+
+// mergeBatch joins the points of requests that sameBatch allows to merge.
+func mergeBatch(batch []WriteRequest) WriteRequest {
+	if len(batch) == 1 {
+		return batch[0]
+	}
+	wr := batch[0]
+	n := 0
+	for _, b := range batch {
+		n += len(b.Points)
+	}
+	wr.Points = make(models.Points, 0, n)
+	for _, b := range batch {
+		wr.Points = append(wr.Points, b.Points...)
+	}
+	return wr
+}
+
+// throttle waits until the rate limit allows writing n points. A batch of
+// more points than the burst is reserved a burst at a time, every point
+// counts against the rate.
+func (r *RetryHTTPNode) throttle(n int) {
+	if r.limiter == nil {
+		return
+	}
+	now := time.Now()
+	var delay time.Duration
+	for burst := r.limiter.Burst(); n > 0; n -= burst {
+		if n < burst {
+			burst = n
+		}
+		delay = r.limiter.ReserveN(now, burst).DelayFrom(now)
+	}
+	r.sleep(delay, r.wake)
+}
+
+// waitResumed blocks while delivery is paused. It returns false once the
+// node is shut down.
+func (r *RetryHTTPNode) waitResumed() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for r.paused && !r.list.isClosed() {
+		r.resumed.Wait()
+	}
+	return !r.list.isClosed()
+}
+
+// sleep waits for d, or until Flush or Shutdown signal wake.
+func (r *RetryHTTPNode) sleep(d time.Duration, wake chan struct{}) {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-wake:
+	}
+}
+
+func (r *RetryHTTPNode) failed(err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.lastError = err.Error()
+	r.lastErrorAt = time.Now().UTC()
+}
+
+// Pause stops delivering queued requests until Resume. Failed writes are
+// still queued, and don't expire meanwhile.
+func (r *RetryHTTPNode) Pause() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.paused = true
+}
+
+func (r *RetryHTTPNode) Resume() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.paused = false
+	r.resumed.Broadcast()
+}
+
+// Flush retries the oldest queued request right away instead of waiting for
+// the backoff. It has no effect while delivery is paused.
+func (r *RetryHTTPNode) Flush() {
+	for _, wake := range []chan struct{}{r.wake, r.handoffWake} {
+		select {
+		case wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Purge drops the queued requests and returns how many there were.
+func (r *RetryHTTPNode) Purge() int {
+	n := r.list.stats().depth
+	purged := 0
+	for ; purged < n; purged++ {
+		wr, ok := r.list.evict()
+		if !ok {
+			break
+		}
+		r.dropped(wr, "purged")
+	}
+	log.Warnf("replica %s: purged %d queued write requests", r.Name(), purged)
+	return purged
+}
+
+// Export writes the queued requests as line protocol in the format of
+// influx -import, with nanosecond timestamps.
+func (r *RetryHTTPNode) Export(w io.Writer) error {
+	var database, rp string
+	started := false
+	return r.list.each(func(wr WriteRequest) error {
+		if !started {
+			if _, err := io.WriteString(w, "# DML\n"); err != nil {
+				return err
+			}
+		}
+		if !started || wr.Database != database || wr.RetentionPolicy != rp {
+			started = true
+			database, rp = wr.Database, wr.RetentionPolicy
+			if _, err := fmt.Fprintf(w, "# CONTEXT-DATABASE: %s\n# CONTEXT-RETENTION-POLICY: %s\n", database, rp); err != nil {
+				return err
+			}
+		}
+		for _, p := range wr.Points {
+			if _, err := io.WriteString(w, p.String()+"\n"); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (r *RetryHTTPNode) Status() QueueStatus {
+	stats := r.list.stats()
+	status := QueueStatus{
+		Replica: r.Name(),
+		Storage: "memory",
+		Depth:   stats.depth,
+		Bytes:   stats.bytes,
+	}
+	if _, ok := r.list.(*diskQueue); ok {
+		status.Storage = "disk"
+	}
+	if !stats.oldest.IsZero() {
+		status.OldestAgeSeconds = time.Since(stats.oldest).Seconds()
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	status.Paused = r.paused
+	status.Handoff = r.handoff.len()
+	if r.lastError != "" {
+		at := r.lastErrorAt
+		status.LastError = r.lastError
+		status.LastErrorAt = &at
+	}
+	return status
+}
+
+// WritePoints buffers the write for retrying if the replica fails to accept
+// it. Writes the replica rejects for good fail right away. While statements
+// wait to be handed off, writes are queued behind them without trying. A
+// write aborted because ctx is done is buffered too.
+func (r *RetryHTTPNode) WritePoints(ctx context.Context, wr WriteRequest) (err error) {
+	if r.handoff.len() == 0 {
+		err = r.ReplicaHTTPNode.WritePoints(ctx, wr)
+		if err == nil || isPermanentWriteError(err) {
+			return err
+		}
+		r.failed(err)
+	}
+	err = r.list.add(wr)
+	if err == ErrBufferFull {
+		return r.overflowed(wr)
+	}
+	return err
+}
+
+// overflowed applies the overflow policy to a write that didn't fit into the
+// retry buffer.
+func (r *RetryHTTPNode) overflowed(wr WriteRequest) error {
+	switch r.overflow {
+	case config.OverflowDropOldest:
+		for {
+			oldest, ok := r.list.evict()
+			if !ok {
+				// wr is larger than the whole buffer.
+				r.dropped(wr, "overflow")
+				return nil
+			}
+			r.dropped(oldest, "overflow")
+			if err := r.list.add(wr); err != ErrBufferFull {
+				return err
+			}
+		}
+	case config.OverflowDeadLetter:
+		if err := r.deadLetter.write(r.Name(), wr, ErrBufferFull); err != nil {
+			log.Errorf("replica %s: writing to dead-letter file %s: %v", r.Name(), r.deadLetter.path, err)
+			return err
+		}
+		r.dropped(wr, "overflow")
+		return nil
+	default:
+		return &BackpressureError{Replica: r.Name(), RetryAfter: r.maxInterval}
+	}
+}
+
+// rejected gives up a buffered write the replica rejected for good, keeping
+// it in the dead-letter file if there is one.
+func (r *RetryHTTPNode) rejected(wr WriteRequest, reason error) {
+	if r.deadLetter == nil {
+		log.Errorf("replica %s rejected a buffered write to %s, dropping it: %v", r.Name(), wr.Database, reason)
+	} else if err := r.deadLetter.write(r.Name(), wr, reason); err != nil {
+		log.Errorf("replica %s: writing to dead-letter file %s: %v", r.Name(), r.deadLetter.path, err)
+	} else {
+		log.Warnf("replica %s rejected a buffered write to %s, moved it to %s: %v", r.Name(), wr.Database, r.deadLetter.path, reason)
+	}
+	r.dropped(wr, "permanent")
+}
+
+func (r *RetryHTTPNode) dropped(wr WriteRequest, reason string) {
+	DroppedPoints.WithLabelValues(r.Name(), wr.Database, reason).Add(float64(len(wr.Points)))
+}
+
+// Shutdown stops retrying. Requests still in a memory buffer are dropped,
+// the ones in a disk queue are replayed when the queue is opened again.
+func (r *RetryHTTPNode) Shutdown() {
+	n := r.list.close()
+	r.handoff.close()
+	r.mu.Lock()
+	r.resumed.Broadcast()
+	r.mu.Unlock()
+	r.Flush()
+	if _, ok := r.list.(*diskQueue); ok {
+		if n > 0 {
+			log.Infof("replica %s shut down with %d write requests kept on disk", r.Name(), n)
+		}
+	} else if n > 0 {
+		log.Warnf("replica %s shut down with %d buffered write requests", r.Name(), n)
+	}
+	r.ReplicaHTTPNode.Shutdown()
+}
+
+// bufferList is the in-memory retry queue.
 type bufferList struct {
 	cond    *sync.Cond
 	maxSize int
 	size    int
 	num     int
 	list    *list.List
+	closed  bool
+	// inflight is the number of elements returned by front.
+	inflight int
 }
 
 func newBufferList(maxSize int) *bufferList {
@@ -83,24 +585,120 @@ func newBufferList(maxSize int) *bufferList {
 	}
 }
 
-// pop will remove and return the first element of the list, blocking if necessary
-func (l *bufferList) pop() (wr WriteRequest) {
+// front will return the first elements of the list, blocking if necessary.
+// It returns false once the list is closed.
+func (l *bufferList) front(maxBytes int) (batch []WriteRequest, ok bool) {
 	l.cond.L.Lock()
+	defer l.cond.L.Unlock()
 
-	for l.list.Len() == 0 {
+	for l.list.Len() == 0 && !l.closed {
 		l.cond.Wait()
 	}
+	if l.closed {
+		return nil, false
+	}
+	size := 0
+	for e := l.list.Front(); e != nil; e = e.Next() {
+		wr := e.Value.(queuedWrite).wr
+		if len(batch) > 0 && (!sameBatch(batch[0], wr) || size+wr.Size() > maxBytes) {
+			break
+		}
+		batch = append(batch, wr)
+		size += wr.Size()
+	}
+	l.inflight = len(batch)
+	return batch, true
+}
+
+func (l *bufferList) commit() {
+	l.cond.L.Lock()
+	defer l.cond.L.Unlock()
+
+	for ; l.inflight > 0; l.inflight-- {
+		l.remove(l.list.Front())
+	}
+}
+
+func (l *bufferList) evict() (wr WriteRequest, ok bool) {
+	l.cond.L.Lock()
+	defer l.cond.L.Unlock()
+
+	e := l.list.Front()
+	if e == nil {
+		return wr, false
+	}
+	if l.inflight > 0 {
+		l.inflight--
+	}
+	return l.remove(e), true
+}
+
+func (l *bufferList) evictBefore(t time.Time) (wr WriteRequest, ok bool) {
+	l.cond.L.Lock()
+	defer l.cond.L.Unlock()
 
 	e := l.list.Front()
-	wr = e.Value.(WriteRequest)
-	l.list.Remove(e)
+	if e == nil || !e.Value.(queuedWrite).at.Before(t) {
+		return wr, false
+	}
+	if l.inflight > 0 {
+		l.inflight--
+	}
+	return l.remove(e), true
+}
+
+func (l *bufferList) remove(e *list.Element) WriteRequest {
+	wr := l.list.Remove(e).(queuedWrite).wr
 	l.size -= wr.Size()
 	RetryRequestCount.Dec()
 	RetryBufferSize.Sub(float64(wr.Size()))
+	return wr
+}
 
+func (l *bufferList) close() int {
+	l.cond.L.Lock()
+	defer l.cond.L.Unlock()
+	l.closed = true
+	l.cond.Broadcast()
+	return l.list.Len()
+}
+
+func (l *bufferList) stats() queueStats {
+	l.cond.L.Lock()
+	defer l.cond.L.Unlock()
+	stats := queueStats{depth: l.list.Len(), bytes: l.size}
+	if e := l.list.Front(); e != nil {
+		stats.oldest = e.Value.(queuedWrite).at
+	}
+	return stats
+}
+
+func (l *bufferList) each(fn func(wr WriteRequest) error) error {
+	l.cond.L.Lock()
+	requests := make([]WriteRequest, 0, l.list.Len())
+	for e := l.list.Front(); e != nil; e = e.Next() {
+		requests = append(requests, e.Value.(queuedWrite).wr)
+	}
 	l.cond.L.Unlock()
 
-	return
+	for _, wr := range requests {
+		if err := fn(wr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (l *bufferList) len() int {
+	l.cond.L.Lock()
+	defer l.cond.L.Unlock()
+	return l.list.Len()
+}
+
+func (l *bufferList) isClosed() bool {
+	l.cond.L.Lock()
+	defer l.cond.L.Unlock()
+	return l.closed
 }
 
 func (l *bufferList) add(wr WriteRequest) error {
@@ -108,10 +706,10 @@ func (l *bufferList) add(wr WriteRequest) error {
 
 	if l.size+wr.Size() > l.maxSize {
 		l.cond.L.Unlock()
-		return errors.New("ErrBufferFull")
+		return ErrBufferFull
 	}
 
-	l.list.PushBack(wr)
+	l.list.PushBack(queuedWrite{wr: wr, at: time.Now()})
 	l.size += wr.Size()
 	l.cond.Signal()
 	RetryRequestCount.Inc()
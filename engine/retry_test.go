@@ -0,0 +1,265 @@
+package engine
+
+import (
+	"context"
+	"encoding/json"
+	"gear/config"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/time/rate"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTestRetryNode(t *testing.T, address string, bufferSize int) *RetryHTTPNode {
+	base, err := NewReplicaHTTPNode(config.HTTPReplicaNode{Address: address})
+	assert.Nil(t, err)
+	return newRetryHTTPNode(*base.(*ReplicaHTTPNode), newBufferList(bufferSize), time.Second)
+}
+
+func newFailingRetryNode(t *testing.T, bufferSize int, overflow string) *RetryHTTPNode {
+	r := newTestRetryNode(t, writeErrorServer.URL, bufferSize)
+	r.overflow = overflow
+	r.start()
+	return r
+}
+
+func TestRetryHTTPNode_OverflowReject(t *testing.T) {
+	r := newFailingRetryNode(t, 40, config.OverflowReject)
+	defer r.Shutdown()
+
+	assert.Nil(t, r.WritePoints(context.Background(), testWriteRequest(t, "cpu,host=a value=1 1465839830100")))
+	err := r.WritePoints(context.Background(), testWriteRequest(t, "cpu,host=b value=2 1465839830200"))
+	assert.IsType(t, &BackpressureError{}, err)
+	assert.Equal(t, time.Second, err.(*BackpressureError).RetryAfter)
+}
+
+func TestRetryHTTPNode_OverflowDropOldest(t *testing.T) {
+	r := newFailingRetryNode(t, 40, config.OverflowDropOldest)
+	defer r.Shutdown()
+
+	assert.Nil(t, r.WritePoints(context.Background(), testWriteRequest(t, "cpu,host=a value=1 1465839830100")))
+	assert.Nil(t, r.WritePoints(context.Background(), testWriteRequest(t, "cpu,host=b value=2 1465839830200")))
+
+	batch, ok := r.list.front(MB)
+	assert.True(t, ok)
+	assert.Len(t, batch, 1)
+	wr := batch[0]
+	assert.Equal(t, "cpu,host=b value=2 1465839830200", wr.Points[0].PrecisionString("ms"))
+	assert.Equal(t, 1, r.list.(*bufferList).len())
+}
+
+func TestRetryHTTPNode_OverflowDeadLetter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gear-dead-letter")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	r := newTestRetryNode(t, writeErrorServer.URL, 40)
+	r.overflow = config.OverflowDeadLetter
+	r.deadLetter, err = openDeadLetter(filepath.Join(dir, "dead-letter.log"))
+	assert.Nil(t, err)
+	r.start()
+	defer r.Shutdown()
+
+	assert.Nil(t, r.WritePoints(context.Background(), testWriteRequest(t, "cpu,host=a value=1 1465839830100")))
+	assert.Nil(t, r.WritePoints(context.Background(), testWriteRequest(t, "cpu,host=b value=2 1465839830200")))
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, "dead-letter.log"))
+	assert.Nil(t, err)
+	var record deadLetterRecord
+	assert.Nil(t, json.Unmarshal(data, &record))
+	assert.Equal(t, "foo", record.Database)
+	assert.Equal(t, ErrBufferFull.Error(), record.Error)
+	assert.Equal(t, "cpu,host=b value=2 1465839830200\n", record.Body)
+}
+
+func TestRetryHTTPNode_PermanentError(t *testing.T) {
+	var writes int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/write" {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		if atomic.AddInt32(&writes, 1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error":"partial write: field type conflict"}`))
+	}))
+	defer ts.Close()
+
+	dir, err := ioutil.TempDir("", "gear-dead-letter")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	r := newTestRetryNode(t, ts.URL, MB)
+	r.initialInterval = time.Millisecond
+	r.deadLetter, err = openDeadLetter(filepath.Join(dir, "dead-letter.log"))
+	assert.Nil(t, err)
+	r.start()
+	defer r.Shutdown()
+
+	// The first attempt fails with a 503 and is buffered, the retry is
+	// rejected for good and moved to the dead-letter file.
+	assert.Nil(t, r.WritePoints(context.Background(), testWriteRequest(t, "cpu,host=a value=1 1465839830100")))
+	assert.True(t, waitFor(func() bool {
+		data, _ := ioutil.ReadFile(filepath.Join(dir, "dead-letter.log"))
+		return len(data) > 0
+	}))
+	data, _ := ioutil.ReadFile(filepath.Join(dir, "dead-letter.log"))
+	var record deadLetterRecord
+	assert.Nil(t, json.Unmarshal(data, &record))
+	assert.Equal(t, "partial write: field type conflict", record.Error)
+	assert.Equal(t, "cpu,host=a value=1 1465839830100\n", record.Body)
+	assert.True(t, waitFor(func() bool { return r.list.(*bufferList).len() == 0 }))
+
+	// Writes rejected right away aren't buffered, the client gets the error.
+	err = r.WritePoints(context.Background(), testWriteRequest(t, "cpu,host=b value=2 1465839830200"))
+	assert.Equal(t, HTTPError{StatusCode: http.StatusBadRequest, Message: "partial write: field type conflict"}, err)
+	assert.Equal(t, 0, r.list.(*bufferList).len())
+}
+
+func TestRetryHTTPNode_Batch(t *testing.T) {
+	var up int32
+	var writes int32
+	var lines = make(chan string, 10)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/write" {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		if atomic.LoadInt32(&up) == 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		atomic.AddInt32(&writes, 1)
+		body, _ := ioutil.ReadAll(r.Body)
+		lines <- string(body)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer ts.Close()
+
+	r := newTestRetryNode(t, ts.URL, MB)
+	r.initialInterval = time.Millisecond
+	r.Pause()
+	r.start()
+	defer r.Shutdown()
+
+	assert.Nil(t, r.WritePoints(context.Background(), testWriteRequest(t, "cpu,host=a value=1 1465839830100")))
+	assert.Nil(t, r.WritePoints(context.Background(), testWriteRequest(t, "cpu,host=b value=2 1465839830200")))
+	assert.Nil(t, r.WritePoints(context.Background(), testWriteRequest(t, "cpu,host=c value=3 1465839830300")))
+
+	atomic.StoreInt32(&up, 1)
+	r.Resume()
+	select {
+	case body := <-lines:
+		assert.Equal(t, "cpu,host=a value=1 1465839830100\ncpu,host=b value=2 1465839830200\n"+
+			"cpu,host=c value=3 1465839830300\n", body)
+	case <-time.After(time.Second):
+		t.Fatal("queued writes weren't retried")
+	}
+	assert.True(t, waitFor(func() bool { return r.list.(*bufferList).len() == 0 }))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&writes))
+}
+
+func TestRetryHTTPNode_BatchPermanentError(t *testing.T) {
+	var up int32
+	var lines = make(chan string, 10)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/write" {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		if atomic.LoadInt32(&up) == 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		if strings.Contains(string(body), "value=\"b\"") {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":"partial write: field type conflict"}`))
+			return
+		}
+		lines <- string(body)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer ts.Close()
+
+	dir, err := ioutil.TempDir("", "gear-dead-letter")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	r := newTestRetryNode(t, ts.URL, MB)
+	r.initialInterval = time.Millisecond
+	r.deadLetter, err = openDeadLetter(filepath.Join(dir, "dead-letter.log"))
+	assert.Nil(t, err)
+	r.Pause()
+	r.start()
+	defer r.Shutdown()
+
+	assert.Nil(t, r.WritePoints(context.Background(), testWriteRequest(t, "cpu,host=a value=1 1465839830100")))
+	assert.Nil(t, r.WritePoints(context.Background(), testWriteRequest(t, `cpu,host=b value="b" 1465839830200`)))
+	assert.Nil(t, r.WritePoints(context.Background(), testWriteRequest(t, "cpu,host=c value=3 1465839830300")))
+
+	// The merged batch is rejected, its requests are retried one by one and
+	// only the rejected one is moved to the dead-letter file.
+	atomic.StoreInt32(&up, 1)
+	r.Resume()
+	assert.True(t, waitFor(func() bool { return r.list.(*bufferList).len() == 0 }))
+	close(lines)
+	var delivered []string
+	for body := range lines {
+		delivered = append(delivered, body)
+	}
+	assert.Equal(t, []string{"cpu,host=a value=1 1465839830100\n", "cpu,host=c value=3 1465839830300\n"}, delivered)
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, "dead-letter.log"))
+	assert.Nil(t, err)
+	var record deadLetterRecord
+	assert.Nil(t, json.Unmarshal(data, &record))
+	assert.Equal(t, "partial write: field type conflict", record.Error)
+	assert.Equal(t, "cpu,host=b value=\"b\" 1465839830200\n", record.Body)
+}
+
+func TestRetryHTTPNode_MaxAge(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gear-dead-letter")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	r := newTestRetryNode(t, writeErrorServer.URL, MB)
+	r.initialInterval = time.Millisecond
+	r.maxInterval = 10 * time.Millisecond
+	r.maxAge = 50 * time.Millisecond
+	r.deadLetter, err = openDeadLetter(filepath.Join(dir, "dead-letter.log"))
+	assert.Nil(t, err)
+	r.start()
+	defer r.Shutdown()
+
+	assert.Nil(t, r.WritePoints(context.Background(), testWriteRequest(t, "cpu,host=a value=1 1465839830100")))
+	assert.Equal(t, 1, r.list.(*bufferList).len())
+	assert.True(t, waitFor(func() bool { return r.list.(*bufferList).len() == 0 }))
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, "dead-letter.log"))
+	assert.Nil(t, err)
+	var record deadLetterRecord
+	assert.Nil(t, json.Unmarshal(data, &record))
+	assert.Equal(t, errExpired.Error(), record.Error)
+}
+
+func TestRetryHTTPNode_ThrottleLargeBatch(t *testing.T) {
+	r := newTestRetryNode(t, writeOKServer.URL, MB)
+	r.limiter = rate.NewLimiter(1000, 10)
+
+	// 300 points at 1000 per second take 0.29s past the first burst, not
+	// the cost of a single burst.
+	start := time.Now()
+	r.throttle(300)
+	assert.True(t, time.Since(start) >= 250*time.Millisecond, time.Since(start))
+}
@@ -0,0 +1,67 @@
+package engine
+
+import (
+	"github.com/influxdata/influxdb/models"
+	"sort"
+	"strconv"
+)
+
+// HashRing places nodes on a consistent-hash ring. Every node owns
+// Weight()*virtualNodes points on the ring, so adding or removing a node only
+// moves the keys that fall between its points and their predecessors.
+type HashRing struct {
+	hashes []uint64
+	nodes  map[uint64]Node
+}
+
+func NewHashRing(nodes []Node, virtualNodes int) *HashRing {
+	ring := &HashRing{
+		nodes: make(map[uint64]Node),
+	}
+	for _, node := range nodes {
+		key := nodeKey(node)
+		for i := 0; i < node.Weight()*virtualNodes; i++ {
+			h := models.NewInlineFNV64a()
+			h.Write([]byte(key + "#" + strconv.Itoa(i)))
+			sum := mix64(h.Sum64())
+			if _, ok := ring.nodes[sum]; ok {
+				continue
+			}
+			ring.nodes[sum] = node
+			ring.hashes = append(ring.hashes, sum)
+		}
+	}
+	sort.Slice(ring.hashes, func(i, j int) bool { return ring.hashes[i] < ring.hashes[j] })
+	return ring
+}
+
+// ShardFor returns the first node clockwise from hash.
+func (r *HashRing) ShardFor(hash uint64) Node {
+	hash = mix64(hash)
+	index := sort.Search(len(r.hashes), func(i int) bool { return r.hashes[i] >= hash })
+	if index == len(r.hashes) {
+		index = 0
+	}
+	return r.nodes[r.hashes[index]]
+}
+
+// nodeKey identifies a node on the ring. The shard name is preferred so that
+// changing the replicas of a shard doesn't move its data.
+func nodeKey(node Node) string {
+	if named, ok := node.(interface{ Name() string }); ok && named.Name() != "" {
+		return named.Name()
+	}
+	return strconv.FormatUint(node.ID(), 10)
+}
+
+// mix64 is the murmur3 finalizer. FNV-1a of keys that only differ in their
+// last bytes leaves the high bits almost untouched, which would cluster
+// neighbouring keys on the ring.
+func mix64(h uint64) uint64 {
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+	return h
+}
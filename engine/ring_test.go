@@ -0,0 +1,73 @@
+package engine
+
+import (
+	"fmt"
+	"github.com/influxdata/influxdb/models"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+type namedMockNode struct {
+	MockNode
+	name string
+}
+
+func (m *namedMockNode) Name() string { return m.name }
+
+func measurementHash(name string) uint64 {
+	h := models.NewInlineFNV64a()
+	h.Write([]byte(name))
+	return h.Sum64()
+}
+
+func TestHashRing_ShardFor(t *testing.T) {
+	nodes := []Node{&namedMockNode{name: "a"}, &namedMockNode{name: "b"}, &namedMockNode{name: "c"}}
+	ring := NewHashRing(nodes, 160)
+
+	owned := map[Node]int{}
+	for i := 0; i < 3000; i++ {
+		node := ring.ShardFor(measurementHash(fmt.Sprintf("cpu%d", i)))
+		assert.Equal(t, node, ring.ShardFor(measurementHash(fmt.Sprintf("cpu%d", i))))
+		owned[node]++
+	}
+	for _, node := range nodes {
+		assert.InDelta(t, 1000, owned[node], 250)
+	}
+}
+
+func TestHashRing_AddNodeMovesFewKeys(t *testing.T) {
+	nodes := []Node{&namedMockNode{name: "a"}, &namedMockNode{name: "b"}, &namedMockNode{name: "c"}}
+	before := NewHashRing(nodes, 160)
+	after := NewHashRing(append(nodes, &namedMockNode{name: "d"}), 160)
+
+	moved := 0
+	for i := 0; i < 4000; i++ {
+		hash := measurementHash(fmt.Sprintf("mem%d", i))
+		if before.ShardFor(hash) != after.ShardFor(hash) {
+			moved++
+			assert.Equal(t, "d", after.ShardFor(hash).(*namedMockNode).name)
+		}
+	}
+	assert.InDelta(t, 1000, moved, 250)
+}
+
+func TestHashRing_Weight(t *testing.T) {
+	heavy := &weightedMockNode{namedMockNode: namedMockNode{name: "heavy"}, weight: 3}
+	light := &namedMockNode{name: "light"}
+	ring := NewHashRing([]Node{heavy, light}, 160)
+
+	owned := 0
+	for i := 0; i < 4000; i++ {
+		if ring.ShardFor(measurementHash(fmt.Sprintf("disk%d", i))) == heavy {
+			owned++
+		}
+	}
+	assert.InDelta(t, 3000, owned, 300)
+}
+
+type weightedMockNode struct {
+	namedMockNode
+	weight int
+}
+
+func (m *weightedMockNode) Weight() int { return m.weight }
@@ -0,0 +1,454 @@
+package engine
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"gear/config"
+	. "gear/influx"
+	"github.com/influxdata/influxdb/models"
+	"github.com/influxdata/influxdb/query"
+	"github.com/influxdata/influxql"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Kinds of schema objects, in the order they have to be created.
+const (
+	schemaDatabase        = "database"
+	schemaRetentionPolicy = "retention_policy"
+	schemaUser            = "user"
+	schemaGrant           = "grant"
+	schemaContinuousQuery = "continuous_query"
+)
+
+var schemaKinds = []string{schemaDatabase, schemaRetentionPolicy, schemaUser, schemaGrant, schemaContinuousQuery}
+
+// SchemaReport is the result of comparing the schema of the replica nodes.
+type SchemaReport struct {
+	Time     time.Time `json:"time"`
+	Replicas []string  `json:"replicas"`
+	// Unreachable are the replicas whose schema couldn't be read, with the
+	// error. They aren't compared.
+	Unreachable map[string]string `json:"unreachable,omitempty"`
+	Drift       []SchemaDrift     `json:"drift"`
+}
+
+// SchemaDrift is an object that isn't the same on every replica.
+type SchemaDrift struct {
+	Kind string `json:"kind"`
+	Name string `json:"name"`
+	// Statement creates the object as most replicas have it. Users have
+	// none, their password can't be read.
+	Statement string `json:"statement,omitempty"`
+	// Missing are the replicas lacking an object most replicas have, Extra
+	// the ones having an object most replicas lack and Differs the ones
+	// having another definition than most replicas.
+	Missing []string          `json:"missing,omitempty"`
+	Extra   []string          `json:"extra,omitempty"`
+	Differs []string          `json:"differs,omitempty"`
+	Applied []string          `json:"applied,omitempty"`
+	Errors  map[string]string `json:"errors,omitempty"`
+}
+
+// SchemaChecker compares the databases, retention policies, users, grants
+// and continuous queries of the replica nodes in the background. DDL is
+// sent to every replica without a transaction, so a replica failing a
+// statement lags behind the others.
+type SchemaChecker struct {
+	interval time.Duration
+	timeout  time.Duration
+	apply    bool
+	targets  []Node
+
+	mu   sync.Mutex
+	last *SchemaReport
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+func NewSchemaChecker(cfg config.SchemaCheck, nodes []Node) (*SchemaChecker, error) {
+	s := &SchemaChecker{
+		apply: cfg.Apply,
+		done:  make(chan struct{}),
+	}
+	var err error
+	if cfg.Interval != "" {
+		if s.interval, err = time.ParseDuration(cfg.Interval); err != nil {
+			return nil, fmt.Errorf("error parsing schema check interval %v", err)
+		}
+	}
+	if cfg.Timeout != "" {
+		if s.timeout, err = time.ParseDuration(cfg.Timeout); err != nil {
+			return nil, fmt.Errorf("error parsing schema check timeout %v", err)
+		}
+	}
+	seen := make(map[string]bool)
+	for _, node := range nodes {
+		if name := nodeKey(node); !seen[name] {
+			seen[name] = true
+			s.targets = append(s.targets, node)
+		}
+	}
+	sort.Slice(s.targets, func(i, j int) bool { return nodeKey(s.targets[i]) < nodeKey(s.targets[j]) })
+	return s, nil
+}
+
+// Start runs the background checks. It does nothing when the interval is 0
+// or there is a single replica.
+func (s *SchemaChecker) Start() {
+	if s.interval <= 0 || len(s.targets) < 2 {
+		return
+	}
+	s.wg.Add(1)
+	go s.run()
+}
+
+func (s *SchemaChecker) Stop() {
+	close(s.done)
+	s.wg.Wait()
+}
+
+func (s *SchemaChecker) run() {
+	defer s.wg.Done()
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+		}
+		s.Check(s.apply)
+	}
+}
+
+// Last returns the report of the latest check, nil before the first one.
+func (s *SchemaChecker) Last() *SchemaReport {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.last
+}
+
+// Check compares the schema of the replicas now. With apply, the objects
+// missing on a minority of the replicas are created there, users excepted.
+func (s *SchemaChecker) Check(apply bool) SchemaReport {
+	report := SchemaReport{Time: time.Now().UTC(), Drift: []SchemaDrift{}}
+	schemas := make([]replicaSchema, len(s.targets))
+	errs := make([]error, len(s.targets))
+	var wg sync.WaitGroup
+	for index, target := range s.targets {
+		index, target := index, target
+		report.Replicas = append(report.Replicas, nodeKey(target))
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			schemas[index], errs[index] = s.fetch(target)
+		}()
+	}
+	wg.Wait()
+
+	var names []string
+	var nodes []Node
+	var reachable []replicaSchema
+	for index, target := range s.targets {
+		name := nodeKey(target)
+		if errs[index] != nil {
+			log.Warnf("schema check: reading the schema of replica %s: %v", name, errs[index])
+			if report.Unreachable == nil {
+				report.Unreachable = make(map[string]string)
+			}
+			report.Unreachable[name] = errs[index].Error()
+			continue
+		}
+		names = append(names, name)
+		nodes = append(nodes, target)
+		reachable = append(reachable, schemas[index])
+	}
+
+	report.Drift = append(report.Drift, compareSchemas(names, reachable)...)
+	if apply {
+		for index := range report.Drift {
+			s.applyDrift(&report.Drift[index], names, nodes)
+		}
+	}
+
+	SchemaDriftObjects.Reset()
+	for _, name := range names {
+		for _, kind := range schemaKinds {
+			SchemaDriftObjects.With(prometheus.Labels{"replica": name, "kind": kind}).Set(0)
+		}
+	}
+	for _, drift := range report.Drift {
+		for _, group := range [][]string{drift.Missing, drift.Extra, drift.Differs} {
+			for _, name := range group {
+				if !contains(drift.Applied, name) {
+					SchemaDriftObjects.With(prometheus.Labels{"replica": name, "kind": drift.Kind}).Inc()
+				}
+			}
+		}
+	}
+	if len(report.Drift) > 0 {
+		log.Warnf("schema check: %d objects differ across %d replicas", len(report.Drift), len(names))
+	}
+
+	s.mu.Lock()
+	s.last = &report
+	s.mu.Unlock()
+	return report
+}
+
+// applyDrift creates the object on the replicas missing it.
+func (s *SchemaChecker) applyDrift(drift *SchemaDrift, names []string, nodes []Node) {
+	if drift.Statement == "" {
+		return
+	}
+	for _, name := range drift.Missing {
+		node := nodes[indexOf(names, name)]
+		_, err := s.query(node, drift.Statement, "")
+		if err != nil {
+			log.Errorf("schema check: applying %q to replica %s: %v", drift.Statement, name, err)
+			if drift.Errors == nil {
+				drift.Errors = make(map[string]string)
+			}
+			drift.Errors[name] = err.Error()
+			continue
+		}
+		log.Infof("schema check: applied %q to replica %s", drift.Statement, name)
+		drift.Applied = append(drift.Applied, name)
+		SchemaObjectsApplied.With(prometheus.Labels{"replica": name, "kind": drift.Kind}).Inc()
+	}
+}
+
+// compareSchemas returns the objects that aren't the same on every replica.
+// Objects are expected where at least half of the replicas have them, so
+// that a replica that missed a DROP isn't taken for the reference.
+func compareSchemas(names []string, schemas []replicaSchema) []SchemaDrift {
+	keys := make(map[schemaKey]bool)
+	for _, schema := range schemas {
+		for key := range schema {
+			keys[key] = true
+		}
+	}
+	sorted := make([]schemaKey, 0, len(keys))
+	for key := range keys {
+		sorted = append(sorted, key)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		ki, kj := indexOf(schemaKinds, sorted[i].kind), indexOf(schemaKinds, sorted[j].kind)
+		if ki != kj {
+			return ki < kj
+		}
+		return sorted[i].name < sorted[j].name
+	})
+
+	var drifts []SchemaDrift
+	for _, key := range sorted {
+		var have, lack []string
+		definitions := make(map[string]int)
+		for index, schema := range schemas {
+			if definition, ok := schema[key]; ok {
+				have = append(have, names[index])
+				definitions[definition]++
+			} else {
+				lack = append(lack, names[index])
+			}
+		}
+		drift := SchemaDrift{Kind: key.kind, Name: key.name}
+		if 2*len(have) < len(schemas) {
+			drift.Extra = have
+			drifts = append(drifts, drift)
+			continue
+		}
+		drift.Missing = lack
+		drift.Statement = majority(definitions)
+		for index, schema := range schemas {
+			if definition, ok := schema[key]; ok && definition != drift.Statement {
+				drift.Differs = append(drift.Differs, names[index])
+			}
+		}
+		if len(drift.Missing) > 0 || len(drift.Differs) > 0 {
+			drifts = append(drifts, drift)
+		}
+	}
+	return drifts
+}
+
+// majority returns the most common definition, the smallest one on a tie.
+func majority(definitions map[string]int) (best string) {
+	count := 0
+	for definition, n := range definitions {
+		if n > count || (n == count && definition < best) {
+			best, count = definition, n
+		}
+	}
+	return best
+}
+
+type schemaKey struct {
+	kind string
+	name string
+}
+
+// replicaSchema maps the objects of a replica to the statement creating them.
+type replicaSchema map[schemaKey]string
+
+// fetch reads the schema of a replica with the SHOW statements.
+func (s *SchemaChecker) fetch(node Node) (replicaSchema, error) {
+	schema := make(replicaSchema)
+
+	result, err := s.query(node, "SHOW DATABASES", "")
+	if err != nil {
+		return nil, err
+	}
+	var databases []string
+	for _, row := range result.Series {
+		for _, values := range row.Values {
+			database := stringValue(field(row, values, "name"))
+			databases = append(databases, database)
+			schema[schemaKey{schemaDatabase, database}] = (&influxql.CreateDatabaseStatement{Name: database}).String()
+		}
+	}
+
+	for _, database := range databases {
+		result, err := s.query(node, "SHOW RETENTION POLICIES ON "+influxql.QuoteIdent(database), database)
+		if err != nil {
+			return nil, err
+		}
+		for _, row := range result.Series {
+			for _, values := range row.Values {
+				stmt := &influxql.CreateRetentionPolicyStatement{
+					Name:     stringValue(field(row, values, "name")),
+					Database: database,
+				}
+				stmt.Duration, _ = time.ParseDuration(stringValue(field(row, values, "duration")))
+				stmt.ShardGroupDuration, _ = time.ParseDuration(stringValue(field(row, values, "shardGroupDuration")))
+				stmt.Replication = intValue(field(row, values, "replicaN"))
+				stmt.Default, _ = field(row, values, "default").(bool)
+				schema[schemaKey{schemaRetentionPolicy, database + "." + stmt.Name}] = stmt.String()
+			}
+		}
+	}
+
+	result, err = s.query(node, "SHOW USERS", "")
+	if err != nil {
+		return nil, err
+	}
+	var users []string
+	for _, row := range result.Series {
+		for _, values := range row.Values {
+			user := stringValue(field(row, values, "user"))
+			users = append(users, user)
+			schema[schemaKey{schemaUser, user}] = ""
+			if admin, _ := field(row, values, "admin").(bool); admin {
+				schema[schemaKey{schemaGrant, "ALL PRIVILEGES TO " + user}] = (&influxql.GrantAdminStatement{User: user}).String()
+			}
+		}
+	}
+
+	for _, user := range users {
+		result, err := s.query(node, "SHOW GRANTS FOR "+influxql.QuoteIdent(user), "")
+		if err != nil {
+			return nil, err
+		}
+		for _, row := range result.Series {
+			for _, values := range row.Values {
+				privilege, ok := parsePrivilege(stringValue(field(row, values, "privilege")))
+				if !ok {
+					continue
+				}
+				stmt := &influxql.GrantStatement{
+					Privilege: privilege,
+					On:        stringValue(field(row, values, "database")),
+					User:      user,
+				}
+				schema[schemaKey{schemaGrant, privilege.String() + " ON " + stmt.On + " TO " + user}] = stmt.String()
+			}
+		}
+	}
+
+	result, err = s.query(node, "SHOW CONTINUOUS QUERIES", "")
+	if err != nil {
+		return nil, err
+	}
+	for _, row := range result.Series {
+		for _, values := range row.Values {
+			name := stringValue(field(row, values, "name"))
+			schema[schemaKey{schemaContinuousQuery, row.Name + "." + name}] = stringValue(field(row, values, "query"))
+		}
+	}
+	return schema, nil
+}
+
+func (s *SchemaChecker) query(node Node, statement, database string) (*query.Result, error) {
+	q, err := NewQueryRequest(statement, database, "", "")
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := withTimeout(context.Background(), s.timeout)
+	defer cancel()
+	result, err := node.Query(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	if result.Err != nil {
+		return nil, result.Err
+	}
+	return result, nil
+}
+
+// field returns the value of a column, nil when the row lacks it.
+func field(row *models.Row, values []interface{}, name string) interface{} {
+	for index, column := range row.Columns {
+		if column == name && index < len(values) {
+			return values[index]
+		}
+	}
+	return nil
+}
+
+func stringValue(v interface{}) string {
+	if v == nil {
+		return ""
+	}
+	return fmt.Sprint(v)
+}
+
+func intValue(v interface{}) int {
+	switch v := v.(type) {
+	case json.Number:
+		n, _ := v.Int64()
+		return int(n)
+	case float64:
+		return int(v)
+	case int64:
+		return int(v)
+	}
+	return 0
+}
+
+func parsePrivilege(s string) (influxql.Privilege, bool) {
+	for _, p := range []influxql.Privilege{influxql.ReadPrivilege, influxql.WritePrivilege, influxql.AllPrivileges} {
+		if p.String() == s {
+			return p, true
+		}
+	}
+	return influxql.NoPrivileges, false
+}
+
+func indexOf(list []string, s string) int {
+	for index, item := range list {
+		if item == s {
+			return index
+		}
+	}
+	return -1
+}
+
+func contains(list []string, s string) bool {
+	return indexOf(list, s) >= 0
+}
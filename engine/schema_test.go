@@ -0,0 +1,164 @@
+package engine
+
+import (
+	"encoding/json"
+	"gear/config"
+	"github.com/influxdata/influxdb/models"
+	"github.com/influxdata/influxdb/query"
+	"github.com/influxdata/influxql"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// schemaServer answers the SHOW statements of the schema checker from an
+// in-memory schema, which the statements creating databases, users, grants
+// and continuous queries are applied to.
+type schemaServer struct {
+	mu        sync.Mutex
+	databases []string
+	users     [][]interface{}
+	grants    map[string][][]interface{}
+	cqs       []*models.Row
+	applied   []string
+	// raw are the applied statements as received, with their passwords.
+	raw []string
+}
+
+func (s *schemaServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stmt, err := influxql.ParseStatement(r.FormValue("q"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	result := &query.Result{}
+	switch stmt := stmt.(type) {
+	case *influxql.ShowDatabasesStatement:
+		row := &models.Row{Name: "databases", Columns: []string{"name"}}
+		for _, database := range s.databases {
+			row.Values = append(row.Values, []interface{}{database})
+		}
+		result.Series = models.Rows{row}
+	case *influxql.ShowRetentionPoliciesStatement:
+		result.Series = models.Rows{{
+			Columns: []string{"name", "duration", "shardGroupDuration", "replicaN", "default"},
+			Values:  [][]interface{}{{"autogen", "0s", "168h0m0s", 1, true}},
+		}}
+	case *influxql.ShowUsersStatement:
+		result.Series = models.Rows{{Columns: []string{"user", "admin"}, Values: s.users}}
+	case *influxql.ShowGrantsForUserStatement:
+		result.Series = models.Rows{{Columns: []string{"database", "privilege"}, Values: s.grants[stmt.Name]}}
+	case *influxql.ShowContinuousQueriesStatement:
+		result.Series = s.cqs
+	case *influxql.CreateDatabaseStatement:
+		s.databases = append(s.databases, stmt.Name)
+		s.applied = append(s.applied, stmt.String())
+	case *influxql.GrantStatement:
+		s.grants[stmt.User] = append(s.grants[stmt.User], []interface{}{stmt.On, stmt.Privilege.String()})
+		s.applied = append(s.applied, stmt.String())
+	case *influxql.CreateUserStatement:
+		s.users = append(s.users, []interface{}{stmt.Name, stmt.Admin})
+		s.applied = append(s.applied, stmt.String())
+		s.raw = append(s.raw, r.FormValue("q"))
+	case *influxql.CreateContinuousQueryStatement:
+		s.cqs = append(s.cqs, &models.Row{
+			Name:    stmt.Database,
+			Columns: []string{"name", "query"},
+			Values:  [][]interface{}{{stmt.Name, stmt.String()}},
+		})
+		s.applied = append(s.applied, stmt.String())
+	default:
+		s.applied = append(s.applied, stmt.String())
+		s.raw = append(s.raw, r.FormValue("q"))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{"results": []*query.Result{result}})
+}
+
+func TestSchemaChecker_Check(t *testing.T) {
+	a := &schemaServer{
+		databases: []string{"foo", "bar"},
+		users:     [][]interface{}{{"admin", true}, {"bob", false}},
+		grants:    map[string][][]interface{}{"bob": {{"foo", "READ"}}},
+		cqs: []*models.Row{{
+			Name:    "foo",
+			Columns: []string{"name", "query"},
+			Values:  [][]interface{}{{"cq", "CREATE CONTINUOUS QUERY cq ON foo BEGIN SELECT mean(value) INTO cpu_1h FROM cpu GROUP BY time(1h) END"}},
+		}},
+	}
+	b := &schemaServer{
+		databases: []string{"foo"},
+		users:     [][]interface{}{{"admin", true}},
+		grants:    map[string][][]interface{}{},
+	}
+	tsA, tsB := httptest.NewServer(a), httptest.NewServer(b)
+	defer tsA.Close()
+	defer tsB.Close()
+
+	nodeA, err := NewReplicaHTTPNode(config.HTTPReplicaNode{Address: tsA.URL})
+	assert.Nil(t, err)
+	nodeB, err := NewReplicaHTTPNode(config.HTTPReplicaNode{Address: tsB.URL})
+	assert.Nil(t, err)
+	checker, err := NewSchemaChecker(config.SchemaCheck{Timeout: "5s"}, []Node{nodeA, nodeB, nodeA})
+	assert.Nil(t, err)
+	assert.Nil(t, checker.Last())
+
+	report := checker.Check(false)
+	assert.Len(t, report.Replicas, 2)
+	assert.Empty(t, report.Unreachable)
+	var names []string
+	for _, drift := range report.Drift {
+		names = append(names, drift.Kind+" "+drift.Name)
+		assert.Equal(t, []string{nodeKey(nodeB)}, drift.Missing)
+		assert.Empty(t, drift.Applied)
+	}
+	assert.Equal(t, []string{
+		"database bar",
+		"retention_policy bar.autogen",
+		"user bob",
+		"grant READ ON foo TO bob",
+		"continuous_query foo.cq",
+	}, names)
+	assert.Equal(t, "CREATE RETENTION POLICY autogen ON bar DURATION 0s REPLICATION 1 SHARD DURATION 1w DEFAULT", report.Drift[1].Statement)
+	assert.Empty(t, report.Drift[2].Statement)
+	assert.Equal(t, &report, checker.Last())
+
+	report = checker.Check(true)
+	assert.Equal(t, []string{nodeKey(nodeB)}, report.Drift[0].Applied)
+	assert.Empty(t, report.Drift[2].Applied)
+	assert.Equal(t, []string{
+		"CREATE DATABASE bar",
+		"CREATE RETENTION POLICY autogen ON bar DURATION 0s REPLICATION 1 SHARD DURATION 1w DEFAULT",
+		"GRANT READ ON foo TO bob",
+		"CREATE CONTINUOUS QUERY cq ON foo BEGIN SELECT mean(value) INTO cpu_1h FROM cpu GROUP BY time(1h) END",
+	}, b.applied)
+	assert.Empty(t, a.applied)
+}
+
+func TestCompareSchemas_Majority(t *testing.T) {
+	db := func(name string) schemaKey { return schemaKey{schemaDatabase, name} }
+	schemas := []replicaSchema{
+		{db("foo"): "CREATE DATABASE foo"},
+		{db("foo"): "CREATE DATABASE foo"},
+		{db("foo"): "CREATE DATABASE foo", db("dropped"): "CREATE DATABASE dropped"},
+	}
+	drifts := compareSchemas([]string{"a", "b", "c"}, schemas)
+	assert.Len(t, drifts, 1)
+	assert.Equal(t, "dropped", drifts[0].Name)
+	assert.Equal(t, []string{"c"}, drifts[0].Extra)
+	assert.Empty(t, drifts[0].Missing)
+	assert.Empty(t, drifts[0].Statement)
+
+	rp := schemaKey{schemaRetentionPolicy, "foo.autogen"}
+	schemas = []replicaSchema{{rp: "1d"}, {rp: "7d"}, {rp: "1d"}}
+	drifts = compareSchemas([]string{"a", "b", "c"}, schemas)
+	assert.Len(t, drifts, 1)
+	assert.Equal(t, "1d", drifts[0].Statement)
+	assert.Equal(t, []string{"b"}, drifts[0].Differs)
+	assert.True(t, strings.HasPrefix(drifts[0].Kind, "retention"))
+}
@@ -0,0 +1,270 @@
+package engine
+
+import (
+	"context"
+	"encoding/json"
+	. "gear/influx"
+	"github.com/influxdata/influxdb/models"
+	"github.com/influxdata/influxdb/query"
+	"github.com/influxdata/influxql"
+	"sort"
+	"time"
+)
+
+// selectPlan is a SELECT split by the shard nodes owning its sources. Every
+// node gets the statement restricted to the sources it owns.
+type selectPlan struct {
+	nodes   []Node
+	sources []influxql.Sources
+}
+
+func (p *selectPlan) add(node Node, source influxql.Source) {
+	for index := range p.nodes {
+		if p.nodes[index] == node {
+			p.sources[index] = append(p.sources[index], source)
+			return
+		}
+	}
+	p.nodes = append(p.nodes, node)
+	p.sources = append(p.sources, influxql.Sources{source})
+}
+
+// MapSources resolves every source of a SELECT separately: regex sources are
+// expanded with SHOW MEASUREMENTS on every shard, measurements are mapped to
+// their owning shards, and subqueries go wherever their own sources live.
+func (e *HTTPEngine) MapSources(ctx context.Context, database string, stmt *influxql.SelectStatement) (*selectPlan, error) {
+	plan := &selectPlan{}
+	for _, source := range stmt.Sources {
+		switch source := source.(type) {
+		case *influxql.Measurement:
+			db := database
+			if source.Database != "" {
+				db = source.Database
+			}
+			measurements := []*influxql.Measurement{source}
+			if source.Regex != nil {
+				var err error
+				if measurements, err = e.expandRegex(ctx, db, source); err != nil {
+					return nil, err
+				}
+			}
+			for _, m := range measurements {
+				for _, node := range e.MapMeasurement(db, m.Name, stmt.Condition) {
+					plan.add(node, m)
+				}
+			}
+		case *influxql.SubQuery:
+			inner, err := e.MapSources(ctx, database, source.Statement)
+			if err != nil {
+				return nil, err
+			}
+			for _, node := range inner.nodes {
+				plan.add(node, source)
+			}
+		default:
+			for _, node := range e.NodeList() {
+				plan.add(node, source)
+			}
+		}
+	}
+	return plan, nil
+}
+
+// expandRegex lists the measurements matching a regex source on every shard.
+func (e *HTTPEngine) expandRegex(ctx context.Context, database string, source *influxql.Measurement) ([]*influxql.Measurement, error) {
+	show := &influxql.ShowMeasurementsStatement{
+		Database: database,
+		Source:   &influxql.Measurement{Regex: source.Regex},
+	}
+	results, err := e.queryNodes(ctx, e.allNodes(), QueryRequest{
+		Query:    &influxql.Query{Statements: influxql.Statements{show}},
+		Database: database,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	seen := make(map[string]bool)
+	for _, result := range results {
+		if result.Err != nil {
+			return nil, result.Err
+		}
+		for _, row := range result.Series {
+			for _, value := range row.Values {
+				name, ok := value[0].(string)
+				if !ok || seen[name] {
+					continue
+				}
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Strings(names)
+
+	measurements := make([]*influxql.Measurement, 0, len(names))
+	for _, name := range names {
+		measurements = append(measurements, &influxql.Measurement{
+			Database:        source.Database,
+			RetentionPolicy: source.RetentionPolicy,
+			Name:            name,
+		})
+	}
+	return measurements, nil
+}
+
+// queryNodes sends qr to every node in parallel. The results keep the order
+// of nodes.
+func (e HTTPEngine) queryNodes(ctx context.Context, nodes []Node, qr QueryRequest) ([]*query.Result, error) {
+	requests := make([]QueryRequest, len(nodes))
+	for index := range requests {
+		requests[index] = qr
+	}
+	return e.queryEach(ctx, nodes, requests)
+}
+
+// queryEach sends requests[i] to nodes[i] in parallel, on at most
+// query.fan-out-concurrency nodes at once. The first node failing cancels
+// the others.
+func (e HTTPEngine) queryEach(ctx context.Context, nodes []Node, requests []QueryRequest) ([]*query.Result, error) {
+	results := make([]*query.Result, len(nodes))
+	err := fanOut(ctx, nodes, e.config.Query.FanOutConcurrency, func(ctx context.Context, index int, node Node) (err error) {
+		results[index], err = node.Query(ctx, requests[index])
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// mergeSelectResults merges the results of one SELECT sent to several shards.
+// Series are ordered by name and tags like InfluxDB does, and rows of the same
+// series coming from different shards are merged in the time order of stmt.
+// Aggregates are recombined by aggregateMerge instead.
+func mergeSelectResults(results []*query.Result, stmt *influxql.SelectStatement) *query.Result {
+	merged := &query.Result{}
+	index := make(map[string]*models.Row)
+	for _, result := range results {
+		if result == nil {
+			continue
+		}
+		if result.Err != nil {
+			return result
+		}
+		merged.StatementID = result.StatementID
+		merged.Messages = append(merged.Messages, result.Messages...)
+		for _, row := range result.Series {
+			id := seriesID(row)
+			if existing, ok := index[id]; ok {
+				existing.Values = mergeValuesByTime(stmt, existing.Columns, existing.Values, row.Values)
+				continue
+			}
+			copied := *row
+			index[id] = &copied
+			merged.Series = append(merged.Series, &copied)
+		}
+	}
+	sort.SliceStable(merged.Series, func(i, j int) bool {
+		return seriesID(merged.Series[i]) < seriesID(merged.Series[j])
+	})
+	return merged
+}
+
+func seriesID(row *models.Row) string {
+	return row.Name + "\x00" + string(models.NewTags(row.Tags).HashKey())
+}
+
+func mergeValuesByTime(stmt *influxql.SelectStatement, columns []string, a, b [][]interface{}) [][]interface{} {
+	values := append(append([][]interface{}{}, a...), b...)
+	if len(columns) == 0 || columns[0] != stmt.TimeFieldName() {
+		return values
+	}
+	ascending := stmt.TimeAscending()
+	sort.SliceStable(values, func(i, j int) bool {
+		ti, _ := timeValue(values[i][0])
+		tj, _ := timeValue(values[j][0])
+		if ascending {
+			return ti < tj
+		}
+		return ti > tj
+	})
+	return values
+}
+
+// withShardLimits returns stmt as sent to one of several shard nodes. Every
+// shard node returns as many values and series as the merged result may
+// need, OFFSET and SOFFSET being applied once merged by limitSelectResult.
+func withShardLimits(stmt *influxql.SelectStatement) *influxql.SelectStatement {
+	if stmt.Offset == 0 && stmt.SOffset == 0 {
+		return stmt
+	}
+	shardStmt := stmt.Clone()
+	if shardStmt.Limit > 0 {
+		shardStmt.Limit += shardStmt.Offset
+	}
+	if shardStmt.SLimit > 0 {
+		shardStmt.SLimit += shardStmt.SOffset
+	}
+	shardStmt.Offset, shardStmt.SOffset = 0, 0
+	return shardStmt
+}
+
+// limitSelectResult applies the OFFSET, LIMIT, SOFFSET and SLIMIT of stmt to
+// a merged result.
+func limitSelectResult(result *query.Result, stmt *influxql.SelectStatement) *query.Result {
+	if result.Err != nil {
+		return result
+	}
+	start, end := window(len(result.Series), stmt.SOffset, stmt.SLimit)
+	series := result.Series[start:end]
+	result.Series = nil
+	for _, row := range series {
+		start, end := window(len(row.Values), stmt.Offset, stmt.Limit)
+		if start == len(row.Values) && start > 0 {
+			// Like InfluxDB, a series whose values are all skipped is left out.
+			continue
+		}
+		row.Values = row.Values[start:end]
+		result.Series = append(result.Series, row)
+	}
+	return result
+}
+
+// window returns the bounds of the items left of n once offset are skipped
+// and at most limit kept, limit 0 keeping all of them.
+func window(n, offset, limit int) (int, int) {
+	start := offset
+	if start > n {
+		start = n
+	}
+	if limit > 0 && start+limit < n {
+		return start, start + limit
+	}
+	return start, n
+}
+
+// timeValue converts the time column of a row decoded from a backend, which is
+// either an RFC3339 string or an epoch number.
+func timeValue(v interface{}) (int64, bool) {
+	switch v := v.(type) {
+	case string:
+		t, err := time.Parse(time.RFC3339Nano, v)
+		if err != nil {
+			return 0, false
+		}
+		return t.UnixNano(), true
+	case json.Number:
+		n, err := v.Int64()
+		if err != nil {
+			return 0, false
+		}
+		return n, true
+	case int64:
+		return v, true
+	case float64:
+		return int64(v), true
+	}
+	return 0, false
+}
@@ -0,0 +1,102 @@
+package engine
+
+import (
+	"context"
+	"encoding/json"
+	"gear/config"
+	"gear/influx"
+	"github.com/influxdata/influxdb/models"
+	"github.com/influxdata/influxdb/query"
+	"github.com/influxdata/influxql"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// newMeasurementServer answers SHOW MEASUREMENTS with the measurements it
+// owns and a SELECT with one row per source it owns.
+func newMeasurementServer(owns func(string) bool, measurements ...string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q, _ := influxql.ParseStatement(r.FormValue("q"))
+		result := &query.Result{}
+		switch stmt := q.(type) {
+		case *influxql.ShowMeasurementsStatement:
+			row := &models.Row{Name: "measurements", Columns: []string{"name"}}
+			for _, m := range measurements {
+				if owns(m) && stmt.Source.(*influxql.Measurement).Regex.Val.MatchString(m) {
+					row.Values = append(row.Values, []interface{}{m})
+				}
+			}
+			result.Series = models.Rows{row}
+		case *influxql.SelectStatement:
+			for _, source := range stmt.Sources {
+				name := source.(*influxql.Measurement).Name
+				if owns(name) {
+					result.Series = append(result.Series, &models.Row{
+						Name:    name,
+						Columns: []string{"time", "value"},
+						Values:  [][]interface{}{{0, 1}},
+					})
+				}
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(influx.Response{Results: []*query.Result{result}})
+	}))
+}
+
+func newShardedEngine(servers ...*httptest.Server) *HTTPEngine {
+	cfg := config.GearConfig{Shard: config.Shard{Strategy: config.ShardStrategyConsistentHash, VirtualNodes: 16}}
+	for index, server := range servers {
+		cfg.HTTPShardNode = append(cfg.HTTPShardNode, config.HTTPShardNode{
+			Name:            "shard" + string('a'+rune(index)),
+			Weight:          1,
+			HTTPReplicaNode: []config.HTTPReplicaNode{{Address: server.URL}},
+		})
+	}
+	return NewEngine(cfg).(*Cluster).Current()
+}
+
+func TestHTTPEngine_SelectMultipleSources(t *testing.T) {
+	var e *HTTPEngine
+	measurements := []string{"cpu", "mem", "disk_io", "disk_free"}
+	ownedBy := func(shard int) func(string) bool {
+		return func(m string) bool {
+			return e.MapMeasurement("foo", m, nil)[0] == e.NodeList()[shard]
+		}
+	}
+	shardA := newMeasurementServer(ownedBy(0), measurements...)
+	shardB := newMeasurementServer(ownedBy(1), measurements...)
+	defer shardA.Close()
+	defer shardB.Close()
+	e = newShardedEngine(shardA, shardB)
+	assert.NotEqual(t, e.MapMeasurement("foo", "cpu", nil), e.MapMeasurement("foo", "mem", nil))
+
+	qr, _ := influx.NewQueryRequest("SELECT * FROM mem, cpu, /disk.*/", "foo", "", "")
+	resp := e.Query(context.Background(), qr)
+	assert.Nil(t, resp.Error)
+
+	var names []string
+	for _, row := range resp.Results[0].Series {
+		names = append(names, row.Name)
+	}
+	assert.Equal(t, []string{"cpu", "disk_free", "disk_io", "mem"}, names)
+}
+
+func TestMergeSelectResults_Limits(t *testing.T) {
+	stmt := mustParseSelect(t, "SELECT * FROM cpu GROUP BY host ORDER BY time DESC LIMIT 2 OFFSET 1 SLIMIT 1 SOFFSET 1")
+	assert.Equal(t, "SELECT * FROM cpu GROUP BY host ORDER BY time DESC LIMIT 3 SLIMIT 2", withShardLimits(stmt).String())
+
+	a := &query.Result{Series: models.Rows{
+		{Name: "cpu", Tags: map[string]string{"host": "a"}, Columns: []string{"time", "value"}, Values: [][]interface{}{{int64(9), 1}}},
+		{Name: "cpu", Tags: map[string]string{"host": "b"}, Columns: []string{"time", "value"}, Values: [][]interface{}{{int64(5), 1}, {int64(1), 1}}},
+	}}
+	b := &query.Result{Series: models.Rows{
+		{Name: "cpu", Tags: map[string]string{"host": "b"}, Columns: []string{"time", "value"}, Values: [][]interface{}{{int64(4), 2}, {int64(3), 2}, {int64(2), 2}}},
+	}}
+	merged := limitSelectResult(mergeSelectResults([]*query.Result{a, b}, stmt), stmt)
+	assert.Equal(t, 1, len(merged.Series))
+	assert.Equal(t, "b", merged.Series[0].Tags["host"])
+	assert.Equal(t, [][]interface{}{{int64(4), 2}, {int64(3), 2}}, merged.Series[0].Values)
+}
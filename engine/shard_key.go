@@ -0,0 +1,127 @@
+package engine
+
+import (
+	"gear/config"
+	"github.com/influxdata/influxdb/models"
+	"github.com/influxdata/influxql"
+)
+
+// shardKey describes what is hashed to place a point. The zero value hashes
+// the measurement name only.
+type shardKey struct {
+	tags   []string
+	series bool
+}
+
+// byMeasurement reports whether all points of a measurement live on one shard.
+func (k shardKey) byMeasurement() bool {
+	return !k.series && len(k.tags) == 0
+}
+
+func (k shardKey) hashPoint(p models.Point) uint64 {
+	h := models.NewInlineFNV64a()
+	if k.series {
+		h.Write(p.Key())
+		return h.Sum64()
+	}
+	h.Write(p.Name())
+	if len(k.tags) > 0 {
+		tags := p.Tags()
+		for _, tag := range k.tags {
+			h.Write([]byte{','})
+			h.Write([]byte(tag))
+			h.Write([]byte{'='})
+			h.Write(tags.Get([]byte(tag)))
+		}
+	}
+	return h.Sum64()
+}
+
+// hashCondition hashes the shard key of a measurement from the tag values a
+// WHERE clause pins. It returns false when the condition doesn't pin every
+// tag of the key, in which case the query has to go to every shard.
+func (k shardKey) hashCondition(name string, cond influxql.Expr) (uint64, bool) {
+	if k.series {
+		return 0, false
+	}
+	h := models.NewInlineFNV64a()
+	h.Write([]byte(name))
+	if len(k.tags) > 0 {
+		values := tagEqualities(cond)
+		for _, tag := range k.tags {
+			value, ok := values[tag]
+			if !ok {
+				return 0, false
+			}
+			h.Write([]byte{','})
+			h.Write([]byte(tag))
+			h.Write([]byte{'='})
+			h.Write([]byte(value))
+		}
+	}
+	return h.Sum64(), true
+}
+
+// tagEqualities collects the `tag = 'value'` comparisons that must all hold
+// for cond to be true, i.e. the ones only joined by AND.
+func tagEqualities(cond influxql.Expr) map[string]string {
+	values := make(map[string]string)
+	var walk func(expr influxql.Expr)
+	walk = func(expr influxql.Expr) {
+		switch expr := expr.(type) {
+		case *influxql.ParenExpr:
+			walk(expr.Expr)
+		case *influxql.BinaryExpr:
+			switch expr.Op {
+			case influxql.AND:
+				walk(expr.LHS)
+				walk(expr.RHS)
+			case influxql.EQ:
+				ref, lit := expr.LHS, expr.RHS
+				if _, ok := ref.(*influxql.StringLiteral); ok {
+					ref, lit = lit, ref
+				}
+				r, ok := ref.(*influxql.VarRef)
+				if !ok {
+					return
+				}
+				l, ok := lit.(*influxql.StringLiteral)
+				if !ok {
+					return
+				}
+				if _, ok := values[r.Val]; !ok {
+					values[r.Val] = l.Val
+				}
+			}
+		}
+	}
+	walk(cond)
+	return values
+}
+
+// ShardKeys resolves the configured shard key of a database and measurement.
+type ShardKeys struct {
+	keys map[[2]string]shardKey
+}
+
+func NewShardKeys(keys []config.ShardKey) ShardKeys {
+	k := ShardKeys{keys: make(map[[2]string]shardKey)}
+	for _, key := range keys {
+		k.keys[[2]string{key.Database, key.Measurement}] = shardKey{
+			tags:   key.Tags,
+			series: key.Series,
+		}
+	}
+	return k
+}
+
+// lookup returns the most specific key: database and measurement, then
+// measurement only, then database only, then the catch-all entry.
+func (k ShardKeys) lookup(database, measurement string) shardKey {
+	for _, id := range [][2]string{{database, measurement}, {"", measurement}, {database, ""}, {"", ""}} {
+		if key, ok := k.keys[id]; ok {
+			return key
+		}
+	}
+	return shardKey{}
+}
@@ -0,0 +1,59 @@
+package engine
+
+import (
+	"encoding/json"
+	"gear/config"
+	"github.com/influxdata/influxdb/models"
+	"github.com/influxdata/influxdb/query"
+	"github.com/influxdata/influxql"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestShardKey_HashConditionMatchesPoint(t *testing.T) {
+	keys := NewShardKeys([]config.ShardKey{{Database: "telegraf", Measurement: "cpu", Tags: []string{"host"}}})
+	key := keys.lookup("telegraf", "cpu")
+
+	p, _ := models.ParsePointsString("cpu,host=server01,region=us usage=1 1465839830100400200")
+	cond, _ := influxql.ParseExpr("region = 'us' AND host = 'server01' AND time > now() - 1h")
+	sum, ok := key.hashCondition("cpu", cond)
+	assert.True(t, ok)
+	assert.Equal(t, key.hashPoint(p[0]), sum)
+
+	cond, _ = influxql.ParseExpr("host = 'server01' OR host = 'server02'")
+	_, ok = key.hashCondition("cpu", cond)
+	assert.False(t, ok)
+}
+
+func TestShardKey_Lookup(t *testing.T) {
+	keys := NewShardKeys([]config.ShardKey{
+		{Measurement: "cpu", Tags: []string{"host"}},
+		{Database: "telegraf", Series: true},
+	})
+	assert.Equal(t, []string{"host"}, keys.lookup("telegraf", "cpu").tags)
+	assert.True(t, keys.lookup("telegraf", "mem").series)
+	assert.True(t, keys.lookup("other", "mem").byMeasurement())
+
+	p, _ := models.ParsePointsString("mem used=1 1465839830100400200")
+	h := models.NewInlineFNV64a()
+	h.Write([]byte("mem"))
+	assert.Equal(t, h.Sum64(), keys.lookup("other", "mem").hashPoint(p[0]))
+}
+
+func TestMergeSelectResults(t *testing.T) {
+	var a, b query.Result
+	_ = json.Unmarshal([]byte(`{"series":[
+		{"name":"cpu","tags":{"host":"b"},"columns":["time","mean"],"values":[[20,1]]},
+		{"name":"cpu","columns":["time","usage"],"values":[[10,1],[30,3]]}]}`), &a)
+	_ = json.Unmarshal([]byte(`{"series":[
+		{"name":"cpu","tags":{"host":"a"},"columns":["time","mean"],"values":[[20,2]]},
+		{"name":"cpu","columns":["time","usage"],"values":[[20,2]]}]}`), &b)
+
+	merged := mergeSelectResults([]*query.Result{&a, &b}, mustParseSelect(t, "SELECT * FROM cpu"))
+	assert.Equal(t, 3, len(merged.Series))
+	assert.Equal(t, 0, len(merged.Series[0].Tags))
+	assert.Equal(t, 3, len(merged.Series[0].Values))
+	assert.Equal(t, float64(20), merged.Series[0].Values[1][0])
+	assert.Equal(t, "a", merged.Series[1].Tags["host"])
+	assert.Equal(t, "b", merged.Series[2].Tags["host"])
+}
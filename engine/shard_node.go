@@ -1,40 +1,77 @@
 package engine
 
 import (
+	"context"
+	"fmt"
 	"gear/config"
 	. "gear/influx"
+	"github.com/influxdata/influxdb/models"
 	"github.com/influxdata/influxdb/query"
+	log "github.com/sirupsen/logrus"
 	"hash/crc32"
+	"strings"
 	"sync"
+	"time"
 )
 
 
 type ShardHTTPNode struct {
-	id       uint64
-	name     string
-	weight   int
-	nodeMap  map[string]Node
-	nodeNum  int
-	nodeList []Node
-	picker   Picker
+	id          uint64
+	name        string
+	weight      int
+	nodeMap     map[string]Node
+	nodeNum     int
+	nodeList    []Node
+	picker      Picker
+	consistency models.ConsistencyLevel
+
+	maxAttempts    int
+	attemptTimeout time.Duration
 }
 
 func NewShardHTTPNode(node config.HTTPShardNode) *ShardHTTPNode {
+	return newShardHTTPNode(node, NewReplicaHTTPNode)
+}
+
+func newShardHTTPNode(node config.HTTPShardNode, newReplica func(config.HTTPReplicaNode) (Node, error)) *ShardHTTPNode {
 	newShardHTTPNode := &ShardHTTPNode{
-		name:   node.Name,
-		weight: node.Weight,
+		name:        node.Name,
+		weight:      node.Weight,
+		consistency: models.ConsistencyLevelAll,
+		maxAttempts: node.QueryMaxAttempts,
+	}
+	if node.Consistency != "" {
+		consistency, err := models.ParseConsistencyLevel(node.Consistency)
+		if err != nil {
+			panic(fmt.Sprintf("node %s: %s: %s", node.Name, err, node.Consistency))
+		}
+		newShardHTTPNode.consistency = consistency
+	}
+	if node.QueryAttemptTimeout != "" {
+		timeout, err := time.ParseDuration(node.QueryAttemptTimeout)
+		if err != nil {
+			panic(fmt.Sprintf("node %s: error parsing query attempt timeout %v", node.Name, err))
+		}
+		newShardHTTPNode.attemptTimeout = timeout
 	}
 
 	var flagString string
 	for _, instance := range node.HTTPReplicaNode {
-		newInstance, _ := NewReplicaHTTPNode(instance)
+		newInstance, err := newReplica(instance)
+		if err != nil {
+			panic(fmt.Sprintf("node %s: replica %s: %s", node.Name, instance.Address, err))
+		}
 		newShardHTTPNode.nodeList = append(newShardHTTPNode.nodeList, newInstance)
 		flagString += instance.Address
 	}
 	if len(newShardHTTPNode.nodeList) < 1 {
 		panic("node dont't have any replica node.")
 	}
-	newShardHTTPNode.picker = NewRRPicker(newShardHTTPNode.nodeList)
+	picker, err := NewPicker(node.Picker, newShardHTTPNode.nodeList)
+	if err != nil {
+		panic(fmt.Sprintf("node %s: %s", node.Name, err))
+	}
+	newShardHTTPNode.picker = picker
 
 	newShardHTTPNode.id = uint64(crc32.ChecksumIEEE([]byte(flagString)))
 	return newShardHTTPNode
@@ -56,60 +93,237 @@ func (n *ShardHTTPNode) GetInstances() []Node {
 	return n.nodeList
 }
 
-func (n *ShardHTTPNode) Query(q QueryRequest) (result *query.Result, err error) {
-	instance := n.picker.Pick()
-	result, err = instance.Query(q)
+// IsAlive reports whether any replica of the shard is alive.
+func (n *ShardHTTPNode) IsAlive() bool {
+	return len(aliveNodes(n.nodeList)) > 0
+}
+
+// Query runs q on a picked replica. When the replica fails with a transport
+// or server error, the query is tried again on the other alive replicas, up
+// to maxAttempts in total. InfluxQL errors are returned as they are. The
+// attempt running when ctx is done is aborted and no other replica is tried.
+func (n *ShardHTTPNode) Query(ctx context.Context, q QueryRequest) (result *query.Result, err error) {
+	instances := n.failoverOrder(n.picker.Pick())
+	if n.maxAttempts > 0 && n.maxAttempts < len(instances) {
+		instances = instances[:n.maxAttempts]
+	}
+
+	for index, instance := range instances {
+		result, err = n.queryAttempt(ctx, instance, q)
+		if err == nil || !isServerError(err) || ctx.Err() != nil {
+			return result, err
+		}
+		if index < len(instances)-1 {
+			log.Warnf("query failed on replica %s, failing over: %v", nodeKey(instance), err)
+		}
+	}
 
 	return result, err
 }
 
+// QueryChunked streams q from a picked replica. Like Query it fails over to
+// the other alive replicas, as long as no chunk was emitted yet.
+func (n *ShardHTTPNode) QueryChunked(ctx context.Context, q QueryRequest, emit func(*query.Result) error) (err error) {
+	instances := n.failoverOrder(n.picker.Pick())
+	if n.maxAttempts > 0 && n.maxAttempts < len(instances) {
+		instances = instances[:n.maxAttempts]
+	}
+
+	for index, instance := range instances {
+		emitted := false
+		err = n.queryChunkedAttempt(ctx, instance, q, func(result *query.Result) error {
+			emitted = true
+			return emit(result)
+		})
+		if err == nil || emitted || !isServerError(err) || ctx.Err() != nil {
+			return err
+		}
+		if index < len(instances)-1 {
+			log.Warnf("chunked query failed on replica %s, failing over: %v", nodeKey(instance), err)
+		}
+	}
+	return err
+}
+
+// queryChunkedAttempt bounds the wait for the first chunk by the attempt
+// timeout, a stream that started may take as long as it needs.
+func (n *ShardHTTPNode) queryChunkedAttempt(ctx context.Context, instance Node, q QueryRequest, emit func(*query.Result) error) error {
+	if n.attemptTimeout <= 0 {
+		return instance.QueryChunked(ctx, q, emit)
+	}
+	attemptCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	timer := time.AfterFunc(n.attemptTimeout, cancel)
+	err := instance.QueryChunked(attemptCtx, q, func(result *query.Result) error {
+		timer.Stop()
+		return emit(result)
+	})
+	if err != nil && attemptCtx.Err() != nil && ctx.Err() == nil {
+		// The attempt timed out, which another replica may not.
+		err = context.DeadlineExceeded
+	}
+	return err
+}
+
+// failoverOrder returns first followed by the other alive replicas.
+func (n *ShardHTTPNode) failoverOrder(first Node) []Node {
+	instances := []Node{first}
+	for _, instance := range aliveNodes(n.nodeList) {
+		if instance != first {
+			instances = append(instances, instance)
+		}
+	}
+	return instances
+}
+
+func (n *ShardHTTPNode) queryAttempt(ctx context.Context, instance Node, q QueryRequest) (*query.Result, error) {
+	if n.attemptTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, n.attemptTimeout)
+		defer cancel()
+	}
+	return instance.Query(ctx, q)
+}
+
 // QueryEachInstance is usually used by statements such as Create, Drop,etc
-// So It only needs to run sequentially
-func (n *ShardHTTPNode) QueryEachInstance(q QueryRequest) (result *query.Result, err error) {
+// So It only needs to run sequentially. It goes on with the other replicas
+// when one fails, replicas that are down get the statement handed off if
+// they can apply it later, as do the replicas still applying statements
+// handed off before, so that they are applied in order. How it went on
+// every replica is reported in the messages of the result. Once ctx is done,
+// the statement isn't handed off nor sent to the replicas left.
+func (n *ShardHTTPNode) QueryEachInstance(ctx context.Context, q QueryRequest) (result *query.Result, err error) {
+	var messages []*query.Message
+	var failed []string
 	for _, instance := range n.nodeList {
-		instance := instance
-		result, err = instance.Query(q)
-		if err != nil {
-			return
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
 		}
-		if result.Err != nil {
-			return
+		var instanceResult *query.Result
+		var instanceErr error
+		target, canHandOff := instance.(handoffTarget)
+		if canHandOff && target.handingOff() {
+			// Running it now would let it overtake the statements
+			// handed off before it.
+			instanceErr = errHandoffPending
+		} else {
+			instanceResult, instanceErr = instance.Query(ctx, q)
+		}
+		handedOff := false
+		if canHandOff && (instanceErr == errHandoffPending || instanceErr != nil && isServerError(instanceErr) && ctx.Err() == nil) {
+			if hErr := target.HandOff(q); hErr == nil {
+				handedOff = true
+			} else {
+				log.Errorf("replica %s: handing off %q: %v", nodeKey(instance), q.Query.String(), hErr)
+			}
+		}
+		statementErr := instanceErr
+		if instanceErr == nil && instanceResult.Err != nil {
+			statementErr = instanceResult.Err
+		}
+
+		outcome := replicaOutcome(nodeKey(instance), statementErr, handedOff)
+		level := "info"
+		if statementErr != nil {
+			level = "warning"
+		}
+		messages = append(messages, &query.Message{Level: level, Text: outcome})
+
+		switch {
+		case instanceErr == nil:
+			// A statement that fails likely does on every replica, its
+			// error is the one reported.
+			if result == nil || (result.Err == nil && instanceResult.Err != nil) {
+				result = instanceResult
+			}
+		case handedOff:
+		default:
+			if err == nil {
+				err = instanceErr
+			}
+			failed = append(failed, outcome)
 		}
 	}
 
-	return
+	if err != nil {
+		if len(n.nodeList) > 1 {
+			err = fmt.Errorf("%v (%s)", err, strings.Join(failed, "; "))
+		}
+		return nil, err
+	}
+	if result == nil {
+		result = &query.Result{}
+	}
+	result.Messages = append(result.Messages, messages...)
+	return result, nil
 }
 
-func (n *ShardHTTPNode) WritePoints(wr WriteRequest) error {
-	var wg sync.WaitGroup
-	wg.Add(len(n.nodeList))
+// WritePoints writes to every replica and returns as soon as enough of them
+// acknowledged the write for the consistency level of the request, or of the
+// node when the request doesn't set one. Writes buffered by a retry replica
+// count as acknowledged, so "any" and "one" both need a single ack. The
+// replicas still writing then go on until the deadline of ctx.
+func (n *ShardHTTPNode) WritePoints(ctx context.Context, wr WriteRequest) error {
+	level := n.consistency
+	if wr.Consistency != "" {
+		l, err := models.ParseConsistencyLevel(wr.Consistency)
+		if err != nil {
+			return err
+		}
+		level = l
+	}
+	required := requiredAcks(level, len(n.nodeList))
 
+	writeCtx, release, cancel := detach(ctx)
+	defer release()
+	// buffered so that replicas finishing after we returned don't block
 	var responses = make(chan error, len(n.nodeList))
+	var wg sync.WaitGroup
+	wg.Add(len(n.nodeList))
 	for _, instance := range n.nodeList {
 		instance := instance
 		go func() {
 			defer wg.Done()
-			err := instance.WritePoints(wr)
-			responses <- err
+			responses <- instance.WritePoints(writeCtx, wr)
 		}()
 	}
-
 	go func() {
 		wg.Wait()
-		close(responses)
+		cancel()
 	}()
 
+	var acked, failed int
 	var writeError error
-	for resp := range responses {
-		// write consistency handler
-		if resp != nil {
-			writeError = resp
+	for range n.nodeList {
+		resp := <-responses
+		if resp == nil {
+			acked++
+			if acked >= required {
+				return nil
+			}
+			continue
+		}
+		failed++
+		writeError = resp
+		if len(n.nodeList)-failed < required {
+			return writeError
 		}
 	}
 
 	return writeError
 }
 
+func requiredAcks(level models.ConsistencyLevel, replicas int) int {
+	switch level {
+	case models.ConsistencyLevelAny, models.ConsistencyLevelOne:
+		return 1
+	case models.ConsistencyLevelQuorum:
+		return replicas/2 + 1
+	default:
+		return replicas
+	}
+}
+
 func (n *ShardHTTPNode) Ping() (err error) {
 	for _, instance := range n.nodeList {
 		err = instance.Ping()
@@ -1,6 +1,7 @@
 package engine
 
 import (
+	"context"
 	"encoding/json"
 	"gear/config"
 	"gear/influx"
@@ -8,7 +9,9 @@ import (
 	"github.com/stretchr/testify/assert"
 	"net/http"
 	"net/http/httptest"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 var (
@@ -70,7 +73,7 @@ func TestHTTPNode_Query(t *testing.T) {
 		"ms",
 		"false")
 
-	result, err := node.Query(selectQuery)
+	result, err := node.Query(context.Background(), selectQuery)
 	assert.Nil(t, err)
 	assert.Equal(t, result.Series[0].Name, "bar")
 	assert.Equal(t, len(result.Series[0].Columns), 2)
@@ -88,7 +91,7 @@ func TestHTTPNode_QueryEachNodeError(t *testing.T) {
 		"ms",
 		"false")
 
-	_, err := node.QueryEachInstance(selectQuery)
+	_, err := node.QueryEachInstance(context.Background(), selectQuery)
 	assert.NotNil(t, err)
 }
 
@@ -104,7 +107,7 @@ func TestHTTPNode_QueryEachNode(t *testing.T) {
 		"ms",
 		"false")
 
-	_, err := node.QueryEachInstance(selectQuery)
+	_, err := node.QueryEachInstance(context.Background(), selectQuery)
 	assert.Nil(t, err)
 }
 
@@ -120,7 +123,7 @@ func TestHTTPNode_QueryEachInstanceError(t *testing.T) {
 		"ms",
 		"false")
 
-	_, err := node.Query(selectQuery)
+	_, err := node.Query(context.Background(), selectQuery)
 	assert.NotNil(t, err)
 }
 
@@ -136,7 +139,7 @@ func TestHTTPNode_WritePoints(t *testing.T) {
 		"ms",
 		"")
 
-	err := node.WritePoints(writeRequest)
+	err := node.WritePoints(context.Background(), writeRequest)
 	assert.Nil(t, err)
 }
 
@@ -152,7 +155,7 @@ func TestHTTPNode_WritePointsOneNodeError(t *testing.T) {
 		"ms",
 		"")
 
-	err := node.WritePoints(writeRequest)
+	err := node.WritePoints(context.Background(), writeRequest)
 	assert.NotNil(t, err)
 }
 
@@ -168,3 +171,113 @@ func TestHTTPNode_PickInstance(t *testing.T) {
 	instanceB = node.picker.Pick()
 	assert.Equal(t, instanceA, instanceB)
 }
+
+func TestHTTPNode_WritePointsConsistency(t *testing.T) {
+	httpInstanceA := config.HTTPReplicaNode{Address: writeOKServer.URL}
+	httpInstanceB := config.HTTPReplicaNode{Address: writeOKServer.URL}
+	httpInstanceC := config.HTTPReplicaNode{Address: writeErrorServer.URL}
+	httpNodeConfig := config.HTTPShardNode{
+		HTTPReplicaNode: []config.HTTPReplicaNode{httpInstanceA, httpInstanceB, httpInstanceC},
+		Consistency:     "quorum",
+	}
+	node := NewShardHTTPNode(httpNodeConfig)
+
+	writeRequest, _ := influx.NewWriteRequest(
+		[]byte("weather,location=us-midwest temperature=82 1465839830100400200"),
+		"foo",
+		"ms",
+		"")
+
+	assert.Nil(t, node.WritePoints(context.Background(), writeRequest))
+
+	writeRequest.Consistency = "all"
+	assert.NotNil(t, node.WritePoints(context.Background(), writeRequest))
+
+	writeRequest.Consistency = "one"
+	assert.Nil(t, node.WritePoints(context.Background(), writeRequest))
+
+	writeRequest.Consistency = "some"
+	assert.NotNil(t, node.WritePoints(context.Background(), writeRequest))
+}
+
+func TestHTTPNode_QueryFailover(t *testing.T) {
+	httpInstanceA := config.HTTPReplicaNode{Address: queryErrorServer.URL}
+	httpInstanceB := config.HTTPReplicaNode{Address: queryOKServer.URL}
+	httpNodeConfig := config.HTTPShardNode{HTTPReplicaNode: []config.HTTPReplicaNode{httpInstanceA, httpInstanceB}}
+	node := NewShardHTTPNode(httpNodeConfig)
+
+	selectQuery, _ := influx.NewQueryRequest(
+		"select * from bar",
+		"foo",
+		"ms",
+		"false")
+
+	for i := 0; i < 2; i++ {
+		result, err := node.Query(context.Background(), selectQuery)
+		assert.Nil(t, err)
+		assert.Equal(t, result.Series[0].Name, "bar")
+	}
+
+	httpNodeConfig.QueryMaxAttempts = 1
+	node = NewShardHTTPNode(httpNodeConfig)
+	_, err := node.Query(context.Background(), selectQuery)
+	assert.NotNil(t, err)
+}
+
+func TestHTTPNode_QueryNoFailoverOnQueryError(t *testing.T) {
+	var queried int32
+	badQueryServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/query" {
+			atomic.AddInt32(&queried, 1)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("{\"error\": \"error parsing query\"}"))
+	}))
+	defer badQueryServer.Close()
+
+	httpInstanceA := config.HTTPReplicaNode{Address: badQueryServer.URL}
+	httpInstanceB := config.HTTPReplicaNode{Address: badQueryServer.URL}
+	httpNodeConfig := config.HTTPShardNode{HTTPReplicaNode: []config.HTTPReplicaNode{httpInstanceA, httpInstanceB}}
+	node := NewShardHTTPNode(httpNodeConfig)
+
+	selectQuery, _ := influx.NewQueryRequest(
+		"select * from bar",
+		"foo",
+		"ms",
+		"false")
+
+	_, err := node.Query(context.Background(), selectQuery)
+	assert.Equal(t, "error parsing query", err.Error())
+	assert.Equal(t, int32(1), atomic.LoadInt32(&queried))
+}
+
+func TestHTTPNode_QueryAttemptTimeout(t *testing.T) {
+	slowServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(300 * time.Millisecond):
+		}
+	}))
+	defer slowServer.Close()
+
+	httpInstanceA := config.HTTPReplicaNode{Address: slowServer.URL}
+	httpInstanceB := config.HTTPReplicaNode{Address: queryOKServer.URL}
+	httpNodeConfig := config.HTTPShardNode{
+		HTTPReplicaNode:     []config.HTTPReplicaNode{httpInstanceA, httpInstanceB},
+		QueryAttemptTimeout: "20ms",
+	}
+	node := NewShardHTTPNode(httpNodeConfig)
+
+	selectQuery, _ := influx.NewQueryRequest(
+		"select * from bar",
+		"foo",
+		"ms",
+		"false")
+
+	start := time.Now()
+	result, err := node.Query(context.Background(), selectQuery)
+	assert.Nil(t, err)
+	assert.Equal(t, result.Series[0].Name, "bar")
+	assert.True(t, time.Since(start) < 250*time.Millisecond)
+}
@@ -0,0 +1,602 @@
+package engine
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	. "gear/influx"
+	"github.com/influxdata/influxdb/models"
+	"github.com/influxdata/influxdb/query"
+	"github.com/influxdata/influxql"
+	"regexp"
+	"sort"
+)
+
+// executeStatementMappedSources runs a SHOW statement restricted by sources
+// and cond on the shard nodes that may hold those sources, every shard node
+// when there are none, and merges their results with merge. LIMIT, OFFSET,
+// SLIMIT and SOFFSET apply to the merged rows.
+func (e HTTPEngine) executeStatementMappedSources(ctx context.Context, qr QueryRequest, sources influxql.Sources, cond influxql.Expr, merge func([]*query.Result) *query.Result) (*query.Result, error) {
+	stmt, page := paginate(qr.Query.Statements[0])
+	nodes := e.allNodes()
+	statements := make([]influxql.Statement, len(nodes))
+	for index := range statements {
+		statements[index] = stmt
+	}
+	if len(sources) > 0 {
+		plan, err := e.MapSources(ctx, qr.Database, &influxql.SelectStatement{Sources: sources, Condition: cond})
+		if err != nil {
+			return nil, err
+		}
+		nodes = plan.nodes
+		statements = make([]influxql.Statement, len(nodes))
+		for index := range plan.nodes {
+			statements[index] = withSources(stmt, plan.sources[index])
+		}
+	}
+
+	switch len(nodes) {
+	case 0:
+		return &query.Result{}, nil
+	case 1:
+		// The shard node has every row, it paginates them itself.
+		qr.Query = &influxql.Query{Statements: influxql.Statements{withSources(qr.Query.Statements[0], sourcesOf(statements[0]))}}
+		return nodes[0].Query(ctx, qr)
+	}
+	requests := make([]QueryRequest, len(nodes))
+	for index := range nodes {
+		requests[index] = qr
+		requests[index].Query = &influxql.Query{Statements: influxql.Statements{statements[index]}}
+	}
+	results, err := e.queryEach(ctx, nodes, requests)
+	if err != nil {
+		return nil, err
+	}
+	return page.apply(merge(results)), nil
+}
+
+// allMeasurements is the source standing for every measurement.
+var allMeasurements = influxql.Sources{&influxql.Measurement{Regex: &influxql.RegexLiteral{Val: regexp.MustCompile(`.*`)}}}
+
+// executeCardinalityStatement runs a cardinality statement on the shard
+// nodes that may hold its sources. Series live on a single shard node, their
+// counts add up. A measurement, tag key, tag value or field key may be on
+// several shard nodes, when a tag or series shard key spreads a measurement
+// or during a migration, so they are listed by every shard node and counted
+// once merged.
+func (e HTTPEngine) executeCardinalityStatement(ctx context.Context, qr QueryRequest) (*query.Result, error) {
+	var show influxql.Statement
+	var sources influxql.Sources
+	var cond influxql.Expr
+	// columns is the number of columns telling listed values apart.
+	columns := 1
+	switch stmt := qr.Query.Statements[0].(type) {
+	case *influxql.ShowSeriesCardinalityStatement:
+		return e.executeSeriesCardinalityStatement(ctx, qr, stmt)
+	case *influxql.ShowMeasurementCardinalityStatement:
+		return e.executeMeasurementCardinalityStatement(ctx, qr, stmt)
+	case *influxql.ShowTagKeyCardinalityStatement:
+		show = &influxql.ShowTagKeysStatement{Database: stmt.Database, Sources: stmt.Sources, Condition: stmt.Condition}
+		sources, cond = stmt.Sources, stmt.Condition
+	case *influxql.ShowTagValuesCardinalityStatement:
+		show = &influxql.ShowTagValuesStatement{Database: stmt.Database, Sources: stmt.Sources, Op: stmt.Op, TagKeyExpr: stmt.TagKeyExpr, Condition: stmt.Condition}
+		sources, cond, columns = stmt.Sources, stmt.Condition, 2
+	case *influxql.ShowFieldKeyCardinalityStatement:
+		show = &influxql.ShowFieldKeysStatement{Database: stmt.Database, Sources: stmt.Sources}
+		sources = stmt.Sources
+	}
+	qr.Query = &influxql.Query{Statements: influxql.Statements{show}}
+	result, err := e.executeStatementMappedSources(ctx, qr, sources, cond, mergeShowResults)
+	if err != nil {
+		return nil, err
+	}
+	return countValues(result, columns), nil
+}
+
+// executeSeriesCardinalityStatement sums the series cardinalities of the
+// shard nodes. During a migration a measurement is on its previous and
+// current shard nodes until dropped, so without sources every measurement
+// is counted on the shard nodes it is read from only.
+func (e HTTPEngine) executeSeriesCardinalityStatement(ctx context.Context, qr QueryRequest, stmt *influxql.ShowSeriesCardinalityStatement) (*query.Result, error) {
+	sources := stmt.Sources
+	if len(sources) == 0 && e.migration != nil {
+		sources = allMeasurements
+		if stmt.Database != "" {
+			qr.Database = stmt.Database
+		}
+	}
+	return e.executeStatementMappedSources(ctx, qr, sources, stmt.Condition, mergeCardinalityResults)
+}
+
+// executeMeasurementCardinalityStatement counts the measurements every shard
+// node lists with SHOW MEASUREMENTS, once per source.
+func (e HTTPEngine) executeMeasurementCardinalityStatement(ctx context.Context, qr QueryRequest, stmt *influxql.ShowMeasurementCardinalityStatement) (*query.Result, error) {
+	shows := []*influxql.ShowMeasurementsStatement{{Database: stmt.Database, Condition: stmt.Condition}}
+	if len(stmt.Sources) > 0 {
+		shows = nil
+		for _, source := range stmt.Sources {
+			shows = append(shows, &influxql.ShowMeasurementsStatement{Database: stmt.Database, Source: source, Condition: stmt.Condition})
+		}
+	}
+	names := make(map[string]bool)
+	merged := &query.Result{}
+	for _, show := range shows {
+		showQr := qr
+		showQr.Query = &influxql.Query{Statements: influxql.Statements{show}}
+		results, err := e.queryNodes(ctx, e.allNodes(), showQr)
+		if err != nil {
+			return nil, err
+		}
+		result := mergeShowResults(results)
+		if result.Err != nil {
+			return result, nil
+		}
+		merged.StatementID = result.StatementID
+		merged.Messages = append(merged.Messages, result.Messages...)
+		for _, row := range result.Series {
+			for _, values := range row.Values {
+				if len(values) > 0 {
+					names[fmt.Sprint(values[0])] = true
+				}
+			}
+		}
+	}
+	merged.Series = models.Rows{{Columns: []string{"count"}, Values: [][]interface{}{{int64(len(names))}}}}
+	return merged, nil
+}
+
+// countValues turns the rows of a SHOW statement into the number of values
+// of every row, the first columns of the values telling them apart.
+func countValues(result *query.Result, columns int) *query.Result {
+	if result.Err != nil {
+		return result
+	}
+	counted := &query.Result{StatementID: result.StatementID, Messages: result.Messages}
+	for _, row := range result.Series {
+		distinct := make(map[string]bool)
+		for _, values := range row.Values {
+			if len(values) > columns {
+				values = values[:columns]
+			}
+			distinct[fmt.Sprintf("%q", values)] = true
+		}
+		counted.Series = append(counted.Series, &models.Row{
+			Name:    row.Name,
+			Tags:    row.Tags,
+			Columns: []string{"count"},
+			Values:  [][]interface{}{{int64(len(distinct))}},
+		})
+	}
+	return counted
+}
+
+// withSources returns a copy of a SHOW statement restricted to sources,
+// unless sources is nil.
+func withSources(stmt influxql.Statement, sources influxql.Sources) influxql.Statement {
+	if sources == nil {
+		return stmt
+	}
+	switch stmt := stmt.(type) {
+	case *influxql.ShowSeriesStatement:
+		copied := *stmt
+		copied.Sources = sources
+		return &copied
+	case *influxql.ShowFieldKeysStatement:
+		copied := *stmt
+		copied.Sources = sources
+		return &copied
+	case *influxql.ShowTagKeysStatement:
+		copied := *stmt
+		copied.Sources = sources
+		return &copied
+	case *influxql.ShowTagValuesStatement:
+		copied := *stmt
+		copied.Sources = sources
+		return &copied
+	case *influxql.ShowSeriesCardinalityStatement:
+		copied := *stmt
+		copied.Sources = sources
+		return &copied
+	case *influxql.ShowMeasurementCardinalityStatement:
+		copied := *stmt
+		copied.Sources = sources
+		return &copied
+	case *influxql.ShowTagKeyCardinalityStatement:
+		copied := *stmt
+		copied.Sources = sources
+		return &copied
+	case *influxql.ShowTagValuesCardinalityStatement:
+		copied := *stmt
+		copied.Sources = sources
+		return &copied
+	case *influxql.ShowFieldKeyCardinalityStatement:
+		copied := *stmt
+		copied.Sources = sources
+		return &copied
+	}
+	return stmt
+}
+
+// sourcesOf returns the sources of a SHOW statement, nil if it has none.
+func sourcesOf(stmt influxql.Statement) influxql.Sources {
+	switch stmt := stmt.(type) {
+	case *influxql.ShowSeriesStatement:
+		return stmt.Sources
+	case *influxql.ShowFieldKeysStatement:
+		return stmt.Sources
+	case *influxql.ShowTagKeysStatement:
+		return stmt.Sources
+	case *influxql.ShowTagValuesStatement:
+		return stmt.Sources
+	case *influxql.ShowSeriesCardinalityStatement:
+		return stmt.Sources
+	case *influxql.ShowMeasurementCardinalityStatement:
+		return stmt.Sources
+	case *influxql.ShowTagKeyCardinalityStatement:
+		return stmt.Sources
+	case *influxql.ShowTagValuesCardinalityStatement:
+		return stmt.Sources
+	case *influxql.ShowFieldKeyCardinalityStatement:
+		return stmt.Sources
+	}
+	return nil
+}
+
+// page is the LIMIT and OFFSET of a SHOW statement, which apply to the
+// values of every row, and its SLIMIT and SOFFSET, which apply to the rows.
+type page struct {
+	limit, offset   int
+	slimit, soffset int
+}
+
+// paginate returns the statement to send to every shard node, which asks
+// for every value up to the end of the page, and the page to apply to the
+// merged result.
+func paginate(stmt influxql.Statement) (influxql.Statement, page) {
+	switch stmt := stmt.(type) {
+	case *influxql.ShowMeasurementsStatement:
+		copied := *stmt
+		p := page{limit: stmt.Limit, offset: stmt.Offset}
+		copied.Limit, copied.Offset = p.end(), 0
+		return &copied, p
+	case *influxql.ShowSeriesStatement:
+		copied := *stmt
+		p := page{limit: stmt.Limit, offset: stmt.Offset}
+		copied.Limit, copied.Offset = p.end(), 0
+		return &copied, p
+	case *influxql.ShowTagKeysStatement:
+		copied := *stmt
+		p := page{limit: stmt.Limit, offset: stmt.Offset, slimit: stmt.SLimit, soffset: stmt.SOffset}
+		copied.Limit, copied.Offset = p.end(), 0
+		copied.SLimit, copied.SOffset = p.send(), 0
+		return &copied, p
+	case *influxql.ShowTagValuesStatement:
+		copied := *stmt
+		p := page{limit: stmt.Limit, offset: stmt.Offset}
+		copied.Limit, copied.Offset = p.end(), 0
+		return &copied, p
+	case *influxql.ShowFieldKeysStatement:
+		copied := *stmt
+		p := page{limit: stmt.Limit, offset: stmt.Offset}
+		copied.Limit, copied.Offset = p.end(), 0
+		return &copied, p
+	}
+	return stmt, page{}
+}
+
+// end is the LIMIT a shard node is sent, 0 for no limit.
+func (p page) end() int {
+	if p.limit == 0 {
+		return 0
+	}
+	return p.limit + p.offset
+}
+
+// send is the SLIMIT a shard node is sent, 0 for no limit.
+func (p page) send() int {
+	if p.slimit == 0 {
+		return 0
+	}
+	return p.slimit + p.soffset
+}
+
+// apply keeps the rows and values of result in the page. Rows left without
+// values are removed.
+func (p page) apply(result *query.Result) *query.Result {
+	if result.Err != nil || p == (page{}) {
+		return result
+	}
+	var rows models.Rows
+	first, last := bounds(len(result.Series), p.soffset, p.slimit)
+	for _, row := range result.Series[first:last] {
+		start, end := bounds(len(row.Values), p.offset, p.limit)
+		row.Values = row.Values[start:end]
+		if len(row.Values) > 0 {
+			rows = append(rows, row)
+		}
+	}
+	result.Series = rows
+	return result
+}
+
+// bounds returns the range of n items left by offset and limit.
+func bounds(n, offset, limit int) (start, end int) {
+	if offset > n {
+		offset = n
+	}
+	end = n
+	if limit > 0 && offset+limit < n {
+		end = offset + limit
+	}
+	return offset, end
+}
+
+// mergeShowResults merges the results of one SHOW statement sent to several
+// shards: rows of the same measurement and tags are merged, without the
+// values several shards returned. Rows and their values are sorted like
+// InfluxDB does.
+func mergeShowResults(results []*query.Result) *query.Result {
+	merged := &query.Result{}
+	index := make(map[string]*models.Row)
+	seen := make(map[string]map[string]bool)
+	for _, result := range results {
+		if result == nil {
+			continue
+		}
+		if result.Err != nil {
+			return result
+		}
+		merged.StatementID = result.StatementID
+		merged.Messages = append(merged.Messages, result.Messages...)
+		for _, row := range result.Series {
+			id := seriesID(row)
+			existing, ok := index[id]
+			if !ok {
+				existing = &models.Row{Name: row.Name, Tags: row.Tags, Columns: row.Columns}
+				index[id] = existing
+				seen[id] = make(map[string]bool)
+				merged.Series = append(merged.Series, existing)
+			}
+			for _, values := range row.Values {
+				key := fmt.Sprintf("%q", values)
+				if !seen[id][key] {
+					seen[id][key] = true
+					existing.Values = append(existing.Values, values)
+				}
+			}
+		}
+	}
+	for _, row := range merged.Series {
+		sort.SliceStable(row.Values, func(i, j int) bool {
+			return lessValues(row.Values[i], row.Values[j])
+		})
+	}
+	sort.SliceStable(merged.Series, func(i, j int) bool {
+		return seriesID(merged.Series[i]) < seriesID(merged.Series[j])
+	})
+	return merged
+}
+
+// lessValues compares two rows of values column by column.
+func lessValues(a, b []interface{}) bool {
+	for index := 0; index < len(a) && index < len(b); index++ {
+		if x, y := fmt.Sprint(a[index]), fmt.Sprint(b[index]); x != y {
+			return x < y
+		}
+	}
+	return len(a) < len(b)
+}
+
+// mergeCardinalityResults merges the series cardinalities of several shards
+// by summing the counts of the same row: a series lives on a single shard.
+func mergeCardinalityResults(results []*query.Result) *query.Result {
+	merged := &query.Result{}
+	index := make(map[string]*models.Row)
+	for _, result := range results {
+		if result == nil {
+			continue
+		}
+		if result.Err != nil {
+			return result
+		}
+		merged.StatementID = result.StatementID
+		merged.Messages = append(merged.Messages, result.Messages...)
+		for _, row := range result.Series {
+			id := seriesID(row)
+			existing, ok := index[id]
+			if !ok {
+				copied := *row
+				copied.Values = make([][]interface{}, len(row.Values))
+				for i, values := range row.Values {
+					copied.Values[i] = append([]interface{}(nil), values...)
+				}
+				index[id] = &copied
+				merged.Series = append(merged.Series, &copied)
+				continue
+			}
+			for i, values := range row.Values {
+				if i >= len(existing.Values) {
+					existing.Values = append(existing.Values, values)
+					continue
+				}
+				for column, value := range values {
+					if column < len(existing.Values[i]) {
+						existing.Values[i][column] = addCounts(existing.Values[i][column], value)
+					}
+				}
+			}
+		}
+	}
+	sort.SliceStable(merged.Series, func(i, j int) bool {
+		return seriesID(merged.Series[i]) < seriesID(merged.Series[j])
+	})
+	return merged
+}
+
+// addCounts adds two counts decoded from backends, a keeping its value when
+// either isn't a number.
+func addCounts(a, b interface{}) interface{} {
+	x, ok := countValue(a)
+	if !ok {
+		return a
+	}
+	y, ok := countValue(b)
+	if !ok {
+		return a
+	}
+	return x + y
+}
+
+func countValue(v interface{}) (int64, bool) {
+	switch v := v.(type) {
+	case float64:
+		return int64(v), true
+	case int64:
+		return v, true
+	case json.Number:
+		n, err := v.Int64()
+		return n, err == nil
+	}
+	return 0, false
+}
+
+// executeExplainStatement explains the SELECT on every shard node it would
+// be sent to. The plans of several shard nodes follow each other, each one
+// after a line naming its shard node.
+func (e HTTPEngine) executeExplainStatement(ctx context.Context, qr QueryRequest) (*query.Result, error) {
+	stmt := qr.Query.Statements[0].(*influxql.ExplainStatement)
+	if !e.sharding {
+		return e.NodeList()[0].Query(ctx, qr)
+	}
+	plan, err := e.MapSources(ctx, qr.Database, stmt.Statement)
+	if err != nil {
+		return nil, err
+	}
+	if len(plan.nodes) == 0 {
+		return &query.Result{}, nil
+	}
+	requests := make([]QueryRequest, len(plan.nodes))
+	for index := range plan.nodes {
+		shardStmt := stmt.Statement.Clone()
+		shardStmt.Sources = plan.sources[index]
+		requests[index] = qr
+		requests[index].Query = &influxql.Query{Statements: influxql.Statements{
+			&influxql.ExplainStatement{Statement: shardStmt, Analyze: stmt.Analyze},
+		}}
+	}
+	if len(plan.nodes) == 1 {
+		return plan.nodes[0].Query(ctx, requests[0])
+	}
+
+	results, err := e.queryEach(ctx, plan.nodes, requests)
+	if err != nil {
+		return nil, err
+	}
+	merged := &query.Result{}
+	for index, result := range results {
+		if result.Err != nil {
+			return result, nil
+		}
+		merged.StatementID = result.StatementID
+		for _, row := range result.Series {
+			if len(merged.Series) == 0 {
+				merged.Series = models.Rows{{Name: row.Name, Columns: row.Columns}}
+			}
+			merged.Series[0].Values = append(merged.Series[0].Values, []interface{}{"shard " + nodeKey(plan.nodes[index]) + ":"})
+			merged.Series[0].Values = append(merged.Series[0].Values, row.Values...)
+		}
+	}
+	return merged, nil
+}
+
+// allReplicas returns the replica nodes of every shard node, once each
+// even when several shard nodes share one.
+func (e HTTPEngine) allReplicas() []Node {
+	var replicas []Node
+	seen := make(map[string]bool)
+	for _, node := range e.allNodes() {
+		for _, replica := range node.(*ShardHTTPNode).GetInstances() {
+			if key := nodeKey(replica); !seen[key] {
+				seen[key] = true
+				replicas = append(replicas, replica)
+			}
+		}
+	}
+	return replicas
+}
+
+// executeShowQueriesStatement lists the queries running on every replica
+// node, with the query ID the replica gave them and the replica in the host
+// column, which KILL QUERY <qid> ON "host:port" takes. Replicas that don't
+// answer are reported in a warning.
+func (e HTTPEngine) executeShowQueriesStatement(ctx context.Context, qr QueryRequest) (*query.Result, error) {
+	replicas := e.allReplicas()
+	results := make([]*query.Result, len(replicas))
+	errs := make([]error, len(replicas))
+	_ = fanOut(ctx, replicas, e.config.Query.FanOutConcurrency, func(ctx context.Context, index int, replica Node) error {
+		results[index], errs[index] = replica.Query(ctx, qr)
+		return nil
+	})
+
+	merged := &query.Result{}
+	var row *models.Row
+	for index, replica := range replicas {
+		result, err := results[index], errs[index]
+		if err == nil {
+			err = result.Err
+		}
+		if err != nil {
+			merged.Messages = append(merged.Messages, &query.Message{
+				Level: query.WarningLevel,
+				Text:  fmt.Sprintf("%s: %v", nodeKey(replica), err),
+			})
+			continue
+		}
+		merged.StatementID = result.StatementID
+		for _, shown := range result.Series {
+			host := indexOf(shown.Columns, "host")
+			if row == nil {
+				row = &models.Row{Name: shown.Name, Columns: shown.Columns}
+				if host < 0 {
+					row.Columns = append(append([]string(nil), shown.Columns...), "host")
+				}
+				merged.Series = models.Rows{row}
+			}
+			for _, values := range shown.Values {
+				if host < 0 {
+					values = append(values, nodeKey(replica))
+				} else if host < len(values) {
+					values[host] = nodeKey(replica)
+				}
+				row.Values = append(row.Values, values)
+			}
+		}
+	}
+	return merged, nil
+}
+
+// executeKillQueryStatement kills a query listed by SHOW QUERIES on the
+// replica node named host:port by ON. Query IDs are given by every replica,
+// ON can be left out only when there is one.
+func (e HTTPEngine) executeKillQueryStatement(ctx context.Context, qr QueryRequest) (*query.Result, error) {
+	stmt := qr.Query.Statements[0].(*influxql.KillQueryStatement)
+	replicas := e.allReplicas()
+	var target Node
+	switch {
+	case stmt.Host != "":
+		for _, replica := range replicas {
+			if nodeKey(replica) == stmt.Host {
+				target = replica
+			}
+		}
+		if target == nil {
+			return nil, fmt.Errorf("no replica node %s", stmt.Host)
+		}
+	case len(replicas) == 1:
+		target = replicas[0]
+	default:
+		return nil, fmt.Errorf("query %d may run on any of %d replica nodes, use KILL QUERY %d ON \"host:port\" with the host of SHOW QUERIES", stmt.QueryID, len(replicas), stmt.QueryID)
+	}
+	qr.Query = &influxql.Query{Statements: influxql.Statements{&influxql.KillQueryStatement{QueryID: stmt.QueryID}}}
+	return target.Query(ctx, qr)
+}
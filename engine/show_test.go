@@ -0,0 +1,314 @@
+package engine
+
+import (
+	"context"
+	"encoding/json"
+	"gear/influx"
+	"github.com/influxdata/influxdb/models"
+	"github.com/influxdata/influxdb/query"
+	"github.com/influxdata/influxql"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+// showServer answers the SHOW statements about the measurements it owns,
+// lists a running query with ID qid and records the queries killed.
+type showServer struct {
+	owns         func(string) bool
+	measurements []string
+	qid          int
+
+	mu     sync.Mutex
+	killed []uint64
+}
+
+func (s *showServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	stmt, _ := influxql.ParseStatement(r.FormValue("q"))
+	result := &query.Result{}
+	owned := func(sources influxql.Sources) []string {
+		var names []string
+		for _, m := range s.measurements {
+			if !s.owns(m) {
+				continue
+			}
+			for _, source := range sources {
+				if source.(*influxql.Measurement).Name == m {
+					names = append(names, m)
+				}
+			}
+			if len(sources) == 0 {
+				names = append(names, m)
+			}
+		}
+		return names
+	}
+	switch stmt := stmt.(type) {
+	case *influxql.ShowMeasurementsStatement:
+		row := &models.Row{Name: "measurements", Columns: []string{"name"}}
+		for _, m := range owned(nil) {
+			if stmt.Source == nil || stmt.Source.(*influxql.Measurement).Regex.Val.MatchString(m) {
+				row.Values = append(row.Values, []interface{}{m})
+			}
+		}
+		result.Series = models.Rows{row}
+	case *influxql.ShowSeriesStatement:
+		row := &models.Row{Columns: []string{"key"}}
+		for _, m := range owned(stmt.Sources) {
+			row.Values = append(row.Values, []interface{}{m + ",host=a"})
+		}
+		result.Series = models.Rows{row}
+	case *influxql.ShowFieldKeysStatement:
+		for _, m := range owned(stmt.Sources) {
+			result.Series = append(result.Series, &models.Row{
+				Name:    m,
+				Columns: []string{"fieldKey", "fieldType"},
+				Values:  [][]interface{}{{"value", "float"}},
+			})
+		}
+	case *influxql.ShowTagKeysStatement:
+		for _, m := range owned(stmt.Sources) {
+			result.Series = append(result.Series, &models.Row{
+				Name:    m,
+				Columns: []string{"tagKey"},
+				Values:  [][]interface{}{{"region"}, {"host"}},
+			})
+		}
+	case *influxql.ShowSeriesCardinalityStatement:
+		result.Series = models.Rows{{Columns: []string{"count"}, Values: [][]interface{}{{len(owned(stmt.Sources))}}}}
+	case *influxql.ShowQueriesStatement:
+		result.Series = models.Rows{{
+			Columns: []string{"qid", "query", "database", "duration", "status"},
+			Values:  [][]interface{}{{s.qid, "SELECT * FROM cpu", "foo", "1s", "running"}},
+		}}
+	case *influxql.KillQueryStatement:
+		s.mu.Lock()
+		s.killed = append(s.killed, stmt.QueryID)
+		s.mu.Unlock()
+	case *influxql.ExplainStatement:
+		row := &models.Row{Columns: []string{"QUERY PLAN"}}
+		for _, source := range stmt.Statement.Sources {
+			row.Values = append(row.Values, []interface{}{"EXPRESSION: " + source.String()})
+		}
+		result.Series = models.Rows{row}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(influx.Response{Results: []*query.Result{result}})
+}
+
+func newShowServers(e **HTTPEngine, measurements ...string) (*showServer, *showServer) {
+	ownedBy := func(shard int) func(string) bool {
+		return func(m string) bool {
+			return (*e).MapMeasurement("foo", m, nil)[0] == (*e).NodeList()[shard]
+		}
+	}
+	return &showServer{owns: ownedBy(0), measurements: measurements, qid: 7},
+		&showServer{owns: ownedBy(1), measurements: measurements, qid: 7}
+}
+
+func TestHTTPEngine_ShowSeriesAndFieldKeys(t *testing.T) {
+	var e *HTTPEngine
+	a, b := newShowServers(&e, "cpu", "mem", "disk_io", "disk_free")
+	serverA, serverB := httptest.NewServer(a), httptest.NewServer(b)
+	defer serverA.Close()
+	defer serverB.Close()
+	e = newShardedEngine(serverA, serverB)
+	assert.NotEqual(t, e.MapMeasurement("foo", "cpu", nil), e.MapMeasurement("foo", "mem", nil))
+
+	qr, _ := influx.NewQueryRequest("SHOW SERIES; SHOW SERIES FROM cpu, /disk.*/; SHOW FIELD KEYS", "foo", "", "")
+	resp := e.Query(context.Background(), qr)
+	assert.Nil(t, resp.Error)
+	if assert.Len(t, resp.Results, 3) {
+		assert.Len(t, resp.Results[0].Series, 1)
+		assert.ElementsMatch(t, [][]interface{}{{"cpu,host=a"}, {"mem,host=a"}, {"disk_io,host=a"}, {"disk_free,host=a"}},
+			resp.Results[0].Series[0].Values)
+		assert.Len(t, resp.Results[1].Series, 1)
+		assert.ElementsMatch(t, [][]interface{}{{"cpu,host=a"}, {"disk_io,host=a"}, {"disk_free,host=a"}},
+			resp.Results[1].Series[0].Values)
+
+		var names []string
+		for _, row := range resp.Results[2].Series {
+			names = append(names, row.Name)
+		}
+		assert.Equal(t, []string{"cpu", "disk_free", "disk_io", "mem"}, names)
+	}
+}
+
+func TestHTTPEngine_ShowAndKillQueries(t *testing.T) {
+	var e *HTTPEngine
+	a, b := newShowServers(&e, "cpu")
+	serverA, serverB := httptest.NewServer(a), httptest.NewServer(b)
+	defer serverA.Close()
+	defer serverB.Close()
+	e = newShardedEngine(serverA, serverB)
+	hostA, hostB := serverA.Listener.Addr().String(), serverB.Listener.Addr().String()
+
+	qr, _ := influx.NewQueryRequest("SHOW QUERIES", "", "", "")
+	resp := e.Query(context.Background(), qr)
+	assert.Nil(t, resp.Error)
+	row := resp.Results[0].Series[0]
+	assert.Equal(t, []string{"qid", "query", "database", "duration", "status", "host"}, row.Columns)
+	var shown [][]interface{}
+	for _, values := range row.Values {
+		shown = append(shown, []interface{}{values[0], values[5]})
+	}
+	assert.Equal(t, [][]interface{}{{7.0, hostA}, {7.0, hostB}}, shown)
+
+	// The query IDs of several replicas overlap, ON tells them apart.
+	qr, _ = influx.NewQueryRequest("KILL QUERY 7", "", "", "")
+	assert.NotNil(t, e.Query(context.Background(), qr).Error)
+	qr, _ = influx.NewQueryRequest("KILL QUERY 7 ON \""+hostB+"\"", "", "", "")
+	assert.Nil(t, e.Query(context.Background(), qr).Error)
+	qr, _ = influx.NewQueryRequest("KILL QUERY 3 ON \""+hostA+"\"", "", "", "")
+	assert.Nil(t, e.Query(context.Background(), qr).Error)
+	assert.Equal(t, []uint64{3}, a.killed)
+	assert.Equal(t, []uint64{7}, b.killed)
+
+	qr, _ = influx.NewQueryRequest("KILL QUERY 3 ON \"unknown:8086\"", "", "", "")
+	assert.NotNil(t, e.Query(context.Background(), qr).Error)
+}
+
+func TestHTTPEngine_ShowQueriesSharedReplica(t *testing.T) {
+	var e *HTTPEngine
+	a, _ := newShowServers(&e, "cpu")
+	serverA := httptest.NewServer(a)
+	defer serverA.Close()
+	e = newShardedEngine(serverA, serverA)
+
+	// A replica of two shard nodes is listed once, and is the only one.
+	qr, _ := influx.NewQueryRequest("SHOW QUERIES", "", "", "")
+	resp := e.Query(context.Background(), qr)
+	assert.Nil(t, resp.Error)
+	assert.Len(t, resp.Results[0].Series[0].Values, 1)
+	qr, _ = influx.NewQueryRequest("KILL QUERY 7", "", "", "")
+	assert.Nil(t, e.Query(context.Background(), qr).Error)
+	assert.Equal(t, []uint64{7}, a.killed)
+}
+
+func TestHTTPEngine_Explain(t *testing.T) {
+	var e *HTTPEngine
+	a, b := newShowServers(&e, "cpu", "mem")
+	serverA, serverB := httptest.NewServer(a), httptest.NewServer(b)
+	defer serverA.Close()
+	defer serverB.Close()
+	e = newShardedEngine(serverA, serverB)
+
+	qr, _ := influx.NewQueryRequest("EXPLAIN SELECT * FROM cpu", "foo", "", "")
+	resp := e.Query(context.Background(), qr)
+	assert.Nil(t, resp.Error)
+	assert.Equal(t, [][]interface{}{{"EXPRESSION: cpu"}}, resp.Results[0].Series[0].Values)
+
+	qr, _ = influx.NewQueryRequest("EXPLAIN SELECT * FROM cpu, mem", "foo", "", "")
+	resp = e.Query(context.Background(), qr)
+	assert.Nil(t, resp.Error)
+	assert.Len(t, resp.Results[0].Series[0].Values, 4)
+}
+
+func TestHTTPEngine_ShowMerge(t *testing.T) {
+	var e *HTTPEngine
+	a, b := newShowServers(&e, "cpu", "mem", "disk_io", "disk_free")
+	serverA, serverB := httptest.NewServer(a), httptest.NewServer(b)
+	defer serverA.Close()
+	defer serverB.Close()
+	e = newShardedEngine(serverA, serverB)
+
+	qr, _ := influx.NewQueryRequest("SHOW MEASUREMENTS LIMIT 2 OFFSET 1; SHOW SERIES CARDINALITY; SHOW TAG KEYS LIMIT 1 SLIMIT 2 SOFFSET 1", "foo", "", "")
+	resp := e.Query(context.Background(), qr)
+	assert.Nil(t, resp.Error)
+	if assert.Len(t, resp.Results, 3) {
+		assert.Equal(t, models.Rows{{Name: "measurements", Columns: []string{"name"}, Values: [][]interface{}{{"disk_free"}, {"disk_io"}}}},
+			resp.Results[0].Series)
+		assert.Equal(t, [][]interface{}{{int64(4)}}, resp.Results[1].Series[0].Values)
+		assert.Equal(t, models.Rows{
+			{Name: "disk_free", Columns: []string{"tagKey"}, Values: [][]interface{}{{"host"}}},
+			{Name: "disk_io", Columns: []string{"tagKey"}, Values: [][]interface{}{{"host"}}},
+		}, resp.Results[2].Series)
+	}
+}
+
+func TestMergeShowResults(t *testing.T) {
+	merged := mergeShowResults([]*query.Result{
+		{Series: models.Rows{
+			{Name: "mem", Columns: []string{"key", "value"}, Values: [][]interface{}{{"host", "b"}, {"host", "a"}}},
+		}},
+		{Series: models.Rows{
+			{Name: "cpu", Columns: []string{"key", "value"}, Values: [][]interface{}{{"host", "c"}}},
+			{Name: "mem", Columns: []string{"key", "value"}, Values: [][]interface{}{{"host", "c"}, {"host", "a"}}},
+		}},
+	})
+	assert.Equal(t, models.Rows{
+		{Name: "cpu", Columns: []string{"key", "value"}, Values: [][]interface{}{{"host", "c"}}},
+		{Name: "mem", Columns: []string{"key", "value"}, Values: [][]interface{}{{"host", "a"}, {"host", "b"}, {"host", "c"}}},
+	}, merged.Series)
+
+	merged = page{limit: 1, offset: 2}.apply(merged)
+	assert.Equal(t, models.Rows{
+		{Name: "mem", Columns: []string{"key", "value"}, Values: [][]interface{}{{"host", "c"}}},
+	}, merged.Series)
+}
+
+func TestMergeCardinalityResults(t *testing.T) {
+	merged := mergeCardinalityResults([]*query.Result{
+		{Series: models.Rows{
+			{Name: "cpu", Columns: []string{"count"}, Values: [][]interface{}{{float64(3)}}},
+		}},
+		{Series: models.Rows{
+			{Name: "cpu", Columns: []string{"count"}, Values: [][]interface{}{{float64(2)}}},
+			{Name: "mem", Columns: []string{"count"}, Values: [][]interface{}{{float64(1)}}},
+		}},
+	})
+	assert.Equal(t, models.Rows{
+		{Name: "cpu", Columns: []string{"count"}, Values: [][]interface{}{{int64(5)}}},
+		{Name: "mem", Columns: []string{"count"}, Values: [][]interface{}{{float64(1)}}},
+	}, merged.Series)
+}
+
+func TestHTTPEngine_SpreadCardinality(t *testing.T) {
+	// cpu is spread over both shard nodes, with some tag keys, tag values
+	// and field keys on both.
+	handler := func(tagKeys, tagValues, fieldKeys, measurements [][]interface{}) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			stmt, _ := influxql.ParseStatement(r.FormValue("q"))
+			result := &query.Result{}
+			switch stmt.(type) {
+			case *influxql.ShowTagKeysStatement:
+				result.Series = models.Rows{{Name: "cpu", Columns: []string{"tagKey"}, Values: tagKeys}}
+			case *influxql.ShowTagValuesStatement:
+				result.Series = models.Rows{{Name: "cpu", Columns: []string{"key", "value"}, Values: tagValues}}
+			case *influxql.ShowFieldKeysStatement:
+				result.Series = models.Rows{{Name: "cpu", Columns: []string{"fieldKey", "fieldType"}, Values: fieldKeys}}
+			case *influxql.ShowMeasurementsStatement:
+				result.Series = models.Rows{{Name: "measurements", Columns: []string{"name"}, Values: measurements}}
+			}
+			w.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(w).Encode(influx.Response{Results: []*query.Result{result}})
+		}
+	}
+	serverA := httptest.NewServer(handler(
+		[][]interface{}{{"host"}, {"region"}},
+		[][]interface{}{{"host", "a"}, {"host", "b"}},
+		[][]interface{}{{"usage", "float"}},
+		[][]interface{}{{"cpu"}, {"mem"}}))
+	serverB := httptest.NewServer(handler(
+		[][]interface{}{{"dc"}, {"host"}},
+		[][]interface{}{{"host", "b"}, {"host", "c"}},
+		[][]interface{}{{"idle", "float"}, {"usage", "integer"}},
+		[][]interface{}{{"cpu"}}))
+	defer serverA.Close()
+	defer serverB.Close()
+	e := newShardedEngine(serverA, serverB)
+
+	qr, _ := influx.NewQueryRequest("SHOW TAG KEY CARDINALITY; SHOW TAG VALUES CARDINALITY WITH KEY = host; "+
+		"SHOW FIELD KEY CARDINALITY; SHOW MEASUREMENT CARDINALITY", "foo", "", "")
+	resp := e.Query(context.Background(), qr)
+	assert.Nil(t, resp.Error)
+	var counts []interface{}
+	for _, result := range resp.Results {
+		assert.Len(t, result.Series, 1)
+		counts = append(counts, result.Series[0].Values[0][0])
+	}
+	assert.Equal(t, []interface{}{int64(3), int64(3), int64(2), int64(2)}, counts)
+	assert.Equal(t, "cpu", resp.Results[0].Series[0].Name)
+}
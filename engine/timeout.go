@@ -0,0 +1,110 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"gear/config"
+	"sync"
+	"time"
+)
+
+// ErrWriteTimeout is returned for a write the backends didn't acknowledge
+// within the write timeout.
+var ErrWriteTimeout = errors.New("timeout")
+
+// timeouts holds the [timeout] section, the zero value sets no limit.
+type timeouts struct {
+	query, write time.Duration
+	databases    map[string]databaseTimeouts
+}
+
+type databaseTimeouts struct {
+	query, write time.Duration
+}
+
+func newTimeouts(cfg config.Timeout) (t timeouts, err error) {
+	parse := func(field, value string, d *time.Duration) {
+		if value == "" || err != nil {
+			return
+		}
+		if *d, err = time.ParseDuration(value); err != nil {
+			err = fmt.Errorf("error parsing %s %v", field, err)
+		}
+	}
+	parse("timeout.query", cfg.Query, &t.query)
+	parse("timeout.write", cfg.Write, &t.write)
+	for _, database := range cfg.Database {
+		d := databaseTimeouts{query: t.query, write: t.write}
+		parse("timeout.database.query", database.Query, &d.query)
+		parse("timeout.database.write", database.Write, &d.write)
+		if t.databases == nil {
+			t.databases = make(map[string]databaseTimeouts)
+		}
+		t.databases[database.Name] = d
+	}
+	return t, err
+}
+
+func (t timeouts) forQuery(database string) time.Duration {
+	if d, ok := t.databases[database]; ok {
+		return d.query
+	}
+	return t.query
+}
+
+func (t timeouts) forWrite(database string) time.Duration {
+	if d, ok := t.databases[database]; ok {
+		return d.write
+	}
+	return t.write
+}
+
+// withTimeout is context.WithTimeout, without a deadline when d is 0.
+func withTimeout(ctx context.Context, d time.Duration) (context.Context, context.CancelFunc) {
+	if d <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, d)
+}
+
+// timeoutError replaces the transport error a backend request failed with
+// when ctx timed out, so that clients are told about the timeout.
+func timeoutError(ctx context.Context, err, timeout error) error {
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		return timeout
+	}
+	return err
+}
+
+// detach returns a context with the deadline of ctx that is canceled with ctx
+// until release is called, so that work started meanwhile can outlive the
+// caller. cancel is to be called once that work is done.
+func detach(ctx context.Context) (detached context.Context, release, cancel context.CancelFunc) {
+	if deadline, ok := ctx.Deadline(); ok {
+		detached, cancel = context.WithDeadline(context.Background(), deadline)
+	} else {
+		detached, cancel = context.WithCancel(context.Background())
+	}
+	var mu sync.Mutex
+	released := false
+	stop := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			mu.Lock()
+			if !released {
+				cancel()
+			}
+			mu.Unlock()
+		case <-stop:
+		}
+	}()
+	release = func() {
+		mu.Lock()
+		released = true
+		mu.Unlock()
+		close(stop)
+	}
+	return detached, release, cancel
+}
@@ -0,0 +1,104 @@
+package engine
+
+import (
+	"context"
+	"gear/config"
+	"gear/influx"
+	"github.com/influxdata/influxdb/models"
+	"github.com/influxdata/influxdb/query"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// hangingServer holds the SELECTs and writes it gets until they are aborted,
+// and reports every aborted request.
+type hangingServer struct {
+	aborted chan string
+}
+
+func (s *hangingServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/query" && !strings.HasPrefix(r.FormValue("q"), "SELECT") {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"results":[{"statement_id":0}]}`))
+		return
+	}
+	if r.URL.Path != "/query" && r.URL.Path != "/write" {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	// The server notices the client went away once the body is read.
+	_, _ = ioutil.ReadAll(r.Body)
+	<-r.Context().Done()
+	s.aborted <- r.URL.Path
+}
+
+func newTimeoutEngine(server *httptest.Server, timeout config.Timeout) *HTTPEngine {
+	return NewEngine(config.GearConfig{
+		Timeout: timeout,
+		HTTPShardNode: []config.HTTPShardNode{
+			{Name: "a", Weight: 1, HTTPReplicaNode: []config.HTTPReplicaNode{{Address: server.URL}}},
+		},
+	}).(*Cluster).Current()
+}
+
+func TestHTTPEngine_Timeouts(t *testing.T) {
+	s := &hangingServer{aborted: make(chan string, 4)}
+	server := httptest.NewServer(s)
+	defer server.Close()
+	e := newTimeoutEngine(server, config.Timeout{
+		Query:    "50ms",
+		Write:    "50ms",
+		Database: []config.DatabaseTimeout{{Name: "slow", Query: "200ms"}},
+	})
+
+	qr, _ := influx.NewQueryRequest("SELECT * FROM cpu", "foo", "", "")
+	assert.Equal(t, query.ErrQueryTimeoutLimitExceeded, e.Query(context.Background(), qr).Error)
+	assert.Equal(t, "/query", <-s.aborted)
+
+	points, err := models.ParsePoints([]byte("cpu,host=a value=1 0"))
+	assert.Nil(t, err)
+	assert.Equal(t, ErrWriteTimeout, e.Write(context.Background(), influx.WriteRequest{Database: "foo", Points: points}))
+	assert.Equal(t, "/write", <-s.aborted)
+
+	qr.Database = "slow"
+	start := time.Now()
+	assert.Equal(t, query.ErrQueryTimeoutLimitExceeded, e.Query(context.Background(), qr).Error)
+	assert.True(t, time.Since(start) >= 200*time.Millisecond)
+	<-s.aborted
+}
+
+func TestHTTPEngine_QueryCanceled(t *testing.T) {
+	s := &hangingServer{aborted: make(chan string, 1)}
+	server := httptest.NewServer(s)
+	defer server.Close()
+	e := newTimeoutEngine(server, config.Timeout{})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+	qr, _ := influx.NewQueryRequest("SELECT * FROM cpu", "foo", "", "")
+	assert.NotNil(t, e.Query(ctx, qr).Error)
+	assert.Equal(t, "/query", <-s.aborted)
+}
+
+func TestDetach(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	detached, release, done := detach(ctx)
+	release()
+	cancel()
+	time.Sleep(10 * time.Millisecond)
+	assert.Nil(t, detached.Err())
+	done()
+	assert.Equal(t, context.Canceled, detached.Err())
+
+	ctx, cancel = context.WithCancel(context.Background())
+	detached, release, done = detach(ctx)
+	defer done()
+	cancel()
+	<-detached.Done()
+	release()
+}
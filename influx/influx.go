@@ -1,6 +1,7 @@
 package influx
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
 	"github.com/influxdata/influxdb/models"
@@ -48,11 +49,31 @@ func (r *Response) UnmarshalJSON(b []byte) error {
 	return nil
 }
 
+// DefaultChunkSize is the number of values per chunk of a chunked query
+// that doesn't set chunk_size, like in InfluxDB.
+const DefaultChunkSize = 10000
+
 type QueryRequest struct {
 	Query     *influxql.Query
 	Database  string
 	Precision string
 	Chunked   string
+	// ChunkSize is the chunk_size of a chunked query, DefaultChunkSize when
+	// it isn't positive.
+	ChunkSize int
+}
+
+// IsChunked reports whether the results are to be streamed in chunks.
+func (qr QueryRequest) IsChunked() bool {
+	return qr.Chunked == "true"
+}
+
+// ValuesPerChunk returns the number of values per chunk of a chunked query.
+func (qr QueryRequest) ValuesPerChunk() int {
+	if qr.ChunkSize > 0 {
+		return qr.ChunkSize
+	}
+	return DefaultChunkSize
 }
 
 func NewQueryRequest(q, database, precision, chunked string) (QueryRequest, error) {
@@ -74,6 +95,7 @@ type WriteRequest struct {
 	Database        string
 	RetentionPolicy string
 	Precision       string
+	Consistency     string
 	pointSize       int
 }
 
@@ -85,7 +107,23 @@ func (wr WriteRequest) PointNum() int {
 	return len(wr.Points)
 }
 
+// LineProtocol writes the points to b in line protocol, with timestamps in
+// the precision of the request.
+func (wr WriteRequest) LineProtocol(b *bytes.Buffer) {
+	for _, p := range wr.Points {
+		if p == nil {
+			continue
+		}
+		b.WriteString(p.PrecisionString(wr.Precision))
+		b.WriteByte('\n')
+	}
+}
+
 func NewWriteRequest(lineData []byte, db, precision, rp string) (WriteRequest, error) {
+	// Parsed points keep referencing lineData, and a write request may outlive
+	// the buffer it was read into while replicas finish or retry it.
+	lineData = append([]byte(nil), lineData...)
+
 	var err error
 	var points models.Points
 	if precision != "" {
@@ -0,0 +1,358 @@
+package service
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"gear/config"
+	"gear/engine"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// AdminAuthMiddleware requires the basic auth credentials of the [admin]
+// section. The admin endpoints are refused until credentials are configured.
+func (g *GearService) AdminAuthMiddleware(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		admin, _ := g.admin.Load().(config.Admin)
+		if admin.Username == "" {
+			g.httpError(w, "admin endpoints are disabled, set username and password in the [admin] section", http.StatusForbidden)
+			return
+		}
+		username, password, ok := r.BasicAuth()
+		if !ok ||
+			subtle.ConstantTimeCompare([]byte(username), []byte(admin.Username)) != 1 ||
+			subtle.ConstantTimeCompare([]byte(password), []byte(admin.Password)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="influx-gear admin"`)
+			g.httpError(w, "authorization failed", http.StatusUnauthorized)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// AdminQueues serves the retry queues of the replica nodes:
+//
+//	GET  /admin/queues                        status of every queue
+//	POST /admin/queues/pause?replica=host:port  stop delivering queued writes
+//	POST /admin/queues/resume?replica=...      deliver them again
+//	POST /admin/queues/flush?replica=...       retry now instead of backing off
+//	POST /admin/queues/purge?replica=...       drop the queued writes
+//	GET  /admin/queues/export?replica=...      queued writes as line protocol
+//
+// Without the replica parameter the POST actions apply to every queue.
+func (g *GearService) AdminQueues(w http.ResponseWriter, r *http.Request) {
+	manager, ok := g.Engine.(engine.QueueManager)
+	if !ok {
+		g.httpError(w, "engine has no retry queues", http.StatusNotImplemented)
+		return
+	}
+	action := strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/queues"), "/")
+	method := http.MethodPost
+	if action == "" || action == "export" {
+		method = http.MethodGet
+	}
+	if r.Method != method {
+		w.Header().Set("Allow", method)
+		g.httpError(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	nodes := manager.RetryNodes()
+	if replica := r.FormValue("replica"); replica != "" {
+		var selected []*engine.RetryHTTPNode
+		for _, node := range nodes {
+			if node.Name() == replica {
+				selected = append(selected, node)
+			}
+		}
+		if len(selected) == 0 {
+			g.httpError(w, "no retry queue for replica "+replica, http.StatusNotFound)
+			return
+		}
+		nodes = selected
+	} else if action == "export" {
+		g.httpError(w, "missing parameter: replica", http.StatusBadRequest)
+		return
+	}
+
+	switch action {
+	case "":
+		statuses := make([]engine.QueueStatus, 0, len(nodes))
+		for _, node := range nodes {
+			statuses = append(statuses, node.Status())
+		}
+		writeJSON(w, statuses)
+	case "pause", "resume", "flush":
+		for _, node := range nodes {
+			switch action {
+			case "pause":
+				node.Pause()
+			case "resume":
+				node.Resume()
+			default:
+				node.Flush()
+			}
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case "purge":
+		type purged struct {
+			Replica string `json:"replica"`
+			Purged  int    `json:"purged"`
+		}
+		result := make([]purged, 0, len(nodes))
+		for _, node := range nodes {
+			result = append(result, purged{Replica: node.Name(), Purged: node.Purge()})
+		}
+		writeJSON(w, result)
+	case "export":
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		if err := nodes[0].Export(w); err != nil {
+			// The status has been sent already, end with the error.
+			w.Write([]byte("# ERROR: " + err.Error() + "\n"))
+		}
+	default:
+		g.httpError(w, "unknown queue action "+action, http.StatusNotFound)
+	}
+}
+
+// AdminSchema serves the comparison of the replica schemas:
+//
+//	GET  /admin/schema                    report of the latest check
+//	POST /admin/schema/check?apply=true   check now, creating missing objects
+//	                                      on the lagging replicas with apply
+//
+// GET runs a check when there was none yet.
+func (g *GearService) AdminSchema(w http.ResponseWriter, r *http.Request) {
+	manager, ok := g.Engine.(engine.SchemaManager)
+	if !ok {
+		g.httpError(w, "engine has no schema checks", http.StatusNotImplemented)
+		return
+	}
+	action := strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/schema"), "/")
+	method := http.MethodPost
+	if action == "" {
+		method = http.MethodGet
+	}
+	if r.Method != method {
+		w.Header().Set("Allow", method)
+		g.httpError(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	switch action {
+	case "":
+		report := manager.LastSchemaReport()
+		if report == nil {
+			checked := manager.CheckSchema(false)
+			report = &checked
+		}
+		writeJSON(w, report)
+	case "check":
+		apply, err := parseBool(r.FormValue("apply"))
+		if err != nil {
+			g.httpError(w, "invalid apply: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, manager.CheckSchema(apply))
+	default:
+		g.httpError(w, "unknown schema action "+action, http.StatusNotFound)
+	}
+}
+
+// AdminRepair serves the jobs copying data between the replicas of a shard
+// node:
+//
+//	GET  /admin/repair                   status of every job
+//	POST /admin/repair/start?source=host:port&target=host:port&db=foo&start=...
+//	                                     start copying, see parseRepairSpec
+//	POST /admin/repair/cancel?id=...     stop a running job
+func (g *GearService) AdminRepair(w http.ResponseWriter, r *http.Request) {
+	manager, ok := g.Engine.(engine.RepairManager)
+	if !ok {
+		g.httpError(w, "engine has no repair jobs", http.StatusNotImplemented)
+		return
+	}
+	action := strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/repair"), "/")
+	method := http.MethodPost
+	if action == "" {
+		method = http.MethodGet
+	}
+	if r.Method != method {
+		w.Header().Set("Allow", method)
+		g.httpError(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	switch action {
+	case "":
+		jobs := manager.RepairJobs()
+		statuses := make([]engine.RepairStatus, 0, len(jobs))
+		for _, job := range jobs {
+			statuses = append(statuses, job.Status())
+		}
+		writeJSON(w, statuses)
+	case "start":
+		spec, err := parseRepairSpec(r, time.Now())
+		if err != nil {
+			g.httpError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		job, err := manager.StartRepair(spec)
+		if err != nil {
+			g.httpError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		_ = json.NewEncoder(w).Encode(job.Status())
+	case "cancel":
+		id := r.FormValue("id")
+		for _, job := range manager.RepairJobs() {
+			if job.ID() == id {
+				job.Cancel()
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+		}
+		g.httpError(w, "no repair job "+id, http.StatusNotFound)
+	default:
+		g.httpError(w, "unknown repair action "+action, http.StatusNotFound)
+	}
+}
+
+// parseRepairSpec reads a repair job from the parameters shard (optional),
+// source, target, db, rp (optional), measurement (optional, comma
+// separated), start and end (RFC3339, end defaults to now), chunk and
+// rate (points per second), which default to the [repair] section.
+func parseRepairSpec(r *http.Request, now time.Time) (engine.RepairSpec, error) {
+	spec := engine.RepairSpec{
+		Shard:           r.FormValue("shard"),
+		Source:          r.FormValue("source"),
+		Target:          r.FormValue("target"),
+		Database:        r.FormValue("db"),
+		RetentionPolicy: r.FormValue("rp"),
+		End:             now.UTC(),
+	}
+	if measurements := r.FormValue("measurement"); measurements != "" {
+		spec.Measurements = strings.Split(measurements, ",")
+	}
+	var err error
+	if spec.Start, err = time.Parse(time.RFC3339, r.FormValue("start")); err != nil {
+		return spec, errors.New("invalid start: " + err.Error())
+	}
+	if end := r.FormValue("end"); end != "" {
+		if spec.End, err = time.Parse(time.RFC3339, end); err != nil {
+			return spec, errors.New("invalid end: " + err.Error())
+		}
+	}
+	if chunk := r.FormValue("chunk"); chunk != "" {
+		if spec.Chunk, err = time.ParseDuration(chunk); err != nil {
+			return spec, errors.New("invalid chunk: " + err.Error())
+		}
+	}
+	if rate := r.FormValue("rate"); rate != "" {
+		if spec.PointsPerSecond, err = strconv.Atoi(rate); err != nil {
+			return spec, errors.New("invalid rate: " + err.Error())
+		}
+	}
+	return spec, nil
+}
+
+// AdminRebalance serves the migration from a previous shard placement:
+//
+//	GET  /admin/rebalance                   measurements moved and job status
+//	POST /admin/rebalance/start?db=foo&drop=true
+//	                                        start moving, see parseRebalanceSpec
+//	POST /admin/rebalance/cancel            stop the running job
+func (g *GearService) AdminRebalance(w http.ResponseWriter, r *http.Request) {
+	manager, ok := g.Engine.(engine.RebalanceManager)
+	if !ok {
+		g.httpError(w, "engine has no migration", http.StatusNotImplemented)
+		return
+	}
+	action := strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/rebalance"), "/")
+	method := http.MethodPost
+	if action == "" {
+		method = http.MethodGet
+	}
+	if r.Method != method {
+		w.Header().Set("Allow", method)
+		g.httpError(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	switch action {
+	case "":
+		status := manager.MigrationStatus()
+		if status == nil {
+			g.httpError(w, "no migration, set from in the [migration] section", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, status)
+	case "start":
+		spec, err := parseRebalanceSpec(r)
+		if err != nil {
+			g.httpError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		job, err := manager.StartRebalance(spec)
+		if err != nil {
+			g.httpError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		_ = json.NewEncoder(w).Encode(job.Status())
+	case "cancel":
+		job := manager.RebalanceJob()
+		if job == nil || job.Status().State != engine.JobRunning {
+			g.httpError(w, "no rebalance job running", http.StatusNotFound)
+			return
+		}
+		job.Cancel()
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		g.httpError(w, "unknown rebalance action "+action, http.StatusNotFound)
+	}
+}
+
+// parseRebalanceSpec reads a rebalance job from the parameters db and
+// measurement (optional, comma separated), drop, chunk and rate (points per
+// second), which default to the [migration] section.
+func parseRebalanceSpec(r *http.Request) (engine.RebalanceSpec, error) {
+	spec := engine.RebalanceSpec{Database: r.FormValue("db")}
+	if measurements := r.FormValue("measurement"); measurements != "" {
+		spec.Measurements = strings.Split(measurements, ",")
+	}
+	var err error
+	if spec.Drop, err = parseBool(r.FormValue("drop")); err != nil {
+		return spec, errors.New("invalid drop: " + err.Error())
+	}
+	if chunk := r.FormValue("chunk"); chunk != "" {
+		if spec.Chunk, err = time.ParseDuration(chunk); err != nil {
+			return spec, errors.New("invalid chunk: " + err.Error())
+		}
+	}
+	if rate := r.FormValue("rate"); rate != "" {
+		if spec.PointsPerSecond, err = strconv.Atoi(rate); err != nil {
+			return spec, errors.New("invalid rate: " + err.Error())
+		}
+	}
+	return spec, nil
+}
+
+func parseBool(s string) (bool, error) {
+	if s == "" {
+		return false, nil
+	}
+	return strconv.ParseBool(s)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(v)
+}
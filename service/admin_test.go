@@ -0,0 +1,316 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"gear/config"
+	"gear/engine"
+	. "gear/influx"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+type queueEngine struct {
+	MockEngine
+	nodes []*engine.RetryHTTPNode
+}
+
+func (e *queueEngine) RetryNodes() []*engine.RetryHTTPNode {
+	return e.nodes
+}
+
+func TestGearService_AdminAuth(t *testing.T) {
+	g := &GearService{bufferPool: NewBufferPool()}
+	g.admin.Store(config.Admin{Username: "admin", Password: "secret"})
+	handler := g.AdminAuthMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	w := httptest.NewRecorder()
+	handler(w, MustNewRequest("POST", "/admin/reload", nil))
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.NotEmpty(t, w.Header().Get("WWW-Authenticate"))
+
+	r := MustNewRequest("POST", "/admin/reload", nil)
+	r.SetBasicAuth("admin", "wrong")
+	w = httptest.NewRecorder()
+	handler(w, r)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	r = MustNewRequest("POST", "/admin/reload", nil)
+	r.SetBasicAuth("admin", "secret")
+	w = httptest.NewRecorder()
+	handler(w, r)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+}
+
+func TestGearService_AdminAuth_NoCredentials(t *testing.T) {
+	g := &GearService{bufferPool: NewBufferPool()}
+	g.admin.Store(config.Admin{})
+	handler := g.AdminAuthMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	r := MustNewRequest("POST", "/admin/reload", nil)
+	r.SetBasicAuth("", "")
+	w := httptest.NewRecorder()
+	handler(w, r)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+}
+
+func TestGearService_AdminReloadRequiresAuth(t *testing.T) {
+	reloads := 0
+	g := &GearService{bufferPool: NewBufferPool(), Engine: &reloadEngine{reloads: &reloads}, ConfigPath: "missing.toml"}
+	g.admin.Store(config.Admin{})
+	handler := g.Handler()
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, MustNewRequest("POST", "/admin/reload", nil))
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	g.admin.Store(config.Admin{Username: "admin", Password: "secret"})
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, MustNewRequest("POST", "/admin/reload", nil))
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Equal(t, 0, reloads)
+}
+
+type reloadEngine struct {
+	MockEngine
+	reloads *int
+}
+
+func (e *reloadEngine) Reload(cfg config.GearConfig) error {
+	*e.reloads++
+	return nil
+}
+
+func TestGearService_AdminQueues(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer ts.Close()
+
+	node, err := engine.NewReplicaHTTPNode(config.HTTPReplicaNode{Address: ts.URL, BufferSizeMb: 1, MaxDelayInterval: "1h"})
+	assert.Nil(t, err)
+	defer node.Shutdown()
+	retry := node.(*engine.RetryHTTPNode)
+	g := &GearService{bufferPool: NewBufferPool(), Engine: &queueEngine{nodes: []*engine.RetryHTTPNode{retry}}}
+
+	wr, _ := NewWriteRequest([]byte("cpu,host=a value=1 1465839830100400200"), "foo", "", "autogen")
+	assert.Nil(t, retry.WritePoints(context.Background(), wr))
+
+	w := httptest.NewRecorder()
+	g.AdminQueues(w, MustNewRequest("POST", "/admin/queues/pause?replica="+retry.Name(), nil))
+	assert.Equal(t, http.StatusNoContent, w.Code)
+
+	w = httptest.NewRecorder()
+	g.AdminQueues(w, MustNewRequest("GET", "/admin/queues", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	var statuses []engine.QueueStatus
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &statuses))
+	assert.Len(t, statuses, 1)
+	assert.Equal(t, retry.Name(), statuses[0].Replica)
+	assert.Equal(t, "memory", statuses[0].Storage)
+	assert.Equal(t, 1, statuses[0].Depth)
+	assert.True(t, statuses[0].Paused)
+	assert.Contains(t, statuses[0].LastError, "503")
+
+	w = httptest.NewRecorder()
+	g.AdminQueues(w, MustNewRequest("GET", "/admin/queues/export?replica="+retry.Name(), nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "# DML\n# CONTEXT-DATABASE: foo\n# CONTEXT-RETENTION-POLICY: autogen\n"+
+		"cpu,host=a value=1 1465839830100400200\n", w.Body.String())
+
+	w = httptest.NewRecorder()
+	g.AdminQueues(w, MustNewRequest("POST", "/admin/queues/purge", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.True(t, strings.Contains(w.Body.String(), `"purged":1`))
+	assert.Equal(t, 0, retry.Status().Depth)
+
+	w = httptest.NewRecorder()
+	g.AdminQueues(w, MustNewRequest("POST", "/admin/queues/flush?replica=unknown:8086", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	w = httptest.NewRecorder()
+	g.AdminQueues(w, MustNewRequest("GET", "/admin/queues/export", nil))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+type schemaEngine struct {
+	MockEngine
+	last   *engine.SchemaReport
+	checks []bool
+}
+
+func (e *schemaEngine) LastSchemaReport() *engine.SchemaReport {
+	return e.last
+}
+
+func (e *schemaEngine) CheckSchema(apply bool) engine.SchemaReport {
+	e.checks = append(e.checks, apply)
+	report := engine.SchemaReport{Replicas: []string{"a:8086", "b:8086"}, Drift: []engine.SchemaDrift{
+		{Kind: "database", Name: "foo", Statement: "CREATE DATABASE foo", Missing: []string{"b:8086"}},
+	}}
+	e.last = &report
+	return report
+}
+
+func TestGearService_AdminSchema(t *testing.T) {
+	e := &schemaEngine{}
+	g := &GearService{bufferPool: NewBufferPool(), Engine: e}
+
+	w := httptest.NewRecorder()
+	g.AdminSchema(w, MustNewRequest("GET", "/admin/schema", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	var report engine.SchemaReport
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &report))
+	assert.Len(t, report.Drift, 1)
+	assert.Equal(t, []string{"b:8086"}, report.Drift[0].Missing)
+	assert.Equal(t, []bool{false}, e.checks)
+
+	w = httptest.NewRecorder()
+	g.AdminSchema(w, MustNewRequest("GET", "/admin/schema", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, []bool{false}, e.checks)
+
+	w = httptest.NewRecorder()
+	g.AdminSchema(w, MustNewRequest("POST", "/admin/schema/check?apply=true", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, []bool{false, true}, e.checks)
+
+	w = httptest.NewRecorder()
+	g.AdminSchema(w, MustNewRequest("POST", "/admin/schema/check?apply=maybe", nil))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = httptest.NewRecorder()
+	g.AdminSchema(w, MustNewRequest("GET", "/admin/schema/check", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+}
+
+type repairEngine struct {
+	MockEngine
+	specs []engine.RepairSpec
+	jobs  []*engine.RepairJob
+}
+
+func (e *repairEngine) StartRepair(spec engine.RepairSpec) (*engine.RepairJob, error) {
+	e.specs = append(e.specs, spec)
+	job, err := engine.NewRepairJob(spec, nil, nil, "")
+	if err != nil {
+		return nil, err
+	}
+	e.jobs = append(e.jobs, job)
+	return job, nil
+}
+
+func (e *repairEngine) RepairJobs() []*engine.RepairJob {
+	return e.jobs
+}
+
+func TestGearService_AdminRepair(t *testing.T) {
+	e := &repairEngine{}
+	g := &GearService{bufferPool: NewBufferPool(), Engine: e}
+
+	w := httptest.NewRecorder()
+	g.AdminRepair(w, MustNewRequest("POST", "/admin/repair/start?source=a:8086&target=b:8086&db=foo"+
+		"&measurement=cpu,mem&start=2019-01-01T00:00:00Z&end=2019-01-02T00:00:00Z&chunk=30m&rate=1000", nil))
+	assert.Equal(t, http.StatusAccepted, w.Code)
+	var status engine.RepairStatus
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &status))
+	assert.Equal(t, engine.JobRunning, status.State)
+	if assert.Len(t, e.specs, 1) {
+		assert.Equal(t, []string{"cpu", "mem"}, e.specs[0].Measurements)
+		assert.Equal(t, 30*time.Minute, e.specs[0].Chunk)
+		assert.Equal(t, 1000, e.specs[0].PointsPerSecond)
+		assert.Equal(t, 24*time.Hour, e.specs[0].End.Sub(e.specs[0].Start))
+	}
+
+	w = httptest.NewRecorder()
+	g.AdminRepair(w, MustNewRequest("GET", "/admin/repair", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), status.ID)
+
+	w = httptest.NewRecorder()
+	g.AdminRepair(w, MustNewRequest("POST", "/admin/repair/cancel?id="+status.ID, nil))
+	assert.Equal(t, http.StatusNoContent, w.Code)
+
+	w = httptest.NewRecorder()
+	g.AdminRepair(w, MustNewRequest("POST", "/admin/repair/cancel?id=unknown", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	w = httptest.NewRecorder()
+	g.AdminRepair(w, MustNewRequest("POST", "/admin/repair/start?source=a:8086&target=b:8086&db=foo&start=yesterday", nil))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+type rebalanceEngine struct {
+	MockEngine
+	migrating bool
+	specs     []engine.RebalanceSpec
+	job       *engine.RebalanceJob
+}
+
+func (e *rebalanceEngine) MigrationStatus() *engine.MigrationStatus {
+	if !e.migrating {
+		return nil
+	}
+	return &engine.MigrationStatus{From: "old.toml", Moved: map[string][]string{"foo": {"cpu"}}}
+}
+
+func (e *rebalanceEngine) StartRebalance(spec engine.RebalanceSpec) (*engine.RebalanceJob, error) {
+	e.specs = append(e.specs, spec)
+	e.job = &engine.RebalanceJob{}
+	return e.job, nil
+}
+
+func (e *rebalanceEngine) RebalanceJob() *engine.RebalanceJob {
+	return e.job
+}
+
+func TestGearService_AdminRebalance(t *testing.T) {
+	e := &rebalanceEngine{}
+	g := &GearService{bufferPool: NewBufferPool(), Engine: e}
+
+	w := httptest.NewRecorder()
+	g.AdminRebalance(w, MustNewRequest("GET", "/admin/rebalance", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	e.migrating = true
+	w = httptest.NewRecorder()
+	g.AdminRebalance(w, MustNewRequest("GET", "/admin/rebalance", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	var status engine.MigrationStatus
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &status))
+	assert.Equal(t, map[string][]string{"foo": {"cpu"}}, status.Moved)
+
+	w = httptest.NewRecorder()
+	g.AdminRebalance(w, MustNewRequest("POST", "/admin/rebalance/start?db=foo&measurement=cpu,mem&drop=true&chunk=30m&rate=1000", nil))
+	assert.Equal(t, http.StatusAccepted, w.Code)
+	if assert.Len(t, e.specs, 1) {
+		assert.Equal(t, engine.RebalanceSpec{
+			Database:        "foo",
+			Measurements:    []string{"cpu", "mem"},
+			Chunk:           30 * time.Minute,
+			PointsPerSecond: 1000,
+			Drop:            true,
+		}, e.specs[0])
+	}
+
+	// The job isn't running.
+	w = httptest.NewRecorder()
+	g.AdminRebalance(w, MustNewRequest("POST", "/admin/rebalance/cancel", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	w = httptest.NewRecorder()
+	g.AdminRebalance(w, MustNewRequest("GET", "/admin/rebalance/start", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+
+	w = httptest.NewRecorder()
+	g.AdminRebalance(w, MustNewRequest("POST", "/admin/rebalance/start?drop=maybe", nil))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
@@ -6,28 +6,39 @@ import (
 	"gear/config"
 	"gear/engine"
 	. "gear/influx"
+	"github.com/influxdata/influxdb/models"
 	"github.com/influxdata/influxdb/prometheus"
+	"github.com/influxdata/influxdb/query"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	log "github.com/sirupsen/logrus"
 	"math"
 	"net/http"
 	"net/http/pprof"
 	_ "net/http/pprof"
+	"strconv"
+	"sync/atomic"
 )
 
 type GearService struct {
 	config     config.GearConfig
 	Engine     engine.Engine
 	bufferPool BufferPool
+
+	// ConfigPath is the file the topology is reloaded from.
+	ConfigPath string
+	// admin holds the config.Admin credentials, which can be reloaded.
+	admin atomic.Value
 }
 
 func NewGearService(gearConfig config.GearConfig) *GearService {
 	gearEngine := engine.NewEngine(gearConfig)
-	return &GearService{
+	g := &GearService{
 		config:     gearConfig,
 		Engine:     gearEngine,
 		bufferPool: NewBufferPool(),
 	}
+	g.admin.Store(gearConfig.Admin)
+	return g
 }
 
 func (g *GearService) httpError(w http.ResponseWriter, errMsg string, code int) {
@@ -70,8 +81,23 @@ func (g *GearService) Query(w http.ResponseWriter, r *http.Request) {
 		g.httpError(rw, "error parsing query: "+err.Error(), http.StatusBadRequest)
 		return
 	}
+	// Like InfluxDB, an invalid chunk_size falls back to the default.
+	if n, err := strconv.Atoi(r.FormValue("chunk_size")); err == nil && n > 0 {
+		queryRequest.ChunkSize = n
+	}
+
+	if querier, ok := g.Engine.(engine.ChunkedQuerier); ok && queryRequest.IsChunked() {
+		err := querier.QueryChunked(r.Context(), queryRequest, func(result *query.Result) error {
+			_, err := rw.WriteResponse(Response{Results: []*query.Result{result}})
+			return err
+		})
+		if err != nil {
+			rw.WriteResponse(Response{Error: err})
+		}
+		return
+	}
 
-	response := g.Engine.Query(queryRequest)
+	response := g.Engine.Query(r.Context(), queryRequest)
 	rw.WriteResponse(*response)
 }
 
@@ -100,13 +126,50 @@ func (g *GearService) Write(w http.ResponseWriter, r *http.Request) {
 		g.httpError(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	err = g.Engine.Write(writeRequest)
+	writeRequest.Consistency, err = parseConsistency(r)
 	if err != nil {
-		g.httpError(w, err.Error(), http.StatusInternalServerError)
+		g.httpError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	err = g.Engine.Write(r.Context(), writeRequest)
+	if err != nil {
+		g.writeError(w, err, err.Error())
+		return
 	}
 	w.WriteHeader(http.StatusNoContent)
 }
 
+// writeError responds to a failed write. Writes rejected because a replica's
+// retry buffer is full get a 503 telling the client when to try again, writes
+// a replica rejected as invalid get its 4xx and error.
+func (g *GearService) writeError(w http.ResponseWriter, err error, errMsg string) {
+	switch e := err.(type) {
+	case *engine.BackpressureError:
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(e.RetryAfter.Seconds()))))
+		g.httpError(w, errMsg, http.StatusServiceUnavailable)
+	case engine.HTTPError:
+		if e.StatusCode/100 == 4 {
+			g.httpError(w, e.Message, e.StatusCode)
+			return
+		}
+		g.httpError(w, errMsg, http.StatusInternalServerError)
+	default:
+		g.httpError(w, errMsg, http.StatusInternalServerError)
+	}
+}
+
+// parseConsistency validates the optional consistency parameter of a write.
+func parseConsistency(r *http.Request) (string, error) {
+	level := r.FormValue("consistency")
+	if level == "" {
+		return "", nil
+	}
+	if _, err := models.ParseConsistencyLevel(level); err != nil {
+		return "", err
+	}
+	return level, nil
+}
+
 func (g *GearService) PromWrite(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		w.Header().Set("Allow", http.MethodPost)
@@ -136,9 +199,14 @@ func (g *GearService) PromWrite(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 	}
-	err = g.Engine.Write(writeRequest)
+	writeRequest.Consistency, err = parseConsistency(r)
 	if err != nil {
-		g.httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		g.httpError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	err = g.Engine.Write(r.Context(), writeRequest)
+	if err != nil {
+		g.writeError(w, err, http.StatusText(http.StatusInternalServerError))
 		return
 	}
 
@@ -174,7 +242,7 @@ func (g *GearService) PromRead(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	response := g.Engine.Query(queryRequest)
+	response := g.Engine.Query(r.Context(), queryRequest)
 
 	_, err = rw.WriteResponse(*response)
 	if err != nil {
@@ -182,12 +250,57 @@ func (g *GearService) PromRead(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func (g *GearService) Run() {
+// Reload re-reads ConfigPath and swaps the engine topology.
+func (g *GearService) Reload() error {
+	reloader, ok := g.Engine.(engine.Reloader)
+	if !ok {
+		return errors.New("engine doesn't support reloading")
+	}
+	cfg, err := config.Load(g.ConfigPath)
+	if err != nil {
+		return err
+	}
+	if err := reloader.Reload(*cfg.WithDefaults()); err != nil {
+		return err
+	}
+	g.admin.Store(cfg.Admin)
+	return nil
+}
+
+func (g *GearService) AdminReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		g.httpError(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	if err := g.Reload(); err != nil {
+		log.Error("reload failed: ", err)
+		g.httpError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Handler returns the routes of gear. The /admin endpoints, reload included,
+// are only ever registered behind AdminAuthMiddleware.
+func (g *GearService) Handler() http.Handler {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/query", RecordMetricMiddleware(g.Query))
 	mux.HandleFunc("/write", RecordMetricMiddleware(g.Write))
 	mux.HandleFunc("/api/v1/prom/write", RecordMetricMiddleware(g.PromWrite))
 	mux.HandleFunc("/api/v1/prom/read", RecordMetricMiddleware(g.PromRead))
+	mux.HandleFunc("/admin/reload", RecordMetricMiddleware(g.AdminAuthMiddleware(g.AdminReload)))
+	mux.HandleFunc("/admin/queues", RecordMetricMiddleware(g.AdminAuthMiddleware(g.AdminQueues)))
+	mux.HandleFunc("/admin/queues/", RecordMetricMiddleware(g.AdminAuthMiddleware(g.AdminQueues)))
+	mux.HandleFunc("/admin/schema", RecordMetricMiddleware(g.AdminAuthMiddleware(g.AdminSchema)))
+	mux.HandleFunc("/admin/schema/", RecordMetricMiddleware(g.AdminAuthMiddleware(g.AdminSchema)))
+	mux.HandleFunc("/admin/repair", RecordMetricMiddleware(g.AdminAuthMiddleware(g.AdminRepair)))
+	mux.HandleFunc("/admin/repair/", RecordMetricMiddleware(g.AdminAuthMiddleware(g.AdminRepair)))
+	mux.HandleFunc("/admin/rebalance", RecordMetricMiddleware(g.AdminAuthMiddleware(g.AdminRebalance)))
+	mux.HandleFunc("/admin/rebalance/", RecordMetricMiddleware(g.AdminAuthMiddleware(g.AdminRebalance)))
+	if g.config.Admin.Username == "" {
+		log.Warn("admin endpoints are disabled, set username and password in the [admin] section")
+	}
 
 	mux.HandleFunc("/debug/pprof/", pprof.Index)
 	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
@@ -196,6 +309,11 @@ func (g *GearService) Run() {
 	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
 
 	mux.Handle("/metrics", promhttp.Handler())
+	return mux
+}
+
+func (g *GearService) Run() {
+	handler := g.Handler()
 	log.Info("Listen on ", g.config.HTTP.BindAddress)
-	log.Fatal(http.ListenAndServe(g.config.HTTP.BindAddress, mux))
+	log.Fatal(http.ListenAndServe(g.config.HTTP.BindAddress, handler))
 }
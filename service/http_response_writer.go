@@ -25,7 +25,8 @@ type ResponseWriter interface {
 
 func NewResponseWriter(w http.ResponseWriter, r *http.Request) ResponseWriter {
 	pretty := r.URL.Query().Get("pretty") == "true"
-	rw := &responseWriter{ResponseWriter: w}
+	chunked := r.FormValue("chunked") == "true"
+	rw := &responseWriter{ResponseWriter: w, chunked: chunked}
 	switch r.Header.Get("Accept") {
 	case "application/csv", "text/csv":
 		w.Header().Add("Content-Type", "text/csv")
@@ -38,7 +39,7 @@ func NewResponseWriter(w http.ResponseWriter, r *http.Request) ResponseWriter {
 		fallthrough
 	default:
 		w.Header().Add("Content-Type", "application/json")
-		rw.formatter = &jsonFormatter{Pretty: pretty}
+		rw.formatter = &jsonFormatter{Pretty: pretty, Chunked: chunked}
 	}
 	return rw
 }
@@ -47,6 +48,8 @@ type responseWriter struct {
 	formatter interface {
 		WriteResponse(w io.Writer, resp Response) error
 	}
+	// chunked responses are flushed as they are written.
+	chunked bool
 	http.ResponseWriter
 }
 
@@ -64,11 +67,16 @@ func (w *bytesCountWriter) Write(data []byte) (int, error) {
 func (w *responseWriter) WriteResponse(resp Response) (int, error) {
 	writer := bytesCountWriter{w: w.ResponseWriter}
 	err := w.formatter.WriteResponse(&writer, resp)
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok && w.chunked {
+		flusher.Flush()
+	}
 	return writer.n, err
 }
 
 type jsonFormatter struct {
 	Pretty bool
+	// Chunked ends every response with a newline, one per chunk.
+	Chunked bool
 }
 
 func (f *jsonFormatter) WriteResponse(w io.Writer, resp Response) (err error) {
@@ -85,7 +93,9 @@ func (f *jsonFormatter) WriteResponse(w io.Writer, resp Response) (err error) {
 		_, err = w.Write(b)
 	}
 
-	//w.Write([]byte("\n"))
+	if err == nil && f.Chunked {
+		_, err = io.WriteString(w, "\n")
+	}
 	return err
 }
 
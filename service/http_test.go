@@ -2,18 +2,22 @@ package service
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"gear/config"
+	"gear/engine"
 	. "gear/influx"
 	"github.com/golang/protobuf/proto"
 	"github.com/golang/snappy"
 	"github.com/influxdata/influxdb/prometheus/remote"
+	"github.com/influxdata/influxdb/query"
 	"github.com/stretchr/testify/assert"
 	"io"
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 )
 
 var (
@@ -36,11 +40,11 @@ type MockEngine struct {
 	WriteFn func(wr WriteRequest) error
 }
 
-func (m *MockEngine) Write(wr WriteRequest) error {
+func (m *MockEngine) Write(ctx context.Context, wr WriteRequest) error {
 	return m.WriteFn(wr)
 }
 
-func (m *MockEngine) Query(qr QueryRequest) *Response {
+func (m *MockEngine) Query(ctx context.Context, qr QueryRequest) *Response {
 	return m.QueryFn(qr)
 }
 
@@ -82,6 +86,41 @@ func TestGearService_Query_BadRequest(t *testing.T) {
 	assert.Equal(t, http.StatusBadRequest, w.Code)
 }
 
+// chunkedEngine streams two chunks per query.
+type chunkedEngine struct {
+	MockEngine
+	chunkSize int
+}
+
+func (e *chunkedEngine) QueryChunked(ctx context.Context, qr QueryRequest, emit func(*query.Result) error) error {
+	e.chunkSize = qr.ValuesPerChunk()
+	if err := emit(&query.Result{Partial: true}); err != nil {
+		return err
+	}
+	if err := emit(&query.Result{}); err != nil {
+		return err
+	}
+	return errors.New("timeout")
+}
+
+func TestGearService_Query_Chunked(t *testing.T) {
+	e := &chunkedEngine{}
+	g := GearService{bufferPool: NewBufferPool(), Engine: e}
+
+	w := httptest.NewRecorder()
+	g.Query(w, MustNewRequest("GET", "/query?q=select * from bar&chunked=true&chunk_size=2", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, 2, e.chunkSize)
+	assert.True(t, w.Flushed)
+	assert.Equal(t, "{\"results\":[{\"statement_id\":0,\"partial\":true}]}\n"+
+		"{\"results\":[{\"statement_id\":0}]}\n"+
+		"{\"error\":\"timeout\"}\n", w.Body.String())
+
+	w = httptest.NewRecorder()
+	g.Query(w, MustNewRequest("GET", "/query?q=select * from bar&chunked=true&chunk_size=x", nil))
+	assert.Equal(t, DefaultChunkSize, e.chunkSize)
+}
+
 func TestGearService_PromRead(t *testing.T) {
 	req := &remote.ReadRequest{
 		Queries: []*remote.Query{{
@@ -181,6 +220,32 @@ func TestGearService_Write_ServerError(t *testing.T) {
 	assert.Equal(t, http.StatusInternalServerError, w.Code)
 }
 
+func TestGearService_Write_Rejected(t *testing.T) {
+	b := bytes.NewBuffer([]byte("cpu_load_short,host=server01,region=us-west value=0.64 1434055562000000000"))
+	r := MustNewRequest("POST", "influxdb", b)
+	w := httptest.NewRecorder()
+	mockEngine.WriteFn = func(wr WriteRequest) error {
+		return engine.HTTPError{StatusCode: http.StatusNotFound, Message: "database not found: \"foo\""}
+	}
+
+	gs.Write(w, r)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.Equal(t, "database not found: \"foo\"", w.Header().Get("X-InfluxDB-Error"))
+}
+
+func TestGearService_Write_Backpressure(t *testing.T) {
+	b := bytes.NewBuffer([]byte("cpu_load_short,host=server01,region=us-west value=0.64 1434055562000000000"))
+	r := MustNewRequest("POST", "influxdb", b)
+	w := httptest.NewRecorder()
+	mockEngine.WriteFn = func(wr WriteRequest) error {
+		return &engine.BackpressureError{Replica: "127.0.0.1:8086", RetryAfter: 1500 * time.Millisecond}
+	}
+
+	gs.Write(w, r)
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Equal(t, "2", w.Header().Get("Retry-After"))
+}
+
 func TestGearService_PromWrite_MethodError(t *testing.T) {
 	r := MustNewRequest("GET", "influxdb", nil)
 	w := httptest.NewRecorder()
@@ -223,3 +288,15 @@ func TestGearService_PromWrite_ServerError(t *testing.T) {
 	gs.PromWrite(w, r)
 	assert.Equal(t, w.Code, http.StatusInternalServerError)
 }
+
+func TestGearService_Write_BadConsistency(t *testing.T) {
+	b := bytes.NewBuffer([]byte("cpu_load_short,host=server01,region=us-west value=0.64 1434055562000000000"))
+	r := MustNewRequest("POST", "/write?consistency=most", b)
+	w := httptest.NewRecorder()
+	mockEngine.WriteFn = func(wr WriteRequest) error {
+		return nil
+	}
+
+	gs.Write(w, r)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
@@ -39,4 +39,11 @@ func init() {
 	prometheus.MustRegister(HTTPRequestDuration)
 	prometheus.MustRegister(engine.RetryRequestCount)
 	prometheus.MustRegister(engine.RetryBufferSize)
+	prometheus.MustRegister(engine.DroppedPoints)
+	prometheus.MustRegister(engine.ReplicaHealthy)
+	prometheus.MustRegister(engine.ReplicaHealthTransitions)
+	prometheus.MustRegister(engine.SchemaDriftObjects)
+	prometheus.MustRegister(engine.SchemaObjectsApplied)
+	prometheus.MustRegister(engine.RepairPointsCopied)
+	prometheus.MustRegister(engine.RebalancePointsMoved)
 }